@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+	"go.uber.org/zap"
+)
+
+/*
+   配置文件中profile的alerts，每次扫描(watch每一轮)结束后检查规则，有告警时POST到webhook:
+
+   alerts:
+     webhook: http://127.0.0.1:9000/alerts
+     headers: {Authorization: Bearer xxx}
+     rules:
+       - name: guangdong-telecom-local
+         domains: [www.example.com]   # 支持通配符，为空时检查所有域名
+         qtypes: [A]                  # 为空时检查所有记录类型
+         filter: {provinces: [广东省], isps: [电信]}
+         cidrs: [10.0.0.0/24]         # A/AAAA应答必须在这些网段内
+       - name: no-servfail
+         forbid_rcodes: [SERVFAIL, error]  # error表示探测失败
+       - name: stable
+         max_answer_sets: 3           # 一个域名的一种记录类型最多有几种不同的answer集合
+       - name: changes
+         on_change: true              # watch时answer集合或者rcode变化
+
+   一个规则可以同时有多个条件，每个不满足的条件各产生一个告警
+*/
+
+const (
+	alertTimeout = 10 * time.Second
+	rcodeError   = "error" // forbid_rcodes中表示探测失败
+)
+
+type alertConfig struct {
+	Webhook string            `yaml:"webhook"`
+	Headers map[string]string `yaml:"headers"`
+	Rules   []alertRule       `yaml:"rules"`
+}
+
+// probeScope 规则检查的探测范围，字段为空时不限制
+type probeScope struct {
+	Domains []string          `yaml:"domains"` // 支持通配符
+	QTypes  []string          `yaml:"qtypes"`
+	Filter  ipDB.RegionFilter `yaml:"filter"`
+}
+
+type alertRule struct {
+	Name          string     `yaml:"name"`
+	Scope         probeScope `yaml:",inline"`
+	CIDRs         []string   `yaml:"cidrs"`
+	ForbidRCodes  []string   `yaml:"forbid_rcodes"`
+	MaxAnswerSets int        `yaml:"max_answer_sets"`
+	OnChange      bool       `yaml:"on_change"`
+}
+
+// alert 一个不满足规则的探测，max_answer_sets的告警没有地区
+type alert struct {
+	Rule       string `json:"rule"`
+	Domain     string `json:"domain"`
+	QType      string `json:"qtype"`
+	Country    string `json:"country,omitempty"`
+	Province   string `json:"province,omitempty"`
+	ISP        string `json:"isp,omitempty"`
+	Subnet     string `json:"subnet,omitempty"`
+	Nameserver string `json:"nameserver,omitempty"`
+	Message    string `json:"message"`
+}
+
+// alertPayload POST到webhook的内容
+type alertPayload struct {
+	Time    time.Time `json:"time"`
+	Started time.Time `json:"started"`
+	Alerts  []alert   `json:"alerts"`
+}
+
+func (config *alertConfig) validate() []error {
+	var errs []error
+	if len(config.Rules) > 0 {
+		if config.Webhook == "" {
+			errs = append(errs, fmt.Errorf("webhook: required"))
+		} else if u, err := url.Parse(config.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("webhook: invalid url %q", config.Webhook))
+		}
+	}
+
+	for idx := range config.Rules {
+		rule := &config.Rules[idx]
+		for _, err := range rule.validate() {
+			errs = append(errs, fmt.Errorf("rules[%d].%w", idx, err))
+		}
+
+		if len(rule.CIDRs) == 0 && len(rule.ForbidRCodes) == 0 && rule.MaxAnswerSets == 0 && !rule.OnChange {
+			errs = append(errs, fmt.Errorf("rules[%d]: no condition, expect cidrs, forbid_rcodes, "+
+				"max_answer_sets or on_change", idx))
+		}
+	}
+
+	return errs
+}
+
+func (scope *probeScope) validate() []error {
+	var errs []error
+	for idx, domain := range scope.Domains {
+		if _, err := path.Match(domain, ""); err != nil {
+			errs = append(errs, fmt.Errorf("domains[%d]: invalid pattern %q", idx, domain))
+		}
+	}
+
+	for idx, qType := range scope.QTypes {
+		if _, err := dnsMsg.ParseType(qType); err != nil {
+			errs = append(errs, fmt.Errorf("qtypes[%d]: %w", idx, err))
+		}
+	}
+
+	if err := scope.Filter.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("filter.%w", err))
+	}
+
+	return errs
+}
+
+func (rule *alertRule) validate() []error {
+	errs := rule.Scope.validate()
+	for idx, cidr := range rule.CIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("cidrs[%d]: %w", idx, err))
+		}
+	}
+
+	for idx, rcode := range rule.ForbidRCodes {
+		if _, err := dnsMsg.ParseRCode(rcode); err != nil && !strings.EqualFold(rcode, rcodeError) {
+			errs = append(errs, fmt.Errorf("forbid_rcodes[%d]: %w", idx, err))
+		}
+	}
+
+	if rule.MaxAnswerSets < 0 {
+		errs = append(errs, fmt.Errorf("max_answer_sets: must not be negative"))
+	}
+
+	return errs
+}
+
+// match 探测是否在范围内
+func (scope *probeScope) match(domain, qType, country, province, isp string) bool {
+	if len(scope.Domains) > 0 && !matchPatterns(scope.Domains, domain) {
+		return false
+	}
+
+	if len(scope.QTypes) > 0 && !containsFold(scope.QTypes, qType) {
+		return false
+	}
+
+	return scope.Filter.Match(&configs.IPRegion{Country: country, Province: province, ISP: isp})
+}
+
+func matchPatterns(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateAlerts 检查一次扫描的结果，changes是watch时和上一轮相比的变化
+func evaluateAlerts(rules []alertRule, report *scanReport, changes []recordChange) []alert {
+	var alerts []alert
+	for idx := range rules {
+		rule := &rules[idx]
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rules[%d]", idx)
+		}
+
+		prefixes := parsePrefixes(rule.CIDRs)
+
+		answerSets := make(map[domainQType]map[string]bool)
+		var keys []domainQType
+		for _, record := range report.Probes {
+			if !rule.Scope.match(record.Domain, record.QType, record.Country, record.Province, record.ISP) {
+				continue
+			}
+
+			newAlert := func(message string) alert {
+				return alert{Rule: name, Domain: record.Domain, QType: record.QType, Country: record.Country,
+					Province: record.Province, ISP: record.ISP, Subnet: record.Subnet, Nameserver: record.Nameserver,
+					Message: message}
+			}
+
+			rcode := record.RCode
+			if record.Error != "" {
+				rcode = rcodeError
+			}
+			if rcode != "" && containsFold(rule.ForbidRCodes, rcode) {
+				message := "rcode " + rcode
+				if record.Error != "" {
+					message = "probe failed: " + record.Error
+				}
+				alerts = append(alerts, newAlert(message))
+			}
+
+			if record.Error != "" {
+				continue
+			}
+
+			if len(prefixes) > 0 {
+				if outside := answersOutside(record.Answers, prefixes); len(outside) > 0 {
+					alerts = append(alerts, newAlert(fmt.Sprintf("answers %s not in %s",
+						strings.Join(outside, ", "), strings.Join(rule.CIDRs, ", "))))
+				}
+			}
+
+			key := domainQType{record.Domain, record.QType}
+			if answerSets[key] == nil {
+				answerSets[key] = make(map[string]bool)
+				keys = append(keys, key)
+			}
+			answers := append([]string(nil), record.Answers...)
+			sort.Strings(answers)
+			answerSets[key][strings.Join(answers, answerSeparator)] = true
+		}
+
+		if rule.MaxAnswerSets > 0 {
+			for _, key := range keys {
+				if count := len(answerSets[key]); count > rule.MaxAnswerSets {
+					alerts = append(alerts, alert{Rule: name, Domain: key.domain, QType: key.qType,
+						Message: fmt.Sprintf("%d answer sets, expect at most %d", count, rule.MaxAnswerSets)})
+				}
+			}
+		}
+
+		if rule.OnChange {
+			for _, change := range changes {
+				if !rule.Scope.match(change.Domain, change.QType, change.Country, change.Province, change.ISP) {
+					continue
+				}
+
+				var parts []string
+				if change.OldRCode != "" {
+					parts = append(parts, "rcode "+change.OldRCode+" -> "+change.NewRCode)
+				}
+				if len(change.Added) > 0 {
+					parts = append(parts, "added "+strings.Join(change.Added, ", "))
+				}
+				if len(change.Removed) > 0 {
+					parts = append(parts, "removed "+strings.Join(change.Removed, ", "))
+				}
+
+				alerts = append(alerts, alert{Rule: name, Domain: change.Domain, QType: change.QType,
+					Country: change.Country, Province: change.Province, ISP: change.ISP, Subnet: change.Subnet,
+					Nameserver: change.Nameserver, Message: strings.Join(parts, "; ")})
+			}
+		}
+	}
+
+	return alerts
+}
+
+// parsePrefixes 解析已经验证过的网段
+func parsePrefixes(cidrs []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		prefix, _ := netip.ParsePrefix(cidr)
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// answersOutside 返回不在prefixes中的IP，非IP的应答不检查
+func answersOutside(answers []string, prefixes []netip.Prefix) []string {
+	var outside []string
+	for _, answer := range answers {
+		addr, err := netip.ParseAddr(answer)
+		if err != nil {
+			continue
+		}
+
+		inside := false
+		for _, prefix := range prefixes {
+			inside = inside || prefix.Contains(addr.Unmap())
+		}
+		if !inside {
+			outside = append(outside, answer)
+		}
+	}
+
+	return outside
+}
+
+// checkAlerts 检查规则并把告警发送到webhook，没有配置规则或者没有告警时不发送，发送失败只记录日志
+func checkAlerts(opts *scanOptions, report *scanReport, changes []recordChange) {
+	if opts.Alerts == nil || len(opts.Alerts.Rules) == 0 {
+		return
+	}
+
+	alerts := evaluateAlerts(opts.Alerts.Rules, report, changes)
+	if len(alerts) == 0 {
+		return
+	}
+
+	logger.Warn("alert rules violated", zap.Int("alerts", len(alerts)))
+	payload := alertPayload{Time: time.Now(), Started: report.Started, Alerts: alerts}
+	if err := postWebhook(opts.Alerts, &payload); err != nil {
+		logger.Error("post alerts to webhook failed", zap.String("webhook", opts.Alerts.Webhook), zap.Error(err))
+	}
+}
+
+func postWebhook(config *alertConfig, payload *alertPayload) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(payload); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, config.Webhook, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range config.Headers {
+		request.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: alertTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestAlertWebhook(t *testing.T) {
+	type request struct {
+		method, contentType, authorization string
+		payload                            alertPayload
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{method: r.Method, contentType: r.Header.Get("Content-Type"),
+			authorization: r.Header.Get("Authorization")}
+		if err := json.NewDecoder(r.Body).Decode(&req.payload); err != nil {
+			t.Errorf("decode payload: %v", err)
+		}
+		requests <- req
+	}))
+	defer server.Close()
+
+	var config alertConfig
+	if err := yaml.Unmarshal([]byte(`
+webhook: `+server.URL+`
+headers: {Authorization: Bearer token}
+rules:
+  - name: local
+    domains: [www.example.com]
+    filter: {provinces: [广东省]}
+    cidrs: [10.0.0.0/24]
+  - name: rcodes
+    forbid_rcodes: [nxdomain, error]
+  - name: stable
+    max_answer_sets: 1
+  - name: changes
+    domains: [www.*]
+    on_change: true
+`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if errs := config.validate(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	report := &scanReport{Started: time.Now(), Probes: []probeRecord{
+		{Domain: "www.example.com", QType: "A", Province: "广东省", ISP: "电信", RCode: "NOERROR",
+			Answers: []string{"10.0.0.1"}},
+		{Domain: "www.example.com", QType: "A", Province: "广东省", ISP: "移动", RCode: "NOERROR",
+			Answers: []string{"10.0.0.2", "10.9.9.9"}},
+		{Domain: "www.example.com", QType: "A", Province: "福建省", ISP: "电信", Error: "i/o timeout"},
+		{Domain: "nx.example.com", QType: "A", Province: "广东省", ISP: "电信", RCode: "NXDOMAIN"},
+	}}
+	changes := []recordChange{
+		{Domain: "www.example.com", QType: "A", ISP: "移动", Added: []string{"10.9.9.9"}, Removed: []string{"10.0.0.3"}},
+		{Domain: "nx.example.com", QType: "A", ISP: "电信", OldRCode: "NOERROR", NewRCode: "NXDOMAIN"},
+	}
+
+	checkAlerts(&scanOptions{Alerts: &config}, report, changes)
+
+	var req request
+	select {
+	case req = <-requests:
+	default:
+		t.Fatal("no alert posted to webhook")
+	}
+	if req.method != http.MethodPost || req.contentType != "application/json" || req.authorization != "Bearer token" {
+		t.Errorf("request %s, content type %q, authorization %q", req.method, req.contentType, req.authorization)
+	}
+
+	var got []string
+	for _, a := range req.payload.Alerts {
+		got = append(got, a.Rule+" "+a.Domain+" "+a.ISP+": "+a.Message)
+	}
+	want := []string{
+		"local www.example.com 移动: answers 10.9.9.9 not in 10.0.0.0/24",
+		"rcodes www.example.com 电信: probe failed: i/o timeout",
+		"rcodes nx.example.com 电信: rcode NXDOMAIN",
+		"stable www.example.com : 2 answer sets, expect at most 1",
+		"changes www.example.com 移动: added 10.9.9.9; removed 10.0.0.3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("alerts\n%q\nwant\n%q", got, want)
+	}
+	if !req.payload.Started.Equal(report.Started) {
+		t.Errorf("started %v, want %v", req.payload.Started, report.Started)
+	}
+
+	// 没有告警时不发送
+	checkAlerts(&scanOptions{Alerts: &config}, &scanReport{Probes: report.Probes[0:1]}, nil)
+	select {
+	case <-requests:
+		t.Error("webhook posted without alerts")
+	default:
+	}
+}
+
+func TestAlertWebhookStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := postWebhook(&alertConfig{Webhook: server.URL}, &alertPayload{})
+	if err == nil {
+		t.Error("non-2xx status of webhook is not an error")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"go.uber.org/zap"
+)
+
+// addressInfo 应答中IP地址的归属地和反向解析的主机名，地区数据中找不到时地区为空
+type addressInfo struct {
+	Country  string `json:"country,omitempty"`
+	Province string `json:"province,omitempty"`
+	ISP      string `json:"isp,omitempty"`
+	PTR      string `json:"ptr,omitempty"`
+}
+
+// String 例如: 中国 广东省 电信, edge-gz1.cdn.example
+func (info *addressInfo) String() string {
+	var region []string
+	for _, field := range []string{info.Country, info.Province, info.ISP} {
+		// 未知的省份/ISP为"0"，省份和国家相同时省略
+		if field != "" && field != "0" && (len(region) == 0 || region[0] != field) {
+			region = append(region, field)
+		}
+	}
+
+	str := "unknown"
+	if len(region) > 0 {
+		str = strings.Join(region, " ")
+	}
+
+	if info.PTR != "" {
+		str += ", " + info.PTR
+	}
+
+	return str
+}
+
+// annotateAnswers 查询所有应答中的IP地址所在的地区，AnnotatePTR时同时反向解析，非IP的应答(CNAME等)不处理
+func annotateAnswers(opts *scanOptions, records []probeRecord) map[string]*addressInfo {
+	addresses := make(map[string]*addressInfo)
+	var addrs []string
+	for _, record := range records {
+		for _, answer := range record.Answers {
+			addr, err := netip.ParseAddr(answer)
+			if err != nil || addresses[answer] != nil {
+				continue
+			}
+
+			info := &addressInfo{}
+			if opts.AnswerDB != nil {
+				if r, ok := opts.AnswerDB.Lookup(addr.Unmap()); ok {
+					info.Country, info.Province, info.ISP = r.Country, r.Province, r.ISP
+				}
+			}
+
+			addresses[answer] = info
+			addrs = append(addrs, answer)
+		}
+	}
+
+	if opts.AnnotatePTR {
+		resolvePTRs(opts, addrs, addresses)
+	}
+
+	return addresses
+}
+
+// resolvePTRs 并发反向解析，失败的地址没有主机名
+func resolvePTRs(opts *scanOptions, addrs []string, addresses map[string]*addressInfo) {
+	logger.Info("resolve PTR of answers", zap.Int("addresses", len(addrs)))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < opts.Concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range jobs {
+				resolver := opts.Resolvers[idx%len(opts.Resolvers)]
+				ptr, err := lookupPTR(resolver, addrs[idx])
+				if err != nil {
+					logger.Debug("resolve PTR failed", zap.String("address", addrs[idx]), zap.Error(err))
+					continue
+				}
+
+				// 每个地址只有一个worker写
+				addresses[addrs[idx]].PTR = ptr
+			}
+		}()
+	}
+
+	for idx := range addrs {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// lookupPTR 通过递归nameserver查询地址的PTR记录，有多个时返回第一个
+func lookupPTR(resolver configs.DNS, addr string) (string, error) {
+	name := reverseName(netip.MustParseAddr(addr))
+	msg, err := probeQuery(resolver, resolver.Network(), makeDNSQuery(name, dnsMsg.TypePTR, "", queryOptions{}))
+	if err != nil {
+		return "", err
+	}
+
+	if rcode := msg.RCode(); rcode != 0 {
+		return "", fmt.Errorf("query PTR of %s: %s", name, dnsMsg.RCodeString(rcode))
+	}
+
+	for idx := range msg.Answers {
+		if msg.Answers[idx].Type == dnsMsg.TypePTR {
+			return msg.RDataString(&msg.Answers[idx]), nil
+		}
+	}
+
+	return "", fmt.Errorf("no PTR record of %s", name)
+}
+
+// reverseName 地址的反向解析域名: 4.3.2.1.in-addr.arpa，IPv6按nibble倒序在ip6.arpa下
+func reverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	bytes := addr.AsSlice()
+
+	var labels []string
+	for idx := len(bytes) - 1; idx >= 0; idx-- {
+		if addr.Is4() {
+			labels = append(labels, fmt.Sprint(bytes[idx]))
+		} else {
+			labels = append(labels, fmt.Sprintf("%x", bytes[idx]&0x0F), fmt.Sprintf("%x", bytes[idx]>>4))
+		}
+	}
+
+	if addr.Is4() {
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+// annotateRecords 把应答中的IP替换成带有归属地的展示形式，用于表格输出
+func annotateRecords(records []probeRecord, addresses map[string]*addressInfo) []probeRecord {
+	annotated := make([]probeRecord, len(records))
+	for idx, record := range records {
+		answers := make([]string, len(record.Answers))
+		for i, answer := range record.Answers {
+			answers[i] = answer
+			if info, ok := addresses[answer]; ok {
+				answers[i] = fmt.Sprintf("%s (%s)", answer, info)
+			}
+		}
+
+		annotated[idx] = record
+		annotated[idx].Answers = answers
+	}
+
+	return annotated
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":          "4.3.2.1.in-addr.arpa",
+		"10.0.0.255":       "255.0.0.10.in-addr.arpa",
+		"::ffff:192.0.2.1": "1.2.0.192.in-addr.arpa",
+		// RFC3596 2.5的示例
+		"4321:0:1:2:3:4:567:89ab": "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa",
+		"2001:db8::1":             "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+		"::":                      "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+	}
+
+	for addr, want := range tests {
+		if name := reverseName(netip.MustParseAddr(addr)); name != want {
+			t.Errorf("reverseName(%s) = %s, want %s", addr, name, want)
+		}
+	}
+}
+
+func TestAddressInfoString(t *testing.T) {
+	tests := []struct {
+		info addressInfo
+		str  string
+	}{
+		{addressInfo{Country: "中国", Province: "广东省", ISP: "电信", PTR: "edge-gz1.cdn.example"}, "中国 广东省 电信, edge-gz1.cdn.example"},
+		{addressInfo{Country: "中国", Province: "广东省", ISP: "电信"}, "中国 广东省 电信"},
+		{addressInfo{Country: "美国", Province: "0", ISP: "Google LLC"}, "美国 Google LLC"},
+		{addressInfo{Country: "新加坡", Province: "新加坡", ISP: "0"}, "新加坡"},
+		{addressInfo{}, "unknown"},
+		{addressInfo{PTR: "dns.google"}, "unknown, dns.google"},
+	}
+
+	for _, test := range tests {
+		if str := test.info.String(); str != test.str {
+			t.Errorf("%+v: %s, want %s", test.info, str, test.str)
+		}
+	}
+}
+
+func TestAnnotateAnswers(t *testing.T) {
+	server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+		hosts := map[string]string{
+			"1.1.0.10.in-addr.arpa": "edge-gz1.cdn.example",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa": "edge-v6.cdn.example",
+		}
+		host, ok := hosts[req.Name]
+		if req.Type != dnsMsg.TypePTR || !ok {
+			return &dnstest.Response{RCode: dnsMsg.RCodeNameError}
+		}
+
+		ptr := dnstest.CNAME(req.Name, 300, host)
+		ptr.Type = dnsMsg.TypePTR
+		return &dnstest.Response{Answers: []dnstest.RR{ptr}}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := &scanOptions{
+		Resolvers:   []configs.DNS{{Nameserver: "127.0.0.1", Port: server.Port(), Timeout: "1s"}},
+		Concurrency: 2,
+		AnswerDB: ipDB.NewDB(ipDB.RegionsToRanges([]configs.IPRegion{
+			{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"10.0.1.0"}},
+			{Country: "中国", Province: "北京市", ISP: "联通", IPs: []string{"10.0.2.0/23", "2001:db8::/48"}},
+		})),
+	}
+	records := []probeRecord{
+		{Answers: []string{"10.0.1.1", "10.0.3.7"}},
+		{Answers: []string{"cdn.example.net", "10.0.1.1", "2001:db8::1", "::ffff:10.0.2.1"}},
+		{Answers: []string{"192.0.2.1"}},
+	}
+
+	addresses := annotateAnswers(opts, records)
+	want := map[string]*addressInfo{
+		"10.0.1.1":        {Country: "中国", Province: "广东省", ISP: "电信"},
+		"10.0.3.7":        {Country: "中国", Province: "北京市", ISP: "联通"},
+		"2001:db8::1":     {Country: "中国", Province: "北京市", ISP: "联通"},
+		"::ffff:10.0.2.1": {Country: "中国", Province: "北京市", ISP: "联通"},
+		"192.0.2.1":       {},
+	}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("annotateAnswers without PTR:\n%+v\nwant\n%+v", addresses, want)
+	}
+
+	opts.AnnotatePTR = true
+	addresses = annotateAnswers(opts, records)
+	want["10.0.1.1"].PTR = "edge-gz1.cdn.example"
+	want["2001:db8::1"].PTR = "edge-v6.cdn.example"
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("annotateAnswers with PTR:\n%+v\nwant\n%+v", addresses, want)
+	}
+
+	annotated := annotateRecords(records[:1], addresses)
+	if answers := annotated[0].Answers; !reflect.DeepEqual(answers,
+		[]string{"10.0.1.1 (中国 广东省 电信, edge-gz1.cdn.example)", "10.0.3.7 (中国 北京市 联通)"}) {
+		t.Errorf("annotated answers %q", answers)
+	}
+	if records[0].Answers[0] != "10.0.1.1" {
+		t.Errorf("annotateRecords modified the original record: %v", records[0].Answers)
+	}
+}
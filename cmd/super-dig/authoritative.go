@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"go.uber.org/zap"
+)
+
+// discoverAuthoritative --authoritative时通过递归nameserver查找每个域名所在zone的权威nameserver，
+// 之后的探测不再经过递归nameserver，直接向权威nameserver发送RD=0的查询
+func discoverAuthoritative(opts *scanOptions) {
+	opts.DomainResolvers = make(map[string][]configs.DNS)
+	for _, domain := range opts.Domains {
+		var servers []configs.DNS
+		var err error
+		for _, resolver := range opts.Resolvers {
+			servers, err = authoritativeServers(resolver, domain)
+			if err == nil {
+				break
+			}
+
+			logger.Warn("discover authoritative nameservers failed", zap.String("domain", domain),
+				zap.String("nameserver", resolver.Address()), zap.Error(err))
+		}
+
+		if len(servers) == 0 {
+			logger.Fatal("no authoritative nameserver found", zap.String("domain", domain), zap.Error(err))
+		}
+
+		for _, ns := range servers {
+			logger.Info("authoritative nameserver", zap.String("domain", domain), zap.String("ns", ns.Desc),
+				zap.String("address", ns.Address()))
+		}
+
+		opts.DomainResolvers[domain] = servers
+	}
+}
+
+// authoritativeServers 返回domain所在zone的所有权威nameserver的地址，IPv4和IPv6都会返回
+func authoritativeServers(resolver configs.DNS, domain string) ([]configs.DNS, error) {
+	zone, nsNames, err := findZoneNS(resolver, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("zone of domain", zap.String("domain", domain), zap.String("zone", zone), zap.Strings("ns", nsNames))
+
+	var servers []configs.DNS
+	for _, nsName := range nsNames {
+		addrs, err := resolveAddrs(resolver, nsName)
+		if err != nil {
+			logger.Warn("resolve authoritative nameserver failed", zap.String("ns", nsName), zap.Error(err))
+			continue
+		}
+
+		for _, addr := range addrs {
+			servers = append(servers, configs.DNS{
+				Nameserver: addr,
+				Desc:       nsName,
+				Protocol:   resolver.Protocol,
+				Timeout:    resolver.Timeout,
+			})
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no address of nameservers %s of zone %s", strings.Join(nsNames, ","), zone)
+	}
+
+	return servers, nil
+}
+
+// findZoneNS 查找domain所在的zone和它的NS记录: domain本身没有NS记录时，NODATA/NXDOMAIN响应中
+// authority的SOA就是zone的起点，没有SOA时去掉最左边的label继续查找
+func findZoneNS(resolver configs.DNS, domain string) (string, []string, error) {
+	name := strings.TrimSuffix(domain, ".")
+	for name != "" {
+		msg, err := probeQuery(resolver, resolver.Network(), makeDNSQuery(name, dnsMsg.TypeNS, "", queryOptions{}))
+		if err != nil {
+			return "", nil, err
+		}
+
+		if rcode := msg.RCode(); rcode != 0 && rcode != 3 {
+			return "", nil, fmt.Errorf("query NS of %s: %s", name, dnsMsg.RCodeString(rcode))
+		}
+
+		var nsNames []string
+		for idx := range msg.Answers {
+			rr := &msg.Answers[idx]
+			if rr.Type == dnsMsg.TypeNS && strings.EqualFold(rr.Name, name) {
+				nsNames = append(nsNames, msg.RDataString(rr))
+			}
+		}
+
+		if len(nsNames) > 0 {
+			return name, nsNames, nil
+		}
+
+		next := ""
+		for idx := range msg.Authority {
+			rr := &msg.Authority[idx]
+			if rr.Type == dnsMsg.TypeSOA && !strings.EqualFold(rr.Name, name) && isSubdomain(name, rr.Name) {
+				next = rr.Name
+				break
+			}
+		}
+
+		if next == "" {
+			if dot := strings.IndexByte(name, '.'); dot >= 0 {
+				next = name[dot+1:]
+			}
+		}
+		name = next
+	}
+
+	return "", nil, fmt.Errorf("no NS record found for %s", domain)
+}
+
+// resolveAddrs 通过递归nameserver查询主机名的A和AAAA记录
+func resolveAddrs(resolver configs.DNS, host string) ([]string, error) {
+	var addrs []string
+	var lastErr error
+	for _, qType := range []uint16{dnsMsg.TypeA, dnsMsg.TypeAAAA} {
+		msg, err := probeQuery(resolver, resolver.Network(), makeDNSQuery(host, qType, "", queryOptions{}))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for idx := range msg.Answers {
+			if msg.Answers[idx].Type == qType {
+				addrs = append(addrs, msg.RDataString(&msg.Answers[idx]))
+			}
+		}
+	}
+
+	if len(addrs) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return addrs, nil
+}
+
+// isSubdomain name是否等于zone或者是zone的子域名，不区分大小写
+func isSubdomain(name, zone string) bool {
+	name, zone = strings.ToLower(name), strings.ToLower(zone)
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
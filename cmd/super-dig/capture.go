@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"go.uber.org/zap"
+)
+
+// capture --record记录的一次查询，JSON行格式，query和response为base64编码的原始报文
+type capture struct {
+	Time       time.Time `json:"time"`
+	Domain     string    `json:"domain"`
+	QType      string    `json:"qtype"`
+	Subnet     string    `json:"subnet"`
+	Nameserver string    `json:"nameserver"`
+	Protocol   string    `json:"protocol"`
+	Country    string    `json:"country"`
+	Province   string    `json:"province"`
+	ISP        string    `json:"isp"`
+	LatencyMS  float64   `json:"latency_ms"`
+	Query      []byte    `json:"query"`
+	Response   []byte    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"` // 查询失败(超时等)时没有response
+}
+
+func newCapture(record *probeRecord, ns configs.DNS, query, response []byte, err error) *capture {
+	c := &capture{
+		Time:       record.Time,
+		Domain:     record.Domain,
+		QType:      record.QType,
+		Subnet:     record.Subnet,
+		Nameserver: record.Nameserver,
+		Protocol:   ns.Network(),
+		Country:    record.Country,
+		Province:   record.Province,
+		ISP:        record.ISP,
+		LatencyMS:  record.LatencyMS,
+		Query:      query,
+		Response:   response,
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+
+	return c
+}
+
+// captureWriter 多个worker并发写入同一个文件
+type captureWriter struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func openCaptureWriter(path string) (*captureWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create record file failed: %w", err)
+	}
+
+	return &captureWriter{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// write writer为nil时不记录
+func (writer *captureWriter) write(c *capture) {
+	if writer == nil {
+		return
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	if err := writer.encoder.Encode(c); err != nil {
+		logger.Error("write record file failed", zap.Error(err))
+	}
+}
+
+func (writer *captureWriter) close() {
+	if writer != nil {
+		writer.file.Close()
+	}
+}
+
+func loadCaptures(path string) ([]capture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open replay file failed: %w", err)
+	}
+	defer file.Close()
+
+	var captures []capture
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var c capture
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("parse replay file %s line %d failed: %w", path, line, err)
+		}
+		captures = append(captures, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read replay file failed: %w", err)
+	}
+
+	if len(captures) == 0 {
+		return nil, fmt.Errorf("no query in replay file %s", path)
+	}
+
+	return captures, nil
+}
+
+// replayCaptures 不访问网络，用记录的响应重新执行解析，得到和扫描时相同格式的探测结果
+func replayCaptures(opts *scanOptions) []probeRecord {
+	records := make([]probeRecord, 0, len(opts.Replay))
+	for idx := range opts.Replay {
+		c := &opts.Replay[idx]
+		record := probeRecord{
+			Domain:     c.Domain,
+			QType:      c.QType,
+			Subnet:     c.Subnet,
+			Nameserver: c.Nameserver,
+			Protocol:   c.Protocol,
+			Country:    c.Country,
+			Province:   c.Province,
+			ISP:        c.ISP,
+			LatencyMS:  c.LatencyMS,
+			Error:      c.Error,
+			Time:       c.Time,
+		}
+
+		if record.Error == "" {
+			qType, err := dnsMsg.ParseType(c.QType)
+			if err != nil {
+				record.Error = err.Error()
+			} else {
+				parseProbeResponse(&record, qType, c.Response, nil)
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(record)
+		}
+		records = append(records, record)
+	}
+
+	logger.Info("replay finished", zap.Int("probes", len(records)))
+	return records
+}
+
+// replayScope 只保留指定域名的记录，用记录中的域名和记录类型作为输出的范围，保持第一次出现的顺序
+func replayScope(opts *scanOptions) {
+	if len(opts.Domains) > 0 {
+		var kept []capture
+		for _, c := range opts.Replay {
+			if contains(opts.Domains, c.Domain) {
+				kept = append(kept, c)
+			}
+		}
+		opts.Replay = kept
+	}
+
+	opts.Domains, opts.QTypes = nil, nil
+	for _, c := range opts.Replay {
+		if !contains(opts.Domains, c.Domain) {
+			opts.Domains = append(opts.Domains, c.Domain)
+		}
+
+		qType, err := dnsMsg.ParseType(c.QType)
+		if err != nil {
+			continue
+		}
+
+		seen := false
+		for _, t := range opts.QTypes {
+			seen = seen || t == qType
+		}
+		if !seen {
+			opts.QTypes = append(opts.QTypes, qType)
+		}
+	}
+}
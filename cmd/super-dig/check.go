@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+   check子命令的--expect文件，扫描结束后检查每个探测，有不满足的预期时退出码为1:
+
+   expectations:
+     - name: guangdong-telecom
+       domains: [www.example.com]      # 支持通配符，为空时检查所有域名
+       qtypes: [A]                     # 为空时检查所有记录类型
+       filter: {provinces: [广东省], isps: [电信]}
+       cidrs: [10.0.0.0/24]            # A/AAAA应答必须在这些网段内
+       cname_suffix: cdn.example.net   # answer中必须有以此结尾的CNAME
+       min_ttl: 60                     # answer中最小的TTL
+       no_nxdomain: true
+       allow_empty: false              # 范围内没有探测时默认不满足预期，避免filter写错时检查被跳过
+
+   失败的探测无法检查，同样视为不满足预期
+*/
+
+const (
+	reportJUnit = "junit"
+	reportJSON  = "json"
+
+	errNoProbeMatches = "no probe matches the expectation, set allow_empty to pass"
+)
+
+type expectationFile struct {
+	Expectations []expectation `yaml:"expectations"`
+}
+
+type expectation struct {
+	Name        string     `yaml:"name"`
+	Scope       probeScope `yaml:",inline"`
+	CIDRs       []string   `yaml:"cidrs"`
+	CNAMESuffix string     `yaml:"cname_suffix"`
+	MinTTL      uint32     `yaml:"min_ttl"`
+	NoNXDomain  bool       `yaml:"no_nxdomain"`
+	AllowEmpty  bool       `yaml:"allow_empty"`
+}
+
+// checkReport --report json的结果
+type checkReport struct {
+	Started      time.Time           `json:"started"`
+	Finished     time.Time           `json:"finished"`
+	Passed       bool                `json:"passed"`
+	Expectations []expectationResult `json:"expectations"`
+}
+
+type expectationResult struct {
+	Name     string       `json:"name"`
+	Probes   int          `json:"probes"`
+	Error    string       `json:"error,omitempty"` // 范围内没有探测
+	Failures []probeCheck `json:"failures,omitempty"`
+	cases    []probeCheck // 范围内的所有探测，JUnit每个探测一个testcase
+}
+
+// probeCheck 一个探测的检查结果，满足预期时Messages为空
+type probeCheck struct {
+	Domain     string   `json:"domain"`
+	QType      string   `json:"qtype"`
+	Country    string   `json:"country"`
+	Province   string   `json:"province"`
+	ISP        string   `json:"isp"`
+	Subnet     string   `json:"subnet"`
+	Nameserver string   `json:"nameserver"`
+	Messages   []string `json:"messages"`
+}
+
+func loadExpectations(path string) ([]expectation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file expectationFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("parse expectations %s failed: %w", path, err)
+	}
+
+	if len(file.Expectations) == 0 {
+		return nil, fmt.Errorf("invalid expectations %s: empty", path)
+	}
+
+	var errs []error
+	for idx := range file.Expectations {
+		expect := &file.Expectations[idx]
+		for _, err := range expect.validate() {
+			errs = append(errs, fmt.Errorf("expectations[%d].%w", idx, err))
+		}
+
+		if len(expect.CIDRs) == 0 && expect.CNAMESuffix == "" && expect.MinTTL == 0 && !expect.NoNXDomain {
+			errs = append(errs, fmt.Errorf("expectations[%d]: no condition, expect cidrs, cname_suffix, "+
+				"min_ttl or no_nxdomain", idx))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid expectations %s:\n%w", path, errors.Join(errs...))
+	}
+
+	for idx := range file.Expectations {
+		if file.Expectations[idx].Name == "" {
+			file.Expectations[idx].Name = fmt.Sprintf("expectations[%d]", idx)
+		}
+	}
+
+	return file.Expectations, nil
+}
+
+func (expect *expectation) validate() []error {
+	errs := expect.Scope.validate()
+	for idx, cidr := range expect.CIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("cidrs[%d]: %w", idx, err))
+		}
+	}
+
+	return errs
+}
+
+// checkRecord 返回探测不满足预期的原因
+func (expect *expectation) checkRecord(record *probeRecord) []string {
+	if record.Error != "" {
+		return []string{"probe failed: " + record.Error}
+	}
+
+	var messages []string
+	if expect.NoNXDomain && record.RCode == "NXDOMAIN" {
+		messages = append(messages, "rcode NXDOMAIN")
+	}
+
+	if len(expect.CIDRs) > 0 {
+		if outside := answersOutside(record.Answers, parsePrefixes(expect.CIDRs)); len(outside) > 0 {
+			messages = append(messages, fmt.Sprintf("answers %s not in %s", strings.Join(outside, ", "),
+				strings.Join(expect.CIDRs, ", ")))
+		}
+	}
+
+	if expect.CNAMESuffix != "" && !matchCNAMESuffix(record.CNAMEs, expect.CNAMESuffix) {
+		cnames := "no CNAME"
+		if len(record.CNAMEs) > 0 {
+			cnames = "CNAME " + strings.Join(record.CNAMEs, " -> ")
+		}
+		messages = append(messages, fmt.Sprintf("%s, expect suffix %s", cnames, expect.CNAMESuffix))
+	}
+
+	if expect.MinTTL > 0 && len(record.Answers) > 0 && record.TTL < expect.MinTTL {
+		messages = append(messages, fmt.Sprintf("ttl %d less than %d", record.TTL, expect.MinTTL))
+	}
+
+	return messages
+}
+
+// matchCNAMESuffix CNAME链中任意一个目标以suffix结尾，不区分大小写和结尾的点
+func matchCNAMESuffix(cnames []string, suffix string) bool {
+	suffix = strings.Trim(strings.ToLower(suffix), ".")
+	for _, cname := range cnames {
+		cname = strings.TrimSuffix(strings.ToLower(cname), ".")
+		if cname == suffix || strings.HasSuffix(cname, "."+suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkExpectations 用每个预期检查范围内的探测
+func checkExpectations(expectations []expectation, report *scanReport) *checkReport {
+	result := &checkReport{Started: report.Started, Finished: report.Finished, Passed: true}
+	for idx := range expectations {
+		expect := &expectations[idx]
+		expectResult := expectationResult{Name: expect.Name}
+		for _, record := range report.Probes {
+			if !expect.Scope.match(record.Domain, record.QType, record.Country, record.Province, record.ISP) {
+				continue
+			}
+
+			probeResult := probeCheck{Domain: record.Domain, QType: record.QType, Country: record.Country,
+				Province: record.Province, ISP: record.ISP, Subnet: record.Subnet, Nameserver: record.Nameserver,
+				Messages: expect.checkRecord(&record)}
+			expectResult.Probes += 1
+			expectResult.cases = append(expectResult.cases, probeResult)
+			if len(probeResult.Messages) > 0 {
+				expectResult.Failures = append(expectResult.Failures, probeResult)
+			}
+		}
+
+		if expectResult.Probes == 0 {
+			logger.Warn("no probe matches expectation", zap.String("name", expect.Name))
+			if !expect.AllowEmpty {
+				expectResult.Error = errNoProbeMatches
+			}
+		}
+		result.Passed = result.Passed && len(expectResult.Failures) == 0 && expectResult.Error == ""
+		result.Expectations = append(result.Expectations, expectResult)
+	}
+
+	return result
+}
+
+// checkScan check子命令: 扫描、检查并输出报告，返回是否满足所有预期
+func checkScan(opts *scanOptions, expectFile, format string) bool {
+	if format != reportJUnit && format != reportJSON {
+		logger.Fatal("invalid --report, expect junit or json", zap.String("report", format))
+	}
+
+	expectations, err := loadExpectations(expectFile)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	report := scan(opts, nil)
+	result := checkExpectations(expectations, report)
+
+	var writer io.Writer = os.Stdout
+	if opts.OutputFile != "" {
+		file, err := os.Create(opts.OutputFile)
+		if err != nil {
+			logger.Fatal("create output file failed", zap.Error(err))
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	if format == reportJSON {
+		encoder := json.NewEncoder(writer)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "    ")
+		err = encoder.Encode(result)
+	} else {
+		err = writeJUnit(writer, result)
+	}
+	if err != nil {
+		logger.Fatal("write check report failed", zap.Error(err))
+	}
+
+	failures := 0
+	for _, expectResult := range result.Expectations {
+		failures += len(expectResult.Failures)
+	}
+	logger.Info("check finished", zap.Bool("passed", result.Passed), zap.Int("failures", failures))
+
+	return result.Passed
+}
+
+// JUnit XML，每个预期一个testsuite，范围内的每个探测一个testcase
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Tests   int          `xml:"tests,attr"`
+	Fail    int          `xml:"failures,attr"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Fail      int         `xml:"failures,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Time      string      `xml:"time,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func writeJUnit(w io.Writer, result *checkReport) error {
+	suites := junitSuites{}
+	elapsed := fmt.Sprintf("%.3f", result.Finished.Sub(result.Started).Seconds())
+	for _, expectResult := range result.Expectations {
+		suite := junitSuite{
+			Name:      expectResult.Name,
+			Tests:     expectResult.Probes,
+			Fail:      len(expectResult.Failures),
+			Timestamp: result.Started.Format("2006-01-02T15:04:05"),
+			Time:      elapsed,
+		}
+
+		// 没有探测的预期输出一个失败的testcase，CI中可以看到原因
+		if expectResult.Error != "" {
+			suite.Tests, suite.Fail = 1, 1
+			suite.Cases = append(suite.Cases, junitCase{
+				Name:      expectResult.Name,
+				ClassName: expectResult.Name,
+				Failure:   &junitFailure{Message: expectResult.Error, Text: expectResult.Error},
+			})
+		}
+
+		for _, probeResult := range expectResult.cases {
+			testCase := junitCase{
+				Name: strings.Join([]string{probeResult.Country, probeResult.Province, probeResult.ISP,
+					probeResult.Subnet, probeResult.Nameserver}, " "),
+				ClassName: probeResult.Domain + "." + probeResult.QType,
+			}
+			if len(probeResult.Messages) > 0 {
+				testCase.Failure = &junitFailure{
+					Message: strings.Join(probeResult.Messages, "; "),
+					Text:    strings.Join(probeResult.Messages, "\n"),
+				}
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+
+		suites.Tests += suite.Tests
+		suites.Fail += suite.Fail
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "    ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+)
+
+// testExpectations 把YAML写入临时文件，通过loadExpectations加载
+func testExpectations(t *testing.T, content string) []expectation {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "expectations.yaml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expectations, err := loadExpectations(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expectations
+}
+
+func TestCheckExpectations(t *testing.T) {
+	report := &scanReport{Probes: []probeRecord{
+		{Domain: "www.example.com", QType: "A", Country: "中国", Province: "福建省", ISP: "电信", Subnet: "1.0.1.0/24",
+			RCode: "NOERROR", Answers: []string{"10.0.1.1"}, CNAMEs: []string{"www.example.com.cdn.example.net"}, TTL: 300},
+		{Domain: "www.example.com", QType: "A", Country: "中国", Province: "福建省", ISP: "移动", Subnet: "36.134.70.0/24",
+			RCode: "NOERROR", Answers: []string{"10.0.2.1"}, TTL: 30},
+		{Domain: "www.example.com", QType: "A", Country: "中国", Province: "福建省", ISP: "联通", Subnet: "1.0.2.0/24",
+			Error: "i/o timeout"},
+	}}
+
+	expectations := testExpectations(t, `
+expectations:
+  - name: telecom
+    filter: {isps: [电信]}
+    cidrs: [10.0.1.0/24]
+    cname_suffix: cdn.example.net
+    no_nxdomain: true
+  - name: mobile
+    filter: {isps: [移动]}
+    cidrs: [10.0.1.0/24]
+    min_ttl: 60
+  - name: unicom
+    filter: {isps: [联通]}
+    no_nxdomain: true
+  - name: guangdong
+    filter: {provinces: [广东]}
+    cidrs: [10.0.1.0/24]
+  - name: guangdong allow empty
+    filter: {provinces: [广东]}
+    cidrs: [10.0.1.0/24]
+    allow_empty: true
+`)
+
+	result := checkExpectations(expectations, report)
+	if result.Passed || len(result.Expectations) != 5 {
+		t.Fatalf("result %+v", result)
+	}
+
+	tests := []struct {
+		probes   int
+		messages []string
+		err      string
+	}{
+		{1, nil, ""},
+		{1, []string{"answers 10.0.2.1 not in 10.0.1.0/24", "ttl 30 less than 60"}, ""},
+		{1, []string{"probe failed: i/o timeout"}, ""},
+		// 省份写错时范围内没有探测，默认不满足预期
+		{0, nil, errNoProbeMatches},
+		{0, nil, ""},
+	}
+
+	for idx, test := range tests {
+		expectResult := result.Expectations[idx]
+		if expectResult.Probes != test.probes || expectResult.Error != test.err {
+			t.Errorf("%s: %+v", expectResult.Name, expectResult)
+			continue
+		}
+
+		var messages []string
+		for _, failure := range expectResult.Failures {
+			messages = append(messages, failure.Messages...)
+		}
+		if len(messages) != len(test.messages) {
+			t.Errorf("%s: messages %q, want %q", expectResult.Name, messages, test.messages)
+			continue
+		}
+		for i := range messages {
+			if messages[i] != test.messages[i] {
+				t.Errorf("%s: messages %q, want %q", expectResult.Name, messages, test.messages)
+				break
+			}
+		}
+	}
+
+	// 没有探测的预期在JUnit中是一个失败的testcase
+	var out bytes.Buffer
+	if err := writeJUnit(&out, result); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(out.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Tests != 4 || suites.Fail != 3 || len(suites.Suites) != 5 {
+		t.Fatalf("junit %s", out.String())
+	}
+
+	guangdong := suites.Suites[3]
+	if guangdong.Tests != 1 || guangdong.Fail != 1 || len(guangdong.Cases) != 1 ||
+		guangdong.Cases[0].Failure == nil || guangdong.Cases[0].Failure.Message != errNoProbeMatches {
+		t.Errorf("junit suite %+v", guangdong)
+	}
+	if allowEmpty := suites.Suites[4]; allowEmpty.Tests != 0 || allowEmpty.Fail != 0 || len(allowEmpty.Cases) != 0 {
+		t.Errorf("junit suite %+v", allowEmpty)
+	}
+}
+
+// runCheck 用GeoDNS作为测试resolver执行check，返回是否通过和输出的报告
+func runCheck(t *testing.T, expectations, format string) (bool, []byte) {
+	t.Helper()
+
+	geo, err := dnstest.NewGeoDNS("www.example.com", map[string][]string{
+		"1.0.1.0/24":       {"10.0.1.1"},
+		"36.134.0.0/16":    {"10.0.2.1"},
+		dnstest.GeoDefault: {"10.0.9.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo.CNAME = "www.example.com.cdn.example.net"
+
+	server, err := dnstest.NewServer(geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dir := t.TempDir()
+	expectFile := filepath.Join(dir, "expectations.yaml")
+	if err := os.WriteFile(expectFile, []byte(expectations), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+		{Country: "中国", Province: "福建省", ISP: "移动", IPs: []string{"36.134.70.0/24"}},
+	})
+	opts.OutputFile = filepath.Join(dir, "report")
+
+	passed := checkScan(opts, expectFile, format)
+	output, err := os.ReadFile(opts.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return passed, output
+}
+
+func TestCheckJSON(t *testing.T) {
+	passed, output := runCheck(t, `
+expectations:
+  - name: telecom
+    filter: {isps: [电信]}
+    cidrs: [10.0.1.0/24]
+    cname_suffix: cdn.example.net
+    no_nxdomain: true
+  - name: mobile
+    filter: {isps: [移动]}
+    cidrs: [10.0.1.0/24]
+`, reportJSON)
+	if passed {
+		t.Error("check passed, want mobile to fail")
+	}
+
+	var report checkReport
+	if err := json.Unmarshal(output, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Passed || len(report.Expectations) != 2 {
+		t.Fatalf("report %s", output)
+	}
+
+	// 每个expectation范围内有UDP和TCP两个nameserver的探测
+	telecom, mobile := report.Expectations[0], report.Expectations[1]
+	if telecom.Probes != 2 || len(telecom.Failures) != 0 {
+		t.Errorf("telecom: %+v", telecom)
+	}
+	if mobile.Probes != 2 || len(mobile.Failures) != 2 ||
+		mobile.Failures[0].Messages[0] != "answers 10.0.2.1 not in 10.0.1.0/24" {
+		t.Errorf("mobile: %+v", mobile)
+	}
+}
+
+func TestCheckJUnit(t *testing.T) {
+	passed, output := runCheck(t, `
+expectations:
+  - name: telecom
+    filter: {isps: [电信]}
+    cidrs: [10.0.1.0/24]
+`, reportJUnit)
+	if !passed {
+		t.Errorf("check failed:\n%s", output)
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(output, &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Tests != 2 || suites.Fail != 0 || len(suites.Suites) != 1 || len(suites.Suites[0].Cases) != 2 {
+		t.Errorf("junit %s", output)
+	}
+}
+
+func TestCheckNoProbeMatches(t *testing.T) {
+	// 省份写错时范围内没有探测，默认不满足预期
+	expectations := `
+expectations:
+  - name: guangdong
+    filter: {provinces: [广东]}
+    cidrs: [10.0.1.0/24]
+`
+	passed, output := runCheck(t, expectations, reportJUnit)
+	if passed {
+		t.Error("check passed without matched probes")
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(output, &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Fail != 1 || len(suites.Suites) != 1 || len(suites.Suites[0].Cases) != 1 ||
+		suites.Suites[0].Cases[0].Failure == nil {
+		t.Errorf("junit %s", output)
+	}
+
+	if passed, output := runCheck(t, expectations+"    allow_empty: true\n", reportJSON); !passed {
+		t.Errorf("check failed with allow_empty:\n%s", output)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	"go.uber.org/zap"
+)
+
+// probeRecord 一次(domain, qtype, subnet, nameserver)探测的结果
+type probeRecord struct {
+	Domain       string    `json:"domain"`
+	QType        string    `json:"qtype"`
+	Subnet       string    `json:"subnet"`
+	Nameserver   string    `json:"nameserver"`         // host:port
+	Protocol     string    `json:"protocol,omitempty"` // udp, tcp
+	Country      string    `json:"country"`
+	Province     string    `json:"province"`
+	ISP          string    `json:"isp"`
+	Answers      []string  `json:"answers"`
+	RCode        string    `json:"rcode,omitempty"`
+	CNAMEs       []string  `json:"cnames,omitempty"`        // answer中的CNAME链，查询CNAME时为空
+	TTL          uint32    `json:"ttl,omitempty"`           // answer中最小的TTL
+	LatencyMS    float64   `json:"latency_ms,omitempty"`    // 查询耗时，失败时为超时前的耗时
+	DNSSEC       string    `json:"dnssec,omitempty"`        // --dnssec时的验证结果: secure, insecure, bogus, indeterminate
+	DNSSECReason string    `json:"dnssec_reason,omitempty"` // 不是secure的原因
+	Error        string    `json:"error,omitempty"`         // 探测失败的原因，失败的探测不会写入checkpoint
+	Time         time.Time `json:"time"`
+}
+
+// probeKey resolver为configs.DNS.Key()，同一host:port的UDP和TCP nameserver是不同的探测
+func probeKey(domain, qType, subnet, resolver string) string {
+	return domain + "|" + qType + "|" + subnet + "|" + resolver
+}
+
+// resolver 探测结果对应的configs.DNS.Key()，早期的结果没有protocol，为UDP
+func (record *probeRecord) resolver() string {
+	protocol := record.Protocol
+	if protocol == "" {
+		protocol = configs.ProtocolUDP
+	}
+
+	return protocol + "/" + record.Nameserver
+}
+
+// checkpoint 把已完成的探测按JSON行持久化到磁盘，中断后可以通过--resume跳过已完成的探测
+type checkpoint struct {
+	mutex   sync.Mutex
+	file    *os.File
+	records []probeRecord
+	done    map[string]bool
+}
+
+func openCheckpoint(path string, resume bool) *checkpoint {
+	ckpt := &checkpoint{
+		done: make(map[string]bool),
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	complete := true
+	if resume {
+		complete = ckpt.load(path)
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		logger.Fatal("openCheckpoint failed", zap.Error(err))
+	}
+	ckpt.file = file
+
+	// 上次中断时写了半行，先换行，避免新记录和残缺的行拼在一起
+	if !complete {
+		ckpt.file.Write([]byte("\n"))
+	}
+
+	return ckpt
+}
+
+// load 加载之前已完成的探测，返回文件最后一行是否完整
+func (ckpt *checkpoint) load(path string) bool {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		logger.Warn("checkpoint file not exist, start from scratch", zap.String("file", path))
+		return true
+	} else if err != nil {
+		logger.Fatal("load checkpoint failed", zap.Error(err))
+	}
+
+	for lineNo, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var record probeRecord
+		// 中断时最后一行可能没写完整，忽略即可，该探测会重新执行
+		if err := json.Unmarshal(line, &record); err != nil {
+			logger.Warn("ignore broken checkpoint line", zap.Int("line", lineNo+1), zap.Error(err))
+			continue
+		}
+
+		// 早期的checkpoint没有qtype，只支持A记录，nameserver没有端口，固定为53
+		if record.QType == "" {
+			record.QType = "A"
+		}
+
+		if _, _, err := net.SplitHostPort(record.Nameserver); err != nil {
+			record.Nameserver = net.JoinHostPort(record.Nameserver, strconv.Itoa(configs.DefaultPort))
+		}
+
+		key := probeKey(record.Domain, record.QType, record.Subnet, record.resolver())
+		if ckpt.done[key] {
+			continue
+		}
+
+		ckpt.done[key] = true
+		ckpt.records = append(ckpt.records, record)
+	}
+
+	logger.Info("resume from checkpoint", zap.String("file", path), zap.Int("probes", len(ckpt.records)))
+
+	return len(data) == 0 || data[len(data)-1] == '\n'
+}
+
+// isDone 判断该探测在之前的扫描中是否已经完成
+func (ckpt *checkpoint) isDone(domain, qType, subnet, resolver string) bool {
+	if ckpt == nil {
+		return false
+	}
+
+	return ckpt.done[probeKey(domain, qType, subnet, resolver)]
+}
+
+// finished 返回之前扫描中已完成的探测结果
+func (ckpt *checkpoint) finished() []probeRecord {
+	if ckpt == nil {
+		return nil
+	}
+
+	return ckpt.records
+}
+
+func (ckpt *checkpoint) save(record probeRecord) {
+	if ckpt == nil {
+		return
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Fatal("marshal checkpoint record failed", zap.Error(err))
+	}
+
+	// 每个探测完成后立即落盘，进程异常退出最多丢失一条记录
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	if _, err := ckpt.file.Write(append(data, '\n')); err != nil {
+		logger.Fatal("write checkpoint failed", zap.Error(err))
+	}
+}
+
+func (ckpt *checkpoint) close() {
+	if ckpt == nil {
+		return
+	}
+
+	ckpt.file.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	geo, err := dnstest.NewGeoDNS("www.example.com", map[string][]string{
+		"1.0.1.0/24":       {"10.0.1.1"},
+		"36.134.70.0/24":   {"10.0.2.1"},
+		dnstest.GeoDefault: {"10.0.9.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次扫描时8.8.8.0/24的查询不应答，模拟网络中断
+	var mutex sync.Mutex
+	queries := make(map[string]int)
+	var broken atomic.Bool
+	broken.Store(true)
+	server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+		subnet := ""
+		if req.ClientSubnet != nil {
+			subnet = req.ClientSubnet.Address.String()
+		}
+
+		mutex.Lock()
+		queries[subnet] += 1
+		mutex.Unlock()
+
+		if broken.Load() && subnet == "8.8.8.0" {
+			return nil
+		}
+		return geo.ServeDNS(req)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+		{Country: "中国", Province: "福建省", ISP: "移动", IPs: []string{"36.134.70.0/24"}},
+		{Country: "美国", Province: "0", ISP: "0", IPs: []string{"8.8.8.0/24"}},
+	})
+	for idx := range opts.Resolvers {
+		opts.Resolvers[idx].Timeout = "100ms"
+	}
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	ckpt := openCheckpoint(path, false)
+	failed := 0
+	for _, record := range scan(opts, ckpt).Probes {
+		if record.Error != "" {
+			failed += 1
+		}
+	}
+	ckpt.close()
+	if failed != 2 {
+		t.Fatalf("%d failed probes in first scan, want 2", failed)
+	}
+
+	// 失败的探测不写入checkpoint，并模拟中断时写了半行
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"domain":"www.example.com","qtype":"A","sub`)
+	file.Close()
+
+	broken.Store(false)
+	mutex.Lock()
+	queries = make(map[string]int)
+	mutex.Unlock()
+
+	ckpt = openCheckpoint(path, true)
+	if finished := len(ckpt.finished()); finished != 4 {
+		t.Fatalf("%d finished probes in checkpoint, want 4", finished)
+	}
+	report := scan(opts, ckpt)
+	ckpt.close()
+
+	// 只重试失败的探测，UDP和TCP的nameserver各一次
+	mutex.Lock()
+	if want := map[string]int{"8.8.8.0": 2}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("queries by subnet after resume %v, want %v", queries, want)
+	}
+	mutex.Unlock()
+
+	var got []string
+	for _, record := range report.Probes {
+		if record.Error != "" {
+			t.Errorf("%s %s: %s", record.Subnet, record.resolver(), record.Error)
+		}
+		got = append(got, fmt.Sprintf("%s %s %v", record.Subnet, record.resolver(), record.Answers))
+	}
+	sort.Strings(got)
+
+	var want []string
+	for subnet, answers := range map[string]string{"1.0.1.0": "10.0.1.1", "36.134.70.0/24": "10.0.2.1", "8.8.8.0/24": "10.0.9.9"} {
+		for _, protocol := range []string{"udp", "tcp"} {
+			want = append(want, fmt.Sprintf("%s %s/127.0.0.1:%d [%s]", subnet, protocol, server.Port(), answers))
+		}
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged probes\n%v\nwant\n%v", got, want)
+	}
+
+	// 残缺的行之后追加的记录仍然可以读出来
+	ckpt = openCheckpoint(path, true)
+	defer ckpt.close()
+	if finished := len(ckpt.finished()); finished != 6 {
+		t.Errorf("%d finished probes in checkpoint after resume, want 6", finished)
+	}
+}
+
+func TestCheckpointOldFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	lines := `{"domain":"www.example.com","subnet":"1.0.1.0","nameserver":"8.8.8.8","country":"中国","answers":["10.0.0.1"]}
+{"domain":"www.example.com","qtype":"AAAA","subnet":"1.0.1.0","nameserver":"127.0.0.1:5353","protocol":"tcp","answers":["2001:db8::1"]}
+{"domain":"www.example.com","subnet":"1.0.1.0","nameserver":"8.8.8.8:53","answers":["10.0.0.2"]}
+not json
+`
+	if err := os.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ckpt := openCheckpoint(path, true)
+	defer ckpt.close()
+
+	// 没有qtype的是A记录，没有端口的是53端口，第三行和第一行是同一个探测
+	records := ckpt.finished()
+	if len(records) != 2 {
+		t.Fatalf("%d finished probes, want 2: %+v", len(records), records)
+	}
+	if records[0].QType != "A" || records[0].Nameserver != "8.8.8.8:53" || records[0].resolver() != "udp/8.8.8.8:53" {
+		t.Errorf("old format record %+v", records[0])
+	}
+
+	tests := []struct {
+		qType, resolver string
+		done            bool
+	}{
+		{"A", "udp/8.8.8.8:53", true},
+		{"A", "tcp/8.8.8.8:53", false},
+		{"AAAA", "udp/8.8.8.8:53", false},
+		{"AAAA", "tcp/127.0.0.1:5353", true},
+		{"AAAA", "udp/127.0.0.1:5353", false},
+	}
+	for _, test := range tests {
+		if done := ckpt.isDone("www.example.com", test.qType, "1.0.1.0", test.resolver); done != test.done {
+			t.Errorf("isDone(%s, %s) = %v, want %v", test.qType, test.resolver, done, test.done)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+// comparisonRow --compare-resolvers时同一个subnet在各个nameserver下的结果
+type comparisonRow struct {
+	country  string
+	province string
+	isp      string
+	subnet   string
+	answers  map[string]string // nameserver -> 排序后用answerSeparator连接的answer，answer本身可能包含逗号
+	failed   map[string]bool
+}
+
+// majority 返回多数nameserver给出的answer，没有唯一的多数时返回false
+func (row *comparisonRow) majority() (string, bool) {
+	counts := make(map[string]int)
+	for _, answer := range row.answers {
+		counts[answer] += 1
+	}
+
+	best, bestCount, unique := "", 0, false
+	for answer, count := range counts {
+		if count > bestCount {
+			best, bestCount, unique = answer, count, true
+		} else if count == bestCount {
+			unique = false
+		}
+	}
+
+	return best, unique && bestCount > 1
+}
+
+// agree 所有成功的探测结果是否一致
+func (row *comparisonRow) agree() bool {
+	var first *string
+	for _, answer := range row.answers {
+		answer := answer
+		if first == nil {
+			first = &answer
+		} else if *first != answer {
+			return false
+		}
+	}
+
+	return true
+}
+
+// buildComparison 按(地区, subnet)汇总每个nameserver的结果
+func buildComparison(records []probeRecord) []*comparisonRow {
+	rowMap := make(map[string]*comparisonRow)
+	var rows []*comparisonRow
+	for _, record := range records {
+		key := strings.Join([]string{record.Country, record.Province, record.ISP, record.Subnet}, "|")
+		row, ok := rowMap[key]
+		if !ok {
+			row = &comparisonRow{
+				country:  record.Country,
+				province: record.Province,
+				isp:      record.ISP,
+				subnet:   record.Subnet,
+				answers:  make(map[string]string),
+				failed:   make(map[string]bool),
+			}
+			rowMap[key] = row
+			rows = append(rows, row)
+		}
+
+		if record.Error != "" {
+			row.failed[record.resolver()] = true
+			continue
+		}
+
+		answers := append([]string(nil), record.Answers...)
+		sort.Strings(answers)
+		row.answers[record.resolver()] = strings.Join(answers, answerSeparator)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		left := []string{rows[i].country, rows[i].province, rows[i].isp, rows[i].subnet}
+		right := []string{rows[j].country, rows[j].province, rows[j].isp, rows[j].subnet}
+		for idx := range left {
+			if left[idx] != right[idx] {
+				return left[idx] < right[idx]
+			}
+		}
+		return false
+	})
+
+	return rows
+}
+
+// prettyComparison 每个地区一行，每个nameserver一列，结果不一致的行标记为DIFF；
+// 再按nameserver汇总: 和多数nameserver不一致的次数，以及不同answer集合的个数，
+// 不支持ECS或者缓存粒度太粗的nameserver不同answer集合的个数会明显偏少
+func prettyComparison(opts *scanOptions, records []probeRecord, domain string, qType uint16) {
+	rows := buildComparison(records)
+	resolvers := opts.resolversFor(domain)
+
+	headers := []string{"Country", "Province", "ISP", "Subnet"}
+	for idx := range resolvers {
+		headers = append(headers, nameserverLabel(&resolvers[idx]))
+	}
+	headers = append(headers, "Agree")
+
+	var matrix [][]string
+	for _, row := range rows {
+		line := []string{row.country, row.province, row.isp, row.subnet}
+		for _, ns := range resolvers {
+			answer, ok := row.answers[ns.Key()]
+			switch {
+			case ok && answer == "":
+				line = append(line, "(empty)")
+			case ok:
+				line = append(line, strings.ReplaceAll(answer, answerSeparator, ", "))
+			case row.failed[ns.Key()]:
+				line = append(line, "(error)")
+			default:
+				line = append(line, "-")
+			}
+		}
+
+		if row.agree() {
+			line = append(line, "yes")
+		} else {
+			line = append(line, "DIFF")
+		}
+		matrix = append(matrix, line)
+	}
+
+	fmt.Printf("Records %s\n", dnsMsg.TypeString(qType))
+	printTable(headers, matrix)
+
+	var summary [][]string
+	for _, ns := range resolvers {
+		probes, failed, differs := 0, 0, 0
+		answerSets := make(map[string]bool)
+		for _, row := range rows {
+			if row.failed[ns.Key()] {
+				probes += 1
+				failed += 1
+				continue
+			}
+
+			answer, ok := row.answers[ns.Key()]
+			if !ok {
+				continue
+			}
+
+			probes += 1
+			answerSets[answer] = true
+			if majority, ok := row.majority(); !row.agree() && (!ok || majority != answer) {
+				differs += 1
+			}
+		}
+
+		summary = append(summary, []string{nameserverLabel(&ns), ns.Desc, strconv.Itoa(probes), strconv.Itoa(failed),
+			strconv.Itoa(differs), strconv.Itoa(len(answerSets))})
+	}
+
+	printTable([]string{"Nameserver", "Desc", "Probes", "Failed", "Disagree", "Answer Sets"}, summary)
+}
+
+// nameserverLabel 同一host:port可以同时配置UDP和TCP的nameserver，TCP的加上协议区分
+func nameserverLabel(ns *configs.DNS) string {
+	if ns.Network() == configs.ProtocolUDP {
+		return ns.Address()
+	}
+
+	return ns.Address() + "/" + ns.Network()
+}
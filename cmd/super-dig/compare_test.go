@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestComparisonAnswersWithComma(t *testing.T) {
+	// SVCB/HTTPS的answer中包含逗号，用逗号连接时两个不同的answer集合会相同
+	records := []probeRecord{
+		{Subnet: "1.0.1.0", Nameserver: "127.0.0.1:53", Answers: []string{`1 . alpn="h2,h3"`}},
+		{Subnet: "1.0.1.0", Nameserver: "127.0.0.2:53", Answers: []string{`1 . alpn="h2`, `h3"`}},
+	}
+
+	rows := buildComparison(records)
+	if len(rows) != 1 {
+		t.Fatalf("%d rows, want 1", len(rows))
+	}
+	if rows[0].agree() {
+		t.Errorf("different answer sets compared as agree: %q", rows[0].answers)
+	}
+}
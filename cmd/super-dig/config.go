@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+var outputFormats = []string{outputTable, outputJSON}
+
+/*
+   --config指定的配置文件，YAML或JSON格式，定义多个命名的扫描profile，通过--profile选择:
+
+   default_profile: cdn
+   profiles:
+     cdn:
+       domains: [walkerdu.com]
+       qtypes: [A, AAAA]
+       resolvers:
+         - {nameserver: 8.8.8.8, desc: Google DNS Server}
+         - {nameserver: 127.0.0.1, port: 5353, protocol: tcp, ecs: false}
+       regions:
+         - {file: ip_region.json}
+       filter:
+         countries: [中国]
+       concurrency: 4
+       outputs: [table, json]
+       output_file: result.json
+       compare_resolvers: false
+       authoritative: false
+       dnssec: false
+       trust_anchor: root.ds
+       annotate_answers: false
+       annotate_ptr: false
+       steering: false
+       history: history.db
+       alerts:
+         webhook: http://127.0.0.1:9000/alerts
+         rules:
+           - {name: no-servfail, forbid_rcodes: [SERVFAIL]}
+
+   配置文件中的相对路径相对于配置文件所在目录，命令行参数优先于配置文件
+*/
+
+type scanConfig struct {
+	DefaultProfile string                  `yaml:"default_profile"`
+	Profiles       map[string]*scanProfile `yaml:"profiles"`
+}
+
+type scanProfile struct {
+	Domains         []string          `yaml:"domains"`
+	QTypes          []string          `yaml:"qtypes"`
+	Resolvers       []configs.DNS     `yaml:"resolvers"`
+	ResolverFile    string            `yaml:"resolver_file"` // ns.json格式的nameserver列表，和resolvers合并
+	Regions         []regionSource    `yaml:"regions"`
+	Sample          string            `yaml:"sample"`
+	Filter          ipDB.RegionFilter `yaml:"filter"`
+	Concurrency     int               `yaml:"concurrency"`
+	Outputs         []string          `yaml:"outputs"`
+	OutputFile      string            `yaml:"output_file"`
+	Compare         bool              `yaml:"compare_resolvers"`
+	Authoritative   bool              `yaml:"authoritative"` // resolvers只用于查找权威nameserver
+	DNSSEC          bool              `yaml:"dnssec"`
+	TrustAnchor     string            `yaml:"trust_anchor"`     // DS格式的trust anchor文件，默认使用根的trust anchor
+	AnnotateAnswers bool              `yaml:"annotate_answers"` // 用regions中的地区数据标注应答中IP的归属地
+	AnnotatePTR     bool              `yaml:"annotate_ptr"`
+	Steering        bool              `yaml:"steering"` // 分析调度质量，隐含annotate_answers
+	History         string            `yaml:"history"`  // 记录每次扫描结果的bbolt数据库
+	Alerts          alertConfig       `yaml:"alerts"`   // 每次扫描后检查的告警规则，见alert.go
+}
+
+// regionSource 地区数据文件，格式见ipDB.LoadOptions
+type regionSource struct {
+	File         string `yaml:"file"`
+	Format       string `yaml:"format"`
+	GeoLocations string `yaml:"geo_locations"`
+	GeoASN       string `yaml:"geo_asn"`
+}
+
+func loadConfig(path string) (*scanConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON是YAML的子集，统一按YAML解析，未知的字段报错，错误信息中带有行号
+	var config scanConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("parse config %s failed: %w", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s:\n%w", path, err)
+	}
+
+	config.resolvePaths(filepath.Dir(path))
+
+	return &config, nil
+}
+
+// profile 返回指定的profile，name为空时使用default_profile，只有一个profile时可以省略
+func (config *scanConfig) profile(name string) (*scanProfile, error) {
+	if name == "" {
+		name = config.DefaultProfile
+	}
+
+	if name == "" && len(config.Profiles) == 1 {
+		for _, profile := range config.Profiles {
+			return profile, nil
+		}
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("please specify --profile, available profiles: %s", strings.Join(config.profileNames(), ", "))
+	}
+
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found, available profiles: %s", name, strings.Join(config.profileNames(), ", "))
+	}
+
+	return profile, nil
+}
+
+func (config *scanConfig) profileNames() []string {
+	var names []string
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// validate 校验所有profile，每个错误以出错的key开头，例如profiles.cdn.resolvers[1].port
+func (config *scanConfig) validate() error {
+	var errs []error
+	if len(config.Profiles) == 0 {
+		errs = append(errs, fmt.Errorf("profiles: at least one profile is required"))
+	}
+
+	if config.DefaultProfile != "" && config.Profiles[config.DefaultProfile] == nil {
+		errs = append(errs, fmt.Errorf("default_profile: profile %q not found", config.DefaultProfile))
+	}
+
+	for _, name := range config.profileNames() {
+		profile := config.Profiles[name]
+		if profile == nil {
+			errs = append(errs, fmt.Errorf("profiles.%s: empty profile", name))
+			continue
+		}
+
+		for _, err := range profile.validate() {
+			errs = append(errs, fmt.Errorf("profiles.%s.%w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (profile *scanProfile) validate() []error {
+	var errs []error
+	for idx, domain := range profile.Domains {
+		if strings.TrimSpace(domain) == "" {
+			errs = append(errs, fmt.Errorf("domains[%d]: empty domain", idx))
+		}
+	}
+
+	for idx, qType := range profile.QTypes {
+		if _, err := dnsMsg.ParseType(qType); err != nil {
+			errs = append(errs, fmt.Errorf("qtypes[%d]: %w", idx, err))
+		}
+	}
+
+	for idx := range profile.Resolvers {
+		if err := profile.Resolvers[idx].Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("resolvers[%d].%w", idx, err))
+		}
+	}
+
+	for idx, source := range profile.Regions {
+		if source.File == "" {
+			errs = append(errs, fmt.Errorf("regions[%d].file: required", idx))
+		}
+
+		if source.Format != "" && !contains(ipDB.Formats, source.Format) {
+			errs = append(errs, fmt.Errorf("regions[%d].format: unknown value %q, expect one of %s",
+				idx, source.Format, strings.Join(ipDB.Formats, ", ")))
+		}
+	}
+
+	if profile.Sample != "" {
+		if _, err := ipDB.ParseSamplePolicy(profile.Sample); err != nil {
+			errs = append(errs, fmt.Errorf("sample: %w", err))
+		}
+	}
+
+	if err := profile.Filter.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("filter.%w", err))
+	}
+
+	if profile.Concurrency < 0 {
+		errs = append(errs, fmt.Errorf("concurrency: must not be negative"))
+	}
+
+	for idx, output := range profile.Outputs {
+		if !contains(outputFormats, output) {
+			errs = append(errs, fmt.Errorf("outputs[%d]: unknown value %q, expect one of %s",
+				idx, output, strings.Join(outputFormats, ", ")))
+		}
+	}
+
+	for _, err := range profile.Alerts.validate() {
+		errs = append(errs, fmt.Errorf("alerts.%w", err))
+	}
+
+	return errs
+}
+
+func (config *scanConfig) resolvePaths(baseDir string) {
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(baseDir, path)
+	}
+
+	for _, profile := range config.Profiles {
+		profile.ResolverFile = resolve(profile.ResolverFile)
+		profile.OutputFile = resolve(profile.OutputFile)
+		profile.TrustAnchor = resolve(profile.TrustAnchor)
+		profile.History = resolve(profile.History)
+		for idx := range profile.Regions {
+			source := &profile.Regions[idx]
+			source.File = resolve(source.File)
+			source.GeoLocations = resolve(source.GeoLocations)
+			source.GeoASN = resolve(source.GeoASN)
+		}
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
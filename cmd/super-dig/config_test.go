@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "conf/profiles.yaml", `
+default_profile: china
+profiles:
+  china:
+    domains: [walkerdu.com]
+    qtypes: [A, AAAA]
+    resolver_file: ns.json
+    resolvers:
+      - {nameserver: 127.0.0.1, port: 5353, protocol: tcp, ecs: false}
+      - {nameserver: dns.google}
+    regions:
+      - {file: ../data/ip.txt, format: ip2region}
+      - {file: /srv/GeoLite2-City-Blocks-IPv4.csv, geo_locations: locations.csv, geo_asn: asn/asn.csv}
+    filter: {countries: [中国], exclude_isps: [移动]}
+    sample: random:4
+    outputs: [table, json]
+    output_file: out/result.json
+    history: history.db
+  global:
+    domains: [walkerdu.com]
+`)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := config.profile("")
+	if err != nil || profile != config.Profiles["china"] {
+		t.Fatalf("default profile %v, %v", profile, err)
+	}
+
+	// 相对路径相对于配置文件所在的目录，绝对路径不变
+	confDir := filepath.Join(dir, "conf")
+	paths := map[string]string{
+		"resolver_file":            profile.ResolverFile,
+		"output_file":              profile.OutputFile,
+		"history":                  profile.History,
+		"trust_anchor":             profile.TrustAnchor,
+		"regions[0].file":          profile.Regions[0].File,
+		"regions[1].file":          profile.Regions[1].File,
+		"regions[1].geo_locations": profile.Regions[1].GeoLocations,
+		"regions[1].geo_asn":       profile.Regions[1].GeoASN,
+	}
+	want := map[string]string{
+		"resolver_file":            filepath.Join(confDir, "ns.json"),
+		"output_file":              filepath.Join(confDir, "out/result.json"),
+		"history":                  filepath.Join(confDir, "history.db"),
+		"trust_anchor":             "",
+		"regions[0].file":          filepath.Join(dir, "data/ip.txt"),
+		"regions[1].file":          "/srv/GeoLite2-City-Blocks-IPv4.csv",
+		"regions[1].geo_locations": filepath.Join(confDir, "locations.csv"),
+		"regions[1].geo_asn":       filepath.Join(confDir, "asn/asn.csv"),
+	}
+	for key, path := range paths {
+		if path != want[key] {
+			t.Errorf("%s = %s, want %s", key, path, want[key])
+		}
+	}
+
+	if len(profile.Resolvers) != 2 || profile.Resolvers[0].Address() != "127.0.0.1:5353" ||
+		profile.Resolvers[0].SupportECS() || profile.Resolvers[1].Key() != "udp/dns.google:53" {
+		t.Errorf("resolvers %+v", profile.Resolvers)
+	}
+
+	if profile, err := config.profile("global"); err != nil || profile.Domains[0] != "walkerdu.com" {
+		t.Errorf("profile global %v, %v", profile, err)
+	}
+	if _, err := config.profile("cdn"); err == nil || !strings.Contains(err.Error(), "available profiles: china, global") {
+		t.Errorf("unknown profile: %v", err)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "profiles.json",
+		`{"profiles": {"cdn": {"domains": ["walkerdu.com"], "resolvers": [{"nameserver": "2001:4860:4860::8888", "port": 53}]}}}`)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有一个profile时可以不指定
+	profile, err := config.profile("")
+	if err != nil || profile.Resolvers[0].Address() != "[2001:4860:4860::8888]:53" {
+		t.Errorf("profile %+v, %v", profile, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errs    []string // 错误信息中应包含的内容
+	}{
+		{"unknown key", `
+profiles:
+  cdn:
+    domains: [walkerdu.com]
+    concurency: 4
+`, []string{"line 5: field concurency not found"}},
+		{"unknown resolver key", `
+profiles:
+  cdn:
+    resolvers:
+      - {nameserver: 8.8.8.8, proto: tcp}
+`, []string{"line 5: field proto not found"}},
+		{"type mismatch", `
+profiles:
+  cdn:
+    concurrency: four
+`, []string{"line 4: cannot unmarshal"}},
+		{"no profile", `default_profile: cdn`, []string{
+			"profiles: at least one profile is required",
+			`default_profile: profile "cdn" not found`,
+		}},
+		{"invalid values", `
+profiles:
+  empty:
+  cdn:
+    domains: [walkerdu.com, " "]
+    qtypes: [A, AAAAA]
+    resolvers:
+      - {nameserver: 8.8.8.8}
+      - {nameserver: 8.8.8.8, port: 70000}
+      - {nameserver: "127.0.0.1:5353"}
+      - {nameserver: 8.8.8.8, protocol: tls, source: "::1"}
+    regions:
+      - {format: csv}
+      - {file: ip.xlsx, format: xlsx}
+    sample: random:0
+    filter: {provinces: ["广["]}
+    concurrency: -1
+    outputs: [table, yaml]
+`, []string{
+			"profiles.cdn.domains[1]: empty domain",
+			"profiles.cdn.qtypes[1]: ",
+			"profiles.cdn.resolvers[1].port: ",
+			"profiles.cdn.resolvers[2].nameserver: ",
+			"profiles.cdn.resolvers[3].protocol: ",
+			"profiles.cdn.regions[0].file: required",
+			`profiles.cdn.regions[1].format: unknown value "xlsx"`,
+			"profiles.cdn.sample: ",
+			`profiles.cdn.filter.provinces: invalid pattern "广["`,
+			"profiles.cdn.concurrency: must not be negative",
+			`profiles.cdn.outputs[1]: unknown value "yaml"`,
+			"profiles.empty: empty profile",
+		}},
+	}
+
+	for _, test := range tests {
+		path := writeConfig(t, t.TempDir(), "profiles.yaml", test.content)
+		_, err := loadConfig(path)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+
+		for _, want := range test.errs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error\n%v\ndoes not contain %q", test.name, err, want)
+			}
+		}
+
+		// 每个错误一行
+		if lines := strings.Count(err.Error(), "\n"); len(test.errs) > 1 && lines != len(test.errs) {
+			t.Errorf("%s: %d error lines, want %d:\n%v", test.name, lines, len(test.errs), err)
+		}
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing config file: no error")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+// denialProof authority中签名验证通过的NSEC/NSEC3，用来证明name或者类型不存在，RFC4035 5.4、RFC5155 8
+type denialProof struct {
+	zone   string
+	nsecs  []*dnsMsg.NSEC
+	nsec3s []*dnsMsg.NSEC3
+}
+
+// collectDenial 验证authority中zone的NSEC/NSEC3的签名，通配符展开的NSEC/NSEC3不能使用
+func (validator *dnssecValidator) collectDenial(msg *dnsMsg.Message, zone string, keys []*dnsMsg.DNSKEY) (*denialProof, error) {
+	proof := &denialProof{zone: zone}
+	for _, rrset := range groupRRSets(msg.Authority) {
+		rr := &rrset[0]
+		if rr.Type != dnsMsg.TypeNSEC && rr.Type != dnsMsg.TypeNSEC3 {
+			continue
+		}
+
+		// NSEC3的owner是zone下一级的hash
+		owner := canonicalZone(rr.Name)
+		if !isSubdomain(owner, zone) || rr.Type == dnsMsg.TypeNSEC3 && (owner == zone || parentName(owner) != zone) {
+			continue
+		}
+
+		sigs := dnsMsg.Signatures(msg.Authority, rr.Name, rr.Type)
+		sig, err := validator.verifyRRSet(msg, rrset, sigs, keys)
+		if err != nil {
+			return nil, err
+		}
+		if expanded(sig, owner) {
+			return nil, fmt.Errorf("%s %s is expanded from wildcard", owner, dnsMsg.TypeString(rr.Type))
+		}
+
+		for idx := range rrset {
+			if rr.Type == dnsMsg.TypeNSEC {
+				if nsec, err := dnsMsg.ParseNSEC(&rrset[idx]); err == nil {
+					proof.nsecs = append(proof.nsecs, nsec)
+				}
+			} else if nsec3, err := dnsMsg.ParseNSEC3(&rrset[idx]); err == nil {
+				proof.nsec3s = append(proof.nsec3s, nsec3)
+			}
+		}
+	}
+
+	if len(proof.nsecs) == 0 && len(proof.nsec3s) == 0 {
+		return nil, fmt.Errorf("no signed NSEC/NSEC3 of %s in authority", zone)
+	}
+
+	return proof, nil
+}
+
+// prove 证明name不存在(nxdomain)，或者name没有qType的记录
+func (proof *denialProof) prove(name string, qType uint16, nxdomain bool) error {
+	switch {
+	case len(proof.nsecs) > 0 && nxdomain:
+		return proof.nsecNXDomain(name)
+	case len(proof.nsecs) > 0:
+		return proof.nsecNoData(name, qType)
+	case nxdomain:
+		return proof.nsec3NXDomain(name)
+	}
+
+	return proof.nsec3NoData(name, qType)
+}
+
+// noCloserMatch 通配符展开的应答需要证明name本身不存在：NSEC覆盖name，或者NSEC3覆盖next closer name，
+// labels为RRSIG的Labels，即通配符去掉"*"之后的label数
+func (proof *denialProof) noCloserMatch(name string, labels int) error {
+	if proof.nsecCovering(name) != nil {
+		return nil
+	}
+
+	parts := strings.Split(name, ".")
+	nextCloser := strings.Join(parts[len(parts)-labels-1:], ".")
+	if proof.nsec3Covering(nextCloser) != nil {
+		return nil
+	}
+
+	return fmt.Errorf("no NSEC/NSEC3 proves %s does not exist for wildcard answer", name)
+}
+
+// nsecNXDomain NSEC覆盖name，并且覆盖closest encloser下的通配符，RFC4035 5.4
+func (proof *denialProof) nsecNXDomain(name string) error {
+	nsec := proof.nsecCovering(name)
+	if nsec == nil {
+		return fmt.Errorf("no NSEC proves %s does not exist", name)
+	}
+
+	wildcard := wildcardOf(nsecEncloser(name, nsec))
+	if proof.nsecCovering(wildcard) == nil {
+		return fmt.Errorf("no NSEC proves wildcard %s does not exist", wildcard)
+	}
+
+	return nil
+}
+
+// nsecNoData owner为name的NSEC没有qType，name是empty non-terminal，或者匹配的通配符没有qType
+func (proof *denialProof) nsecNoData(name string, qType uint16) error {
+	if nsec := proof.nsecMatching(name); nsec != nil {
+		return checkNoData(nsec.HasType, name, qType)
+	}
+
+	if nsec := proof.nsecCovering(name); nsec != nil {
+		// empty non-terminal: 下一个name是name的子域名
+		if isSubdomain(canonicalZone(nsec.NextName), name) {
+			return nil
+		}
+
+		wildcard := wildcardOf(nsecEncloser(name, nsec))
+		if wild := proof.nsecMatching(wildcard); wild != nil {
+			return checkNoData(wild.HasType, wildcard, qType)
+		}
+	}
+
+	return fmt.Errorf("no NSEC proves %s has no %s record", name, dnsMsg.TypeString(qType))
+}
+
+// nsec3NXDomain closest encloser证明，并且NSEC3覆盖closest encloser下的通配符，RFC5155 8.4
+func (proof *denialProof) nsec3NXDomain(name string) error {
+	if proof.nsec3Matching(name) != nil {
+		return fmt.Errorf("NSEC3 proves %s exists", name)
+	}
+
+	encloser, _, err := proof.closestEncloser(name)
+	if err != nil {
+		return err
+	}
+
+	wildcard := wildcardOf(encloser)
+	if proof.nsec3Covering(wildcard) == nil {
+		return fmt.Errorf("no NSEC3 proves wildcard %s does not exist", wildcard)
+	}
+
+	return nil
+}
+
+// nsec3NoData 匹配name的NSEC3没有qType，RFC5155 8.5；DS的next closer在opt-out范围内，RFC5155 8.6；
+// 或者匹配的通配符没有qType，RFC5155 8.7
+func (proof *denialProof) nsec3NoData(name string, qType uint16) error {
+	if nsec3 := proof.nsec3Matching(name); nsec3 != nil {
+		return checkNoData(nsec3.HasType, name, qType)
+	}
+
+	encloser, optOut, err := proof.closestEncloser(name)
+	if err != nil {
+		return err
+	}
+
+	if qType == dnsMsg.TypeDS && optOut {
+		return nil
+	}
+
+	wildcard := wildcardOf(encloser)
+	if wild := proof.nsec3Matching(wildcard); wild != nil {
+		return checkNoData(wild.HasType, wildcard, qType)
+	}
+
+	return fmt.Errorf("no NSEC3 proves %s has no %s record", name, dnsMsg.TypeString(qType))
+}
+
+// closestEncloser 找到NSEC3匹配的最近的祖先，并且next closer name被NSEC3覆盖，返回closest encloser
+// 和覆盖next closer的NSEC3是否opt-out，RFC5155 8.3
+func (proof *denialProof) closestEncloser(name string) (string, bool, error) {
+	for nextCloser := name; nextCloser != proof.zone && nextCloser != "."; nextCloser = parentName(nextCloser) {
+		encloser := parentName(nextCloser)
+		nsec3 := proof.nsec3Matching(encloser)
+		if nsec3 == nil {
+			continue
+		}
+
+		// 委派点和DNAME下面的name不由该zone证明
+		if nsec3.HasType(dnsMsg.TypeDNAME) || nsec3.HasType(dnsMsg.TypeNS) && !nsec3.HasType(dnsMsg.TypeSOA) {
+			return "", false, fmt.Errorf("closest encloser %s of %s is a delegation", encloser, name)
+		}
+
+		cover := proof.nsec3Covering(nextCloser)
+		if cover == nil {
+			return "", false, fmt.Errorf("no NSEC3 covers next closer name %s", nextCloser)
+		}
+
+		return encloser, cover.OptOut(), nil
+	}
+
+	return "", false, fmt.Errorf("no NSEC3 proves closest encloser of %s", name)
+}
+
+func (proof *denialProof) nsecMatching(name string) *dnsMsg.NSEC {
+	for _, nsec := range proof.nsecs {
+		if canonicalZone(nsec.Owner) == name {
+			return nsec
+		}
+	}
+
+	return nil
+}
+
+// nsecCovering 返回覆盖name的NSEC，父zone在委派点的NSEC不能证明子zone中的name不存在
+func (proof *denialProof) nsecCovering(name string) *dnsMsg.NSEC {
+	for _, nsec := range proof.nsecs {
+		if !nsec.Covers(name) {
+			continue
+		}
+
+		if isSubdomain(name, canonicalZone(nsec.Owner)) &&
+			(nsec.HasType(dnsMsg.TypeDNAME) || nsec.HasType(dnsMsg.TypeNS) && !nsec.HasType(dnsMsg.TypeSOA)) {
+			continue
+		}
+
+		return nsec
+	}
+
+	return nil
+}
+
+// nsec3Matching 返回hash和name的hash相同的NSEC3，不支持的hash算法忽略
+func (proof *denialProof) nsec3Matching(name string) *dnsMsg.NSEC3 {
+	for _, nsec3 := range proof.nsec3s {
+		if hash, err := nsec3.Hash(name); err == nil && nsec3.Matches(hash) {
+			return nsec3
+		}
+	}
+
+	return nil
+}
+
+func (proof *denialProof) nsec3Covering(name string) *dnsMsg.NSEC3 {
+	for _, nsec3 := range proof.nsec3s {
+		if hash, err := nsec3.Hash(name); err == nil && nsec3.Covers(hash) {
+			return nsec3
+		}
+	}
+
+	return nil
+}
+
+// checkNoData NODATA的NSEC/NSEC3不能有qType和CNAME；DS的NSEC/NSEC3来自父zone，不能是子zone的顶点，
+// 其他类型不能是父zone在委派点的NSEC/NSEC3
+func checkNoData(hasType func(uint16) bool, name string, qType uint16) error {
+	switch {
+	case hasType(qType):
+		return fmt.Errorf("NSEC/NSEC3 of %s has %s record", name, dnsMsg.TypeString(qType))
+	case hasType(dnsMsg.TypeCNAME):
+		return fmt.Errorf("NSEC/NSEC3 of %s has CNAME record", name)
+	case qType == dnsMsg.TypeDS && hasType(dnsMsg.TypeSOA) && name != ".":
+		return fmt.Errorf("NSEC/NSEC3 of %s is from child zone", name)
+	case qType != dnsMsg.TypeDS && hasType(dnsMsg.TypeNS) && !hasType(dnsMsg.TypeSOA):
+		return fmt.Errorf("NSEC/NSEC3 of %s is from parent zone at delegation", name)
+	}
+
+	return nil
+}
+
+// nsecEncloser 覆盖name的NSEC证明的closest encloser，即name和NSEC的owner、next的公共祖先中最长的一个
+func nsecEncloser(name string, nsec *dnsMsg.NSEC) string {
+	encloser := commonAncestor(name, canonicalZone(nsec.Owner))
+	if next := commonAncestor(name, canonicalZone(nsec.NextName)); dnsMsg.LabelCount(next) > dnsMsg.LabelCount(encloser) {
+		encloser = next
+	}
+
+	return encloser
+}
+
+// expanded RRSIG是否是通配符展开的，owner本身是通配符时Labels不包括"*"，RFC4034 3.1.3
+func expanded(sig *dnsMsg.RRSIG, owner string) bool {
+	labels := dnsMsg.LabelCount(owner)
+	if owner == "*" || strings.HasPrefix(owner, "*.") {
+		labels--
+	}
+
+	return int(sig.Labels) < labels
+}
+
+func commonAncestor(a, b string) string {
+	for ancestor := a; ancestor != "."; ancestor = parentName(ancestor) {
+		if isSubdomain(b, ancestor) {
+			return ancestor
+		}
+	}
+
+	return "."
+}
+
+func wildcardOf(encloser string) string {
+	if encloser == "." {
+		return "*"
+	}
+
+	return "*." + encloser
+}
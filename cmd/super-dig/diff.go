@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var diffUsage = `Usage: %s diff [options] old.json new.json
+Compare two json scan results: changed answers of each region, addresses appeared or disappeared,
+and the number of regions behind each answer set.
+Options:
+	--ignore-nameserver <match probes by subnet only, for results scanned with different name servers>
+	--format <output format: table, json, default table>
+	--log_level <zap log level>
+`
+
+// scanDiff diff子命令的json格式结果
+type scanDiff struct {
+	Changes   []recordChange  `json:"changes"`
+	Addresses []addressChange `json:"addresses"`
+	Groups    []groupChange   `json:"groups"`
+}
+
+// addressChange 一个域名的一种记录类型在所有地区的应答中新出现和消失的记录
+type addressChange struct {
+	Domain  string   `json:"domain"`
+	QType   string   `json:"qtype"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// groupChange 返回同一个answer集合的探测个数的变化
+type groupChange struct {
+	Domain  string   `json:"domain"`
+	QType   string   `json:"qtype"`
+	Answers []string `json:"answers"`
+	Old     int      `json:"old"`
+	New     int      `json:"new"`
+}
+
+// recordChange 同一个探测(domain, qtype, subnet, nameserver)前后两次结果的差异
+type recordChange struct {
+	Time       time.Time `json:"time"`
+	Domain     string    `json:"domain"`
+	QType      string    `json:"qtype"`
+	Subnet     string    `json:"subnet"`
+	Nameserver string    `json:"nameserver"`
+	Country    string    `json:"country"`
+	Province   string    `json:"province"`
+	ISP        string    `json:"isp"`
+	OldRCode   string    `json:"old_rcode,omitempty"`
+	NewRCode   string    `json:"new_rcode,omitempty"`
+	Added      []string  `json:"added,omitempty"`
+	Removed    []string  `json:"removed,omitempty"`
+}
+
+// recordKey 按探测匹配前后两次的结果
+func recordKey(record *probeRecord) string {
+	return probeKey(record.Domain, record.QType, record.Subnet, record.resolver())
+}
+
+// subnetKey 不区分nameserver，按subnet匹配前后两次的结果
+func subnetKey(record *probeRecord) string {
+	return probeKey(record.Domain, record.QType, record.Subnet, "")
+}
+
+// duplicateKey 返回key相同的两个探测中第一个重复的key，比如每个subnet有多个nameserver时的subnetKey
+func duplicateKey(records []probeRecord, key func(*probeRecord) string) (string, bool) {
+	keys := make(map[string]bool)
+	for idx := range records {
+		k := key(&records[idx])
+		if keys[k] {
+			return k, true
+		}
+		keys[k] = true
+	}
+
+	return "", false
+}
+
+// diffRecords 对比前后两次的探测结果，只返回answer集合或者rcode变化的探测，
+// 失败的探测和只在一边出现的探测不参与对比
+func diffRecords(oldRecords, newRecords []probeRecord, key func(*probeRecord) string) []recordChange {
+	oldMap := make(map[string]*probeRecord)
+	for idx := range oldRecords {
+		record := &oldRecords[idx]
+		if record.Error == "" {
+			oldMap[key(record)] = record
+		}
+	}
+
+	var changes []recordChange
+	for idx := range newRecords {
+		record := &newRecords[idx]
+		old, ok := oldMap[key(record)]
+		if !ok || record.Error != "" {
+			continue
+		}
+
+		change := recordChange{
+			Time:       record.Time,
+			Domain:     record.Domain,
+			QType:      record.QType,
+			Subnet:     record.Subnet,
+			Nameserver: record.Nameserver,
+			Country:    record.Country,
+			Province:   record.Province,
+			ISP:        record.ISP,
+		}
+
+		// 之前的结果中没有rcode时不对比
+		if old.RCode != "" && record.RCode != "" && old.RCode != record.RCode {
+			change.OldRCode, change.NewRCode = old.RCode, record.RCode
+		}
+		change.Added, change.Removed = diffAnswers(old.Answers, record.Answers)
+
+		if change.OldRCode != "" || len(change.Added) > 0 || len(change.Removed) > 0 {
+			changes = append(changes, change)
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		left := []string{changes[i].Domain, changes[i].QType, changes[i].Country, changes[i].Province, changes[i].ISP, changes[i].Subnet}
+		right := []string{changes[j].Domain, changes[j].QType, changes[j].Country, changes[j].Province, changes[j].ISP, changes[j].Subnet}
+		for idx := range left {
+			if left[idx] != right[idx] {
+				return left[idx] < right[idx]
+			}
+		}
+		return false
+	})
+
+	return changes
+}
+
+// diffAnswers 返回新增和删除的记录，去重后各自按字典序排列
+func diffAnswers(oldAnswers, newAnswers []string) (added, removed []string) {
+	oldSet := make(map[string]bool)
+	for _, answer := range oldAnswers {
+		oldSet[answer] = true
+	}
+
+	newSet := make(map[string]bool)
+	for _, answer := range newAnswers {
+		if !oldSet[answer] && !newSet[answer] {
+			added = append(added, answer)
+		}
+		newSet[answer] = true
+	}
+
+	for answer := range oldSet {
+		if !newSet[answer] {
+			removed = append(removed, answer)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// prettyChanges 每个变化的探测一行，rcode变化表示为"NOERROR -> NXDOMAIN"
+func prettyChanges(changes []recordChange) {
+	var rows [][]string
+	for _, change := range changes {
+		rcode := ""
+		if change.OldRCode != "" {
+			rcode = change.OldRCode + " -> " + change.NewRCode
+		}
+
+		rows = append(rows, []string{change.Time.Local().Format("2006-01-02 15:04:05"), change.Domain, change.QType,
+			change.Country, change.Province, change.ISP, change.Subnet, change.Nameserver, rcode,
+			strings.Join(change.Added, ", "), strings.Join(change.Removed, ", ")})
+	}
+
+	printTable([]string{"Time", "Domain", "Type", "Country", "Province", "ISP", "Subnet", "Nameserver", "RCode",
+		"Added", "Removed"}, rows)
+}
+
+func diffMain(args []string) {
+	flagSet := flag.NewFlagSet("diff", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Printf(diffUsage, os.Args[0])
+	}
+	ignoreNameserver := flagSet.Bool("ignore-nameserver", false, "match probes by subnet only")
+	format := flagSet.String("format", outputTable, "output format")
+	level := flagSet.Int("log_level", 0, "zap log level, default info")
+
+	// 文件可以在options之前
+	var files []string
+	flagSet.Parse(args)
+	for flagSet.NArg() > 0 {
+		files = append(files, flagSet.Arg(0))
+		flagSet.Parse(flagSet.Args()[1:])
+	}
+
+	initLogger(*level, "stderr")
+	defer logger.Sync()
+
+	if len(files) != 2 {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	if *format != outputTable && *format != outputJSON {
+		logger.Fatal("invalid --format, expect table or json", zap.String("format", *format))
+	}
+
+	oldReport := loadReport(files[0])
+	newReport := loadReport(files[1])
+
+	key := recordKey
+	if *ignoreNameserver {
+		key = subnetKey
+
+		// 每个subnet有多个nameserver时按subnet无法一一对应，匹配的结果取决于遍历顺序
+		for idx, report := range []*scanReport{oldReport, newReport} {
+			if k, ok := duplicateKey(report.Probes, key); ok {
+				logger.Fatal("--ignore-nameserver requires one nameserver per subnet, but the result scanned a subnet with several nameservers",
+					zap.String("file", files[idx]), zap.String("probe", k))
+			}
+		}
+	}
+
+	result := scanDiff{
+		Changes:   diffRecords(oldReport.Probes, newReport.Probes, key),
+		Addresses: diffAddresses(oldReport.Probes, newReport.Probes),
+		Groups:    diffGroups(oldReport.Probes, newReport.Probes),
+	}
+	logUnmatched(oldReport.Probes, newReport.Probes, key)
+
+	if *format == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "    ")
+		if err := encoder.Encode(result); err != nil {
+			logger.Fatal("write json diff failed", zap.Error(err))
+		}
+		return
+	}
+
+	fmt.Println("Changed regions")
+	prettyChanges(result.Changes)
+
+	var addressRows [][]string
+	for _, change := range result.Addresses {
+		addressRows = append(addressRows, []string{change.Domain, change.QType, strings.Join(change.Added, ", "),
+			strings.Join(change.Removed, ", ")})
+	}
+	fmt.Println("\nAddresses")
+	printTable([]string{"Domain", "Type", "Appeared", "Disappeared"}, addressRows)
+
+	var groupRows [][]string
+	for _, group := range result.Groups {
+		groupRows = append(groupRows, []string{group.Domain, group.QType, answerSetString(group.Answers),
+			fmt.Sprint(group.Old), fmt.Sprint(group.New), fmt.Sprintf("%+d", group.New-group.Old)})
+	}
+	fmt.Println("\nAnswer groups")
+	printTable([]string{"Domain", "Type", "Answers", "Old", "New", "Delta"}, groupRows)
+}
+
+func loadReport(path string) *scanReport {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Fatal("load scan result failed", zap.Error(err))
+	}
+
+	var report scanReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		logger.Fatal("parse scan result failed", zap.String("file", path), zap.Error(err))
+	}
+
+	return &report
+}
+
+// logUnmatched 只在一边出现的探测不参与对比，通常是地区数据或者nameserver不同
+func logUnmatched(oldRecords, newRecords []probeRecord, key func(*probeRecord) string) {
+	oldKeys := make(map[string]bool)
+	for idx := range oldRecords {
+		oldKeys[key(&oldRecords[idx])] = true
+	}
+
+	onlyNew := 0
+	newKeys := make(map[string]bool)
+	for idx := range newRecords {
+		newKeys[key(&newRecords[idx])] = true
+		if !oldKeys[key(&newRecords[idx])] {
+			onlyNew += 1
+		}
+	}
+
+	onlyOld := 0
+	for k := range oldKeys {
+		if !newKeys[k] {
+			onlyOld += 1
+		}
+	}
+
+	if onlyOld > 0 || onlyNew > 0 {
+		logger.Warn("some probes only exist in one result, try --ignore-nameserver if name servers are different",
+			zap.Int("only_old", onlyOld), zap.Int("only_new", onlyNew))
+	}
+}
+
+// domainQType 按domain和qtype分组，保持第一次出现的顺序
+type domainQType struct {
+	domain string
+	qType  string
+}
+
+func groupByDomain(oldRecords, newRecords []probeRecord) ([]domainQType, map[domainQType][2][]probeRecord) {
+	var keys []domainQType
+	groups := make(map[domainQType][2][]probeRecord)
+	for side, records := range [][]probeRecord{oldRecords, newRecords} {
+		for _, record := range records {
+			if record.Error != "" {
+				continue
+			}
+
+			key := domainQType{record.Domain, record.QType}
+			group, ok := groups[key]
+			if !ok {
+				keys = append(keys, key)
+			}
+			group[side] = append(group[side], record)
+			groups[key] = group
+		}
+	}
+
+	return keys, groups
+}
+
+// diffAddresses 所有地区的应答合在一起对比，得到新出现和消失的记录
+func diffAddresses(oldRecords, newRecords []probeRecord) []addressChange {
+	keys, groups := groupByDomain(oldRecords, newRecords)
+
+	var changes []addressChange
+	for _, key := range keys {
+		var all [2][]string
+		for side, records := range groups[key] {
+			for _, record := range records {
+				all[side] = append(all[side], record.Answers...)
+			}
+		}
+
+		added, removed := diffAnswers(all[0], all[1])
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, addressChange{Domain: key.domain, QType: key.qType, Added: added, Removed: removed})
+		}
+	}
+
+	return changes
+}
+
+// diffGroups 和prettyStatistic一样按answer集合聚合，对比每个集合背后的探测个数
+func diffGroups(oldRecords, newRecords []probeRecord) []groupChange {
+	keys, groups := groupByDomain(oldRecords, newRecords)
+
+	var changes []groupChange
+	for _, key := range keys {
+		var sets []string
+		counts := make(map[string]*groupChange)
+		for side, records := range groups[key] {
+			for _, record := range records {
+				answers := append([]string(nil), record.Answers...)
+				sort.Strings(answers)
+				set := strings.Join(answers, answerSeparator)
+
+				change, ok := counts[set]
+				if !ok {
+					change = &groupChange{Domain: key.domain, QType: key.qType, Answers: answers}
+					counts[set] = change
+					sets = append(sets, set)
+				}
+
+				if side == 0 {
+					change.Old += 1
+				} else {
+					change.New += 1
+				}
+			}
+		}
+
+		sort.Strings(sets)
+		for _, set := range sets {
+			changes = append(changes, *counts[set])
+		}
+	}
+
+	return changes
+}
+
+func answerSetString(answers []string) string {
+	if len(answers) == 0 {
+		return "(empty)"
+	}
+
+	return strings.Join(answers, ", ")
+}
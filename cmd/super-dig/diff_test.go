@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffRecords(t *testing.T) {
+	oldReport := loadReport("testdata/diff_old.json")
+	newReport := loadReport("testdata/diff_new.json")
+
+	// 失败的探测、只在一边出现的探测和没有rcode的旧结果不算变化
+	now := time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC)
+	want := []recordChange{
+		{Time: now, Domain: "www.example.com", QType: "A", Subnet: "1.0.2.0", Nameserver: "8.8.8.8:53",
+			Country: "中国", Province: "北京市", ISP: "联通", Added: []string{"10.0.2.3"}, Removed: []string{"10.0.2.2"}},
+		{Time: now, Domain: "www.example.com", QType: "A", Subnet: "1.0.1.0", Nameserver: "8.8.8.8:53",
+			Country: "中国", Province: "广东省", ISP: "电信", Added: []string{"10.0.1.2"}, Removed: []string{"10.0.1.1"}},
+		{Time: now, Domain: "www.example.com", QType: "A", Subnet: "36.134.0.0/16", Nameserver: "8.8.8.8:53",
+			Country: "中国", Province: "广东省", ISP: "移动", OldRCode: "NOERROR", NewRCode: "NXDOMAIN", Removed: []string{"10.0.9.9"}},
+	}
+
+	if changes := diffRecords(oldReport.Probes, newReport.Probes, recordKey); !reflect.DeepEqual(changes, want) {
+		t.Errorf("diffRecords =\n%+v\nwant\n%+v", changes, want)
+	}
+
+	// 换了nameserver之后只能按subnet匹配
+	for idx := range newReport.Probes {
+		newReport.Probes[idx].Nameserver = "1.1.1.1:53"
+	}
+	if changes := diffRecords(oldReport.Probes, newReport.Probes, recordKey); len(changes) != 0 {
+		t.Errorf("diffRecords with different nameservers by recordKey = %+v", changes)
+	}
+
+	for idx := range want {
+		want[idx].Nameserver = "1.1.1.1:53"
+	}
+	if changes := diffRecords(oldReport.Probes, newReport.Probes, subnetKey); !reflect.DeepEqual(changes, want) {
+		t.Errorf("diffRecords by subnetKey =\n%+v\nwant\n%+v", changes, want)
+	}
+}
+
+func TestDuplicateKey(t *testing.T) {
+	records := loadReport("testdata/diff_old.json").Probes
+	if k, ok := duplicateKey(records, subnetKey); ok {
+		t.Errorf("duplicateKey(subnetKey) = %s", k)
+	}
+
+	// 同一个subnet的UDP和TCP nameserver按subnet无法区分
+	tcp := records[0]
+	tcp.Protocol = "tcp"
+	records = append(records, tcp)
+	if k, ok := duplicateKey(records, recordKey); ok {
+		t.Errorf("duplicateKey(recordKey) = %s", k)
+	}
+	if k, ok := duplicateKey(records, subnetKey); !ok || k != "www.example.com|A|1.0.1.0|" {
+		t.Errorf("duplicateKey(subnetKey) = %s, %v", k, ok)
+	}
+}
+
+func TestDiffAddresses(t *testing.T) {
+	oldReport := loadReport("testdata/diff_old.json")
+	newReport := loadReport("testdata/diff_new.json")
+
+	// 失败的探测不参与对比，1.0.6.0之前超时，现在的应答算新出现的记录
+	want := []addressChange{
+		{Domain: "www.example.com", QType: "A",
+			Added:   []string{"10.0.1.2", "10.0.2.3", "10.0.5.1", "10.0.6.1"},
+			Removed: []string{"10.0.1.1", "10.0.2.2", "10.0.4.1"}},
+	}
+	if changes := diffAddresses(oldReport.Probes, newReport.Probes); !reflect.DeepEqual(changes, want) {
+		t.Errorf("diffAddresses =\n%+v\nwant\n%+v", changes, want)
+	}
+
+	if changes := diffAddresses(oldReport.Probes, oldReport.Probes); len(changes) != 0 {
+		t.Errorf("diffAddresses of the same result = %+v", changes)
+	}
+}
+
+func TestDiffGroups(t *testing.T) {
+	oldReport := loadReport("testdata/diff_old.json")
+	newReport := loadReport("testdata/diff_new.json")
+
+	group := func(qType string, old, new int, answers ...string) groupChange {
+		return groupChange{Domain: "www.example.com", QType: qType, Answers: answers, Old: old, New: new}
+	}
+	want := []groupChange{
+		group("A", 0, 1),
+		group("A", 1, 0, "10.0.1.1"),
+		group("A", 0, 1, "10.0.1.2"),
+		group("A", 1, 0, "10.0.2.1", "10.0.2.2"),
+		group("A", 0, 1, "10.0.2.1", "10.0.2.3", "10.0.2.3"),
+		group("A", 1, 0, "10.0.4.1"),
+		group("A", 0, 1, "10.0.5.1"),
+		group("A", 0, 1, "10.0.6.1"),
+		group("A", 2, 1, "10.0.9.9"),
+		group("AAAA", 1, 1, "2001:db8::1"),
+	}
+	if groups := diffGroups(oldReport.Probes, newReport.Probes); !reflect.DeepEqual(groups, want) {
+		t.Errorf("diffGroups =\n%+v\nwant\n%+v", groups, want)
+	}
+}
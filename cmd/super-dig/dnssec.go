@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"go.uber.org/zap"
+)
+
+// DNSSEC验证结果，RFC4033 5
+const (
+	dnssecSecure        = "secure"
+	dnssecInsecure      = "insecure"
+	dnssecBogus         = "bogus"
+	dnssecIndeterminate = "indeterminate" // 获取DNSKEY/DS失败，无法判断
+)
+
+// 根的trust anchor，https://data.iana.org/root-anchors/root-anchors.xml
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// zoneKeys 一个zone经过验证的DNSKEY
+type zoneKeys struct {
+	status string
+	reason string
+	keys   []*dnsMsg.DNSKEY
+}
+
+// zoneKeysEntry 缓存一个zone的DNSKEY，并发的探测等待同一个zone的第一次查询完成，失败的结果同样缓存
+type zoneKeysEntry struct {
+	once sync.Once
+	keys *zoneKeys
+}
+
+// zoneLookup 缓存name所在的zone，和zoneKeysEntry一样每个name只查询一次
+type zoneLookup struct {
+	once sync.Once
+	zone string
+	err  error
+}
+
+// dnssecValidator 从trust anchor开始逐级验证DS和DNSKEY，验证结果按zone缓存，
+// DNSKEY和DS通过递归nameserver查询，查询时设置CD，验证失败的数据也能拿到
+// 多个worker并发调用validate，mutex只保护zones和zoneOf两个map，查询和验证时不持有锁
+type dnssecValidator struct {
+	mutex     sync.Mutex
+	resolvers []configs.DNS
+	anchors   map[string][]*dnsMsg.DS
+	zones     map[string]*zoneKeysEntry
+	zoneOf    map[string]*zoneLookup
+	now       func() time.Time
+}
+
+func newDNSSECValidator(resolvers []configs.DNS, anchors []*dnsMsg.DS) *dnssecValidator {
+	validator := &dnssecValidator{
+		resolvers: resolvers,
+		anchors:   make(map[string][]*dnsMsg.DS),
+		zones:     make(map[string]*zoneKeysEntry),
+		zoneOf:    make(map[string]*zoneLookup),
+		now:       time.Now,
+	}
+
+	for _, ds := range anchors {
+		zone := canonicalZone(ds.Owner)
+		validator.anchors[zone] = append(validator.anchors[zone], ds)
+	}
+
+	return validator
+}
+
+// loadTrustAnchors 读取DS格式的trust anchor，每行一条，例如". IN DS 20326 8 2 E06D...8EC8D"，path为空时使用根的trust anchor
+func loadTrustAnchors(path string) ([]*dnsMsg.DS, error) {
+	lines := defaultTrustAnchors
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		lines = nil
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var anchors []*dnsMsg.DS
+	for lineNo, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ds, err := parseDSLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo+1, err)
+		}
+		anchors = append(anchors, ds)
+	}
+
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchor found")
+	}
+
+	return anchors, nil
+}
+
+// parseDSLine 解析zone文件格式的DS记录: <owner> [TTL] [IN] DS <key tag> <algorithm> <digest type> <digest>
+func parseDSLine(line string) (*dnsMsg.DS, error) {
+	fields := strings.Fields(line)
+	typeIdx := -1
+	for idx, field := range fields {
+		if strings.EqualFold(field, "DS") {
+			typeIdx = idx
+			break
+		}
+	}
+
+	if typeIdx < 1 || len(fields) < typeIdx+5 {
+		return nil, fmt.Errorf("invalid DS record %q", line)
+	}
+
+	values := fields[typeIdx+1:]
+	keyTag, err1 := strconv.ParseUint(values[0], 10, 16)
+	algorithm, err2 := strconv.ParseUint(values[1], 10, 8)
+	digestType, err3 := strconv.ParseUint(values[2], 10, 8)
+	digest, err4 := hex.DecodeString(strings.Join(values[3:], ""))
+	for _, err := range []error{err1, err2, err3, err4} {
+		if err != nil {
+			return nil, fmt.Errorf("invalid DS record %q: %w", line, err)
+		}
+	}
+
+	return &dnsMsg.DS{
+		Owner:      canonicalZone(fields[0]),
+		KeyTag:     uint16(keyTag),
+		Algorithm:  uint8(algorithm),
+		DigestType: uint8(digestType),
+		Digest:     digest,
+	}, nil
+}
+
+// validate 验证响应中answer的每个RRset，都是secure时为secure，有一个insecure时为insecure；
+// 通配符展开的RRset还需要authority中的NSEC/NSEC3证明没有更接近的name，否定应答(NXDOMAIN/NODATA)见validateNegative
+func (validator *dnssecValidator) validate(msg *dnsMsg.Message, name string, qType uint16) (string, string) {
+	if len(msg.Answers) == 0 {
+		return validator.validateNegative(msg, name, qType)
+	}
+
+	status, reason := dnssecSecure, ""
+	for _, rrset := range groupRRSets(msg.Answers) {
+		owner, rType := rrset[0].Name, rrset[0].Type
+		sigs := dnsMsg.Signatures(msg.Answers, owner, rType)
+		if len(sigs) == 0 {
+			zone, err := validator.findZone(owner)
+			if err != nil {
+				return dnssecIndeterminate, err.Error()
+			}
+
+			keys := validator.keysFor(zone)
+			switch keys.status {
+			case dnssecSecure:
+				return dnssecBogus, fmt.Sprintf("missing RRSIG for %s %s in signed zone %s", owner, dnsMsg.TypeString(rType), zone)
+			case dnssecInsecure:
+				status, reason = dnssecInsecure, keys.reason
+				continue
+			default:
+				return keys.status, keys.reason
+			}
+		}
+
+		signer := canonicalZone(sigs[0].SignerName)
+		if !isSubdomain(owner, signer) {
+			return dnssecBogus, fmt.Sprintf("%s %s is signed by %s out of zone", owner, dnsMsg.TypeString(rType), signer)
+		}
+
+		keys := validator.keysFor(signer)
+		switch keys.status {
+		case dnssecSecure:
+		case dnssecInsecure:
+			status, reason = dnssecInsecure, keys.reason
+			continue
+		default:
+			return keys.status, keys.reason
+		}
+
+		sig, err := validator.verifyRRSet(msg, rrset, sigs, keys.keys)
+		if err != nil {
+			return dnssecBogus, err.Error()
+		}
+
+		// 通配符展开，RFC4035 5.3.4、RFC5155 8.8
+		if expanded(sig, canonicalZone(owner)) {
+			proof, err := validator.collectDenial(msg, signer, keys.keys)
+			if err == nil {
+				err = proof.noCloserMatch(canonicalZone(owner), int(sig.Labels))
+			}
+			if err != nil {
+				return dnssecBogus, err.Error()
+			}
+		}
+	}
+
+	return status, reason
+}
+
+// validateNegative 否定应答中的SOA需要有签名，NSEC/NSEC3需要证明name不存在(NXDOMAIN)或者没有qType的记录(NODATA)
+func (validator *dnssecValidator) validateNegative(msg *dnsMsg.Message, name string, qType uint16) (string, string) {
+	name = canonicalZone(name)
+	zone, err := validator.findZone(name)
+	if err != nil {
+		return dnssecIndeterminate, err.Error()
+	}
+
+	keys := validator.keysFor(zone)
+	if keys.status != dnssecSecure {
+		return keys.status, keys.reason
+	}
+
+	for _, rrset := range groupRRSets(msg.Authority) {
+		if rrset[0].Type != dnsMsg.TypeSOA {
+			continue
+		}
+
+		sigs := dnsMsg.Signatures(msg.Authority, rrset[0].Name, dnsMsg.TypeSOA)
+		if _, err := validator.verifyRRSet(msg, rrset, sigs, keys.keys); err != nil {
+			return dnssecBogus, err.Error()
+		}
+	}
+
+	proof, err := validator.collectDenial(msg, zone, keys.keys)
+	if err == nil {
+		err = proof.prove(name, qType, msg.RCode() == dnsMsg.RCodeNameError)
+	}
+	if err != nil {
+		return dnssecBogus, err.Error()
+	}
+
+	return dnssecSecure, ""
+}
+
+// verifyRRSet 有一个RRSIG能用keys验证通过即可，返回验证通过的RRSIG
+func (validator *dnssecValidator) verifyRRSet(msg *dnsMsg.Message, rrset []dnsMsg.RR, sigs []*dnsMsg.RRSIG, keys []*dnsMsg.DNSKEY) (*dnsMsg.RRSIG, error) {
+	owner, rType := rrset[0].Name, dnsMsg.TypeString(rrset[0].Type)
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("missing RRSIG for %s %s", owner, rType)
+	}
+
+	var lastErr error
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+
+			lastErr = msg.VerifyRRSIG(sig, key, rrset, validator.now())
+			if lastErr == nil {
+				return sig, nil
+			}
+		}
+	}
+
+	if lastErr == nil {
+		return nil, fmt.Errorf("no DNSKEY matches RRSIG of %s %s (key tag %d)", owner, rType, sigs[0].KeyTag)
+	}
+
+	return nil, fmt.Errorf("%s %s: %w", owner, rType, lastErr)
+}
+
+// keysFor 返回zone经过验证的DNSKEY，trust anchor的zone用anchor验证，其他zone用父zone签名的DS验证
+func (validator *dnssecValidator) keysFor(zone string) *zoneKeys {
+	validator.mutex.Lock()
+	entry, ok := validator.zones[zone]
+	if !ok {
+		entry = &zoneKeysEntry{}
+		validator.zones[zone] = entry
+	}
+	validator.mutex.Unlock()
+
+	entry.once.Do(func() {
+		entry.keys = validator.buildKeys(zone)
+		logger.Debug("dnssec zone keys", zap.String("zone", zone), zap.String("status", entry.keys.status),
+			zap.String("reason", entry.keys.reason))
+	})
+
+	return entry.keys
+}
+
+func (validator *dnssecValidator) buildKeys(zone string) *zoneKeys {
+	if anchors, ok := validator.anchors[zone]; ok {
+		return validator.verifyDNSKEY(zone, anchors)
+	}
+
+	if zone == "." {
+		return &zoneKeys{status: dnssecInsecure, reason: "no trust anchor"}
+	}
+
+	// 父zone一定是zone的祖先，沿着祖先向上查找，keysFor不会重入同一个zone
+	parent, err := validator.findZone(parentName(zone))
+	if err != nil {
+		return &zoneKeys{status: dnssecIndeterminate, reason: err.Error()}
+	}
+
+	parentKeys := validator.keysFor(parent)
+	if parentKeys.status != dnssecSecure {
+		return parentKeys
+	}
+
+	msg, err := validator.query(zone, dnsMsg.TypeDS)
+	if err != nil {
+		return &zoneKeys{status: dnssecIndeterminate, reason: err.Error()}
+	}
+
+	dsSet := dnsMsg.RRSet(msg.Answers, zone, dnsMsg.TypeDS)
+	if len(dsSet) == 0 {
+		// 父zone需要用签名的NSEC/NSEC3证明没有DS
+		if err := validator.proveNoDS(msg, zone, parent, parentKeys.keys); err != nil {
+			return &zoneKeys{status: dnssecBogus, reason: err.Error()}
+		}
+
+		return &zoneKeys{status: dnssecInsecure, reason: "no DS for " + zone}
+	}
+
+	sigs := dnsMsg.Signatures(msg.Answers, zone, dnsMsg.TypeDS)
+	if _, err := validator.verifyRRSet(msg, dsSet, sigs, parentKeys.keys); err != nil {
+		return &zoneKeys{status: dnssecBogus, reason: err.Error()}
+	}
+
+	var dsList []*dnsMsg.DS
+	for idx := range dsSet {
+		if ds, err := dnsMsg.ParseDS(&dsSet[idx]); err == nil {
+			dsList = append(dsList, ds)
+		}
+	}
+
+	return validator.verifyDNSKEY(zone, dsList)
+}
+
+// verifyDNSKEY DNSKEY RRset需要被一个和DS匹配的key签名，DS的算法都不支持时按insecure处理
+func (validator *dnssecValidator) verifyDNSKEY(zone string, dsList []*dnsMsg.DS) *zoneKeys {
+	supported := false
+	for _, ds := range dsList {
+		if dnsMsg.SupportedAlgorithm(ds.Algorithm) && dnsMsg.SupportedDigest(ds.DigestType) {
+			supported = true
+		}
+	}
+
+	if !supported {
+		return &zoneKeys{status: dnssecInsecure, reason: "unsupported DS algorithm of " + zone}
+	}
+
+	msg, err := validator.query(zone, dnsMsg.TypeDNSKEY)
+	if err != nil {
+		return &zoneKeys{status: dnssecIndeterminate, reason: err.Error()}
+	}
+
+	keySet := dnsMsg.RRSet(msg.Answers, zone, dnsMsg.TypeDNSKEY)
+	var keys, trusted []*dnsMsg.DNSKEY
+	for idx := range keySet {
+		key, err := dnsMsg.ParseDNSKEY(&keySet[idx])
+		if err != nil {
+			continue
+		}
+		key.Owner = zone
+		keys = append(keys, key)
+
+		for _, ds := range dsList {
+			if ds.Matches(key) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+
+	if len(trusted) == 0 {
+		return &zoneKeys{status: dnssecBogus, reason: fmt.Sprintf("no DNSKEY of %s matches DS", zone)}
+	}
+
+	sigs := dnsMsg.Signatures(msg.Answers, zone, dnsMsg.TypeDNSKEY)
+	if _, err := validator.verifyRRSet(msg, keySet, sigs, trusted); err != nil {
+		return &zoneKeys{status: dnssecBogus, reason: err.Error()}
+	}
+
+	return &zoneKeys{status: dnssecSecure, keys: keys}
+}
+
+// proveNoDS 检查DS查询的否定应答，父zone需要用NSEC/NSEC3证明zone没有DS，或者zone在opt-out的范围内
+func (validator *dnssecValidator) proveNoDS(msg *dnsMsg.Message, zone, parent string, parentKeys []*dnsMsg.DNSKEY) error {
+	proof, err := validator.collectDenial(msg, parent, parentKeys)
+	if err != nil {
+		return fmt.Errorf("no DS for %s: %w", zone, err)
+	}
+
+	return proof.prove(zone, dnsMsg.TypeDS, false)
+}
+
+// findZone 通过SOA查询找到name所在的zone
+func (validator *dnssecValidator) findZone(name string) (string, error) {
+	name = canonicalZone(name)
+	if name == "." {
+		return ".", nil
+	}
+
+	validator.mutex.Lock()
+	lookup, ok := validator.zoneOf[name]
+	if !ok {
+		lookup = &zoneLookup{}
+		validator.zoneOf[name] = lookup
+	}
+	validator.mutex.Unlock()
+
+	lookup.once.Do(func() {
+		lookup.zone, lookup.err = validator.lookupZone(name)
+	})
+
+	return lookup.zone, lookup.err
+}
+
+// lookupZone SOA查询的answer中有name的SOA时name就是zone，否则取authority中SOA的owner，
+// 返回的zone是name或者name的祖先
+func (validator *dnssecValidator) lookupZone(name string) (string, error) {
+	msg, err := validator.query(name, dnsMsg.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+
+	zone := ""
+	if len(dnsMsg.RRSet(msg.Answers, name, dnsMsg.TypeSOA)) > 0 {
+		zone = name
+	} else if len(dnsMsg.RRSet(msg.Answers, name, dnsMsg.TypeCNAME)) > 0 {
+		// CNAME不会出现在zone的顶点
+		if zone, err = validator.findZone(parentName(name)); err != nil {
+			return "", err
+		}
+	} else {
+		for idx := range msg.Authority {
+			rr := &msg.Authority[idx]
+			if rr.Type == dnsMsg.TypeSOA && isSubdomain(name, canonicalZone(rr.Name)) {
+				zone = canonicalZone(rr.Name)
+				break
+			}
+		}
+	}
+
+	if zone == "" {
+		return "", fmt.Errorf("can not find zone of %s", name)
+	}
+
+	return zone, nil
+}
+
+// query 依次向递归nameserver查询，设置DO和CD
+func (validator *dnssecValidator) query(name string, qType uint16) (*dnsMsg.Message, error) {
+	var lastErr error
+	for _, ns := range validator.resolvers {
+		query := makeDNSQuery(name, qType, "", queryOptions{DNSSEC: true, CheckingDisabled: true})
+		msg, err := probeQuery(ns, ns.Network(), query)
+		if err == nil {
+			if rcode := msg.RCode(); rcode != 0 && rcode != 3 {
+				err = fmt.Errorf("query %s %s: %s", name, dnsMsg.TypeString(qType), dnsMsg.RCodeString(rcode))
+			}
+		}
+
+		if err == nil {
+			return msg, nil
+		}
+
+		logger.Debug("dnssec query failed", zap.String("nameserver", ns.Address()), zap.String("name", name), zap.Error(err))
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// groupRRSets 按(owner, type)分组，忽略RRSIG和OPT
+func groupRRSets(rrs []dnsMsg.RR) [][]dnsMsg.RR {
+	index := make(map[string]int)
+	var rrsets [][]dnsMsg.RR
+	for _, rr := range rrs {
+		if rr.Type == dnsMsg.TypeRRSIG || rr.Type == dnsMsg.TypeOPT {
+			continue
+		}
+
+		key := strings.ToLower(rr.Name) + "|" + strconv.Itoa(int(rr.Type))
+		if idx, ok := index[key]; ok {
+			rrsets[idx] = append(rrsets[idx], rr)
+			continue
+		}
+
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []dnsMsg.RR{rr})
+	}
+
+	return rrsets
+}
+
+// canonicalZone 小写，去掉末尾的点，根为"."
+func canonicalZone(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return "."
+	}
+
+	return name
+}
+
+func parentName(name string) string {
+	if dot := strings.IndexByte(name, '.'); dot >= 0 && dot < len(name)-1 {
+		return name[dot+1:]
+	}
+
+	return "."
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+)
+
+var testNSEC3Salt = []byte{0xaa, 0xbb, 0xcc, 0xdd}
+
+// testZone 测试resolver中的一个zone，records包括签名和NSEC/NSEC3链，signer为nil时没有签名
+type testZone struct {
+	signer  *dnstest.Signer
+	records []dnstest.RR
+}
+
+// rrs 返回owner为name、类型为rType的记录和覆盖它们的RRSIG
+func (zone *testZone) rrs(name string, rType uint16) []dnstest.RR {
+	var rrs []dnstest.RR
+	for _, rr := range zone.records {
+		if rr.Name == name && (rr.Type == rType || rr.Type == dnsMsg.TypeRRSIG && binary.BigEndian.Uint16(rr.Data) == rType) {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// denial 返回owner为names的NSEC/NSEC3和签名，names为空时返回整个链
+func (zone *testZone) denial(names ...string) []dnstest.RR {
+	var rrs []dnstest.RR
+	for _, rr := range zone.records {
+		rType := rr.Type
+		if rType == dnsMsg.TypeRRSIG {
+			rType = binary.BigEndian.Uint16(rr.Data)
+		}
+		if rType != dnsMsg.TypeNSEC && rType != dnsMsg.TypeNSEC3 {
+			continue
+		}
+
+		for _, name := range names {
+			if rr.Name == name {
+				rrs = append(rrs, rr)
+			}
+		}
+		if len(names) == 0 {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+func newTestZone(t *testing.T, name string, algorithm uint8, records []dnstest.RR) *testZone {
+	t.Helper()
+
+	zone := &testZone{records: append([]dnstest.RR{dnstest.SOA(name, 3600, "ns."+strings.TrimPrefix(name, "."), "admin.example", 1)}, records...)}
+	if algorithm == 0 {
+		return zone
+	}
+
+	signer, err := dnstest.NewSigner(name, algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone.signer = signer
+	zone.records = signer.Signed(append(zone.records, signer.DNSKEY(3600)))
+	return zone
+}
+
+// testResolverHandler 应答validator的SOA、DNSKEY和DS查询，DS由父zone应答，没有记录时在authority中返回SOA，
+// DS查询还返回父zone完整的NSEC/NSEC3链
+func testResolverHandler(zones map[string]*testZone) dnstest.HandlerFunc {
+	return func(req *dnstest.Request) *dnstest.Response {
+		name := canonicalZone(req.Name)
+		zoneName := ""
+		for candidate := range zones {
+			if isSubdomain(name, candidate) && !(req.Type == dnsMsg.TypeDS && name == candidate) &&
+				dnsMsg.LabelCount(candidate) >= dnsMsg.LabelCount(zoneName) {
+				zoneName = candidate
+			}
+		}
+
+		zone := zones[zoneName]
+		if answers := zone.rrs(name, req.Type); len(answers) > 0 {
+			return &dnstest.Response{Authoritative: true, Answers: answers}
+		}
+
+		resp := &dnstest.Response{Authoritative: true, Authority: zone.rrs(zoneName, dnsMsg.TypeSOA)}
+		if req.Type == dnsMsg.TypeDS {
+			resp.Authority = append(resp.Authority, zone.denial()...)
+		}
+		return resp
+	}
+}
+
+func newTestResolver(t *testing.T, zones map[string]*testZone) *dnstest.Server {
+	t.Helper()
+
+	server, err := dnstest.NewServer(testResolverHandler(zones))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+// testValidator 使用server作为递归nameserver，root的DS作为trust anchor
+func testValidator(t *testing.T, server *dnstest.Server, root *testZone) *dnssecValidator {
+	t.Helper()
+
+	anchor := root.signer.DS(3600)
+	ds, err := dnsMsg.ParseDS(&dnsMsg.RR{Name: anchor.Name, Type: anchor.Type, Data: anchor.Data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newDNSSECValidator([]configs.DNS{
+		{Nameserver: "127.0.0.1", Port: server.Port(), Protocol: configs.ProtocolUDP, Timeout: "1s"},
+	}, []*dnsMsg.DS{ds})
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	// example用NSEC，example3用NSEC3，wild.example和ent.example是empty non-terminal
+	exampleNames := map[string][]uint16{
+		"example":        {dnsMsg.TypeSOA, dnsMsg.TypeNS, dnsMsg.TypeDNSKEY},
+		"www.example":    {dnsMsg.TypeA},
+		"*.wild.example": {dnsMsg.TypeA},
+		"a.ent.example":  {dnsMsg.TypeA},
+		"cname.example":  {dnsMsg.TypeCNAME},
+	}
+	example3Names := map[string][]uint16{
+		"example3":        {dnsMsg.TypeSOA, dnsMsg.TypeNS, dnsMsg.TypeDNSKEY},
+		"www.example3":    {dnsMsg.TypeA},
+		"*.wild.example3": {dnsMsg.TypeA},
+		"wild.example3":   nil,
+		"a.ent.example3":  {dnsMsg.TypeA},
+		"ent.example3":    nil,
+		"cname.example3":  {dnsMsg.TypeCNAME},
+	}
+
+	example := newTestZone(t, "example", dnsMsg.AlgED25519, dnstest.NSECChain(3600, exampleNames))
+	example3 := newTestZone(t, "example3", dnsMsg.AlgRSASHA256,
+		dnstest.NSEC3Chain("example3", 3600, testNSEC3Salt, 12, false, example3Names))
+	insecure := newTestZone(t, "insecure", 0, nil)
+	root := newTestZone(t, ".", dnsMsg.AlgECDSAP256SHA256, append([]dnstest.RR{
+		example.signer.DS(3600), example3.signer.DS(3600),
+	}, dnstest.NSECChain(3600, map[string][]uint16{
+		".":        {dnsMsg.TypeSOA, dnsMsg.TypeNS, dnsMsg.TypeDNSKEY},
+		"example":  {dnsMsg.TypeNS, dnsMsg.TypeDS},
+		"example3": {dnsMsg.TypeNS, dnsMsg.TypeDS},
+		"insecure": {dnsMsg.TypeNS},
+	})...))
+
+	server := newTestResolver(t, map[string]*testZone{".": root, "example": example, "example3": example3, "insecure": insecure})
+	defer server.Close()
+
+	validator := testValidator(t, server, root)
+
+	www := []dnstest.RR{dnstest.A("www.example", 300, "10.0.0.1")}
+	expired := *example.signer
+	expired.Inception, expired.Expiration = time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour)
+
+	// 通配符展开的应答，RRSIG的owner改成查询的name
+	wildcard := func(zone *testZone, name, wildcardName string) []dnstest.RR {
+		sig := zone.signer.Sign([]dnstest.RR{dnstest.A(wildcardName, 300, "10.0.0.3")})
+		sig.Name = name
+		return []dnstest.RR{dnstest.A(name, 300, "10.0.0.3"), sig}
+	}
+	hashed := func(name string) string {
+		return dnstest.NSEC3Hash(name, testNSEC3Salt, 12) + ".example3"
+	}
+	negative := func(zone *testZone, rcode uint16, denial []dnstest.RR) *dnstest.Response {
+		return &dnstest.Response{RCode: rcode, Authority: append(zone.rrs(zone.signer.Zone, dnsMsg.TypeSOA), denial...)}
+	}
+
+	tests := []struct {
+		name   string
+		qName  string
+		qType  uint16
+		resp   *dnstest.Response
+		status string
+	}{
+		{"signed answer", "www.example", dnsMsg.TypeA,
+			&dnstest.Response{Answers: example.signer.Signed(www)}, dnssecSecure},
+		{"signed answer of NSEC3 zone", "www.example3", dnsMsg.TypeA,
+			&dnstest.Response{Answers: example3.signer.Signed([]dnstest.RR{dnstest.A("www.example3", 300, "10.0.0.1")})}, dnssecSecure},
+		{"tampered answer", "www.example", dnsMsg.TypeA,
+			&dnstest.Response{Answers: []dnstest.RR{dnstest.A("www.example", 300, "10.0.0.9"), example.signer.Sign(www)}}, dnssecBogus},
+		{"missing RRSIG", "www.example", dnsMsg.TypeA, &dnstest.Response{Answers: www}, dnssecBogus},
+		{"expired RRSIG", "www.example", dnsMsg.TypeA,
+			&dnstest.Response{Answers: append(www, expired.Sign(www))}, dnssecBogus},
+		{"unsigned zone", "www.insecure", dnsMsg.TypeA,
+			&dnstest.Response{Answers: []dnstest.RR{dnstest.A("www.insecure", 300, "10.0.0.1")}}, dnssecInsecure},
+
+		// NSEC
+		{"NXDOMAIN", "zz.example", dnsMsg.TypeA,
+			negative(example, dnsMsg.RCodeNameError, example.denial("www.example", "example")), dnssecSecure},
+		{"NXDOMAIN without wildcard proof", "zz.example", dnsMsg.TypeA,
+			negative(example, dnsMsg.RCodeNameError, example.denial("www.example")), dnssecBogus},
+		{"NXDOMAIN with unrelated NSEC", "nx.example", dnsMsg.TypeA,
+			negative(example, dnsMsg.RCodeNameError, example.denial("www.example", "example")), dnssecBogus},
+		{"NXDOMAIN with NSEC3 of other zone", "zz.example", dnsMsg.TypeA,
+			negative(example, dnsMsg.RCodeNameError, example3.denial()), dnssecBogus},
+		{"NODATA", "www.example", dnsMsg.TypeAAAA,
+			negative(example, 0, example.denial("www.example")), dnssecSecure},
+		{"NODATA of existing type", "www.example", dnsMsg.TypeA,
+			negative(example, 0, example.denial("www.example")), dnssecBogus},
+		{"NODATA of empty non-terminal", "ent.example", dnsMsg.TypeA,
+			negative(example, 0, example.denial("cname.example")), dnssecSecure},
+		{"wildcard answer", "foo.wild.example", dnsMsg.TypeA, &dnstest.Response{
+			Answers:   wildcard(example, "foo.wild.example", "*.wild.example"),
+			Authority: example.denial("*.wild.example")}, dnssecSecure},
+		{"wildcard answer without proof", "foo.wild.example", dnsMsg.TypeA, &dnstest.Response{
+			Answers: wildcard(example, "foo.wild.example", "*.wild.example")}, dnssecBogus},
+
+		// NSEC3
+		{"NSEC3 NXDOMAIN", "nx.example3", dnsMsg.TypeA,
+			negative(example3, dnsMsg.RCodeNameError, example3.denial()), dnssecSecure},
+		{"NSEC3 NXDOMAIN without closest encloser proof", "nx.example3", dnsMsg.TypeA,
+			negative(example3, dnsMsg.RCodeNameError, example3.denial(hashed("example3"))), dnssecBogus},
+		{"NSEC3 NXDOMAIN of existing name", "www.example3", dnsMsg.TypeA,
+			negative(example3, dnsMsg.RCodeNameError, example3.denial()), dnssecBogus},
+		{"NSEC3 NODATA", "www.example3", dnsMsg.TypeAAAA,
+			negative(example3, 0, example3.denial(hashed("www.example3"))), dnssecSecure},
+		{"NSEC3 NODATA of existing type", "www.example3", dnsMsg.TypeA,
+			negative(example3, 0, example3.denial()), dnssecBogus},
+		{"NSEC3 NODATA of empty non-terminal", "ent.example3", dnsMsg.TypeA,
+			negative(example3, 0, example3.denial(hashed("ent.example3"))), dnssecSecure},
+		{"NSEC3 wildcard answer", "foo.wild.example3", dnsMsg.TypeA, &dnstest.Response{
+			Answers:   wildcard(example3, "foo.wild.example3", "*.wild.example3"),
+			Authority: example3.denial()}, dnssecSecure},
+		{"NSEC3 wildcard answer without proof", "foo.wild.example3", dnsMsg.TypeA, &dnstest.Response{
+			Answers:   wildcard(example3, "foo.wild.example3", "*.wild.example3"),
+			Authority: example3.denial(hashed("wild.example3"))}, dnssecBogus},
+	}
+
+	for _, test := range tests {
+		msg, err := dnsMsg.ParseMessage(dnstest.Pack(test.qName, test.qType, test.resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status, reason := validator.validate(msg, test.qName, test.qType)
+		if status != test.status {
+			t.Errorf("%s: %s (%s), want %s", test.name, status, reason, test.status)
+		}
+	}
+
+	// insecure来自根的NSEC证明没有DS
+	if keys := validator.keysFor("insecure"); keys.status != dnssecInsecure || keys.reason != "no DS for insecure" {
+		t.Errorf("zone keys of insecure: %+v", keys)
+	}
+}
+
+func TestDNSSECValidatorConcurrent(t *testing.T) {
+	example := newTestZone(t, "example", dnsMsg.AlgED25519, nil)
+	slow := newTestZone(t, "slow", dnsMsg.AlgED25519, nil)
+	root := newTestZone(t, ".", dnsMsg.AlgECDSAP256SHA256, []dnstest.RR{example.signer.DS(3600), slow.signer.DS(3600)})
+	handler := testResolverHandler(map[string]*testZone{".": root, "example": example, "slow": slow})
+
+	// slow的DNSKEY查询一直等到example验证完成才应答，validate持有全局锁时会一直等下去
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	queries := make(map[string]int)
+	server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+		mutex.Lock()
+		queries[canonicalZone(req.Name)+" "+dnsMsg.TypeString(req.Type)] += 1
+		mutex.Unlock()
+
+		if req.Name == "slow" && req.Type == dnsMsg.TypeDNSKEY {
+			<-release
+		}
+		return handler(req)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	validator := testValidator(t, server, root)
+	validator.resolvers[0].Timeout = "5s"
+
+	validate := func(zone *testZone, name string) string {
+		answers := zone.signer.Signed([]dnstest.RR{dnstest.A(name, 300, "10.0.0.1")})
+		msg, err := dnsMsg.ParseMessage(dnstest.Pack(name, dnsMsg.TypeA, &dnstest.Response{Answers: answers}))
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+
+		status, reason := validator.validate(msg, name, dnsMsg.TypeA)
+		if status != dnssecSecure {
+			t.Errorf("%s: %s (%s)", name, status, reason)
+		}
+		return status
+	}
+
+	slowDone := make(chan string)
+	go func() {
+		slowDone <- validate(slow, "www.slow")
+	}()
+
+	// 并发验证同一个zone，每个DS、DNSKEY查询只发出一次
+	var wg sync.WaitGroup
+	for idx := 0; idx < 8; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			validate(example, "www.example")
+		}()
+	}
+
+	exampleDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(exampleDone)
+	}()
+
+	select {
+	case <-exampleDone:
+	case <-time.After(3 * time.Second):
+		close(release)
+		t.Fatal("validation of www.example is blocked by the pending DNSKEY query of slow")
+	}
+
+	close(release)
+	<-slowDone
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for query, count := range queries {
+		if count != 1 {
+			t.Errorf("%s queried %d times", query, count)
+		}
+	}
+	for _, query := range []string{". DNSKEY", "example DS", "example DNSKEY", "slow DS", "slow DNSKEY"} {
+		if queries[query] != 1 {
+			t.Errorf("%s queried %d times, want 1", query, queries[query])
+		}
+	}
+}
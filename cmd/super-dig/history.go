@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var historyUsage = `Usage: %s history list [options]
+       %s history show [options] Run-ID
+       %s history changes [options]
+Query scans recorded by --history.
+Options:
+	--db <history database file>
+	--domain <only runs of the domain>
+	--resolver <only runs using the name server, e.g. 8.8.8.8:53>
+	--limit <list at most N latest runs, default 20>
+	--country, --province, --isp <changes of matched regions only, glob pattern, repeatable>
+	--all <changes: print every change instead of the last change of each region>
+	--log_level <zap log level>
+`
+
+/*
+   --history指定的bbolt数据库，每次扫描一条记录:
+
+   runs:    run ID -> historyRun
+   reports: run ID -> scanReport
+   index:   domain | 0 | nameserver | 0 | 开始时间(纳秒) | run ID -> 空
+
+   run ID是递增的序号，index按域名和nameserver前缀遍历即得到按时间排列的run
+*/
+
+var (
+	bucketRuns    = []byte("runs")
+	bucketReports = []byte("reports")
+	bucketIndex   = []byte("index")
+)
+
+// historyRun 一次扫描的概要
+type historyRun struct {
+	ID        uint64    `json:"id"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Domains   []string  `json:"domains"`
+	QTypes    []string  `json:"qtypes"`
+	Resolvers []string  `json:"resolvers"`
+	Probes    int       `json:"probes"`
+	Failed    int       `json:"failed"`
+}
+
+const (
+	// historyTimeout 查询时等待save释放数据库锁的时间
+	historyTimeout = 3 * time.Second
+	// historySaveTimeout save时等待history子命令释放共享锁的时间，查询较多的run时可能需要几秒
+	historySaveTimeout = 30 * time.Second
+)
+
+// historyStore bbolt打开数据库期间一直持有文件锁(读写为排他锁，只读为共享锁)，
+// 所以记录时只在每次save期间打开数据库，watch和serve运行时也可以用history子命令查询
+type historyStore struct {
+	path  string
+	mutex sync.Mutex // serve同时结束的扫描依次save
+
+	db *bolt.DB // 只读打开时的数据库，查询期间一直持有共享锁
+}
+
+// openHistory 创建或者检查--history的数据库，readOnly时只读打开用于查询，多个查询可以同时进行
+func openHistory(path string, readOnly bool) (*historyStore, error) {
+	if readOnly {
+		db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true, Timeout: historyTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("open history %s failed: %w", path, err)
+		}
+
+		err = db.View(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{bucketRuns, bucketReports, bucketIndex} {
+				if tx.Bucket(name) == nil {
+					return fmt.Errorf("bucket %s not found", name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s is not a history database: %w", path, err)
+		}
+
+		return &historyStore{path: path, db: db}, nil
+	}
+
+	store := &historyStore{path: path}
+	err := store.update(historyTimeout, func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketRuns, bucketReports, bucketIndex} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("init history %s failed: %w", path, err)
+	}
+
+	return store, nil
+}
+
+// update 打开数据库执行一个写事务后关闭，释放文件锁
+func (store *historyStore) update(timeout time.Duration, fn func(tx *bolt.Tx) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	db, err := bolt.Open(store.path, 0644, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// view 在只读打开的数据库上执行读事务，用于记录的store时临时只读打开
+func (store *historyStore) view(fn func(tx *bolt.Tx) error) error {
+	if store.db != nil {
+		return store.db.View(fn)
+	}
+
+	db, err := bolt.Open(store.path, 0644, &bolt.Options{ReadOnly: true, Timeout: historyTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+func (store *historyStore) close() {
+	if store != nil && store.db != nil {
+		store.db.Close()
+	}
+}
+
+// save 保存一次扫描结果，返回run ID
+func (store *historyStore) save(report *scanReport) (uint64, error) {
+	run := historyRun{
+		Started:  report.Started,
+		Finished: report.Finished,
+	}
+
+	domains := make(map[string]bool)
+	qTypes := make(map[string]bool)
+	resolvers := make(map[string]bool)
+	pairs := make(map[[2]string]bool)
+	for _, record := range report.Probes {
+		run.Probes += 1
+		if record.Error != "" {
+			run.Failed += 1
+		}
+
+		if !domains[record.Domain] {
+			domains[record.Domain] = true
+			run.Domains = append(run.Domains, record.Domain)
+		}
+		if !qTypes[record.QType] {
+			qTypes[record.QType] = true
+			run.QTypes = append(run.QTypes, record.QType)
+		}
+		if !resolvers[record.Nameserver] {
+			resolvers[record.Nameserver] = true
+			run.Resolvers = append(run.Resolvers, record.Nameserver)
+		}
+		pairs[[2]string{record.Domain, record.Nameserver}] = true
+	}
+
+	err := store.update(historySaveTimeout, func(tx *bolt.Tx) error {
+		runs := tx.Bucket(bucketRuns)
+		id, err := runs.NextSequence()
+		if err != nil {
+			return err
+		}
+		run.ID = id
+
+		runData, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		reportData, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+
+		if err := runs.Put(runKey(id), runData); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketReports).Put(runKey(id), reportData); err != nil {
+			return err
+		}
+
+		index := tx.Bucket(bucketIndex)
+		for pair := range pairs {
+			key := indexPrefix(pair[0], pair[1])
+			key = binary.BigEndian.AppendUint64(key, uint64(run.Started.UnixNano()))
+			key = append(key, runKey(id)...)
+			if err := index.Put(key, nil); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return run.ID, err
+}
+
+// runs 按开始时间返回domain和resolver的run，domain为空时返回所有run，resolver为空时不区分nameserver
+func (store *historyStore) runs(domain, resolver string) ([]historyRun, error) {
+	var runs []historyRun
+	err := store.view(func(tx *bolt.Tx) error {
+		runBucket := tx.Bucket(bucketRuns)
+		appendRun := func(data []byte) error {
+			var run historyRun
+			if err := json.Unmarshal(data, &run); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+			return nil
+		}
+
+		if domain == "" {
+			return runBucket.ForEach(func(_, data []byte) error {
+				if resolver != "" && !contains(decodeRunResolvers(data), resolver) {
+					return nil
+				}
+				return appendRun(data)
+			})
+		}
+
+		// 同一个run在index中可能有多个nameserver
+		prefix := indexPrefix(domain, resolver)
+		if resolver == "" {
+			prefix = append([]byte(domain), 0)
+		}
+
+		seen := make(map[uint64]bool)
+		cursor := tx.Bucket(bucketIndex).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			id := binary.BigEndian.Uint64(key[len(key)-8:])
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			if data := runBucket.Get(runKey(id)); data != nil {
+				if err := appendRun(data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Started.Before(runs[j].Started)
+	})
+
+	return runs, err
+}
+
+func (store *historyStore) report(id uint64) (*historyRun, *scanReport, error) {
+	var run historyRun
+	var report scanReport
+	err := store.view(func(tx *bolt.Tx) error {
+		runData := tx.Bucket(bucketRuns).Get(runKey(id))
+		reportData := tx.Bucket(bucketReports).Get(runKey(id))
+		if runData == nil || reportData == nil {
+			return fmt.Errorf("run %d not found", id)
+		}
+
+		if err := json.Unmarshal(runData, &run); err != nil {
+			return err
+		}
+		return json.Unmarshal(reportData, &report)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &run, &report, nil
+}
+
+func runKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+func indexPrefix(domain, resolver string) []byte {
+	key := append([]byte(domain), 0)
+	key = append(key, resolver...)
+	return append(key, 0)
+}
+
+func decodeRunResolvers(data []byte) []string {
+	var run historyRun
+	json.Unmarshal(data, &run)
+	return run.Resolvers
+}
+
+// saveHistory 扫描结束后记录到--history，失败不影响扫描结果的输出
+func saveHistory(store *historyStore, report *scanReport) {
+	if store == nil {
+		return
+	}
+
+	id, err := store.save(report)
+	if err != nil {
+		logger.Error("save scan to history failed", zap.Error(err))
+		return
+	}
+
+	logger.Info("scan saved to history", zap.Uint64("run", id))
+}
+
+func historyMain(args []string) {
+	if len(args) == 0 {
+		fmt.Printf(historyUsage, os.Args[0], os.Args[0], os.Args[0])
+		os.Exit(1)
+	}
+
+	command := args[0]
+	flagSet := flag.NewFlagSet("history", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Printf(historyUsage, os.Args[0], os.Args[0], os.Args[0])
+	}
+	dbFile := flagSet.String("db", "", "history database file")
+	domain := flagSet.String("domain", "", "only runs of the domain")
+	resolver := flagSet.String("resolver", "", "only runs using the name server")
+	limit := flagSet.Int("limit", 20, "list at most N latest runs")
+	all := flagSet.Bool("all", false, "print every change")
+	level := flagSet.Int("log_level", 0, "zap log level, default info")
+	var filter ipDB.RegionFilter
+	flagSet.Var((*stringList)(&filter.Countries), "country", "only matched countries")
+	flagSet.Var((*stringList)(&filter.Provinces), "province", "only matched provinces")
+	flagSet.Var((*stringList)(&filter.ISPs), "isp", "only matched ISPs")
+
+	// 位置参数可以在options之前
+	var positional []string
+	flagSet.Parse(args[1:])
+	for flagSet.NArg() > 0 {
+		positional = append(positional, flagSet.Arg(0))
+		flagSet.Parse(flagSet.Args()[1:])
+	}
+
+	initLogger(*level, "stderr")
+	defer logger.Sync()
+
+	if *dbFile == "" {
+		logger.Fatal("history requires --db file")
+	}
+	if err := filter.Validate(); err != nil {
+		logger.Fatal("invalid region filter", zap.Error(err))
+	}
+
+	if *resolver != "" {
+		ns, err := configs.ParseNameserver(*resolver)
+		if err != nil {
+			logger.Fatal("invalid --resolver", zap.Error(err))
+		}
+		*resolver = ns.Address()
+	}
+
+	if _, err := os.Stat(*dbFile); err != nil {
+		logger.Fatal("history database not found", zap.Error(err))
+	}
+
+	store, err := openHistory(*dbFile, true)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	defer store.close()
+
+	switch command {
+	case "list":
+		runs, err := store.runs(*domain, *resolver)
+		if err != nil {
+			logger.Fatal("list history failed", zap.Error(err))
+		}
+		if *limit > 0 && len(runs) > *limit {
+			runs = runs[len(runs)-*limit:]
+		}
+		prettyRuns(runs)
+	case "show":
+		if len(positional) != 1 {
+			logger.Fatal("history show requires a run ID")
+		}
+		id, err := strconv.ParseUint(positional[0], 10, 64)
+		if err != nil {
+			logger.Fatal("invalid run ID", zap.String("id", positional[0]))
+		}
+		showRun(store, id)
+	case "changes":
+		historyChanges(store, *domain, *resolver, &filter, *all)
+	default:
+		flagSet.Usage()
+		os.Exit(1)
+	}
+}
+
+func prettyRuns(runs []historyRun) {
+	var rows [][]string
+	for _, run := range runs {
+		rows = append(rows, []string{fmt.Sprint(run.ID), run.Started.Local().Format("2006-01-02 15:04:05"),
+			run.Finished.Sub(run.Started).Round(time.Millisecond).String(), strings.Join(run.Domains, ","),
+			strings.Join(run.QTypes, ","), strings.Join(run.Resolvers, ","), fmt.Sprint(run.Probes), fmt.Sprint(run.Failed)})
+	}
+
+	printTable([]string{"ID", "Started", "Duration", "Domains", "Types", "Resolvers", "Probes", "Failed"}, rows)
+}
+
+// showRun 和扫描时一样按answer集合汇总输出
+func showRun(store *historyStore, id uint64) {
+	run, report, err := store.report(id)
+	if err != nil {
+		logger.Fatal("load history failed", zap.Error(err))
+	}
+
+	opts := scanOptions{Domains: run.Domains}
+	for _, qType := range run.QTypes {
+		if rType, err := dnsMsg.ParseType(qType); err == nil {
+			opts.QTypes = append(opts.QTypes, rType)
+		}
+	}
+
+	fmt.Printf("Run %d started at %s\n", run.ID, run.Started.Local().Format("2006-01-02 15:04:05"))
+	prettyReport(&opts, report)
+}
+
+// historyChanges 输出domain的扫描历史中匹配的地区的answer变化
+func historyChanges(store *historyStore, domain, resolver string, filter *ipDB.RegionFilter, all bool) {
+	if domain == "" {
+		logger.Fatal("history changes requires --domain")
+	}
+
+	runs, changes, err := collectChanges(store, domain, resolver, filter, all)
+	if err != nil {
+		logger.Fatal("load history failed", zap.Error(err))
+	}
+
+	logger.Info("history changes", zap.String("domain", domain), zap.Int("runs", runs), zap.Int("changes", len(changes)))
+	prettyChanges(changes)
+}
+
+// collectChanges 按时间顺序对比domain相邻的两次扫描，返回run的个数和匹配的地区最后一次answer变化，all时返回所有变化。
+// 不同的run可能轮换到不同的nameserver，按subnet匹配；一次扫描中每个subnet有多个nameserver时(--compare-resolvers)
+// 按subnet无法区分，改为按nameserver匹配
+func collectChanges(store *historyStore, domain, resolver string, filter *ipDB.RegionFilter, all bool) (int, []recordChange, error) {
+	runs, err := store.runs(domain, resolver)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var changes []recordChange
+	var regions []string // 每个变化对应的地区，all为false时每个地区只保留最后一次变化
+	var previous []probeRecord
+	for _, run := range runs {
+		_, report, err := store.report(run.ID)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		var records []probeRecord
+		for _, record := range report.Probes {
+			region := configs.IPRegion{Country: record.Country, Province: record.Province, ISP: record.ISP}
+			if record.Domain == domain && (resolver == "" || record.Nameserver == resolver) && filter.Match(&region) {
+				records = append(records, record)
+			}
+		}
+
+		_, previousDuplicated := duplicateKey(previous, subnetKey)
+		_, duplicated := duplicateKey(records, subnetKey)
+		byResolver := previousDuplicated || duplicated
+		key := subnetKey
+		if byResolver {
+			key = recordKey
+		}
+
+		if previous != nil {
+			for _, change := range diffRecords(previous, records, key) {
+				region := change.QType + "|" + change.Subnet
+				if byResolver {
+					region += "|" + change.Nameserver
+				}
+				changes = append(changes, change)
+				regions = append(regions, region)
+			}
+		}
+		previous = keepFailed(previous, records, key)
+	}
+
+	if !all {
+		last := make(map[string]int)
+		for idx, region := range regions {
+			last[region] = idx
+		}
+
+		var lastChanges []recordChange
+		for idx, change := range changes {
+			if last[regions[idx]] == idx {
+				lastChanges = append(lastChanges, change)
+			}
+		}
+		changes = lastChanges
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Time.Before(changes[j].Time)
+	})
+
+	return len(runs), changes, nil
+}
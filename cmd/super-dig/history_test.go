@@ -0,0 +1,224 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyStart = time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+
+func historyRecord(started time.Time, domain, subnet, nameserver string, answers ...string) probeRecord {
+	province := "广东省"
+	if subnet == "1.0.2.0" {
+		province = "北京市"
+	}
+
+	return probeRecord{Domain: domain, QType: "A", Subnet: subnet, Nameserver: nameserver, Protocol: "udp",
+		Country: "中国", Province: province, ISP: "电信", Answers: answers, RCode: "NOERROR", Time: started}
+}
+
+func historyReport(started time.Time, records ...probeRecord) *scanReport {
+	return &scanReport{Started: started, Finished: started.Add(time.Minute), Probes: records}
+}
+
+func runIDs(runs []historyRun) []uint64 {
+	var ids []uint64
+	for _, run := range runs {
+		ids = append(ids, run.ID)
+	}
+	return ids
+}
+
+func TestHistoryStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := openHistory(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	// run ID按保存的顺序，查询按开始时间
+	t0, t1, t2 := historyStart, historyStart.Add(time.Hour), historyStart.Add(2*time.Hour)
+	failed := historyRecord(t0, "b.example", "1.0.2.0", "1.1.1.1:53")
+	failed.Error = "timeout"
+	reports := []*scanReport{
+		historyReport(t2, historyRecord(t2, "a.example", "1.0.1.0", "8.8.8.8:53", "10.0.1.1")),
+		historyReport(t0, historyRecord(t0, "a.example", "1.0.1.0", "1.1.1.1:53", "10.0.1.1"),
+			historyRecord(t0, "b.example", "1.0.1.0", "1.1.1.1:53", "10.0.2.1"), failed),
+		historyReport(t1, historyRecord(t1, "a.example", "1.0.1.0", "8.8.8.8:53", "10.0.1.1"),
+			historyRecord(t1, "a.example", "1.0.1.0", "1.1.1.1:53", "10.0.1.2")),
+	}
+	for idx, report := range reports {
+		if id, err := store.save(report); err != nil || id != uint64(idx+1) {
+			t.Fatalf("save report %d: %d, %v", idx, id, err)
+		}
+	}
+
+	// 记录的store没有一直持有文件锁，可以同时有多个只读的查询
+	reader, err := openHistory(path, true)
+	if err != nil {
+		t.Fatalf("open history read-only while recording: %v", err)
+	}
+	defer reader.close()
+	another, err := openHistory(path, true)
+	if err != nil {
+		t.Fatalf("open history read-only twice: %v", err)
+	}
+	defer another.close()
+
+	tests := []struct {
+		domain, resolver string
+		ids              []uint64
+	}{
+		{"", "", []uint64{2, 3, 1}},
+		{"a.example", "", []uint64{2, 3, 1}},
+		{"a.example", "8.8.8.8:53", []uint64{3, 1}},
+		{"b.example", "", []uint64{2}},
+		{"", "1.1.1.1:53", []uint64{2, 3}},
+		{"c.example", "", nil},
+		{"b.example", "8.8.8.8:53", nil},
+	}
+	for _, test := range tests {
+		runs, err := reader.runs(test.domain, test.resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := runIDs(runs); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("runs(%q, %q) = %v, want %v", test.domain, test.resolver, ids, test.ids)
+		}
+	}
+
+	run, report, err := another.report(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRun := historyRun{ID: 2, Started: t0, Finished: t0.Add(time.Minute), Domains: []string{"a.example", "b.example"},
+		QTypes: []string{"A"}, Resolvers: []string{"1.1.1.1:53"}, Probes: 3, Failed: 1}
+	if !reflect.DeepEqual(*run, wantRun) {
+		t.Errorf("run 2 = %+v, want %+v", *run, wantRun)
+	}
+	if !reflect.DeepEqual(report, reports[1]) {
+		t.Errorf("report 2 = %+v, want %+v", report, reports[1])
+	}
+	if _, _, err := reader.report(4); err == nil {
+		t.Error("report 4: no error")
+	}
+
+	// 查询持有共享锁时save等待查询结束
+	saved := make(chan error, 1)
+	go func() {
+		_, err := store.save(historyReport(t2.Add(time.Hour)))
+		saved <- err
+	}()
+	select {
+	case err := <-saved:
+		t.Fatalf("save while querying finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	reader.close()
+	another.close()
+	if err := <-saved; err != nil {
+		t.Fatalf("save after querying: %v", err)
+	}
+	if runs, err := store.runs("", ""); err != nil || len(runs) != 4 {
+		t.Errorf("runs after save: %d, %v", len(runs), err)
+	}
+}
+
+func TestOpenHistoryReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := openHistory(filepath.Join(dir, "missing.db"), true); err == nil {
+		t.Error("open missing history: no error")
+	}
+
+	// 不是--history创建的bbolt文件
+	path := filepath.Join(dir, "other.db")
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := openHistory(path, true); err == nil {
+		t.Error("open bbolt file without history buckets: no error")
+	}
+}
+
+func TestCollectChanges(t *testing.T) {
+	store, err := openHistory(filepath.Join(t.TempDir(), "history.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	at := func(hours int) time.Time {
+		return historyStart.Add(time.Duration(hours) * time.Hour)
+	}
+	rec := func(hours int, subnet, nameserver string, answers ...string) probeRecord {
+		return historyRecord(at(hours), "www.example.com", subnet, nameserver, answers...)
+	}
+	failed := rec(4, "1.0.2.0", "1.1.1.1:53")
+	failed.Error = "timeout"
+
+	reports := []*scanReport{
+		// --compare-resolvers: 每个subnet两个nameserver，应答不同但是没有变化
+		historyReport(at(0), rec(0, "1.0.1.0", "8.8.8.8:53", "10.0.1.1"), rec(0, "1.0.1.0", "1.1.1.1:53", "10.0.8.1"),
+			rec(0, "1.0.2.0", "8.8.8.8:53", "10.0.2.1"), rec(0, "1.0.2.0", "1.1.1.1:53", "10.0.2.1")),
+		historyReport(at(1), rec(1, "1.0.1.0", "1.1.1.1:53", "10.0.8.1"), rec(1, "1.0.1.0", "8.8.8.8:53", "10.0.1.1"),
+			rec(1, "1.0.2.0", "1.1.1.1:53", "10.0.2.1"), rec(1, "1.0.2.0", "8.8.8.8:53", "10.0.2.1")),
+		historyReport(at(2), rec(2, "1.0.1.0", "8.8.8.8:53", "10.0.1.2"), rec(2, "1.0.1.0", "1.1.1.1:53", "10.0.8.1"),
+			rec(2, "1.0.2.0", "8.8.8.8:53", "10.0.2.1"), rec(2, "1.0.2.0", "1.1.1.1:53", "10.0.2.1")),
+		// 之后每次扫描轮换到一个nameserver，按subnet匹配
+		historyReport(at(3), rec(3, "1.0.1.0", "9.9.9.9:53", "10.0.1.2"), rec(3, "1.0.2.0", "9.9.9.9:53", "10.0.2.1")),
+		historyReport(at(4), rec(4, "1.0.1.0", "1.1.1.1:53", "10.0.1.3"), failed),
+		historyReport(at(5), rec(5, "1.0.1.0", "9.9.9.9:53", "10.0.1.3"), rec(5, "1.0.2.0", "9.9.9.9:53", "10.0.2.2")),
+		historyReport(at(6), rec(6, "1.0.1.0", "9.9.9.9:53", "10.0.1.4"), rec(6, "1.0.2.0", "9.9.9.9:53", "10.0.2.2")),
+		historyReport(at(7), historyRecord(at(7), "other.example", "1.0.1.0", "9.9.9.9:53", "10.0.3.1")),
+	}
+	for _, report := range reports {
+		if _, err := store.save(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	change := func(hours int, subnet, nameserver, added, removed string) recordChange {
+		province := "广东省"
+		if subnet == "1.0.2.0" {
+			province = "北京市"
+		}
+		return recordChange{Time: at(hours), Domain: "www.example.com", QType: "A", Subnet: subnet, Nameserver: nameserver,
+			Country: "中国", Province: province, ISP: "电信", Added: []string{added}, Removed: []string{removed}}
+	}
+	run3 := change(2, "1.0.1.0", "8.8.8.8:53", "10.0.1.2", "10.0.1.1")
+	run5 := change(4, "1.0.1.0", "1.1.1.1:53", "10.0.1.3", "10.0.1.2")
+	run6 := change(5, "1.0.2.0", "9.9.9.9:53", "10.0.2.2", "10.0.2.1") // 上一次失败，沿用第4次的结果
+	run7 := change(6, "1.0.1.0", "9.9.9.9:53", "10.0.1.4", "10.0.1.3")
+
+	tests := []struct {
+		name     string
+		resolver string
+		filter   ipDB.RegionFilter
+		all      bool
+		runs     int
+		changes  []recordChange
+	}{
+		{"all changes", "", ipDB.RegionFilter{}, true, 7, []recordChange{run3, run5, run6, run7}},
+		{"last change of each region", "", ipDB.RegionFilter{}, false, 7, []recordChange{run3, run6, run7}},
+		{"region filter", "", ipDB.RegionFilter{Provinces: []string{"北京*"}}, true, 7, []recordChange{run6}},
+		{"one resolver", "9.9.9.9:53", ipDB.RegionFilter{}, true, 3,
+			[]recordChange{run6, change(5, "1.0.1.0", "9.9.9.9:53", "10.0.1.3", "10.0.1.2"), run7}},
+	}
+	for _, test := range tests {
+		runs, changes, err := collectChanges(store, "www.example.com", test.resolver, &test.filter, test.all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs != test.runs || !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: %d runs, changes\n%+v\nwant %d runs\n%+v", test.name, runs, changes, test.runs, test.changes)
+		}
+	}
+}
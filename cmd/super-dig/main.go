@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
@@ -15,34 +15,125 @@ import (
 
 	"github.com/walkerdu/super-dig/configs"
 	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 var (
-	usage = `Usage: %s [options] Domain-Name
+	usage = `Usage: %s [options] Domain-Name...
+       %s regions build [options] <ip range file>...
+       %s probe-resolvers [options]
+       %s trace [options] Domain-Name
+       %s watch [options] --interval 5m Domain-Name...
+       %s diff [options] old.json new.json
+       %s history list|show|changes [options]
+       %s serve [options] --listen :8080
+       %s check [options] --expect expectations.yaml Domain-Name...
 Options:
-	-t, --type <A, NS, CNAME, ANY type Resource Records>
+	--config <YAML/JSON config file of scan profiles>
+	--profile <profile name in config file>
+	-t, --type <A, AAAA, NS, CNAME, HTTPS, SVCB, ANY type Resource Records, comma separated>
 	-f, --subnet_file <ip region file, for DNS client subnet>
-	-ns <name server>
+	--region-format <format of ip region file: json, txt, ip2region, csv, geolite2, default by file extension>
+	--geo-locations <GeoLite2 locations csv, for geolite2 format>
+	--geo-asn <GeoLite2 ASN csv, for geolite2 format, optional>
+	--sample <sampling policy of CIDR in ip region file: first, random:N, every /24, default first>
+	--country, --province, --isp <only scan matched regions, glob pattern, repeatable>
+	--exclude-country, --exclude-province, --exclude-isp <skip matched regions, glob pattern, repeatable>
+	--list-regions <print regions to be scanned and number of probes, then exit>
+	-ns <name server, e.g. 8.8.8.8, 127.0.0.1:5353, [2001:4860:4860::8888]:53>
 	--ns_file <name server file>
 	--log_level <zap log level>
+	--checkpoint <file, persist finished probes as JSON lines>
+	--resume <skip probes finished in checkpoint file and merge results>
+	--concurrency <number of concurrent queries, default 1>
+	--compare-resolvers <query every subnet of every name server and report disagreements>
+	--dnssec <set DO bit and validate answers: secure, insecure, bogus>
+	--trust-anchor <file of DS records of trust anchors, default the root KSK>
+	--annotate-answers <look up the region of every address in answers in the ip region file>
+	--annotate-ptr <also resolve PTR of every address in answers>
+	--steering <classify answers of every region: same ISP and province, other province, cross ISP, cross border>
+	--authoritative <find authoritative name servers of the domain via -ns/--ns_file and query them directly with RD=0>
+	--format <output formats: table, json, comma separated, default table>
+	-o <output file of json format, default stdout>
+	--interval <interval of rescans in watch mode, default 5m>
+	--history <bbolt database file, record every scan for the history subcommand>
+	--listen <listen address of HTTP API in serve mode, default :8080; /metrics in watch mode, default disabled>
+	--expect <expectations file of check mode, exit 1 if any probe violates them>
+	--record <file, save raw query and response of every probe as JSON lines>
+	--replay <file saved by --record, parse and report the saved responses without network>
+	--pcap <file, write sent and received DNS packets as synthesized frames in libpcap format>
+	--report <report format of check mode: junit, json, default junit; written to -o or stdout>
 `
 	Usage = func() {
-		fmt.Printf(usage, os.Args[0])
+		fmt.Printf(usage, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+			os.Args[0])
 	}
 )
 
 var (
+	configFile     = flag.String("config", "", "config file of scan profiles")
+	profileName    = flag.String("profile", "", "profile name in config file")
 	rrType         = flag.String("t", "A", "request RR type")
 	nameServer     = flag.String("ns", "8.8.8.8", "name server")
 	ipRegionFile   = flag.String("f", "", "ip region file")
 	nameServerFile = flag.String("ns_file", "", "name server")
+	regionFormat   = flag.String("region-format", "", "format of ip region file")
+	geoLocations   = flag.String("geo-locations", "", "GeoLite2 locations csv")
+	geoASN         = flag.String("geo-asn", "", "GeoLite2 ASN csv")
+	samplePolicy   = flag.String("sample", ipDB.SampleFirst, "default sampling policy of CIDR")
 	logLevel       = flag.Int("log_level", 0, "zap log level, default info")
-	domainName     = ""
+	checkpointFile = flag.String("checkpoint", "", "checkpoint file of finished probes")
+	resume         = flag.Bool("resume", false, "resume scan from checkpoint file")
+	listRegions    = flag.Bool("list-regions", false, "print regions to be scanned")
+	concurrency    = flag.Int("concurrency", 1, "number of concurrent queries")
+	compareMode    = flag.Bool("compare-resolvers", false, "query every subnet of every name server")
+	authoritative  = flag.Bool("authoritative", false, "query authoritative name servers directly")
+	dnssec         = flag.Bool("dnssec", false, "validate answers with DNSSEC")
+	trustAnchor    = flag.String("trust-anchor", "", "file of DS records of trust anchors")
+	annotate       = flag.Bool("annotate-answers", false, "look up the region of answer addresses")
+	annotatePTR    = flag.Bool("annotate-ptr", false, "resolve PTR of answer addresses")
+	steering       = flag.Bool("steering", false, "analyze steering quality of answers")
+	outputFormat   = flag.String("format", outputTable, "output formats")
+	outputFile     = flag.String("o", "", "output file of json format")
+	historyFile    = flag.String("history", "", "record scans into the database file")
+	listenAddr     = flag.String("listen", "", "listen address of HTTP API in serve mode, /metrics in watch mode")
+	watchInterval  = flag.Duration("interval", 5*time.Minute, "interval of rescans in watch mode")
+	expectFile     = flag.String("expect", "", "expectations file of check mode")
+	reportFormat   = flag.String("report", reportJUnit, "report format of check mode")
+	recordFile     = flag.String("record", "", "save raw queries and responses")
+	replayFile     = flag.String("replay", "", "replay saved responses without network")
+	pcapFile       = flag.String("pcap", "", "write DNS packets in libpcap format")
+	regionFilter   ipDB.RegionFilter
+	watchMode      bool
+	serveMode      bool
+	checkMode      bool
+	domainNames    []string
 	logger         *zap.Logger
 )
 
+// stringList 可重复指定的参数
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+func init() {
+	flag.Var((*stringList)(&regionFilter.Countries), "country", "only scan matched countries")
+	flag.Var((*stringList)(&regionFilter.Provinces), "province", "only scan matched provinces")
+	flag.Var((*stringList)(&regionFilter.ISPs), "isp", "only scan matched ISPs")
+	flag.Var((*stringList)(&regionFilter.ExcludeCountries), "exclude-country", "skip matched countries")
+	flag.Var((*stringList)(&regionFilter.ExcludeProvinces), "exclude-province", "skip matched provinces")
+	flag.Var((*stringList)(&regionFilter.ExcludeISPs), "exclude-isp", "skip matched ISPs")
+}
+
 func main() {
 	flag.Usage = Usage
 	if len(os.Args) <= 1 {
@@ -50,152 +141,459 @@ func main() {
 		os.Exit(1)
 	}
 
+	// 子命令
+	switch os.Args[1] {
+	case "regions":
+		regionsMain(os.Args[2:])
+		return
+	case "probe-resolvers":
+		probeResolversMain(os.Args[2:])
+		return
+	case "trace":
+		traceMain(os.Args[2:])
+		return
+	case "diff":
+		diffMain(os.Args[2:])
+		return
+	case "history":
+		historyMain(os.Args[2:])
+		return
+	case "serve":
+		// 和普通扫描使用同样的参数作为默认值
+		serveMode = true
+		os.Args = append(os.Args[0:1], os.Args[2:]...)
+	case "watch":
+		// 和普通扫描使用同样的参数
+		watchMode = true
+		os.Args = append(os.Args[0:1], os.Args[2:]...)
+	case "check":
+		// 和普通扫描使用同样的参数，扫描后按--expect检查
+		checkMode = true
+		os.Args = append(os.Args[0:1], os.Args[2:]...)
+	}
+
 	flag.Parse()
 
-	// 输入参数中没有options的默认位URL参数，可以在任意位置
+	// 输入参数中没有options的默认为域名参数，可以在任意位置
 	for flag.NArg() > 0 {
-		if len(domainName) == 0 {
-			domainName = flag.Args()[0]
-		} else {
-			panic(fmt.Sprintf("ignore unkown params: %s", flag.Args()[0]))
-		}
+		domainNames = append(domainNames, flag.Args()[0])
 
 		os.Args = flag.Args()[0:]
 		flag.Parse()
 	}
 
-	// 初始化日志
-	config := zap.Config{
-		Level:            zap.NewAtomicLevelAt(zapcore.Level(*logLevel)),
-		Encoding:         "console",                         // 使用默认的 console 编码器
-		EncoderConfig:    zap.NewDevelopmentEncoderConfig(), // 使用开发环境的默认编码器配置
-		OutputPaths:      []string{"stdout"},                // 输出到标准输出
-		ErrorOutputPaths: []string{"stderr"},                // 错误输出到标准错误输出
+	// 初始化日志，json结果输出到标准输出时，日志输出到标准错误输出
+	logOutput := "stdout"
+	if (strings.Contains(*outputFormat, outputJSON) || checkMode) && *outputFile == "" {
+		logOutput = "stderr"
 	}
+	initLogger(*logLevel, logOutput)
+	defer logger.Sync()
 
-	loggerIns, err := config.Build()
-	if err != nil {
-		panic("无法创建日志记录器")
+	opts := buildScanOptions()
+
+	if *listRegions {
+		prettyRegions(os.Stdout, &opts)
+		return
 	}
-	defer loggerIns.Sync()
-	logger = loggerIns
 
-	if len(domainName) == 0 {
+	if *replayFile != "" {
+		// 回放时不能发送额外的查询
+		if serveMode || watchMode || *recordFile != "" || *pcapFile != "" || *checkpointFile != "" {
+			logger.Fatal("--replay is not supported with serve, watch, --record, --pcap and --checkpoint")
+		}
+		if opts.Authoritative || opts.DNSSEC || opts.AnnotatePTR {
+			logger.Fatal("--replay is not supported with --authoritative, --dnssec and --annotate-ptr")
+		}
+
+		captures, err := loadCaptures(*replayFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		opts.Replay = captures
+		replayScope(&opts)
+		if len(opts.Replay) == 0 {
+			logger.Fatal("no query of the domains in replay file", zap.Strings("domains", domainNames))
+		}
+	}
+
+	if *recordFile != "" {
+		recorder, err := openCaptureWriter(*recordFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		defer recorder.close()
+		opts.Recorder = recorder
+	}
+
+	if *pcapFile != "" {
+		pcap, err := openPcapWriter(*pcapFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		defer pcap.close()
+		opts.PCAP = pcap
+	}
+
+	var store *historyStore
+	if opts.History != "" {
+		var err error
+		if store, err = openHistory(opts.History, false); err != nil {
+			logger.Fatal(err.Error())
+		}
+		defer store.close()
+	}
+
+	if serveMode {
+		listen := *listenAddr
+		if listen == "" {
+			listen = ":8080"
+		}
+		serveAPI(&opts, listen, store)
+		return
+	}
+
+	if len(opts.Domains) == 0 {
 		logger.Error("[WARN] please input domain names")
 		flag.Usage()
 		return
 	}
 
-	var ipRegions []configs.IPRegion
-	if *ipRegionFile != "" {
-		ipRegions = parseIPRegionFile(*ipRegionFile)
+	if opts.Authoritative {
+		discoverAuthoritative(&opts)
 	}
 
-	// 如果没有subnet文件，默认只看本机dig的结果
-	if len(ipRegions) == 0 {
-		ipRegions = append(ipRegions, configs.IPRegion{
-			IPs: []string{""},
-		})
+	var ckpt *checkpoint
+	if *checkpointFile != "" {
+		ckpt = openCheckpoint(*checkpointFile, *resume)
+		defer ckpt.close()
+	} else if *resume {
+		logger.Fatal("--resume requires --checkpoint file")
 	}
 
-	var nsList []configs.DNS
-	if *nameServerFile != "" {
-		nsList = parseNameServerFile(*nameServerFile)
+	if watchMode {
+		if ckpt != nil {
+			logger.Fatal("--checkpoint is not supported in watch mode")
+		}
+		if *watchInterval <= 0 {
+			logger.Fatal("invalid --interval", zap.Duration("interval", *watchInterval))
+		}
+		watchScan(&opts, *watchInterval, store, *listenAddr)
+		return
+	}
+
+	if checkMode {
+		if ckpt != nil {
+			logger.Fatal("--checkpoint is not supported in check mode")
+		}
+		if *expectFile == "" {
+			logger.Fatal("check mode requires --expect file")
+		}
+		if !checkScan(&opts, *expectFile, *reportFormat) {
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+
+	report := scan(&opts, ckpt)
+	saveHistory(store, report)
+	checkAlerts(&opts, report, nil)
+	writeReport(&opts, report)
+}
+
+// scan 执行一次扫描并完成标注和分析
+func scan(opts *scanOptions, ckpt *checkpoint) *scanReport {
+	report := &scanReport{
+		Started: time.Now(),
+	}
+	if opts.Replay != nil {
+		report.Probes = replayCaptures(opts)
+	} else {
+		report.Probes = runScan(opts, ckpt)
+	}
+	report.Finished = time.Now()
+
+	if opts.AnnotateAnswers || opts.AnnotatePTR {
+		report.Addresses = annotateAnswers(opts, report.Probes)
+	}
+
+	if opts.Steering {
+		report.Steering = analyzeSteering(opts, report.Probes, report.Addresses)
+	}
+
+	return report
+}
+
+// buildScanOptions 合并配置文件和命令行参数，命令行中显式指定的参数优先于配置文件
+func buildScanOptions() scanOptions {
+	profile := scanProfile{}
+	if *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+
+		configProfile, err := config.profile(*profileName)
+		if err != nil {
+			logger.Fatal("select profile failed", zap.Error(err))
+		}
+		profile = *configProfile
+	} else if *profileName != "" {
+		logger.Fatal("--profile requires --config file")
+	}
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	if len(domainNames) > 0 {
+		profile.Domains = domainNames
+	}
+
+	if setFlags["t"] || len(profile.QTypes) == 0 {
+		profile.QTypes = strings.Split(*rrType, ",")
+	}
+
+	if setFlags["ns"] || setFlags["ns_file"] {
+		profile.Resolvers = nil
+		profile.ResolverFile = *nameServerFile
+		if setFlags["ns"] {
+			profile.Resolvers = append(profile.Resolvers, parseNameServerFlag())
+		}
+	}
+
+	if setFlags["f"] {
+		profile.Regions = []regionSource{{
+			File:         *ipRegionFile,
+			Format:       *regionFormat,
+			GeoLocations: *geoLocations,
+			GeoASN:       *geoASN,
+		}}
+	}
+
+	if setFlags["sample"] || profile.Sample == "" {
+		profile.Sample = *samplePolicy
+	}
+
+	overrideList(&profile.Filter.Countries, regionFilter.Countries)
+	overrideList(&profile.Filter.Provinces, regionFilter.Provinces)
+	overrideList(&profile.Filter.ISPs, regionFilter.ISPs)
+	overrideList(&profile.Filter.ExcludeCountries, regionFilter.ExcludeCountries)
+	overrideList(&profile.Filter.ExcludeProvinces, regionFilter.ExcludeProvinces)
+	overrideList(&profile.Filter.ExcludeISPs, regionFilter.ExcludeISPs)
+
+	if setFlags["concurrency"] || profile.Concurrency == 0 {
+		profile.Concurrency = *concurrency
+	}
+
+	if setFlags["compare-resolvers"] {
+		profile.Compare = *compareMode
+	}
+
+	if setFlags["authoritative"] {
+		profile.Authoritative = *authoritative
+	}
+
+	if setFlags["dnssec"] {
+		profile.DNSSEC = *dnssec
+	}
+
+	if setFlags["trust-anchor"] {
+		profile.TrustAnchor = *trustAnchor
+	}
+
+	if setFlags["annotate-answers"] {
+		profile.AnnotateAnswers = *annotate
+	}
+
+	if setFlags["annotate-ptr"] {
+		profile.AnnotatePTR = *annotatePTR
+	}
+
+	if setFlags["steering"] {
+		profile.Steering = *steering
+	}
+
+	if setFlags["history"] {
+		profile.History = *historyFile
+	}
+
+	if setFlags["format"] || len(profile.Outputs) == 0 {
+		profile.Outputs = strings.Split(*outputFormat, ",")
+	}
+
+	if setFlags["o"] {
+		profile.OutputFile = *outputFile
+	}
+
+	// 命令行参数同样需要校验
+	if errs := profile.validate(); len(errs) > 0 {
+		logger.Fatal("invalid options", zap.Error(errors.Join(errs...)))
+	}
+
+	opts := scanOptions{
+		Domains:          profile.Domains,
+		Resolvers:        profile.Resolvers,
+		Concurrency:      profile.Concurrency,
+		Outputs:          profile.Outputs,
+		OutputFile:       profile.OutputFile,
+		CompareResolvers: profile.Compare,
+		Authoritative:    profile.Authoritative,
+		DNSSEC:           profile.DNSSEC,
+		AnnotateAnswers:  profile.AnnotateAnswers,
+		AnnotatePTR:      profile.AnnotatePTR,
+		Steering:         profile.Steering,
+		History:          profile.History,
+		Alerts:           &profile.Alerts,
+	}
+
+	// 调度质量分析依赖应答IP的归属地
+	if opts.Steering {
+		opts.AnnotateAnswers = true
+	}
+
+	if opts.DNSSEC {
+		anchors, err := loadTrustAnchors(profile.TrustAnchor)
+		if err != nil {
+			logger.Fatal("load trust anchor failed", zap.Error(err))
+		}
+		opts.TrustAnchors = anchors
+	}
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+
+	for _, qType := range profile.QTypes {
+		rType, _ := dnsMsg.ParseType(qType)
+		opts.QTypes = append(opts.QTypes, rType)
+	}
+
+	if profile.ResolverFile != "" {
+		opts.Resolvers = append(opts.Resolvers, parseNameServerFile(profile.ResolverFile)...)
 	}
 
 	// 没有指定用默认的nameserver
-	if len(nsList) == 0 {
-		nsList = append(nsList, configs.DNS{
-			Nameserver: *nameServer,
-		})
+	if len(opts.Resolvers) == 0 {
+		opts.Resolvers = append(opts.Resolvers, parseNameServerFlag())
 	}
 
-	idx := 0
-	nsIdx := 0
-	var conn net.Conn
-	rr2RegionMap := make(map[string]map[string]map[string]string)
-	for _, ipRegion := range ipRegions {
-		for _, ip := range ipRegion.IPs {
-			// 每50个请求切换一下nameserver
-			if idx%50 == 0 {
-				// 释放上一个conn
-				if conn != nil {
-					conn.Close()
-				}
+	opts.Sample, _ = ipDB.ParseSamplePolicy(profile.Sample)
 
-				ns := nsList[nsIdx%len(nsList)]
-				nsIdx += 1
+	for _, source := range profile.Regions {
+		opts.Regions = append(opts.Regions, parseIPRegionFile(source)...)
+	}
 
-				// Create UDP connection to DNS server
-				var err error
-				conn, err = net.Dial("udp", ns.Nameserver+":53")
-				if err != nil {
-					logger.Fatal("Error creating UDP connection", zap.Error(err))
-				}
+	// 应答的归属地使用过滤前的全部地区数据，serve时由每个请求决定是否标注
+	if opts.AnnotateAnswers && len(opts.Regions) == 0 {
+		logger.Fatal("--annotate-answers requires ip region file")
+	}
+	if opts.AnnotateAnswers || (serveMode && len(opts.Regions) > 0) {
+		opts.AnswerDB = ipDB.NewDB(ipDB.RegionsToRanges(opts.Regions))
+	}
 
-				logger.Debug("switch to DNS", zap.String("nameserver", ns.Nameserver), zap.Int("port", 53))
-				conn.SetDeadline(time.Now().Add(time.Second * 10))
+	if len(profile.Regions) > 0 {
+		opts.Regions = profile.Filter.Filter(opts.Regions)
+		if len(opts.Regions) == 0 {
+			logger.Fatal("no region matches the filters")
+		}
+	} else if !profile.Filter.IsEmpty() {
+		logger.Warn("region filters are ignored without ip region file")
+	}
+
+	// 如果没有subnet文件，默认只看本机dig的结果
+	if len(opts.Regions) == 0 {
+		opts.Regions = append(opts.Regions, configs.IPRegion{
+			IPs: []string{""},
+		})
+	} else if !opts.Authoritative {
+		for _, ns := range opts.Resolvers {
+			if !ns.SupportECS() {
+				logger.Warn("nameserver does not support ECS, skip it for client subnet probes", zap.String("nameserver", ns.Address()))
 			}
+		}
 
-			idx += 1
+		if len(ecsCapable(opts.Resolvers)) == 0 {
+			logger.Fatal("no nameserver supports ECS")
+		}
+	}
 
-			// Construct DNS query
-			query := makeDNSQuery(domainName, ip)
+	return opts
+}
 
-			// Send DNS query
-			_, err := conn.Write(query)
-			if err != nil {
-				logger.Fatal("Error sending DNS query", zap.Error(err))
-			}
+func parseNameServerFlag() configs.DNS {
+	ns, err := configs.ParseNameserver(*nameServer)
+	if err != nil {
+		logger.Fatal("invalid -ns", zap.Error(err))
+	}
 
-			// Receive DNS response
-			response := make([]byte, 1024*100)
-			resBytes, err := conn.Read(response)
-			if err != nil {
-				logger.Fatal("Error receiving DNS response", zap.Error(err))
-			}
+	return ns
+}
 
-			// Process and print DNS response
-			aRRs := parseDNSResponse(response[0:resBytes])
+// overrideList 命令行中指定了就覆盖配置文件中的值
+func overrideList(list *[]string, flagValue []string) {
+	if len(flagValue) > 0 {
+		*list = flagValue
+	}
+}
 
-			// 汇总结果
-			sort.Strings(aRRs)
-			aStr := strings.Join(aRRs, ",")
+const answerSeparator = "\n"
 
-			province := ipRegion.Province
-			if ipRegion.Province == "0" {
-				province = ipRegion.Country
-			}
+// aggregateResults 按A记录集合汇总所有探测结果: A记录 -> ISP -> Province -> Country
+func aggregateResults(results []probeRecord) map[string]map[string]map[string]string {
+	rr2RegionMap := make(map[string]map[string]map[string]string)
+	for _, record := range results {
+		// 汇总结果
+		aRRs := append([]string(nil), record.Answers...)
+		sort.Strings(aRRs)
+		// SVCB/HTTPS记录中带有逗号(alpn="h2,h3")，用换行分隔记录
+		aStr := strings.Join(aRRs, answerSeparator)
+
+		province := record.Province
+		if record.Province == "0" {
+			province = record.Country
+		}
 
-			if regionInfo, ok := rr2RegionMap[aStr]; !ok {
-				rr2RegionMap[aStr] = make(map[string]map[string]string)
-				rr2RegionMap[aStr][ipRegion.ISP] = make(map[string]string)
-				rr2RegionMap[aStr][ipRegion.ISP][province] = ipRegion.Country
+		if regionInfo, ok := rr2RegionMap[aStr]; !ok {
+			rr2RegionMap[aStr] = make(map[string]map[string]string)
+			rr2RegionMap[aStr][record.ISP] = make(map[string]string)
+			rr2RegionMap[aStr][record.ISP][province] = record.Country
+		} else {
+			if _, ok := regionInfo[record.ISP]; !ok {
+				regionInfo[record.ISP] = make(map[string]string)
+				regionInfo[record.ISP][province] = record.Country
 			} else {
-				if _, ok := regionInfo[ipRegion.ISP]; !ok {
-					regionInfo[ipRegion.ISP] = make(map[string]string)
-					regionInfo[ipRegion.ISP][province] = ipRegion.Country
-				} else {
-					regionInfo[ipRegion.ISP][province] = ipRegion.Country
-				}
+				regionInfo[record.ISP][province] = record.Country
 			}
-
-			// 控制频率
-			time.Sleep(5 * time.Millisecond)
 		}
 	}
 
-	prettyStatistic(rr2RegionMap)
+	return rr2RegionMap
+}
+
+func initLogger(level int, outputPath string) {
+	config := zap.Config{
+		Level:            zap.NewAtomicLevelAt(zapcore.Level(level)),
+		Encoding:         "console",                         // 使用默认的 console 编码器
+		EncoderConfig:    zap.NewDevelopmentEncoderConfig(), // 使用开发环境的默认编码器配置
+		OutputPaths:      []string{outputPath},              // 默认输出到标准输出
+		ErrorOutputPaths: []string{"stderr"},                // 错误输出到标准错误输出
+	}
+
+	loggerIns, err := config.Build()
+	if err != nil {
+		panic("无法创建日志记录器")
+	}
+	logger = loggerIns
 }
 
 func parseNameServerFile(nsFile string) []configs.DNS {
-	jsonFile, err := os.Open(nsFile)
+	byteValue, err := os.ReadFile(nsFile)
 	if err != nil {
 		logger.Fatal("parseNameServerFile failed", zap.Error(err))
 	}
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
 
 	var nsList []configs.DNS
 	err = json.Unmarshal(byteValue, &nsList)
@@ -203,43 +601,86 @@ func parseNameServerFile(nsFile string) []configs.DNS {
 		logger.Fatal("parseNameServerFile failed", zap.Error(err))
 	}
 
+	for idx := range nsList {
+		if err := nsList[idx].Validate(); err != nil {
+			logger.Fatal("parseNameServerFile failed", zap.String("file", nsFile), zap.Int("index", idx), zap.Error(err))
+		}
+	}
+
 	return nsList
 }
 
-func parseIPRegionFile(ipRegionFile string) []configs.IPRegion {
-	jsonFile, err := os.Open(ipRegionFile)
+func parseIPRegionFile(source regionSource) []configs.IPRegion {
+	illegalLines := 0
+	ipRegions, err := ipDB.LoadRegionFile(source.File, ipDB.LoadOptions{
+		Format:       source.Format,
+		GeoLocations: source.GeoLocations,
+		GeoASN:       source.GeoASN,
+		Illegal: func(lineNo int, line string, err error) {
+			illegalLines += 1
+			logger.Debug("ignore illegal line", zap.String("file", source.File), zap.Int("line", lineNo), zap.Error(err))
+		},
+	})
 	if err != nil {
 		logger.Fatal("parseIPRegionFile failed", zap.Error(err))
 	}
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
 
-	var ipRegions []configs.IPRegion
-	err = json.Unmarshal(byteValue, &ipRegions)
-	if err != nil {
-		logger.Fatal("parseIPRegionFile failed", zap.Error(err))
+	if illegalLines > 0 {
+		logger.Warn("parseIPRegionFile ignored illegal lines", zap.String("file", source.File), zap.Int("illegal_lines", illegalLines))
 	}
 
 	return ipRegions
 }
 
-func makeDNSQuery(domain string, clientSubnet string) []byte {
+// queryOptions 查询报文的可选项，零值为普通的递归查询
+type queryOptions struct {
+	NoRecursion      bool   // RD=0
+	DNSSEC           bool   // OPT中设置DO
+	CheckingDisabled bool   // CD=1，递归nameserver验证失败时也返回结果
+	NSID             bool   // 请求nameserver的NSID
+	Cookie           []byte // client cookie
+	EDNSVersion      uint8
+}
+
+func (opts *queryOptions) needEDNS() bool {
+	return opts.DNSSEC || opts.NSID || len(opts.Cookie) > 0 || opts.EDNSVersion > 0
+}
+
+func makeDNSQuery(domain string, qType uint16, clientSubnet string, opts queryOptions) []byte {
 	var dnsHeader dnsMsg.DNSHeader
 
 	// DNS query header
 	dnsHeader.SetID(uint16(rand.Int31n(65535))) // Use your own query ID
 	dnsHeader.SetQR(0)                          // Standard query
-	dnsHeader.SetRD(1)                          // Recusive Desired
-	dnsHeader.SetQDCount(1)                     // Number of questions
+	if !opts.NoRecursion {
+		dnsHeader.SetRD(1) // Recusive Desired
+	}
+	if opts.CheckingDisabled {
+		dnsHeader.SetCD(1)
+	}
+	dnsHeader.SetQDCount(1) // Number of questions
 
 	// Construct DNS query packet using domain name
 	var dnsQuestion dnsMsg.Question
-	dnsQuestion.AddQuestion(domain, 1, 1)
+	dnsQuestion.AddQuestion(domain, qType, dnsMsg.ClassINET)
 
 	queryData := append(dnsHeader.GetHeader(), dnsQuestion.Data...)
 
-	if clientSubnet != "" {
+	if clientSubnet != "" || opts.needEDNS() {
+		var options []dnsMsg.EDNSOption
+		if clientSubnet != "" {
+			clientIP, sourceNetMaskLen := parseClientSubnet(clientSubnet)
+			options = append(options, dnsMsg.NewClientSubnetOption(clientIP, sourceNetMaskLen))
+		}
+
+		if opts.NSID {
+			options = append(options, dnsMsg.EDNSOption{Code: dnsMsg.OptionNSID})
+		}
+
+		if len(opts.Cookie) > 0 {
+			options = append(options, dnsMsg.EDNSOption{Code: dnsMsg.OptionCookie, Data: opts.Cookie})
+		}
+
 		dnsAdditional := dnsMsg.Additional{
 			Data: make([]byte, 1024),
 		}
@@ -247,106 +688,60 @@ func makeDNSQuery(domain string, clientSubnet string) []byte {
 		dnsHeader.SetARCount(1) // Number of additional records
 
 		queryData = append(dnsHeader.GetHeader(), dnsQuestion.Data...)
-		offset := dnsAdditional.AddEDNSClientSubnet(0, net.ParseIP(clientSubnet), 24) //nolint
+		offset := dnsAdditional.AddOPT(0, dnsMsg.DefaultUDPSize, opts.EDNSVersion, opts.DNSSEC, options)
 		queryData = append(queryData, dnsAdditional.Data[0:offset]...)
 	}
 
 	logger.Debug(fmt.Sprintf("Request:%02x", queryData))
-	logger.Debug(fmt.Sprintf("Request Header", &dnsHeader))
+	logger.Debug(fmt.Sprintf("Request Header:%s", &dnsHeader))
 
 	return queryData
 }
 
-func parseDNSResponse(response []byte) []string {
-	logger.Debug(fmt.Sprintf("Reponse:%02x\n", response))
+// parseClientSubnet 解析client subnet，单个IP默认IPv4取/24，IPv6取/56
+func parseClientSubnet(clientSubnet string) (net.IP, uint8) {
+	if !strings.Contains(clientSubnet, "/") {
+		clientIP := net.ParseIP(clientSubnet)
+		if clientIP == nil {
+			logger.Fatal("invalid client subnet", zap.String("subnet", clientSubnet))
+		}
 
-	// DNS response header
-	var dnsHeader dnsMsg.DNSHeader
-	copy(dnsHeader[:], response[0:len(dnsHeader)])
-	logger.Debug(fmt.Sprintf("Reponse header:%s", &dnsHeader))
-
-	qdCount := dnsHeader.GetQDCount()
-	anCount := dnsHeader.GetANCount()
-	nsCount := dnsHeader.GetNSCount()
-	arCount := dnsHeader.GetARCount()
-
-	var aRRs []string
-
-	// Parse DNS answers, authority records, and additional records
-	offset := len(dnsHeader) // Start after header
-	for idx := uint16(0); idx < qdCount+anCount+nsCount+arCount; idx++ {
-		if idx < qdCount {
-			logger.Debug("----------------Query Section---------------")
-			offset = parseQuerySection(response, offset)
-		} else if idx < qdCount+anCount {
-			logger.Debug("-----------Answer Records Section-----------")
-			var rType uint16
-			var rData []byte
-			rType, rData, offset = parseAnswerSection(response, offset)
-			if rType == 1 {
-				aRRs = append(aRRs, dnsMsg.ParseIPFromRData(rData).String())
-			}
-		} else if idx < qdCount+anCount+nsCount {
-			logger.Debug("----------Authority Records Section---------")
-		} else if idx < qdCount+anCount+nsCount+arCount {
-			logger.Debug("----------Additional Records Section--------")
+		if clientIP.To4() != nil {
+			return clientIP, ipDB.IPv4SubnetBits
 		}
+		return clientIP, ipDB.IPv6SubnetBits
 	}
 
-	return aRRs
-}
-
-func parseQuerySection(response []byte, offset int) int {
-	dnsQuestion := dnsMsg.Question{
-		Data: response,
+	clientIP, ipNet, err := net.ParseCIDR(clientSubnet)
+	if err != nil {
+		logger.Fatal("invalid client subnet", zap.String("subnet", clientSubnet), zap.Error(err))
 	}
 
-	name, length := dnsQuestion.GetQName(offset)
-	offset += length
-
-	rType, length := dnsQuestion.GetQType(offset)
-	offset += length
-
-	rClass, length := dnsQuestion.GetQClass(offset)
-	offset += length
-
-	logger.Debug(fmt.Sprintf("Name:%s", name))
-	logger.Debug(fmt.Sprintf("Type:%s", rType))
-	logger.Debug(fmt.Sprintf("Class:%s", rClass))
-
-	return offset
+	ones, _ := ipNet.Mask.Size()
+	return clientIP, uint8(ones)
 }
 
-func parseAnswerSection(response []byte, offset int) (uint16, []byte, int) {
-	dnsAnswer := dnsMsg.Answer{
-		Data: response,
-	}
-
-	name, length := dnsAnswer.GetName(offset)
-	offset += length
-
-	rType, length := dnsAnswer.GetType(offset)
-	offset += length
-
-	rClass, length := dnsAnswer.GetClass(offset)
-	offset += length
-
-	rTTL, length := dnsAnswer.GetTTL(offset)
-	offset += length
-
-	rDLen, length := dnsAnswer.GetDLen(offset)
-	offset += length
-
-	rData := dnsAnswer.GetData(offset, rDLen)
+// parseDNSResponse 返回Answer中qType类型的记录，ANY返回所有类型的记录
+func parseDNSResponse(response []byte, qType uint16) ([]string, error) {
+	logger.Debug(fmt.Sprintf("Reponse:%02x\n", response))
 
-	logger.Debug(fmt.Sprintf("Name:%s", name))
-	logger.Debug(fmt.Sprintf("Type:%s", rType))
-	logger.Debug(fmt.Sprintf("Class:%s", rClass))
-	logger.Debug(fmt.Sprintf("TTL:%s", rTTL))
-	logger.Debug(fmt.Sprintf("Data Length:%s", rDLen))
-	logger.Debug(fmt.Sprintf("Data:%s", dnsMsg.ParseIPFromRData(rData)))
+	msg, err := dnsMsg.ParseMessage(response)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug(fmt.Sprintf("Reponse:\n%s", msg))
+
+	var answers []string
+	for idx := range msg.Answers {
+		rr := &msg.Answers[idx]
+		if qType == dnsMsg.TypeANY {
+			answers = append(answers, dnsMsg.TypeString(rr.Type)+" "+msg.RDataString(rr))
+		} else if rr.Type == qType {
+			answers = append(answers, msg.RDataString(rr))
+		}
+	}
 
-	return rType, rData, offset + int(rDLen)
+	return answers, nil
 }
 
 func chineseCharCount(str string) int {
@@ -359,14 +754,14 @@ func chineseCharCount(str string) int {
 	return count
 }
 
-func prettyStatistic(aRRs map[string]map[string]map[string]string) {
+func prettyStatistic(aRRs map[string]map[string]map[string]string, qType string) {
 	newLineStr := strings.Repeat("-", 30)
 	fmt.Printf("|%s---%s---%s|\n", newLineStr, newLineStr, newLineStr)
-	fmt.Printf("|%-30s | %-30s | %-30s|\n", "Local Subnet", "ISP", "Records A")
+	fmt.Printf("|%-30s | %-30s | %-30s|\n", "Local Subnet", "ISP", "Records "+qType)
 	fmt.Printf("|%s---%s---%s|\n", newLineStr, newLineStr, newLineStr)
 
 	for ips, regions := range aRRs {
-		ipList := strings.Split(ips, ",")
+		ipList := strings.Split(ips, answerSeparator)
 
 		ipLines := 0
 		ispLen := 0
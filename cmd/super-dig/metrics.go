@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Prometheus文本格式的/metrics，serve和watch模式下每次扫描结束后更新:
+
+   super_dig_scans_total                       完成的扫描次数
+   super_dig_last_scan_timestamp_seconds       最后一次扫描完成的时间
+   super_dig_probes_total{domain,qtype,rcode}  探测次数，失败的探测rcode为error
+   super_dig_query_duration_seconds{nameserver} 查询耗时的直方图
+   super_dig_answer_sets{domain,qtype}         最后一次扫描中不同answer集合的个数
+   super_dig_answer_changes_total{domain,qtype,country,province,isp}
+                                               地区的answer集合或者rcode相比上一次探测变化的次数
+*/
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []float64 // 每个bucket的累计个数
+	count   float64
+	sum     float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.buckets == nil {
+		h.buckets = make([]float64, len(latencyBuckets))
+	}
+
+	for idx, bound := range latencyBuckets {
+		if value <= bound {
+			h.buckets[idx] += 1
+		}
+	}
+	h.count += 1
+	h.sum += value
+}
+
+// scanMetrics 按label汇总的指标，map的key是渲染好的label，例如{domain="a.com",qtype="A"}
+type scanMetrics struct {
+	mutex      sync.Mutex
+	scans      float64
+	lastScan   float64
+	probes     map[string]float64
+	latency    map[string]*histogram
+	answerSets map[string]float64
+	changes    map[string]float64
+	last       map[string]probeRecord // 每个探测最后一次成功的结果
+}
+
+func newScanMetrics() *scanMetrics {
+	return &scanMetrics{
+		probes:     make(map[string]float64),
+		latency:    make(map[string]*histogram),
+		answerSets: make(map[string]float64),
+		changes:    make(map[string]float64),
+		last:       make(map[string]probeRecord),
+	}
+}
+
+// observe 统计一次扫描的结果，metrics为nil时不统计
+func (metrics *scanMetrics) observe(report *scanReport) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.scans += 1
+	metrics.lastScan = float64(report.Finished.UnixNano()) / float64(time.Second)
+
+	answerSets := make(map[string]map[string]bool)
+	for _, record := range report.Probes {
+		rcode := record.RCode
+		if record.Error != "" {
+			rcode = "error"
+		}
+		metrics.probes[metricLabels("domain", record.Domain, "qtype", record.QType, "rcode", rcode)] += 1
+
+		if record.LatencyMS > 0 {
+			key := metricLabels("nameserver", record.Nameserver)
+			if metrics.latency[key] == nil {
+				metrics.latency[key] = &histogram{}
+			}
+			metrics.latency[key].observe(record.LatencyMS / 1000)
+		}
+
+		if record.Error == "" {
+			key := metricLabels("domain", record.Domain, "qtype", record.QType)
+			if answerSets[key] == nil {
+				answerSets[key] = make(map[string]bool)
+			}
+			answers := append([]string(nil), record.Answers...)
+			sort.Strings(answers)
+			answerSets[key][strings.Join(answers, answerSeparator)] = true
+		}
+	}
+
+	for key, sets := range answerSets {
+		metrics.answerSets[key] = float64(len(sets))
+	}
+
+	// 和每个探测上一次成功的结果对比，serve时不同的请求可能只扫描部分地区
+	var previous []probeRecord
+	for _, record := range metrics.last {
+		previous = append(previous, record)
+	}
+	for _, change := range diffRecords(previous, report.Probes, recordKey) {
+		metrics.changes[metricLabels("domain", change.Domain, "qtype", change.QType, "country", change.Country,
+			"province", change.Province, "isp", change.ISP)] += 1
+	}
+
+	for _, record := range report.Probes {
+		if record.Error == "" {
+			metrics.last[recordKey(&record)] = record
+		}
+	}
+}
+
+func (metrics *scanMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+func (metrics *scanMetrics) write(w io.Writer) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	writeMetric(w, "super_dig_scans_total", "counter", "Number of finished scans.",
+		map[string]float64{"": metrics.scans})
+	writeMetric(w, "super_dig_last_scan_timestamp_seconds", "gauge", "Unix time of the last finished scan.",
+		map[string]float64{"": metrics.lastScan})
+	writeMetric(w, "super_dig_probes_total", "counter", "Number of probes by rcode, error for failed probes.",
+		metrics.probes)
+
+	fmt.Fprintf(w, "# HELP super_dig_query_duration_seconds Latency of DNS queries.\n")
+	fmt.Fprintf(w, "# TYPE super_dig_query_duration_seconds histogram\n")
+	for _, key := range sortedKeys(metrics.latency) {
+		h := metrics.latency[key]
+		labels := strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+		for idx, bound := range latencyBuckets {
+			fmt.Fprintf(w, "super_dig_query_duration_seconds_bucket{%s,le=\"%g\"} %g\n", labels, bound, h.buckets[idx])
+		}
+		fmt.Fprintf(w, "super_dig_query_duration_seconds_bucket{%s,le=\"+Inf\"} %g\n", labels, h.count)
+		fmt.Fprintf(w, "super_dig_query_duration_seconds_sum%s %g\n", key, h.sum)
+		fmt.Fprintf(w, "super_dig_query_duration_seconds_count%s %g\n", key, h.count)
+	}
+
+	writeMetric(w, "super_dig_answer_sets", "gauge", "Number of distinct answer sets in the last scan.",
+		metrics.answerSets)
+	writeMetric(w, "super_dig_answer_changes_total", "counter", "Number of answer set or rcode changes of regions.",
+		metrics.changes)
+}
+
+func writeMetric(w io.Writer, name, metricType, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %g\n", name, key, values[key])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricLabels 按name, value成对的参数渲染label，value中的\、"和换行需要转义
+func metricLabels(pairs ...string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	var labels []string
+	for idx := 0; idx+1 < len(pairs); idx += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[idx], replacer.Replace(pairs[idx+1])))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
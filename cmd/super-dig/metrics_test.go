@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanMetrics(t *testing.T) {
+	record := func(subnet, province, isp string, latencyMS float64, answers ...string) probeRecord {
+		return probeRecord{Domain: "www.example.com", QType: "A", Subnet: subnet, Nameserver: "8.8.8.8:53", Protocol: "udp",
+			Country: "中国", Province: province, ISP: isp, Answers: answers, RCode: "NOERROR", LatencyMS: latencyMS}
+	}
+	finished := time.Unix(1790000000, 500000000)
+
+	// 第一次扫描
+	guangdong := record("1.0.1.0", "广东省", `电"信`, 1, "10.0.1.1", "10.0.1.2")
+	beijing := record("1.0.2.0", `北京\市`, "联通", 30, "10.0.2.1")
+	failed := record("1.0.3.0", "上海市", "移动", 1500)
+	failed.RCode, failed.Error = "", "timeout"
+	metrics := newScanMetrics()
+	metrics.observe(&scanReport{Finished: finished.Add(-time.Minute), Probes: []probeRecord{guangdong, beijing, failed}})
+
+	// 第二次扫描广东的answer集合变化，上海之前失败不算变化
+	guangdong = record("1.0.1.0", "广东省", `电"信`, 8, "10.0.1.2", "10.0.1.1")
+	beijing = record("1.0.2.0", `北京\市`, "联通", 400, "10.0.2.2")
+	shanghai := record("1.0.3.0", "上海市", "移动", 0, "10.0.3.1")
+	shanghai.RCode = "NXDOMAIN"
+	metrics.observe(&scanReport{Finished: finished, Probes: []probeRecord{guangdong, beijing, shanghai}})
+
+	want := `# HELP super_dig_scans_total Number of finished scans.
+# TYPE super_dig_scans_total counter
+super_dig_scans_total 2
+# HELP super_dig_last_scan_timestamp_seconds Unix time of the last finished scan.
+# TYPE super_dig_last_scan_timestamp_seconds gauge
+super_dig_last_scan_timestamp_seconds 1.7900000005e+09
+# HELP super_dig_probes_total Number of probes by rcode, error for failed probes.
+# TYPE super_dig_probes_total counter
+super_dig_probes_total{domain="www.example.com",qtype="A",rcode="NOERROR"} 4
+super_dig_probes_total{domain="www.example.com",qtype="A",rcode="NXDOMAIN"} 1
+super_dig_probes_total{domain="www.example.com",qtype="A",rcode="error"} 1
+# HELP super_dig_query_duration_seconds Latency of DNS queries.
+# TYPE super_dig_query_duration_seconds histogram
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="0.005"} 1
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="0.01"} 2
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="0.025"} 2
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="0.05"} 3
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="0.1"} 3
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="0.25"} 3
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="0.5"} 4
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="1"} 4
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="2.5"} 5
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="5"} 5
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="10"} 5
+super_dig_query_duration_seconds_bucket{nameserver="8.8.8.8:53",le="+Inf"} 5
+super_dig_query_duration_seconds_sum{nameserver="8.8.8.8:53"} 1.939
+super_dig_query_duration_seconds_count{nameserver="8.8.8.8:53"} 5
+# HELP super_dig_answer_sets Number of distinct answer sets in the last scan.
+# TYPE super_dig_answer_sets gauge
+super_dig_answer_sets{domain="www.example.com",qtype="A"} 3
+# HELP super_dig_answer_changes_total Number of answer set or rcode changes of regions.
+# TYPE super_dig_answer_changes_total counter
+super_dig_answer_changes_total{domain="www.example.com",qtype="A",country="中国",province="北京\\市",isp="联通"} 1
+`
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %s", contentType)
+	}
+	if got := recorder.Body.String(); got != want {
+		t.Errorf("metrics after 2 scans:\n%s\nwant\n%s", got, want)
+	}
+
+	// 再次变化时累加
+	guangdong.Answers = []string{"10.0.1.3"}
+	beijing.Answers = []string{"10.0.2.3"}
+	metrics.observe(&scanReport{Finished: finished, Probes: []probeRecord{guangdong, beijing}})
+	var buffer bytes.Buffer
+	metrics.write(&buffer)
+	for _, line := range []string{
+		`super_dig_answer_changes_total{domain="www.example.com",qtype="A",country="中国",province="广东省",isp="电\"信"} 1`,
+		`super_dig_answer_changes_total{domain="www.example.com",qtype="A",country="中国",province="北京\\市",isp="联通"} 2`,
+		`super_dig_query_duration_seconds_count{nameserver="8.8.8.8:53"} 7`,
+		`super_dig_answer_sets{domain="www.example.com",qtype="A"} 2`,
+		"super_dig_scans_total 3",
+	} {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Errorf("metrics after 3 scans do not contain %s:\n%s", line, buffer.String())
+		}
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		pairs  []string
+		labels string
+	}{
+		{nil, "{}"},
+		{[]string{"nameserver", "8.8.8.8:53"}, `{nameserver="8.8.8.8:53"}`},
+		{[]string{"province", "广东省", "isp", `中国"电信"`}, `{province="广东省",isp="中国\"电信\""}`},
+		{[]string{"isp", "a\\b\nc"}, `{isp="a\\b\nc"}`},
+	}
+
+	for _, test := range tests {
+		if labels := metricLabels(test.pairs...); labels != test.labels {
+			t.Errorf("metricLabels(%q) = %s, want %s", test.pairs, labels, test.labels)
+		}
+	}
+}
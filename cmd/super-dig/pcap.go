@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+   --pcap把扫描中收发的DNS报文按libpcap格式写入文件，不需要root权限和抓包:
+   https://wiki.wireshark.org/Development/LibpcapFileFormat
+
+   每个报文合成Ethernet/IPv4或IPv6/UDP或TCP的帧，地址和端口使用socket实际的地址，
+   TCP连接在第一个报文前合成三次握手，关闭时合成FIN，序号按收发的字节递增，大的应答按MSS分段，
+   Wireshark可以重组DNS over TCP
+*/
+
+const (
+	pcapMagic       = 0xa1b2c3d4 // 微秒精度
+	pcapSnapLen     = 262144
+	pcapLinkTypeEth = 1
+
+	// 以太网MTU 1500减去IP和TCP头部，大的TCP应答按MSS分成多个segment
+	tcpMSSIPv4 = 1460
+	tcpMSSIPv6 = 1440
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+
+	protocolTCP = 6
+	protocolUDP = 17
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+var (
+	localMAC  = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	remoteMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// pcapWriter 多个worker并发写入同一个文件，每个报文直接写入，serve和watch模式被中断时文件仍然完整
+type pcapWriter struct {
+	mutex sync.Mutex
+	file  *os.File
+	ipID  uint16
+}
+
+func openPcapWriter(path string) (*pcapWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create pcap file failed: %w", err)
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeEth)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write pcap file failed: %w", err)
+	}
+
+	return &pcapWriter{file: file}, nil
+}
+
+func (writer *pcapWriter) close() {
+	if writer != nil {
+		writer.file.Close()
+	}
+}
+
+// writeFrame 写入一个以太网帧，segment为UDP或TCP的头部和数据
+func (writer *pcapWriter) writeFrame(t time.Time, src, dst netip.Addr, protocol uint8, segment []byte, outgoing bool) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	frame := make([]byte, 0, 14+40+len(segment))
+	if outgoing {
+		frame = append(frame, remoteMAC...)
+		frame = append(frame, localMAC...)
+	} else {
+		frame = append(frame, localMAC...)
+		frame = append(frame, remoteMAC...)
+	}
+
+	if src.Is4() {
+		writer.ipID++
+		frame = binary.BigEndian.AppendUint16(frame, etherTypeIPv4)
+		ip := make([]byte, 20)
+		ip[0] = 0x45 // version 4, IHL 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(segment)))
+		binary.BigEndian.PutUint16(ip[4:], writer.ipID)
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64   // TTL
+		ip[9] = protocol
+		srcIP, dstIP := src.As4(), dst.As4()
+		copy(ip[12:], srcIP[:])
+		copy(ip[16:], dstIP[:])
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		frame = append(frame, ip...)
+	} else {
+		frame = binary.BigEndian.AppendUint16(frame, etherTypeIPv6)
+		ip := make([]byte, 40)
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(segment)))
+		ip[6] = protocol
+		ip[7] = 64 // hop limit
+		srcIP, dstIP := src.As16(), dst.As16()
+		copy(ip[8:], srcIP[:])
+		copy(ip[24:], dstIP[:])
+		frame = append(frame, ip...)
+	}
+	frame = append(frame, segment...)
+
+	// 超过snaplen的部分不写入，original length仍然为帧的实际长度
+	capLen := len(frame)
+	if capLen > pcapSnapLen {
+		capLen = pcapSnapLen
+	}
+
+	record := make([]byte, 16, 16+capLen)
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(capLen))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	if _, err := writer.file.Write(append(record, frame[:capLen]...)); err != nil {
+		logger.Error("write pcap file failed", zap.Error(err))
+	}
+}
+
+// pcapConn 一个连接上的报文，记录TCP的序号
+type pcapConn struct {
+	writer    *pcapWriter
+	tcp       bool
+	local     netip.AddrPort
+	remote    netip.AddrPort
+	opened    bool
+	closed    bool
+	localSeq  uint32
+	remoteSeq uint32
+}
+
+// newPcapConn writer为nil时返回nil，nil的pcapConn不记录
+func newPcapConn(writer *pcapWriter, conn net.Conn) *pcapConn {
+	if writer == nil {
+		return nil
+	}
+
+	c := &pcapConn{writer: writer}
+	switch addr := conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		c.tcp = true
+		c.local = addr.AddrPort()
+		c.remote = conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	case *net.UDPAddr:
+		c.local = addr.AddrPort()
+		c.remote = conn.RemoteAddr().(*net.UDPAddr).AddrPort()
+	default:
+		return nil
+	}
+
+	c.local = netip.AddrPortFrom(c.local.Addr().Unmap(), c.local.Port())
+	c.remote = netip.AddrPortFrom(c.remote.Addr().Unmap(), c.remote.Port())
+	c.localSeq, c.remoteSeq = 1000, 2000
+	return c
+}
+
+func (c *pcapConn) sent(payload []byte) {
+	if c == nil {
+		return
+	}
+
+	c.handshake()
+	c.push(true, payload)
+}
+
+func (c *pcapConn) received(payload []byte) {
+	if c == nil {
+		return
+	}
+
+	c.handshake()
+	c.push(false, payload)
+}
+
+// push UDP一个报文一个帧，TCP按MSS分段，最后一个segment设置PSH
+func (c *pcapConn) push(outgoing bool, payload []byte) {
+	if !c.tcp {
+		c.write(outgoing, 0, payload)
+		return
+	}
+
+	mss := tcpMSSIPv4
+	if c.local.Addr().Is6() {
+		mss = tcpMSSIPv6
+	}
+
+	for len(payload) > mss {
+		c.write(outgoing, tcpFlagACK, payload[:mss])
+		payload = payload[mss:]
+	}
+	c.write(outgoing, tcpFlagPSH|tcpFlagACK, payload)
+}
+
+// close TCP连接合成双方的FIN
+func (c *pcapConn) close() {
+	if c == nil || !c.tcp || !c.opened || c.closed {
+		return
+	}
+
+	c.closed = true
+	c.write(true, tcpFlagFIN|tcpFlagACK, nil)
+	c.write(false, tcpFlagFIN|tcpFlagACK, nil)
+	c.write(true, tcpFlagACK, nil)
+}
+
+func (c *pcapConn) handshake() {
+	if !c.tcp || c.opened {
+		return
+	}
+
+	c.opened = true
+	c.write(true, tcpFlagSYN, nil)
+	c.write(false, tcpFlagSYN|tcpFlagACK, nil)
+	c.write(true, tcpFlagACK, nil)
+}
+
+// write 构造UDP或TCP的segment，TCP的SYN和FIN各占一个序号
+func (c *pcapConn) write(outgoing bool, flags uint8, payload []byte) {
+	src, dst := c.local, c.remote
+	seq, ack := &c.localSeq, &c.remoteSeq
+	if !outgoing {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+
+	var segment []byte
+	protocol := uint8(protocolUDP)
+	if c.tcp {
+		protocol = protocolTCP
+		segment = make([]byte, 20, 20+len(payload))
+		binary.BigEndian.PutUint16(segment[0:], src.Port())
+		binary.BigEndian.PutUint16(segment[2:], dst.Port())
+		binary.BigEndian.PutUint32(segment[4:], *seq)
+		if flags&tcpFlagACK != 0 {
+			binary.BigEndian.PutUint32(segment[8:], *ack)
+		}
+		segment[12] = 5 << 4 // data offset
+		segment[13] = flags
+		binary.BigEndian.PutUint16(segment[14:], 65535) // window
+		segment = append(segment, payload...)
+
+		*seq += uint32(len(payload))
+		if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+			*seq += 1
+		}
+	} else {
+		segment = make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(segment[0:], src.Port())
+		binary.BigEndian.PutUint16(segment[2:], dst.Port())
+		binary.BigEndian.PutUint16(segment[4:], uint16(8+len(payload)))
+		segment = append(segment, payload...)
+	}
+
+	// 校验和覆盖伪首部
+	pseudo := src.Addr().AsSlice()
+	pseudo = append(pseudo, dst.Addr().AsSlice()...)
+	pseudo = append(pseudo, 0, protocol)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	sum := checksum(segment, checksum(pseudo, 0)^0xffff)
+	if protocol == protocolUDP {
+		if sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(segment[6:], sum)
+	} else {
+		binary.BigEndian.PutUint16(segment[16:], sum)
+	}
+
+	c.writer.writeFrame(time.Now(), src.Addr(), dst.Addr(), protocol, segment, outgoing)
+}
+
+// checksum 反码求和，initial为之前部分的和(未取反)
+func checksum(data []byte, initial uint16) uint16 {
+	sum := uint32(initial)
+	for idx := 0; idx+1 < len(data); idx += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[idx:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"go.uber.org/zap"
+)
+
+var probeResolversUsage = `Usage: %s probe-resolvers [options]
+Check the capabilities of name servers: ECS, TCP, EDNS version, DNSSEC DO, NSID, cookies.
+Queries a geo-steered name with different client subnets and checks whether the ECS option
+is echoed, whether the scope prefix is non-zero and whether the answers vary.
+Options:
+	--ns_file <name server file>
+	-ns <name server, repeatable>
+	--name <geo-steered test domain name, default www.google.com>
+	-t <RR type of test queries, default A>
+	--subnet <client subnet of ECS test queries, repeatable>
+	--log_level <zap log level>
+`
+
+// 不同国家和运营商的client subnet，用于检查answer是否随subnet变化
+var defaultProbeSubnets = []string{
+	"1.0.1.0/24",     // 中国 福建省 电信
+	"36.134.70.0/24", // 中国 福建省 移动
+	"1.0.0.0/24",     // 澳大利亚
+	"4.0.0.0/24",     // 美国
+	"2.16.0.0/24",    // 欧洲
+}
+
+// resolverCapability 一个nameserver的探测结果，每一项为展示的字符串
+type resolverCapability struct {
+	ns     configs.DNS
+	ecs    string // 响应中是否带回ECS option
+	scope  string // 响应中最大的scope prefix
+	vary   string // 不同subnet的answer是否不同
+	tcp    string
+	edns   string
+	do     string
+	nsid   string
+	cookie string
+}
+
+func probeResolversMain(args []string) {
+	flagSet := flag.NewFlagSet("probe-resolvers", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Printf(probeResolversUsage, os.Args[0])
+	}
+	nsFile := flagSet.String("ns_file", "", "name server file")
+	var nsAddrs, subnets stringList
+	flagSet.Var(&nsAddrs, "ns", "name server")
+	flagSet.Var(&subnets, "subnet", "client subnet")
+	name := flagSet.String("name", "www.google.com", "geo-steered test domain name")
+	qTypeName := flagSet.String("t", "A", "RR type of test queries")
+	level := flagSet.Int("log_level", 0, "zap log level, default info")
+	flagSet.Parse(args)
+
+	initLogger(*level, "stderr")
+	defer logger.Sync()
+
+	qType, err := dnsMsg.ParseType(*qTypeName)
+	if err != nil {
+		logger.Fatal("invalid -t", zap.Error(err))
+	}
+
+	var nsList []configs.DNS
+	if *nsFile != "" {
+		nsList = parseNameServerFile(*nsFile)
+	}
+
+	for _, addr := range nsAddrs {
+		ns, err := configs.ParseNameserver(addr)
+		if err != nil {
+			logger.Fatal("invalid -ns", zap.Error(err))
+		}
+		nsList = append(nsList, ns)
+	}
+
+	if len(nsList) == 0 {
+		logger.Error("[WARN] please input name servers")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	if len(subnets) == 0 {
+		subnets = defaultProbeSubnets
+	}
+
+	var rows [][]string
+	for _, ns := range nsList {
+		capability := probeResolver(ns, *name, qType, subnets)
+		rows = append(rows, []string{
+			ns.Address(), ns.Desc, capability.ecs, capability.scope, capability.vary,
+			capability.tcp, capability.edns, capability.do, capability.nsid, capability.cookie,
+		})
+	}
+
+	printTable([]string{"Nameserver", "Desc", "ECS", "Scope", "Vary", "TCP", "EDNS", "DO", "NSID", "Cookie"}, rows)
+}
+
+// probeResolver 依次发送ECS、TCP和EDNS特性的测试查询，某一项失败不影响其他项
+func probeResolver(ns configs.DNS, name string, qType uint16, subnets []string) resolverCapability {
+	capability := resolverCapability{ns: ns}
+
+	// ECS: 每个subnet查询一次
+	echoed := 0
+	maxScope := -1
+	answerSets := make(map[string]bool)
+	for _, subnet := range subnets {
+		msg, err := probeQuery(ns, ns.Network(), makeDNSQuery(name, qType, subnet, queryOptions{}))
+		if err != nil {
+			logger.Warn("ECS probe failed", zap.String("nameserver", ns.Address()), zap.String("subnet", subnet), zap.Error(err))
+			continue
+		}
+
+		var answers []string
+		for idx := range msg.Answers {
+			if msg.Answers[idx].Type == qType {
+				answers = append(answers, msg.RDataString(&msg.Answers[idx]))
+			}
+		}
+		sort.Strings(answers)
+		answerSets[strings.Join(answers, ",")] = true
+
+		edns, ok := msg.EDNS()
+		if !ok {
+			continue
+		}
+
+		data, ok := edns.Option(dnsMsg.OptionClientSubnet)
+		if !ok {
+			continue
+		}
+
+		clientSubnet, err := dnsMsg.ParseClientSubnet(data)
+		if err != nil {
+			logger.Warn("invalid ECS option in response", zap.String("nameserver", ns.Address()), zap.Error(err))
+			continue
+		}
+
+		echoed += 1
+		if int(clientSubnet.ScopePrefix) > maxScope {
+			maxScope = int(clientSubnet.ScopePrefix)
+		}
+	}
+
+	capability.ecs = fmt.Sprintf("%d/%d", echoed, len(subnets))
+	capability.scope = "-"
+	if maxScope >= 0 {
+		capability.scope = strconv.Itoa(maxScope)
+	}
+
+	capability.vary = "error"
+	if len(answerSets) > 0 {
+		capability.vary = fmt.Sprintf("%d sets", len(answerSets))
+	}
+
+	// TCP
+	capability.tcp = "yes"
+	if _, err := probeQuery(ns, configs.ProtocolTCP, makeDNSQuery(name, qType, "", queryOptions{})); err != nil {
+		logger.Debug("TCP probe failed", zap.String("nameserver", ns.Address()), zap.Error(err))
+		capability.tcp = "no"
+	}
+
+	// EDNS: 同时请求DO、NSID和cookie
+	clientCookie := make([]byte, 8)
+	rand.Read(clientCookie)
+	query := makeDNSQuery(name, qType, "", queryOptions{DNSSEC: true, NSID: true, Cookie: clientCookie})
+
+	capability.edns, capability.do, capability.nsid, capability.cookie = "error", "error", "error", "error"
+	msg, err := probeQuery(ns, ns.Network(), query)
+	if err != nil {
+		logger.Warn("EDNS probe failed", zap.String("nameserver", ns.Address()), zap.Error(err))
+		return capability
+	}
+
+	edns, ok := msg.EDNS()
+	if !ok {
+		capability.edns, capability.do, capability.nsid, capability.cookie = "no", "no", "no", "no"
+		return capability
+	}
+
+	capability.edns = fmt.Sprintf("%d (udp %d)", edns.Version, edns.UDPSize)
+
+	capability.do = "no"
+	if edns.DO {
+		capability.do = "yes"
+	}
+
+	capability.nsid = "no"
+	if nsid, ok := edns.Option(dnsMsg.OptionNSID); ok {
+		capability.nsid = printableNSID(nsid)
+	}
+
+	// 服务端支持cookie时会在client cookie后面带上8-32字节的server cookie
+	capability.cookie = "no"
+	if cookie, ok := edns.Option(dnsMsg.OptionCookie); ok {
+		if len(cookie) >= 16 && string(cookie[0:8]) == string(clientCookie) {
+			capability.cookie = "yes"
+		} else {
+			capability.cookie = "invalid"
+		}
+	}
+
+	return capability
+}
+
+func probeQuery(ns configs.DNS, network string, query []byte) (*dnsMsg.Message, error) {
+	conn, err := dial(ns, network)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	response, err := conn.exchange(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return dnsMsg.ParseMessage(response)
+}
+
+// printableNSID NSID一般是可读的主机名，否则以16进制展示
+func printableNSID(nsid []byte) string {
+	if len(nsid) == 0 {
+		return "empty"
+	}
+
+	for _, r := range string(nsid) {
+		if !unicode.IsPrint(r) {
+			return fmt.Sprintf("%x", nsid)
+		}
+	}
+
+	return string(nsid)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/walkerdu/super-dig/configs"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+	"go.uber.org/zap"
+)
+
+var regionsUsage = `Usage: %s regions build [options] <ip range file>...
+Build client subnet list ([]configs.IPRegion JSON) from ip2region style range files:
+	startIP|endIP|country|region|province|city|isp
+Options:
+	--rules <sampling rules JSON file, default: each province's big three ISPs in China, each country abroad>
+	-o <output file, default stdout>
+	--log_level <zap log level>
+`
+
+func regionsMain(args []string) {
+	if len(args) == 0 || args[0] != "build" {
+		fmt.Printf(regionsUsage, os.Args[0])
+		os.Exit(1)
+	}
+
+	flagSet := flag.NewFlagSet("regions build", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Printf(regionsUsage, os.Args[0])
+	}
+	rulesFile := flagSet.String("rules", "", "sampling rules file")
+	outputFile := flagSet.String("o", "", "output file")
+	level := flagSet.Int("log_level", 0, "zap log level, default info")
+	flagSet.Parse(args[1:])
+
+	// JSON结果默认输出到标准输出，日志输出到标准错误输出
+	initLogger(*level, "stderr")
+	defer logger.Sync()
+
+	if flagSet.NArg() == 0 {
+		logger.Error("[WARN] please input ip range files")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	rules := ipDB.DefaultSampleRules
+	if *rulesFile != "" {
+		rules = parseSampleRulesFile(*rulesFile)
+	}
+
+	var ranges []ipDB.Range
+	for _, file := range flagSet.Args() {
+		illegalLines := 0
+		fileRanges, err := ipDB.LoadRangeFile(file, func(lineNo int, line string, err error) {
+			illegalLines += 1
+			logger.Debug("ignore illegal line", zap.String("file", file), zap.Int("line", lineNo), zap.Error(err))
+		})
+		if err != nil {
+			logger.Fatal("load ip range file failed", zap.String("file", file), zap.Error(err))
+		}
+
+		logger.Info("load ip range file", zap.String("file", file),
+			zap.Int("ranges", len(fileRanges)), zap.Int("illegal_lines", illegalLines))
+		ranges = append(ranges, fileRanges...)
+	}
+
+	ipRegions, err := ipDB.Sample(ranges, rules)
+	if err != nil {
+		logger.Fatal("sample ip ranges failed", zap.Error(err))
+	}
+
+	var output io.Writer = os.Stdout
+	if *outputFile != "" {
+		file, err := os.Create(*outputFile)
+		if err != nil {
+			logger.Fatal("create output file failed", zap.Error(err))
+		}
+		defer file.Close()
+		output = file
+	}
+
+	if err := writeIPRegions(output, ipRegions); err != nil {
+		logger.Fatal("write ip regions failed", zap.Error(err))
+	}
+
+	logger.Info("build ip regions", zap.Int("regions", len(ipRegions)))
+}
+
+func parseSampleRulesFile(rulesFile string) []ipDB.SampleRule {
+	byteValue, err := os.ReadFile(rulesFile)
+	if err != nil {
+		logger.Fatal("parseSampleRulesFile failed", zap.Error(err))
+	}
+
+	var rules []ipDB.SampleRule
+	if err := json.Unmarshal(byteValue, &rules); err != nil {
+		logger.Fatal("parseSampleRulesFile failed", zap.Error(err))
+	}
+
+	if err := ipDB.ValidateSampleRules(rules); err != nil {
+		logger.Fatal("parseSampleRulesFile failed", zap.String("file", rulesFile), zap.Error(err))
+	}
+
+	return rules
+}
+
+// regionSubnets 按采样策略展开IPRegion中的所有client subnet
+func regionSubnets(ipRegion configs.IPRegion, defaultPolicy ipDB.SamplePolicy) []string {
+	policy := defaultPolicy
+	if ipRegion.Sample != "" {
+		var err error
+		policy, err = ipDB.ParseSamplePolicy(ipRegion.Sample)
+		if err != nil {
+			logger.Fatal("invalid ip region", zap.Any("region", ipRegion), zap.Error(err))
+		}
+	}
+
+	var subnets []string
+	for _, ip := range ipRegion.IPs {
+		ipSubnets, err := ipDB.ExpandSubnets(ip, policy)
+		if err != nil {
+			logger.Fatal("invalid ip region", zap.Any("region", ipRegion), zap.Error(err))
+		}
+
+		subnets = append(subnets, ipSubnets...)
+	}
+
+	return subnets
+}
+
+// prettyRegions 输出将要扫描的地区，以及每个地区展开后的client subnet个数，
+// 指定了域名时输出按记录类型和nameserver展开后的探测次数
+func prettyRegions(writer io.Writer, opts *scanOptions) {
+	newLineStr := strings.Repeat("-", 30)
+	fmt.Fprintf(writer, "|%s---%s---%s---%s|\n", newLineStr, newLineStr, newLineStr, newLineStr[:10])
+	fmt.Fprintf(writer, "|%-30s | %-30s | %-30s | %-10s|\n", "Country", "Province", "ISP", "Subnets")
+	fmt.Fprintf(writer, "|%s---%s---%s---%s|\n", newLineStr, newLineStr, newLineStr, newLineStr[:10])
+
+	total := 0
+	for _, ipRegion := range opts.Regions {
+		subnets := len(regionSubnets(ipRegion, opts.Sample))
+		total += subnets
+
+		fmt.Fprintf(writer, "|%-*s | %-*s | %-*s | %-10d|\n",
+			30-chineseCharCount(ipRegion.Country), ipRegion.Country,
+			30-chineseCharCount(ipRegion.Province), ipRegion.Province,
+			30-chineseCharCount(ipRegion.ISP), ipRegion.ISP, subnets)
+	}
+
+	fmt.Fprintf(writer, "|%s---%s---%s---%s|\n", newLineStr, newLineStr, newLineStr, newLineStr[:10])
+	fmt.Fprintf(writer, "%d regions, %d subnets\n", len(opts.Regions), total)
+
+	switch {
+	case len(opts.Domains) == 0:
+	case opts.Authoritative:
+		// 权威nameserver在扫描时才查找，无法提前计算
+		fmt.Fprintf(writer, "probes of %d domains depend on authoritative nameservers found at scan time\n", len(opts.Domains))
+	default:
+		fmt.Fprintf(writer, "%d probes of %d domains\n", len(buildProbes(opts)), len(opts.Domains))
+	}
+}
+
+// writeIPRegions 输出和configs/ip_region.json相同格式的JSON
+func writeIPRegions(writer io.Writer, ipRegions []configs.IPRegion) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(ipRegions)
+}
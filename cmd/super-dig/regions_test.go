@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+)
+
+func TestPrettyRegions(t *testing.T) {
+	noECS := false
+	regions := []configs.IPRegion{
+		{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0", "36.134.0.0/22"}},
+		{Country: "中国", Province: "北京市", ISP: "联通", IPs: []string{"36.135.0.0/16"}, Sample: "random:3"},
+	}
+	resolvers := []configs.DNS{
+		{Nameserver: "8.8.8.8"},
+		{Nameserver: "1.1.1.1"},
+		{Nameserver: "127.0.0.1", Port: 5353, ECS: &noECS},
+	}
+
+	tests := []struct {
+		name  string
+		opts  scanOptions
+		lines []string
+	}{
+		{"no domain", scanOptions{Regions: regions},
+			[]string{"2 regions, 8 subnets"}},
+		{"rotate resolvers", scanOptions{Domains: []string{"a.example", "b.example"}, QTypes: []uint16{dnsMsg.TypeA, dnsMsg.TypeAAAA},
+			Regions: regions, Resolvers: resolvers},
+			[]string{"2 regions, 8 subnets", "32 probes of 2 domains"}},
+		// 不支持ECS的nameserver不参与client subnet的探测
+		{"compare resolvers", scanOptions{Domains: []string{"a.example"}, QTypes: []uint16{dnsMsg.TypeA},
+			Regions: regions, Resolvers: resolvers, CompareResolvers: true},
+			[]string{"2 regions, 8 subnets", "16 probes of 1 domains"}},
+		{"authoritative", scanOptions{Domains: []string{"a.example"}, QTypes: []uint16{dnsMsg.TypeA},
+			Regions: regions, Resolvers: resolvers, Authoritative: true},
+			[]string{"2 regions, 8 subnets", "probes of 1 domains depend on authoritative nameservers found at scan time"}},
+	}
+
+	for _, test := range tests {
+		test.opts.Sample = ipDB.SamplePolicy{Mode: ipDB.SampleEvery}
+
+		var out bytes.Buffer
+		prettyRegions(&out, &test.opts)
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 6+len(test.lines) {
+			t.Errorf("%s: output\n%s", test.name, out.String())
+			continue
+		}
+		if !strings.Contains(lines[3], "广东省") || !strings.HasSuffix(lines[3], "| 5         |") ||
+			!strings.Contains(lines[4], "北京市") || !strings.HasSuffix(lines[4], "| 3         |") {
+			t.Errorf("%s: region lines\n%s\n%s", test.name, lines[3], lines[4])
+		}
+
+		for idx, line := range test.lines {
+			if lines[6+idx] != line {
+				t.Errorf("%s: line %q, want %q", test.name, lines[6+idx], line)
+			}
+		}
+	}
+}
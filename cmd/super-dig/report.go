@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"go.uber.org/zap"
+)
+
+// scanReport json格式的扫描结果
+type scanReport struct {
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Probes   []probeRecord `json:"probes"`
+
+	// --annotate-answers时应答中每个IP的归属地
+	Addresses map[string]*addressInfo `json:"addresses,omitempty"`
+
+	// --steering时每个域名的调度质量
+	Steering []steeringSummary `json:"steering,omitempty"`
+}
+
+func writeReport(opts *scanOptions, report *scanReport) {
+	for _, output := range opts.Outputs {
+		switch output {
+		case outputTable:
+			prettyReport(opts, report)
+		case outputJSON:
+			var writer io.Writer = os.Stdout
+			if opts.OutputFile != "" {
+				file, err := os.Create(opts.OutputFile)
+				if err != nil {
+					logger.Fatal("create output file failed", zap.Error(err))
+				}
+				defer file.Close()
+				writer = file
+			}
+
+			encoder := json.NewEncoder(writer)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "    ")
+			if err := encoder.Encode(report); err != nil {
+				logger.Fatal("write json report failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// prettyReport 每个域名的每种记录类型输出一个表格，失败的探测不参与汇总，对比模式下标记为(error)
+func prettyReport(opts *scanOptions, report *scanReport) {
+	results := report.Probes
+	if report.Addresses != nil {
+		results = annotateRecords(results, report.Addresses)
+	}
+
+	for _, domain := range opts.Domains {
+		for _, qType := range opts.QTypes {
+			var records []probeRecord
+			for _, record := range results {
+				if record.Domain == domain && record.QType == dnsMsg.TypeString(qType) && (record.Error == "" || opts.CompareResolvers) {
+					records = append(records, record)
+				}
+			}
+
+			if len(opts.Domains) > 1 || len(opts.QTypes) > 1 {
+				fmt.Printf("\n%s %s\n", domain, dnsMsg.TypeString(qType))
+			}
+			if opts.CompareResolvers {
+				prettyComparison(opts, records, domain, qType)
+			} else {
+				prettyStatistic(aggregateResults(records), dnsMsg.TypeString(qType))
+			}
+
+			if opts.DNSSEC {
+				prettyDNSSEC(records)
+			}
+		}
+	}
+
+	if report.Steering != nil {
+		prettySteering(report.Steering, report.Addresses)
+	}
+}
+
+// prettyDNSSEC 输出每个subnet的DNSSEC验证结果
+func prettyDNSSEC(records []probeRecord) {
+	var rows [][]string
+	for _, record := range records {
+		status := record.DNSSEC
+		if record.Error != "" {
+			status = "(error)"
+		}
+
+		rows = append(rows, []string{record.Country, record.Province, record.ISP, record.Subnet, record.Nameserver,
+			status, record.DNSSECReason})
+	}
+
+	printTable([]string{"Country", "Province", "ISP", "Subnet", "Nameserver", "DNSSEC", "Reason"}, rows)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+	"go.uber.org/zap"
+)
+
+// 每50个请求切换一下nameserver
+const nsSwitchInterval = 50
+
+// scanOptions 一次扫描的参数，由配置文件和命令行参数合并得到
+type scanOptions struct {
+	Domains          []string
+	QTypes           []uint16
+	Resolvers        []configs.DNS
+	Regions          []configs.IPRegion
+	Sample           ipDB.SamplePolicy
+	Concurrency      int
+	Outputs          []string
+	OutputFile       string
+	CompareResolvers bool                     // 每个subnet都向所有的nameserver查询，对比不同nameserver的结果
+	Authoritative    bool                     // 直接查询权威nameserver，Resolvers只用于查找权威nameserver
+	DomainResolvers  map[string][]configs.DNS // --authoritative时每个域名的权威nameserver
+	DNSSEC           bool                     // 设置DO并验证answer
+	TrustAnchors     []*dnsMsg.DS
+	AnnotateAnswers  bool              // 查询应答中的IP所在的地区
+	AnnotatePTR      bool              // 反向解析应答中的IP
+	AnswerDB         *ipDB.DB          // 所有地区数据(过滤前)的IP段
+	Steering         bool              // 分析应答IP和客户端地区的匹配程度，需要AnnotateAnswers
+	History          string            // 记录扫描结果的数据库文件
+	Alerts           *alertConfig      // 扫描结束后检查的告警规则
+	Progress         func(probeRecord) // 每完成一个探测的回调，会被多个worker并发调用
+	Recorder         *captureWriter    // --record，记录每次查询的原始报文
+	Replay           []capture         // --replay，不访问网络，用记录的报文代替查询
+	PCAP             *pcapWriter       // --pcap，把收发的报文写入pcap文件
+}
+
+// resolversFor 返回探测domain使用的nameserver
+func (opts *scanOptions) resolversFor(domain string) []configs.DNS {
+	if resolvers, ok := opts.DomainResolvers[domain]; ok {
+		return resolvers
+	}
+
+	return opts.Resolvers
+}
+
+// probe 一次探测: 向nameserver查询domain在client subnet下的qType记录
+type probe struct {
+	domain string
+	qType  uint16
+	subnet string
+	region *configs.IPRegion
+	ns     configs.DNS
+	query  queryOptions
+}
+
+// buildProbes 展开所有的探测，nameserver按探测的顺序轮换，保证resume前后同一个探测使用的nameserver不变
+// 带client subnet的探测只使用支持ECS的nameserver，CompareResolvers时每个subnet向所有nameserver各探测一次
+func buildProbes(opts *scanOptions) []probe {
+	// 权威nameserver不需要递归
+	// 验证DNSSEC时设置CD，递归nameserver验证失败时也返回结果，由我们自己判断bogus
+	query := queryOptions{NoRecursion: opts.Authoritative, DNSSEC: opts.DNSSEC, CheckingDisabled: opts.DNSSEC}
+
+	var probes []probe
+	for _, domain := range opts.Domains {
+		allResolvers := opts.resolversFor(domain)
+		ecsResolvers := ecsCapable(allResolvers)
+		for _, qType := range opts.QTypes {
+			for idx := range opts.Regions {
+				ipRegion := &opts.Regions[idx]
+				for _, subnet := range regionSubnets(*ipRegion, opts.Sample) {
+					resolvers := allResolvers
+					if subnet != "" {
+						resolvers = ecsResolvers
+					}
+
+					if !opts.CompareResolvers {
+						resolvers = resolvers[(len(probes)/nsSwitchInterval)%len(resolvers):][0:1]
+					}
+
+					for _, ns := range resolvers {
+						probes = append(probes, probe{
+							domain: domain,
+							qType:  qType,
+							subnet: subnet,
+							region: ipRegion,
+							ns:     ns,
+							query:  query,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return probes
+}
+
+func ecsCapable(resolvers []configs.DNS) []configs.DNS {
+	var capable []configs.DNS
+	for _, ns := range resolvers {
+		if ns.SupportECS() {
+			capable = append(capable, ns)
+		}
+	}
+
+	return capable
+}
+
+// runScan 并发执行所有未完成的探测，返回checkpoint中已完成的和本次的探测结果
+func runScan(opts *scanOptions, ckpt *checkpoint) []probeRecord {
+	// 之前已完成的探测结果和本次的结果合并输出
+	results := ckpt.finished()
+
+	var pending []probe
+	for _, p := range buildProbes(opts) {
+		if !ckpt.isDone(p.domain, dnsMsg.TypeString(p.qType), p.subnet, p.ns.Key()) {
+			pending = append(pending, p)
+		}
+	}
+
+	logger.Info("start scan", zap.Int("probes", len(pending)), zap.Int("finished", len(results)),
+		zap.Int("concurrency", opts.Concurrency))
+
+	var validator *dnssecValidator
+	if opts.DNSSEC {
+		validator = newDNSSECValidator(opts.Resolvers, opts.TrustAnchors)
+	}
+
+	records := make([]probeRecord, len(pending))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < opts.Concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// 每个worker到每个nameserver各自一个连接
+			conns := make(map[string]*dnsConn)
+			defer func() {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}()
+
+			for idx := range jobs {
+				records[idx] = runProbe(&pending[idx], conns, validator, opts.Recorder, opts.PCAP)
+				if records[idx].Error == "" {
+					ckpt.save(records[idx])
+				}
+				if opts.Progress != nil {
+					opts.Progress(records[idx])
+				}
+
+				// 控制频率
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+	}
+
+	for idx := range pending {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	failed := 0
+	for _, record := range records {
+		if record.Error != "" {
+			failed += 1
+		}
+	}
+
+	if failed > 0 {
+		logger.Warn("some probes failed, use --checkpoint and --resume to retry them", zap.Int("failed", failed))
+	}
+
+	return append(results, records...)
+}
+
+func runProbe(p *probe, conns map[string]*dnsConn, validator *dnssecValidator, recorder *captureWriter,
+	pcap *pcapWriter) probeRecord {
+	record := probeRecord{
+		Domain:     p.domain,
+		QType:      dnsMsg.TypeString(p.qType),
+		Subnet:     p.subnet,
+		Nameserver: p.ns.Address(),
+		Protocol:   p.ns.Network(),
+		Country:    p.region.Country,
+		Province:   p.region.Province,
+		ISP:        p.region.ISP,
+	}
+
+	// 同一host:port的UDP和TCP nameserver使用各自的连接
+	conn, ok := conns[p.ns.Key()]
+	if !ok {
+		var err error
+		conn, err = dialNameserver(p.ns)
+		if err != nil {
+			logger.Warn("Error creating connection", zap.String("nameserver", p.ns.Address()), zap.Error(err))
+			record.Error = err.Error()
+			record.Time = time.Now()
+			return record
+		}
+
+		conn.pcap = newPcapConn(pcap, conn.conn)
+		conns[p.ns.Key()] = conn
+		logger.Debug("switch to DNS", zap.String("nameserver", p.ns.Address()), zap.String("protocol", p.ns.Network()))
+	}
+
+	// Construct DNS query
+	query := makeDNSQuery(p.domain, p.qType, p.subnet, p.query)
+
+	sent := time.Now()
+	response, err := conn.exchange(query)
+	record.Time = time.Now()
+	record.LatencyMS = float64(record.Time.Sub(sent).Microseconds()) / 1000
+	recorder.write(newCapture(&record, p.ns, query, response, err))
+	if err != nil {
+		logger.Warn("Error exchanging DNS query", zap.String("nameserver", p.ns.Address()),
+			zap.String("domain", p.domain), zap.String("subnet", p.subnet), zap.Error(err))
+		record.Error = err.Error()
+
+		// 连接可能已经不可用，下次重新建立
+		conn.Close()
+		delete(conns, p.ns.Key())
+		return record
+	}
+
+	// Process DNS response
+	parseProbeResponse(&record, p.qType, response, validator)
+	if record.Error != "" {
+		logger.Warn("Error parsing DNS response", zap.String("nameserver", p.ns.Address()),
+			zap.String("domain", p.domain), zap.String("subnet", p.subnet), zap.String("error", record.Error))
+	}
+
+	return record
+}
+
+// parseProbeResponse 从响应中解析answer、rcode、CNAME链和TTL，扫描和--replay共用
+func parseProbeResponse(record *probeRecord, qType uint16, response []byte, validator *dnssecValidator) {
+	var err error
+	record.Answers, err = parseDNSResponse(response, qType)
+	if err != nil {
+		record.Error = err.Error()
+		return
+	}
+
+	msg, _ := dnsMsg.ParseMessage(response)
+	record.RCode = dnsMsg.RCodeString(msg.RCode())
+	for idx := range msg.Answers {
+		rr := &msg.Answers[idx]
+		if rr.Type == dnsMsg.TypeCNAME && qType != dnsMsg.TypeCNAME {
+			record.CNAMEs = append(record.CNAMEs, msg.RDataString(rr))
+		}
+		if idx == 0 || rr.TTL < record.TTL {
+			record.TTL = rr.TTL
+		}
+	}
+
+	if validator != nil {
+		record.DNSSEC, record.DNSSECReason = validator.validate(msg, record.Domain, qType)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+)
+
+// testOptions 用dnstest的server作为UDP和TCP两个nameserver，每个subnet向两个nameserver各查询一次
+func testOptions(t *testing.T, server *dnstest.Server, regions []configs.IPRegion) *scanOptions {
+	t.Helper()
+
+	sample, err := ipDB.ParseSamplePolicy(ipDB.SampleFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &scanOptions{
+		Domains: []string{"www.example.com"},
+		QTypes:  []uint16{dnsMsg.TypeA},
+		Resolvers: []configs.DNS{
+			{Nameserver: "127.0.0.1", Port: server.Port(), Protocol: configs.ProtocolUDP, Timeout: "1s"},
+			{Nameserver: "127.0.0.1", Port: server.Port(), Protocol: configs.ProtocolTCP, Timeout: "1s"},
+		},
+		Regions:          regions,
+		Sample:           sample,
+		Concurrency:      2,
+		CompareResolvers: true,
+	}
+}
+
+func TestScanGeoDNS(t *testing.T) {
+	geo, err := dnstest.NewGeoDNS("www.example.com", map[string][]string{
+		"1.0.1.0/24":       {"10.0.1.1", "10.0.1.2"},
+		"36.134.0.0/16":    {"10.0.2.1"},
+		dnstest.GeoDefault: {"10.0.9.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo.CNAME = "www.example.com.cdn.example.net"
+	geo.TTL = 120
+
+	server, err := dnstest.NewServer(geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+		{Country: "中国", Province: "福建省", ISP: "移动", IPs: []string{"36.134.70.0/24"}},
+		{Country: "美国", Province: "0", ISP: "0", IPs: []string{"8.8.8.0/24"}},
+	})
+	// 一个worker依次查询两个nameserver，两者不能共用连接
+	opts.Concurrency = 1
+
+	report := scan(opts, nil)
+	if len(report.Probes) != 6 {
+		t.Fatalf("%d probes, want 6", len(report.Probes))
+	}
+
+	want := map[string]string{
+		"电信": "[10.0.1.1 10.0.1.2]",
+		"移动": "[10.0.2.1]",
+		"0":  "[10.0.9.9]",
+	}
+	for _, record := range report.Probes {
+		if record.Error != "" {
+			t.Fatalf("%s %s: %s", record.Subnet, record.Nameserver, record.Error)
+		}
+
+		answers := append([]string(nil), record.Answers...)
+		sort.Strings(answers)
+		if got := fmt.Sprint(answers); got != want[record.ISP] {
+			t.Errorf("%s %s: answers %s, want %s", record.Subnet, record.Nameserver, got, want[record.ISP])
+		}
+
+		if record.RCode != "NOERROR" || record.TTL != 120 ||
+			fmt.Sprint(record.CNAMEs) != "[www.example.com.cdn.example.net]" {
+			t.Errorf("%s %s: rcode %s, ttl %d, cnames %v", record.Subnet, record.Nameserver, record.RCode,
+				record.TTL, record.CNAMEs)
+		}
+	}
+
+	aggregated := aggregateResults(report.Probes)
+	if len(aggregated) != 3 {
+		t.Errorf("%d answer sets, want 3", len(aggregated))
+	}
+	if country := aggregated["10.0.1.1"+answerSeparator+"10.0.1.2"]["电信"]["福建省"]; country != "中国" {
+		t.Errorf("aggregated 10.0.1.1: %v", aggregated)
+	}
+	// 没有省份的地区按国家汇总
+	if country := aggregated["10.0.9.9"]["0"]["美国"]; country != "美国" {
+		t.Errorf("aggregated 10.0.9.9: %v", aggregated)
+	}
+
+	// 同一host:port的UDP和TCP nameserver各自使用自己的协议
+	if udp, tcp := server.NetworkQueries("udp"), server.NetworkQueries("tcp"); udp != 3 || tcp != 3 {
+		t.Errorf("server received %d udp and %d tcp queries, want 3 and 3", udp, tcp)
+	}
+}
+
+func TestScanTruncatedAndNXDOMAIN(t *testing.T) {
+	server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+		if req.Name != "www.example.com" {
+			return &dnstest.Response{RCode: dnsMsg.RCodeNameError}
+		}
+
+		// 超过UDP payload size，UDP的nameserver需要通过TCP重试
+		resp := &dnstest.Response{}
+		for idx := 0; idx < 300; idx++ {
+			resp.Answers = append(resp.Answers, dnstest.A(req.Name, 60, fmt.Sprintf("10.%d.%d.1", idx/256, idx%256)))
+		}
+		return resp
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+	})
+	opts.Domains = append(opts.Domains, "nx.example.com")
+
+	records := scan(opts, nil).Probes
+	if len(records) != 4 {
+		t.Fatalf("%d probes, want 4", len(records))
+	}
+	for _, record := range records {
+		if record.Error != "" {
+			t.Fatalf("%s %s: %s", record.Domain, record.Nameserver, record.Error)
+		}
+
+		switch record.Domain {
+		case "www.example.com":
+			if len(record.Answers) != 300 {
+				t.Errorf("%s: %d answers, want 300", record.Nameserver, len(record.Answers))
+			}
+		case "nx.example.com":
+			if record.RCode != "NXDOMAIN" || len(record.Answers) != 0 {
+				t.Errorf("%s: rcode %s, answers %v", record.Nameserver, record.RCode, record.Answers)
+			}
+		}
+	}
+
+	// UDP nameserver: www被截断后通过TCP重试，nx只需要UDP；TCP nameserver两次都是TCP
+	if udp, tcp := server.NetworkQueries("udp"), server.NetworkQueries("tcp"); udp != 2 || tcp != 3 {
+		t.Errorf("server received %d udp and %d tcp queries, want 2 and 3", udp, tcp)
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+	})
+	opts.Resolvers = opts.Resolvers[:1]
+	opts.Resolvers[0].Timeout = "100ms"
+
+	records := scan(opts, nil).Probes
+	if len(records) != 1 || records[0].Error == "" {
+		t.Errorf("probes %+v, want one failed probe", records)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	geo, err := dnstest.NewGeoDNS("www.example.com", map[string][]string{
+		"1.0.1.0/24":       {"10.0.1.1", "2001:db8::1"},
+		dnstest.GeoDefault: {"10.0.9.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := dnstest.NewServer(geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+		{Country: "美国", Province: "0", ISP: "0", IPs: []string{"8.8.8.0/24"}},
+	})
+	opts.QTypes = []uint16{dnsMsg.TypeA, dnsMsg.TypeAAAA}
+	opts.Domains = append(opts.Domains, "nx.example.com")
+
+	path := filepath.Join(t.TempDir(), "record.jsonl")
+	if opts.Recorder, err = openCaptureWriter(path); err != nil {
+		t.Fatal(err)
+	}
+	scanned := scan(opts, nil).Probes
+	opts.Recorder.close()
+
+	// 回放时不访问网络
+	server.Close()
+	replay := &scanOptions{Domains: []string{"www.example.com"}}
+	if replay.Replay, err = loadCaptures(path); err != nil {
+		t.Fatal(err)
+	}
+	replayScope(replay)
+	if fmt.Sprint(replay.Domains, replay.QTypes) != "[www.example.com] [1 28]" {
+		t.Errorf("replay scope %v %v", replay.Domains, replay.QTypes)
+	}
+	replayed := scan(replay, nil).Probes
+
+	var want []probeRecord
+	for _, record := range scanned {
+		if record.Domain == "www.example.com" {
+			want = append(want, record)
+		}
+	}
+
+	// recordKey包含协议，UDP和TCP nameserver的结果不会并列，再按时间保证顺序确定
+	less := func(records []probeRecord) func(i, j int) bool {
+		return func(i, j int) bool {
+			left, right := recordKey(&records[i]), recordKey(&records[j])
+			if left != right {
+				return left < right
+			}
+			return records[i].Time.Before(records[j].Time)
+		}
+	}
+	sort.SliceStable(want, less(want))
+	sort.SliceStable(replayed, less(replayed))
+	for idx := range want {
+		want[idx].Time = want[idx].Time.UTC()
+	}
+	for idx := range replayed {
+		replayed[idx].Time = replayed[idx].Time.UTC()
+	}
+
+	keys := make(map[string]bool)
+	for idx := range replayed {
+		keys[recordKey(&replayed[idx])] = true
+	}
+	if len(keys) != len(replayed) {
+		t.Errorf("%d distinct keys of %d replayed probes", len(keys), len(replayed))
+	}
+
+	if len(want) != 8 || !reflect.DeepEqual(want, replayed) {
+		t.Errorf("replayed probes differ from scanned\nscanned:  %+v\nreplayed: %+v", want, replayed)
+	}
+}
+
+func TestPcap(t *testing.T) {
+	server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+		resp := &dnstest.Response{}
+		for idx := 0; idx < 300; idx++ {
+			resp.Answers = append(resp.Answers, dnstest.A(req.Name, 60, fmt.Sprintf("10.%d.%d.1", idx/256, idx%256)))
+		}
+		return resp
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+	})
+	opts.Resolvers = opts.Resolvers[:1]
+
+	path := filepath.Join(t.TempDir(), "scan.pcap")
+	if opts.PCAP, err = openPcapWriter(path); err != nil {
+		t.Fatal(err)
+	}
+	records := scan(opts, nil).Probes
+	opts.PCAP.close()
+	if len(records) != 1 || len(records[0].Answers) != 300 {
+		t.Fatalf("probes %+v, want 300 answers", records)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != pcapMagic {
+		t.Fatalf("invalid pcap header % x", data[:24])
+	}
+
+	// UDP的应答被截断，通过TCP重试: UDP查询和应答，TCP三次握手、查询、应答和FIN
+	var frames []string
+	for offset := 24; offset < len(data); {
+		length := int(binary.LittleEndian.Uint32(data[offset+8:]))
+		frame := data[offset+16 : offset+16+length]
+		offset += 16 + length
+
+		if binary.BigEndian.Uint16(frame[12:]) != etherTypeIPv4 || checksum(frame[14:34], 0) != 0 ||
+			int(binary.BigEndian.Uint16(frame[16:])) != len(frame)-14 {
+			t.Fatalf("invalid ipv4 header % x", frame[14:34])
+		}
+		segment := frame[34:]
+		if frame[23] == protocolUDP {
+			frames = append(frames, fmt.Sprintf("udp:%d", len(segment)-8))
+		} else {
+			frames = append(frames, fmt.Sprintf("tcp:%02x:%d", segment[13], len(segment)-20))
+		}
+	}
+
+	// 9357字节的TCP应答按MSS分成7个segment
+	want := "[udp:55 udp:55 tcp:02:0 tcp:12:0 tcp:10:0 tcp:18:57 " + strings.Repeat("tcp:10:1460 ", 6) +
+		"tcp:18:597 tcp:11:0 tcp:11:0 tcp:10:0]"
+	if got := fmt.Sprint(frames); got != want {
+		t.Errorf("frames %s, want %s", got, want)
+	}
+}
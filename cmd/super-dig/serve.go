@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	ipDB "github.com/walkerdu/super-dig/pkg/ip_db"
+	"go.uber.org/zap"
+)
+
+/*
+   serve子命令的HTTP API，扫描参数的默认值来自命令行和配置文件:
+
+   POST /scans              提交扫描，返回{"id": "..."}
+   GET  /scans              所有扫描的状态
+   GET  /scans/{id}         扫描的状态，完成后带有和--format json相同的结果
+   GET  /scans/{id}/events  按JSON行流式输出每个完成的探测，扫描结束后关闭
+   GET  /metrics            Prometheus指标，见scanMetrics
+*/
+
+const (
+	scanRunning  = "running"
+	scanFinished = "finished"
+
+	maxScanJobs        = 100 // 内存中最多保留的扫描，超过时删除最早完成的，都没有完成时拒绝新的扫描
+	maxScanConcurrency = 64
+)
+
+// scanRequest POST /scans的请求，为空的字段使用serve的默认值
+type scanRequest struct {
+	Domains          []string          `json:"domains"`
+	QTypes           []string          `json:"qtypes"`
+	Resolvers        []configs.DNS     `json:"resolvers"`
+	Filter           ipDB.RegionFilter `json:"filter"`
+	Concurrency      int               `json:"concurrency"`
+	CompareResolvers bool              `json:"compare_resolvers"`
+	AnnotateAnswers  bool              `json:"annotate_answers"`
+	Steering         bool              `json:"steering"`
+}
+
+// scanJob 一次通过API提交的扫描
+type scanJob struct {
+	mutex    sync.Mutex
+	id       string
+	status   string
+	created  time.Time
+	total    int
+	records  []probeRecord
+	report   *scanReport
+	progress chan struct{} // 每完成一个探测关闭并替换，通知所有/events的连接
+}
+
+// scanStatus GET /scans/{id}的结果
+type scanStatus struct {
+	ID      string      `json:"id"`
+	Status  string      `json:"status"`
+	Created time.Time   `json:"created"`
+	Total   int         `json:"total"`
+	Done    int         `json:"done"`
+	Result  *scanReport `json:"result,omitempty"`
+}
+
+func (job *scanJob) finish(report *scanReport) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.status = scanFinished
+	job.report = report
+	close(job.progress)
+	job.progress = make(chan struct{})
+}
+
+func (job *scanJob) addRecord(record probeRecord) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.records = append(job.records, record)
+	close(job.progress)
+	job.progress = make(chan struct{})
+}
+
+func (job *scanJob) snapshot(withResult bool) scanStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	status := scanStatus{
+		ID:      job.id,
+		Status:  job.status,
+		Created: job.created,
+		Total:   job.total,
+		Done:    len(job.records),
+	}
+	if withResult {
+		status.Result = job.report
+	}
+
+	return status
+}
+
+type scanServer struct {
+	defaults *scanOptions
+	store    *historyStore
+	metrics  *scanMetrics
+
+	mutex sync.Mutex
+	jobs  map[string]*scanJob
+}
+
+func serveAPI(defaults *scanOptions, listen string, store *historyStore) {
+	if defaults.Authoritative {
+		logger.Fatal("--authoritative is not supported in serve mode")
+	}
+
+	server := newScanServer(defaults, store)
+
+	logger.Info("serve HTTP API", zap.String("listen", listen))
+	if err := http.ListenAndServe(listen, server.handler()); err != nil {
+		logger.Fatal("serve failed", zap.Error(err))
+	}
+}
+
+func newScanServer(defaults *scanOptions, store *historyStore) *scanServer {
+	return &scanServer{
+		defaults: defaults,
+		store:    store,
+		metrics:  newScanMetrics(),
+		jobs:     make(map[string]*scanJob),
+	}
+}
+
+func (server *scanServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scans", server.handleScans)
+	mux.HandleFunc("/scans/", server.handleScan)
+	mux.Handle("/metrics", server.metrics)
+
+	return mux
+}
+
+func (server *scanServer) handleScans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		server.createScan(w, r)
+	case http.MethodGet:
+		server.mutex.Lock()
+		var statuses []scanStatus
+		for _, job := range server.jobs {
+			statuses = append(statuses, job.snapshot(false))
+		}
+		server.mutex.Unlock()
+
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Created.Before(statuses[j].Created)
+		})
+		writeJSON(w, http.StatusOK, statuses)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleScan /scans/{id}和/scans/{id}/events
+func (server *scanServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	id, events := strings.TrimPrefix(r.URL.Path, "/scans/"), false
+	if strings.HasSuffix(id, "/events") {
+		id, events = strings.TrimSuffix(id, "/events"), true
+	}
+
+	server.mutex.Lock()
+	job, ok := server.jobs[id]
+	server.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("scan %q not found", id))
+		return
+	}
+
+	if events {
+		streamEvents(w, r, job)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job.snapshot(true))
+}
+
+func (server *scanServer) createScan(w http.ResponseWriter, r *http.Request) {
+	var request scanRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	opts, err := server.scanOptions(&request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	job := &scanJob{
+		id:       newScanID(),
+		status:   scanRunning,
+		created:  time.Now(),
+		total:    len(buildProbes(opts)),
+		progress: make(chan struct{}),
+	}
+	opts.Progress = job.addRecord
+
+	// 内存中的扫描都没有完成时拒绝新的扫描
+	server.mutex.Lock()
+	if !server.evictJobs() {
+		server.mutex.Unlock()
+		writeError(w, http.StatusTooManyRequests, fmt.Errorf("too many running scans, at most %d", maxScanJobs))
+		return
+	}
+	server.jobs[job.id] = job
+	server.mutex.Unlock()
+
+	logger.Info("scan submitted", zap.String("id", job.id), zap.Strings("domains", opts.Domains),
+		zap.Int("probes", job.total))
+
+	go func() {
+		report := scan(opts, nil)
+		saveHistory(server.store, report)
+		server.metrics.observe(report)
+		checkAlerts(opts, report, nil)
+		job.finish(report)
+		logger.Info("scan finished", zap.String("id", job.id))
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": job.id})
+}
+
+// scanOptions 在serve的默认参数上应用请求中的参数，地区在默认的地区上进一步过滤
+func (server *scanServer) scanOptions(request *scanRequest) (*scanOptions, error) {
+	opts := *server.defaults
+	opts.Outputs = nil
+	opts.OutputFile = ""
+
+	if len(request.Domains) == 0 {
+		return nil, fmt.Errorf("domains: required")
+	}
+	opts.Domains = request.Domains
+
+	if len(request.QTypes) > 0 {
+		opts.QTypes = nil
+		for _, qType := range request.QTypes {
+			rType, err := dnsMsg.ParseType(qType)
+			if err != nil {
+				return nil, fmt.Errorf("qtypes: %w", err)
+			}
+			opts.QTypes = append(opts.QTypes, rType)
+		}
+	}
+
+	if len(request.Resolvers) > 0 {
+		for idx := range request.Resolvers {
+			if err := request.Resolvers[idx].Validate(); err != nil {
+				return nil, fmt.Errorf("resolvers[%d].%w", idx, err)
+			}
+		}
+		opts.Resolvers = request.Resolvers
+	}
+
+	if err := request.Filter.Validate(); err != nil {
+		return nil, fmt.Errorf("filter.%w", err)
+	}
+	opts.Regions = request.Filter.Filter(opts.Regions)
+	if len(opts.Regions) == 0 {
+		return nil, fmt.Errorf("filter: no region matches")
+	}
+
+	hasSubnet := false
+	for _, ipRegion := range opts.Regions {
+		for _, ip := range ipRegion.IPs {
+			hasSubnet = hasSubnet || ip != ""
+		}
+	}
+	if hasSubnet && len(ecsCapable(opts.Resolvers)) == 0 {
+		return nil, fmt.Errorf("resolvers: no nameserver supports ECS")
+	}
+
+	if request.Concurrency > 0 {
+		opts.Concurrency = request.Concurrency
+		if opts.Concurrency > maxScanConcurrency {
+			opts.Concurrency = maxScanConcurrency
+		}
+	}
+
+	opts.CompareResolvers = opts.CompareResolvers || request.CompareResolvers
+	opts.Steering = opts.Steering || request.Steering
+	opts.AnnotateAnswers = opts.AnnotateAnswers || request.AnnotateAnswers || opts.Steering
+	if opts.AnnotateAnswers && opts.AnswerDB == nil {
+		return nil, fmt.Errorf("annotate_answers: serve is started without ip region file")
+	}
+
+	return &opts, nil
+}
+
+// evictJobs 达到maxScanJobs时删除最早完成的扫描，所有的扫描都没有完成时返回false，调用方持有锁
+func (server *scanServer) evictJobs() bool {
+	for len(server.jobs) >= maxScanJobs {
+		var oldest *scanJob
+		for _, job := range server.jobs {
+			if job.snapshot(false).Status == scanFinished && (oldest == nil || job.created.Before(oldest.created)) {
+				oldest = job
+			}
+		}
+
+		if oldest == nil {
+			return false
+		}
+		delete(server.jobs, oldest.id)
+	}
+
+	return true
+}
+
+// streamEvents 先输出已完成的探测，之后每完成一个输出一行，扫描结束后输出状态并关闭
+func streamEvents(w http.ResponseWriter, r *http.Request, job *scanJob) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	sent := 0
+	for {
+		job.mutex.Lock()
+		records := job.records[sent:]
+		finished := job.status == scanFinished
+		progress := job.progress
+		job.mutex.Unlock()
+
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return
+			}
+		}
+		sent += len(records)
+		flusher.Flush()
+
+		if finished {
+			encoder.Encode(job.snapshot(false))
+			return
+		}
+
+		select {
+		case <-progress:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func newScanID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
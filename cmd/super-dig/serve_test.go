@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+)
+
+func newTestScanServer(t *testing.T) *scanServer {
+	t.Helper()
+
+	geo, err := dnstest.NewGeoDNS("www.example.com", map[string][]string{
+		"1.0.1.0/24":       {"10.0.1.1"},
+		"36.134.0.0/16":    {"10.0.2.1"},
+		dnstest.GeoDefault: {"10.0.9.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns, err := dnstest.NewServer(geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dns.Close() })
+
+	return newScanServer(testOptions(t, dns, []configs.IPRegion{
+		{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+		{Country: "中国", Province: "北京市", ISP: "移动", IPs: []string{"36.134.70.0/24"}},
+		{Country: "美国", Province: "0", ISP: "0", IPs: []string{"8.8.8.0/24"}},
+	}), nil)
+}
+
+// request 调用handler，返回状态码和json解码后的结果
+func request(t *testing.T, handler http.Handler, method, path, body string, result interface{}) int {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if result != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil {
+			t.Fatalf("%s %s: %v\n%s", method, path, err, recorder.Body)
+		}
+	}
+
+	return recorder.Code
+}
+
+func TestServeValidation(t *testing.T) {
+	handler := newTestScanServer(t).handler()
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		err                string
+	}{
+		{"POST", "/scans", `{"domains": ["www.example.com"]`, http.StatusBadRequest, "invalid request"},
+		{"POST", "/scans", `{"domain": ["www.example.com"]}`, http.StatusBadRequest, `unknown field "domain"`},
+		{"POST", "/scans", `{}`, http.StatusBadRequest, "domains: required"},
+		{"POST", "/scans", `{"domains": ["www.example.com"], "qtypes": ["AAAAA"]}`, http.StatusBadRequest, "qtypes: "},
+		{"POST", "/scans", `{"domains": ["www.example.com"], "resolvers": [{"nameserver": "8.8.8.8", "port": 70000}]}`,
+			http.StatusBadRequest, "resolvers[0].port: "},
+		{"POST", "/scans", `{"domains": ["www.example.com"], "resolvers": [{"nameserver": "8.8.8.8", "ecs": false}]}`,
+			http.StatusBadRequest, "resolvers: no nameserver supports ECS"},
+		{"POST", "/scans", `{"domains": ["www.example.com"], "filter": {"provinces": ["广["]}}`, http.StatusBadRequest, "filter.provinces: "},
+		{"POST", "/scans", `{"domains": ["www.example.com"], "filter": {"countries": ["日本"]}}`, http.StatusBadRequest, "filter: no region matches"},
+		{"POST", "/scans", `{"domains": ["www.example.com"], "steering": true}`, http.StatusBadRequest, "annotate_answers: "},
+		{"DELETE", "/scans", ``, http.StatusMethodNotAllowed, "method DELETE not allowed"},
+		{"POST", "/scans/0123", ``, http.StatusMethodNotAllowed, "method POST not allowed"},
+		{"GET", "/scans/0123", ``, http.StatusNotFound, `scan "0123" not found`},
+		{"GET", "/scans/0123/events", ``, http.StatusNotFound, `scan "0123" not found`},
+	}
+
+	for _, test := range tests {
+		var result map[string]string
+		code := request(t, handler, test.method, test.path, test.body, &result)
+		if code != test.code || !strings.Contains(result["error"], test.err) {
+			t.Errorf("%s %s %s: %d %q, want %d %q", test.method, test.path, test.body, code, result["error"], test.code, test.err)
+		}
+	}
+}
+
+func TestServeScan(t *testing.T) {
+	server := newTestScanServer(t)
+	httpServer := httptest.NewServer(server.handler())
+	defer httpServer.Close()
+
+	var created map[string]string
+	code := request(t, server.handler(), "POST", "/scans", `{"domains": ["www.example.com"], "qtypes": ["A"], "concurrency": 1000}`, &created)
+	if code != http.StatusAccepted || created["id"] == "" {
+		t.Fatalf("POST /scans: %d %v", code, created)
+	}
+	id := created["id"]
+
+	// 每个探测一行，最后一行是扫描结束时的状态
+	response, err := http.Get(httpServer.URL + "/scans/" + id + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("events Content-Type %s", contentType)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 7 {
+		t.Fatalf("%d event lines, want 7:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+
+	answers := make(map[string]string)
+	for _, line := range lines[:6] {
+		var record probeRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil || record.Domain != "www.example.com" {
+			t.Fatalf("event %s: %v", line, err)
+		}
+		answers[record.Subnet+" "+record.resolver()] = strings.Join(record.Answers, ",")
+	}
+	for _, subnet := range []string{"1.0.1.0", "36.134.70.0/24", "8.8.8.0/24"} {
+		want := map[string]string{"1.0.1.0": "10.0.1.1", "36.134.70.0/24": "10.0.2.1", "8.8.8.0/24": "10.0.9.9"}[subnet]
+		for _, resolver := range server.defaults.Resolvers {
+			if answer := answers[subnet+" "+resolver.Key()]; answer != want {
+				t.Errorf("event %s %s: %s, want %s", subnet, resolver.Key(), answer, want)
+			}
+		}
+	}
+
+	var last scanStatus
+	if err := json.Unmarshal([]byte(lines[6]), &last); err != nil {
+		t.Fatalf("last event %s: %v", lines[6], err)
+	}
+	if last.ID != id || last.Status != scanFinished || last.Total != 6 || last.Done != 6 || last.Result != nil {
+		t.Errorf("last event %+v", last)
+	}
+
+	// 扫描结束后的状态带有完整的结果
+	var status scanStatus
+	if code := request(t, server.handler(), "GET", "/scans/"+id, "", &status); code != http.StatusOK {
+		t.Fatalf("GET /scans/%s: %d", id, code)
+	}
+	if status.Status != scanFinished || status.Done != 6 || status.Result == nil || len(status.Result.Probes) != 6 {
+		t.Errorf("GET /scans/%s: %+v", id, status)
+	}
+
+	// 扫描结束后连接events输出所有探测后立即关闭
+	response, err = http.Get(httpServer.URL + "/scans/" + id + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner = bufio.NewScanner(response.Body)
+	replayed := 0
+	for scanner.Scan() {
+		replayed += 1
+	}
+	response.Body.Close()
+	if replayed != 7 {
+		t.Errorf("%d event lines after the scan finished, want 7", replayed)
+	}
+
+	var statuses []scanStatus
+	if code := request(t, server.handler(), "GET", "/scans", "", &statuses); code != http.StatusOK ||
+		len(statuses) != 1 || statuses[0].ID != id || statuses[0].Result != nil {
+		t.Errorf("GET /scans: %d %+v", code, statuses)
+	}
+}
+
+func TestServeEvictJobs(t *testing.T) {
+	server := newTestScanServer(t)
+
+	created := time.Now().Add(-time.Hour)
+	for idx := 0; idx < maxScanJobs; idx++ {
+		id := fmt.Sprintf("job%03d", idx)
+		server.jobs[id] = &scanJob{id: id, status: scanRunning, created: created.Add(time.Duration(idx) * time.Second),
+			progress: make(chan struct{})}
+	}
+
+	// 所有扫描都在进行中时拒绝新的扫描
+	var result map[string]string
+	body := `{"domains": ["www.example.com"]}`
+	if code := request(t, server.handler(), "POST", "/scans", body, &result); code != http.StatusTooManyRequests {
+		t.Fatalf("POST /scans with %d running scans: %d %v", maxScanJobs, code, result)
+	}
+	if len(server.jobs) != maxScanJobs {
+		t.Errorf("%d jobs after rejected submission", len(server.jobs))
+	}
+
+	// 删除最早完成的扫描
+	server.jobs["job050"].finish(&scanReport{})
+	server.jobs["job070"].finish(&scanReport{})
+	if code := request(t, server.handler(), "POST", "/scans", body, &result); code != http.StatusAccepted {
+		t.Fatalf("POST /scans after finished: %d %v", code, result)
+	}
+	if _, ok := server.jobs["job050"]; ok || len(server.jobs) != maxScanJobs {
+		t.Errorf("job050 not evicted, %d jobs", len(server.jobs))
+	}
+	if _, ok := server.jobs["job070"]; !ok {
+		t.Error("job070 evicted")
+	}
+
+	// 等待提交的扫描结束
+	job := server.jobs[result["id"]]
+	for job.snapshot(false).Status != scanFinished {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
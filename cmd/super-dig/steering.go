@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 调度质量，按从好到差排列
+const (
+	steeringLocal       = "same-isp-same-province"
+	steeringProvince    = "same-isp-cross-province"
+	steeringCrossISP    = "cross-isp"
+	steeringCrossBorder = "cross-border"
+	steeringUnknown     = "unknown" // 应答中的IP都不在地区数据中
+)
+
+var steeringLevels = []string{steeringLocal, steeringProvince, steeringCrossISP, steeringCrossBorder, steeringUnknown}
+
+// steeringSummary 一个域名所有探测的调度质量统计
+type steeringSummary struct {
+	Domain    string           `json:"domain"`
+	Probes    int              `json:"probes"`
+	Counts    map[string]int   `json:"counts"`
+	Offending []steeringRegion `json:"offending,omitempty"` // 不是同ISP同省份的地区
+}
+
+type steeringRegion struct {
+	QType      string   `json:"qtype"`
+	Country    string   `json:"country"`
+	Province   string   `json:"province"`
+	ISP        string   `json:"isp"`
+	Subnet     string   `json:"subnet"`
+	Nameserver string   `json:"nameserver"`
+	Steering   string   `json:"steering"`
+	Answers    []string `json:"answers"`
+}
+
+// classifySteering 按应答中最差的IP评价一次探测: 客户端只要可能拿到跨网的IP就算跨网，
+// 不在地区数据中的IP不参与评价，没有可评价的IP时为unknown
+func classifySteering(record *probeRecord, addresses map[string]*addressInfo) string {
+	worst := -1
+	for _, answer := range record.Answers {
+		info, ok := addresses[answer]
+		if !ok || info.Country == "" {
+			continue
+		}
+
+		level := 0
+		switch {
+		case info.Country != record.Country:
+			level = 3
+		case info.ISP != record.ISP:
+			level = 2
+		case info.Province != record.Province:
+			level = 1
+		}
+
+		if level > worst {
+			worst = level
+		}
+	}
+
+	if worst < 0 {
+		return steeringUnknown
+	}
+
+	return steeringLevels[worst]
+}
+
+// analyzeSteering 按域名汇总每个地区拿到的IP和地区本身的匹配程度，失败和没有IP应答的探测不参与统计
+func analyzeSteering(opts *scanOptions, records []probeRecord, addresses map[string]*addressInfo) []steeringSummary {
+	var summaries []steeringSummary
+	for _, domain := range opts.Domains {
+		summary := steeringSummary{
+			Domain: domain,
+			Counts: make(map[string]int),
+		}
+
+		for idx := range records {
+			record := &records[idx]
+			if record.Domain != domain || record.Error != "" || record.Subnet == "" || !hasAddress(record, addresses) {
+				continue
+			}
+
+			steering := classifySteering(record, addresses)
+			summary.Probes += 1
+			summary.Counts[steering] += 1
+
+			if steering != steeringLocal {
+				summary.Offending = append(summary.Offending, steeringRegion{
+					QType:      record.QType,
+					Country:    record.Country,
+					Province:   record.Province,
+					ISP:        record.ISP,
+					Subnet:     record.Subnet,
+					Nameserver: record.Nameserver,
+					Steering:   steering,
+					Answers:    record.Answers,
+				})
+			}
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries
+}
+
+func hasAddress(record *probeRecord, addresses map[string]*addressInfo) bool {
+	for _, answer := range record.Answers {
+		if _, ok := addresses[answer]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prettySteering 每个域名一行各调度质量的占比，再列出所有不是同ISP同省份的地区
+func prettySteering(summaries []steeringSummary, addresses map[string]*addressInfo) {
+	headers := []string{"Domain", "Probes"}
+	headers = append(headers, steeringLevels...)
+
+	var rows [][]string
+	for _, summary := range summaries {
+		row := []string{summary.Domain, fmt.Sprint(summary.Probes)}
+		for _, level := range steeringLevels {
+			percent := 0.0
+			if summary.Probes > 0 {
+				percent = float64(summary.Counts[level]) * 100 / float64(summary.Probes)
+			}
+			row = append(row, fmt.Sprintf("%d (%.1f%%)", summary.Counts[level], percent))
+		}
+		rows = append(rows, row)
+	}
+
+	fmt.Println("\nSteering")
+	printTable(headers, rows)
+
+	var offending [][]string
+	for _, summary := range summaries {
+		for _, region := range summary.Offending {
+			var answers []string
+			for _, answer := range region.Answers {
+				if info, ok := addresses[answer]; ok {
+					answer = fmt.Sprintf("%s (%s)", answer, info)
+				}
+				answers = append(answers, answer)
+			}
+
+			offending = append(offending, []string{summary.Domain, region.QType, region.Country, region.Province,
+				region.ISP, region.Subnet, region.Steering, strings.Join(answers, ", ")})
+		}
+	}
+
+	if len(offending) > 0 {
+		printTable([]string{"Domain", "Type", "Country", "Province", "ISP", "Subnet", "Steering", "Answers"}, offending)
+	}
+}
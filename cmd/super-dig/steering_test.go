@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var steeringAddresses = map[string]*addressInfo{
+	"10.0.1.1": {Country: "中国", Province: "广东省", ISP: "电信"},
+	"10.0.1.2": {Country: "中国", Province: "广东省", ISP: "电信"},
+	"10.0.2.1": {Country: "中国", Province: "北京市", ISP: "电信"},
+	"10.0.3.1": {Country: "中国", Province: "广东省", ISP: "联通"},
+	"10.0.4.1": {Country: "中国", Province: "北京市", ISP: "联通"},
+	"10.0.5.1": {Country: "日本", Province: "东京都", ISP: "电信"},
+	"10.0.9.9": {},
+}
+
+func TestClassifySteering(t *testing.T) {
+	tests := []struct {
+		name     string
+		answers  []string
+		steering string
+	}{
+		{"same isp same province", []string{"10.0.1.1", "10.0.1.2"}, steeringLocal},
+		{"cross province", []string{"10.0.2.1"}, steeringProvince},
+		{"cross isp in same province", []string{"10.0.3.1"}, steeringCrossISP},
+		{"cross isp and province", []string{"10.0.4.1"}, steeringCrossISP},
+		{"cross border with same isp name", []string{"10.0.5.1"}, steeringCrossBorder},
+		// 最差的IP决定结果，与顺序无关
+		{"worst answer wins", []string{"10.0.1.1", "10.0.2.1", "10.0.3.1"}, steeringCrossISP},
+		{"worst answer first", []string{"10.0.5.1", "10.0.1.1"}, steeringCrossBorder},
+		{"worst answer last", []string{"10.0.1.1", "10.0.2.1", "10.0.5.1"}, steeringCrossBorder},
+		// 不在地区数据中的IP和非IP的应答不参与评价
+		{"unknown address ignored", []string{"10.0.9.9", "10.0.1.1"}, steeringLocal},
+		{"not annotated ignored", []string{"cdn.example.net", "192.0.2.1", "10.0.2.1"}, steeringProvince},
+		{"only unknown addresses", []string{"10.0.9.9", "192.0.2.1"}, steeringUnknown},
+		{"no answers", nil, steeringUnknown},
+	}
+
+	for _, test := range tests {
+		record := &probeRecord{Country: "中国", Province: "广东省", ISP: "电信", Answers: test.answers}
+		if steering := classifySteering(record, steeringAddresses); steering != test.steering {
+			t.Errorf("%s: %s, want %s", test.name, steering, test.steering)
+		}
+	}
+}
+
+func TestAnalyzeSteering(t *testing.T) {
+	gd := func(domain, subnet string, answers ...string) probeRecord {
+		return probeRecord{Domain: domain, QType: "A", Subnet: subnet, Nameserver: "8.8.8.8:53",
+			Country: "中国", Province: "广东省", ISP: "电信", Answers: answers}
+	}
+	failed := gd("a.example", "1.0.4.0/24", "10.0.5.1")
+	failed.Error = "timeout"
+
+	records := []probeRecord{
+		gd("a.example", "1.0.1.0/24", "10.0.1.1"),
+		gd("a.example", "1.0.2.0/24", "10.0.1.1", "10.0.2.1"),
+		gd("a.example", "1.0.3.0/24", "10.0.9.9"),
+		gd("a.example", "", "10.0.5.1"),              // 没有client subnet
+		gd("a.example", "1.0.5.0/24", "192.0.2.1"),   // 没有标注的IP
+		gd("a.example", "1.0.6.0/24", "cdn.example"), // 只有CNAME
+		failed,
+		gd("b.example", "1.0.1.0/24", "10.0.4.1"),
+	}
+
+	summaries := analyzeSteering(&scanOptions{Domains: []string{"a.example", "b.example", "c.example"}}, records, steeringAddresses)
+	want := []steeringSummary{
+		{Domain: "a.example", Probes: 3, Counts: map[string]int{steeringLocal: 1, steeringProvince: 1, steeringUnknown: 1},
+			Offending: []steeringRegion{
+				{QType: "A", Country: "中国", Province: "广东省", ISP: "电信", Subnet: "1.0.2.0/24", Nameserver: "8.8.8.8:53",
+					Steering: steeringProvince, Answers: []string{"10.0.1.1", "10.0.2.1"}},
+				{QType: "A", Country: "中国", Province: "广东省", ISP: "电信", Subnet: "1.0.3.0/24", Nameserver: "8.8.8.8:53",
+					Steering: steeringUnknown, Answers: []string{"10.0.9.9"}},
+			}},
+		{Domain: "b.example", Probes: 1, Counts: map[string]int{steeringCrossISP: 1},
+			Offending: []steeringRegion{
+				{QType: "A", Country: "中国", Province: "广东省", ISP: "电信", Subnet: "1.0.1.0/24", Nameserver: "8.8.8.8:53",
+					Steering: steeringCrossISP, Answers: []string{"10.0.4.1"}},
+			}},
+		{Domain: "c.example", Counts: map[string]int{}},
+	}
+
+	if !reflect.DeepEqual(summaries, want) {
+		t.Errorf("analyzeSteering =\n%+v\nwant\n%+v", summaries, want)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// displayWidth 终端中的显示宽度，中文字符占两个字符宽度
+func displayWidth(str string) int {
+	return utf8.RuneCountInString(str) + chineseCharCount(str)
+}
+
+// printTable 按照prettyStatistic的风格输出表格，列宽按每一列最长的内容计算
+func printTable(headers []string, rows [][]string) {
+	widths := make([]int, len(headers))
+	for idx, header := range headers {
+		widths[idx] = displayWidth(header)
+	}
+
+	for _, row := range rows {
+		for idx, cell := range row {
+			if width := displayWidth(cell); idx < len(widths) && width > widths[idx] {
+				widths[idx] = width
+			}
+		}
+	}
+
+	var lineParts []string
+	for _, width := range widths {
+		lineParts = append(lineParts, strings.Repeat("-", width))
+	}
+	line := "|" + strings.Join(lineParts, "---") + "|"
+
+	printRow := func(row []string) {
+		var cells []string
+		for idx, width := range widths {
+			cell := ""
+			if idx < len(row) {
+				cell = row[idx]
+			}
+			cells = append(cells, fmt.Sprintf("%-*s", width-chineseCharCount(cell), cell))
+		}
+		fmt.Printf("|%s|\n", strings.Join(cells, " | "))
+	}
+
+	fmt.Println(line)
+	printRow(headers)
+	fmt.Println(line)
+	for _, row := range rows {
+		printRow(row)
+	}
+	fmt.Println(line)
+}
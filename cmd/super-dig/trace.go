@@ -0,0 +1,400 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"go.uber.org/zap"
+)
+
+var traceUsage = `Usage: %s trace [options] Domain-Name
+Resolve the domain iteratively from the root servers and print each referral, like dig +trace.
+Options:
+	-t <RR type, default A>
+	--subnet <client subnet, only sent to the final authoritative server>
+	--root <root server address, repeatable, default the IANA root hints>
+	--port <port of name servers found in referrals, default 53>
+	--tcp <query over tcp>
+	--timeout <timeout of each query, default 5s>
+	--log_level <zap log level>
+`
+
+// https://www.iana.org/domains/root/servers
+var rootHints = []struct {
+	name string
+	addr string
+}{
+	{"a.root-servers.net", "198.41.0.4"},
+	{"b.root-servers.net", "170.247.170.2"},
+	{"c.root-servers.net", "192.33.4.12"},
+	{"d.root-servers.net", "199.7.91.13"},
+	{"e.root-servers.net", "192.203.230.10"},
+	{"f.root-servers.net", "192.5.5.241"},
+	{"g.root-servers.net", "192.112.36.4"},
+	{"h.root-servers.net", "198.97.190.53"},
+	{"i.root-servers.net", "192.36.148.17"},
+	{"j.root-servers.net", "192.58.128.30"},
+	{"k.root-servers.net", "193.0.14.129"},
+	{"l.root-servers.net", "199.7.83.42"},
+	{"m.root-servers.net", "202.12.27.33"},
+}
+
+const (
+	maxReferrals = 16 // 一次解析最多跟随的referral次数
+	maxCNAMEs    = 8  // 最多跟随的CNAME次数
+	maxGlueDepth = 4  // 解析没有glue的NS主机名时的最大嵌套深度
+	traceTimeout = "5s"
+)
+
+// tracer 从根服务器开始迭代解析
+type tracer struct {
+	roots    []configs.DNS
+	port     int
+	protocol string
+	timeout  string
+	subnet   string
+	hosts    map[string][]string // 解析过的NS主机名的地址
+}
+
+func traceMain(args []string) {
+	flagSet := flag.NewFlagSet("trace", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Printf(traceUsage, os.Args[0])
+	}
+	qTypeName := flagSet.String("t", "A", "RR type")
+	subnet := flagSet.String("subnet", "", "client subnet of the final query")
+	var roots stringList
+	flagSet.Var(&roots, "root", "root server address")
+	port := flagSet.Int("port", configs.DefaultPort, "port of name servers found in referrals")
+	useTCP := flagSet.Bool("tcp", false, "query over tcp")
+	timeout := flagSet.String("timeout", traceTimeout, "timeout of each query")
+	level := flagSet.Int("log_level", 0, "zap log level, default info")
+
+	// 域名可以在options之前
+	var domain string
+	flagSet.Parse(args)
+	for flagSet.NArg() > 0 {
+		domain = flagSet.Arg(0)
+		flagSet.Parse(flagSet.Args()[1:])
+	}
+
+	initLogger(*level, "stderr")
+	defer logger.Sync()
+
+	if domain == "" {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	qType, err := dnsMsg.ParseType(*qTypeName)
+	if err != nil {
+		logger.Fatal("invalid -t", zap.Error(err))
+	}
+
+	t := &tracer{
+		port:     *port,
+		protocol: configs.ProtocolUDP,
+		timeout:  *timeout,
+		subnet:   *subnet,
+		hosts:    make(map[string][]string),
+	}
+	if *useTCP {
+		t.protocol = configs.ProtocolTCP
+	}
+
+	if *subnet != "" {
+		parseClientSubnet(*subnet)
+	}
+
+	if len(roots) == 0 {
+		for _, hint := range rootHints {
+			t.roots = append(t.roots, t.server(hint.addr, hint.name))
+		}
+	}
+
+	for _, addr := range roots {
+		ns, err := configs.ParseNameserver(addr)
+		if err != nil {
+			logger.Fatal("invalid --root", zap.Error(err))
+		}
+		ns.Desc = addr
+		ns.Protocol = t.protocol
+		ns.Timeout = t.timeout
+		t.roots = append(t.roots, ns)
+	}
+
+	for _, root := range t.roots {
+		if err := root.Validate(); err != nil {
+			logger.Fatal("invalid option", zap.Error(err))
+		}
+	}
+
+	if _, err := t.trace(domain, qType); err != nil {
+		logger.Fatal("trace failed", zap.String("domain", domain), zap.Error(err))
+	}
+}
+
+// trace 从根开始解析domain，权威服务器只返回了CNAME时，从根开始解析CNAME的目标，返回最后一跳的响应
+func (t *tracer) trace(domain string, qType uint16) (*dnsMsg.Message, error) {
+	name := strings.TrimSuffix(domain, ".")
+	for cname := 0; ; cname++ {
+		msg, err := t.resolve(name, qType, 0, true)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		target := cnameTarget(msg, name, qType)
+		if target == "" {
+			return msg, nil
+		}
+
+		if cname >= maxCNAMEs {
+			return nil, fmt.Errorf("too many CNAMEs")
+		}
+
+		fmt.Printf(";; following CNAME %s -> %s\n\n", name, target)
+		name = target
+	}
+}
+
+func (t *tracer) server(addr, name string) configs.DNS {
+	return configs.DNS{
+		Nameserver: addr,
+		Port:       t.port,
+		Desc:       name,
+		Protocol:   t.protocol,
+		Timeout:    t.timeout,
+	}
+}
+
+// resolve 从根开始跟随referral直到拿到权威的响应，verbose时输出每一跳
+func (t *tracer) resolve(name string, qType uint16, depth int, verbose bool) (*dnsMsg.Message, error) {
+	zone := "."
+	servers := t.roots
+	for hop := 0; hop < maxReferrals; hop++ {
+		msg, server, rtt, err := t.queryAny(servers, name, qType, "")
+		if err != nil {
+			return nil, fmt.Errorf("query servers of zone %s: %w", zone, err)
+		}
+
+		childZone, nsNames := referral(msg, name)
+		if childZone == "" {
+			// 最后一跳，带上ECS重新查询同一个权威服务器
+			if t.subnet != "" && verbose {
+				if ecsMsg, ecsRTT, err := t.query(server, name, qType, t.subnet); err == nil {
+					msg, rtt = ecsMsg, ecsRTT
+				} else {
+					logger.Warn("query with client subnet failed", zap.String("nameserver", server.Address()), zap.Error(err))
+				}
+			}
+
+			if verbose {
+				printHop(msg, server, rtt, append(msg.Answers, msg.Authority...))
+			}
+			return msg, nil
+		}
+
+		if verbose {
+			printHop(msg, server, rtt, append(msg.Authority, msg.Additional...))
+		}
+
+		// 只能向更下层的zone委派，否则是lame delegation
+		if !isSubdomain(childZone, zone) || strings.EqualFold(childZone, zone) {
+			return nil, fmt.Errorf("bad referral from %s to zone %s", server.Address(), childZone)
+		}
+
+		zone = childZone
+		servers = t.delegationServers(msg, nsNames, depth)
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no address of nameservers %s of zone %s", strings.Join(nsNames, ","), zone)
+		}
+	}
+
+	return nil, fmt.Errorf("too many referrals")
+}
+
+// delegationServers 优先使用additional中的glue，没有glue的NS(out-of-bailiwick)再从根开始解析它的地址
+func (t *tracer) delegationServers(msg *dnsMsg.Message, nsNames []string, depth int) []configs.DNS {
+	var servers []configs.DNS
+	var unresolved []string
+	for _, nsName := range nsNames {
+		found := false
+		for idx := range msg.Additional {
+			rr := &msg.Additional[idx]
+			if (rr.Type == dnsMsg.TypeA || rr.Type == dnsMsg.TypeAAAA) && strings.EqualFold(rr.Name, nsName) {
+				servers = append(servers, t.server(msg.RDataString(rr), nsName))
+				found = true
+			}
+		}
+
+		if !found {
+			unresolved = append(unresolved, nsName)
+		}
+	}
+
+	if len(servers) > 0 || depth >= maxGlueDepth {
+		return sortServers(servers)
+	}
+
+	// 有一个NS能解析出地址就够了
+	for _, nsName := range unresolved {
+		for _, addr := range t.lookupHost(nsName, depth+1) {
+			servers = append(servers, t.server(addr, nsName))
+		}
+
+		if len(servers) > 0 {
+			break
+		}
+	}
+
+	return sortServers(servers)
+}
+
+// lookupHost 迭代解析NS主机名的A记录
+func (t *tracer) lookupHost(host string, depth int) []string {
+	key := strings.ToLower(host)
+	if addrs, ok := t.hosts[key]; ok {
+		return addrs
+	}
+
+	// 先占位，避免NS互相依赖时死循环
+	t.hosts[key] = nil
+
+	var addrs []string
+	msg, err := t.resolve(host, dnsMsg.TypeA, depth, false)
+	if err != nil {
+		logger.Warn("resolve nameserver failed", zap.String("ns", host), zap.Error(err))
+		return nil
+	}
+
+	for idx := range msg.Answers {
+		if msg.Answers[idx].Type == dnsMsg.TypeA {
+			addrs = append(addrs, msg.RDataString(&msg.Answers[idx]))
+		}
+	}
+
+	logger.Debug("resolve nameserver", zap.String("ns", host), zap.Strings("addrs", addrs))
+	t.hosts[key] = addrs
+
+	return addrs
+}
+
+// queryAny 依次查询servers，直到有一个返回NOERROR或者NXDOMAIN
+func (t *tracer) queryAny(servers []configs.DNS, name string, qType uint16, subnet string) (*dnsMsg.Message, configs.DNS, time.Duration, error) {
+	var lastErr error
+	for _, server := range servers {
+		msg, rtt, err := t.query(server, name, qType, subnet)
+		if err == nil {
+			return msg, server, rtt, nil
+		}
+
+		logger.Debug("query failed, try next server", zap.String("nameserver", server.Address()), zap.Error(err))
+		lastErr = err
+	}
+
+	return nil, configs.DNS{}, 0, lastErr
+}
+
+func (t *tracer) query(server configs.DNS, name string, qType uint16, subnet string) (*dnsMsg.Message, time.Duration, error) {
+	start := time.Now()
+	msg, err := probeQuery(server, server.Network(), makeDNSQuery(name, qType, subnet, queryOptions{NoRecursion: true}))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if rcode := msg.RCode(); rcode != 0 && rcode != 3 {
+		return nil, 0, fmt.Errorf("%s from %s", dnsMsg.RCodeString(rcode), server.Address())
+	}
+
+	return msg, time.Since(start), nil
+}
+
+// referral 响应是否是referral: 没有answer，authority中有name的上级zone的NS记录
+func referral(msg *dnsMsg.Message, name string) (string, []string) {
+	if len(msg.Answers) > 0 || msg.Header.GetAA() == 1 {
+		return "", nil
+	}
+
+	zone := ""
+	var nsNames []string
+	for idx := range msg.Authority {
+		rr := &msg.Authority[idx]
+		if rr.Type != dnsMsg.TypeNS || !isSubdomain(name, rr.Name) {
+			continue
+		}
+
+		if zone == "" {
+			zone = rr.Name
+		}
+
+		if strings.EqualFold(rr.Name, zone) {
+			nsNames = append(nsNames, msg.RDataString(rr))
+		}
+	}
+
+	return zone, nsNames
+}
+
+// cnameTarget answer中只有name的CNAME，没有qType的记录时返回CNAME的目标
+func cnameTarget(msg *dnsMsg.Message, name string, qType uint16) string {
+	if qType == dnsMsg.TypeCNAME || qType == dnsMsg.TypeANY {
+		return ""
+	}
+
+	target := ""
+	for idx := range msg.Answers {
+		rr := &msg.Answers[idx]
+		if rr.Type == qType {
+			return ""
+		}
+
+		if rr.Type == dnsMsg.TypeCNAME && strings.EqualFold(rr.Name, name) {
+			target = msg.RDataString(rr)
+		}
+	}
+
+	return target
+}
+
+// sortServers IPv4地址在前
+func sortServers(servers []configs.DNS) []configs.DNS {
+	var sorted, ipv6 []configs.DNS
+	for _, server := range servers {
+		if ip := net.ParseIP(server.Nameserver); ip != nil && ip.To4() == nil {
+			ipv6 = append(ipv6, server)
+		} else {
+			sorted = append(sorted, server)
+		}
+	}
+
+	return append(sorted, ipv6...)
+}
+
+// printHop 按dig +trace的格式输出一跳的结果
+func printHop(msg *dnsMsg.Message, server configs.DNS, rtt time.Duration, rrs []dnsMsg.RR) {
+	for idx := range rrs {
+		if rrs[idx].Type != dnsMsg.TypeOPT {
+			fmt.Println(msg.RRString(&rrs[idx]))
+		}
+	}
+
+	if edns, ok := msg.EDNS(); ok {
+		if data, ok := edns.Option(dnsMsg.OptionClientSubnet); ok {
+			if clientSubnet, err := dnsMsg.ParseClientSubnet(data); err == nil {
+				fmt.Printf(";; CLIENT-SUBNET: %s\n", clientSubnet)
+			}
+		}
+	}
+
+	if rcode := msg.RCode(); rcode != 0 {
+		fmt.Printf(";; status: %s\n", dnsMsg.RCodeString(rcode))
+	}
+
+	fmt.Printf(";; Received %d bytes from %s(%s) in %d ms\n\n", len(msg.Raw), server.Address(), server.Desc, rtt.Milliseconds())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+)
+
+// referralTo 返回zone的referral，glue为NS主机名到地址，可以没有glue
+func referralTo(zone string, nsNames []string, glue map[string]string) *dnstest.Response {
+	resp := &dnstest.Response{}
+	for _, nsName := range nsNames {
+		resp.Authority = append(resp.Authority, dnstest.NS(zone, 3600, nsName))
+		if addr, ok := glue[nsName]; ok {
+			resp.Additional = append(resp.Additional, dnstest.A(nsName, 3600, addr))
+		}
+	}
+	return resp
+}
+
+func inZone(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func TestTrace(t *testing.T) {
+	// 根和TLD服务器都有glue；example.com的NS没有glue，需要从根开始解析ns1.dns-host.net；
+	// www.example.com是CNAME，从根开始解析edge.dns-host.net
+	handlers := []dnstest.HandlerFunc{
+		// 127.0.0.1 根
+		func(req *dnstest.Request) *dnstest.Response {
+			for _, tld := range []string{"com", "net"} {
+				if inZone(req.Name, tld) {
+					return referralTo(tld, []string{"a.gtld-servers.net"}, map[string]string{"a.gtld-servers.net": "127.0.0.2"})
+				}
+			}
+			return &dnstest.Response{RCode: dnsMsg.RCodeNameError, Authoritative: true}
+		},
+		// 127.0.0.2 com和net
+		func(req *dnstest.Request) *dnstest.Response {
+			switch {
+			case inZone(req.Name, "example.com"):
+				return referralTo("example.com", []string{"ns1.dns-host.net"}, nil)
+			case inZone(req.Name, "dns-host.net"):
+				return referralTo("dns-host.net", []string{"ns.dns-host.net"}, map[string]string{"ns.dns-host.net": "127.0.0.4"})
+			}
+			return &dnstest.Response{RCode: dnsMsg.RCodeNameError, Authoritative: true}
+		},
+		// 127.0.0.3 example.com
+		func(req *dnstest.Request) *dnstest.Response {
+			if req.Name == "www.example.com" {
+				return &dnstest.Response{Authoritative: true,
+					Answers: []dnstest.RR{dnstest.CNAME(req.Name, 300, "edge.dns-host.net")}}
+			}
+			return &dnstest.Response{RCode: dnsMsg.RCodeNameError, Authoritative: true}
+		},
+		// 127.0.0.4 dns-host.net
+		func(req *dnstest.Request) *dnstest.Response {
+			addrs := map[string]string{"ns1.dns-host.net": "127.0.0.3", "edge.dns-host.net": "10.0.0.1"}
+			if addr, ok := addrs[req.Name]; ok && req.Type == dnsMsg.TypeA {
+				return &dnstest.Response{Authoritative: true, Answers: []dnstest.RR{dnstest.A(req.Name, 60, addr)}}
+			}
+			return &dnstest.Response{RCode: dnsMsg.RCodeNameError, Authoritative: true}
+		},
+	}
+
+	// referral中只有地址，所有服务器使用根服务器的端口
+	var servers []*dnstest.Server
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+	port := 0
+	for idx, handler := range handlers {
+		server, err := dnstest.NewServerAt(fmt.Sprintf("127.0.0.%d:%d", idx+1, port), handler)
+		if err != nil {
+			if idx == 0 {
+				t.Fatal(err)
+			}
+			t.Skipf("listen on 127.0.0.%d failed: %v", idx+1, err)
+		}
+		servers = append(servers, server)
+		port = server.Port()
+	}
+
+	tracer := &tracer{
+		port:     port,
+		protocol: configs.ProtocolUDP,
+		timeout:  "1s",
+		hosts:    make(map[string][]string),
+	}
+	tracer.roots = []configs.DNS{tracer.server("127.0.0.1", "root")}
+
+	msg, err := tracer.trace("www.example.com.", dnsMsg.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var answers []string
+	for idx := range msg.Answers {
+		answers = append(answers, msg.Answers[idx].Name+" "+msg.RDataString(&msg.Answers[idx]))
+	}
+	if fmt.Sprint(answers) != "[edge.dns-host.net 10.0.0.1]" {
+		t.Errorf("answers %v", answers)
+	}
+
+	// www.example.com、ns1.dns-host.net、edge.dns-host.net各从根解析一次
+	want := []int{3, 3, 1, 2}
+	for idx, server := range servers {
+		if server.Queries() != want[idx] {
+			t.Errorf("server %s received %d queries, want %d", server.Addr, server.Queries(), want[idx])
+		}
+	}
+
+	if addrs := tracer.hosts["ns1.dns-host.net"]; fmt.Sprint(addrs) != "[127.0.0.3]" {
+		t.Errorf("glueless nameserver resolved to %v", addrs)
+	}
+}
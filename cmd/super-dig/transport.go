@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/walkerdu/super-dig/configs"
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+// dnsConn 到一个nameserver的连接，UDP和TCP都只支持串行的请求
+type dnsConn struct {
+	ns   configs.DNS
+	conn net.Conn
+	pcap *pcapConn // --pcap时记录收发的报文
+}
+
+func dialNameserver(ns configs.DNS) (*dnsConn, error) {
+	return dial(ns, ns.Network())
+}
+
+func dial(ns configs.DNS, network string) (*dnsConn, error) {
+	dialer := net.Dialer{
+		Timeout: ns.QueryTimeout(),
+	}
+
+	// 绑定本地地址
+	if ns.Source != "" {
+		ip := net.ParseIP(ns.Source)
+		if network == configs.ProtocolTCP {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		}
+	}
+
+	conn, err := dialer.Dial(network, ns.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsConn{ns: ns, conn: conn}, nil
+}
+
+// exchange 发送请求并等待ID相同的响应，UDP会丢弃之前超时的请求迟到的响应，响应被截断时通过TCP重试
+func (dc *dnsConn) exchange(query []byte) ([]byte, error) {
+	dc.conn.SetDeadline(time.Now().Add(dc.ns.QueryTimeout()))
+
+	if _, ok := dc.conn.(*net.TCPConn); ok {
+		return dc.exchangeTCP(query)
+	}
+
+	response, err := dc.exchangeUDP(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var dnsHeader dnsMsg.DNSHeader
+	copy(dnsHeader[:], response)
+	if len(response) < len(dnsHeader) || dnsHeader.GetTC() == 0 {
+		return response, nil
+	}
+
+	tcpConn, err := dial(dc.ns, configs.ProtocolTCP)
+	if err != nil {
+		return nil, fmt.Errorf("response truncated, retry over tcp failed: %w", err)
+	}
+	if dc.pcap != nil {
+		tcpConn.pcap = newPcapConn(dc.pcap.writer, tcpConn.conn)
+	}
+	defer tcpConn.Close()
+
+	tcpConn.conn.SetDeadline(time.Now().Add(dc.ns.QueryTimeout()))
+	return tcpConn.exchangeTCP(query)
+}
+
+func (dc *dnsConn) exchangeUDP(query []byte) ([]byte, error) {
+	if _, err := dc.conn.Write(query); err != nil {
+		return nil, err
+	}
+	dc.pcap.sent(query)
+
+	response := make([]byte, 65535)
+	for {
+		resBytes, err := dc.conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		dc.pcap.received(response[0:resBytes])
+
+		if resBytes >= 2 && binary.BigEndian.Uint16(response) == binary.BigEndian.Uint16(query) {
+			return response[0:resBytes], nil
+		}
+	}
+}
+
+// exchangeTCP DNS over TCP，报文前加2字节长度
+func (dc *dnsConn) exchangeTCP(query []byte) ([]byte, error) {
+	data := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(data, uint16(len(query)))
+	copy(data[2:], query)
+
+	if _, err := dc.conn.Write(data); err != nil {
+		return nil, err
+	}
+	dc.pcap.sent(data)
+
+	var length [2]byte
+	if _, err := io.ReadFull(dc.conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(dc.conn, response); err != nil {
+		return nil, err
+	}
+	dc.pcap.received(append(length[:], response...))
+
+	if len(response) < 2 || binary.BigEndian.Uint16(response) != binary.BigEndian.Uint16(query) {
+		return nil, fmt.Errorf("mismatched response id from %s", dc.ns.Address())
+	}
+
+	return response, nil
+}
+
+func (dc *dnsConn) Close() error {
+	dc.pcap.close()
+	return dc.conn.Close()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// watchScan 按interval重复扫描，第一次输出完整的结果，之后只输出和上一次相比answer集合或者rcode变化的探测，
+// 指定了listen时在listen上提供/metrics
+func watchScan(opts *scanOptions, interval time.Duration, store *historyStore, listen string) {
+	var metrics *scanMetrics
+	if listen != "" {
+		metrics = newScanMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			logger.Info("serve metrics", zap.String("listen", listen))
+			if err := http.ListenAndServe(listen, mux); err != nil {
+				logger.Fatal("serve metrics failed", zap.Error(err))
+			}
+		}()
+	}
+
+	watcher := &watcher{opts: opts, store: store, metrics: metrics}
+	for {
+		started := time.Now()
+		watcher.runRound()
+
+		// 从上一轮开始时计算间隔，扫描耗时超过interval时立即开始下一轮
+		time.Sleep(time.Until(started.Add(interval)))
+	}
+}
+
+// watcher 保存上一轮的结果，每一轮和上一轮对比
+type watcher struct {
+	opts     *scanOptions
+	store    *historyStore
+	metrics  *scanMetrics
+	previous []probeRecord
+	round    int
+}
+
+// runRound 扫描一轮，第一轮输出完整的结果，之后输出变化，返回和上一轮相比的变化
+func (watcher *watcher) runRound() []recordChange {
+	opts := watcher.opts
+	watcher.round += 1
+
+	report := scan(opts, nil)
+	saveHistory(watcher.store, report)
+	watcher.metrics.observe(report)
+
+	var changes []recordChange
+	if watcher.previous == nil {
+		writeWatchReport(opts, report)
+	} else {
+		changes = diffRecords(watcher.previous, report.Probes, recordKey)
+		logger.Info("watch round finished", zap.Int("round", watcher.round), zap.Int("changes", len(changes)))
+		if len(changes) > 0 {
+			writeChanges(opts, changes)
+		}
+	}
+	checkAlerts(opts, report, changes)
+
+	watcher.previous = keepFailed(watcher.previous, report.Probes, recordKey)
+
+	return changes
+}
+
+// keepFailed 本轮失败的探测沿用上一轮的结果，避免偶发的超时被当作变化
+func keepFailed(previous, current []probeRecord, key func(*probeRecord) string) []probeRecord {
+	previousMap := make(map[string]probeRecord)
+	for _, record := range previous {
+		previousMap[key(&record)] = record
+	}
+
+	merged := make([]probeRecord, 0, len(current))
+	for _, record := range current {
+		if record.Error != "" {
+			if old, ok := previousMap[key(&record)]; ok {
+				record = old
+			}
+		}
+		merged = append(merged, record)
+	}
+
+	return merged
+}
+
+// writeWatchReport 第一轮的完整结果，json格式和变化一样输出为一行
+func writeWatchReport(opts *scanOptions, report *scanReport) {
+	for _, output := range opts.Outputs {
+		switch output {
+		case outputTable:
+			prettyReport(opts, report)
+		case outputJSON:
+			encoder, done := watchJSONEncoder(opts, true)
+			if err := encoder.Encode(report); err != nil {
+				logger.Fatal("write json report failed", zap.Error(err))
+			}
+			done()
+		}
+	}
+}
+
+// writeChanges table格式输出变化的表格，json格式每个变化输出一行
+func writeChanges(opts *scanOptions, changes []recordChange) {
+	for _, output := range opts.Outputs {
+		switch output {
+		case outputTable:
+			fmt.Printf("\n%s %d changes\n", time.Now().Format("2006-01-02 15:04:05"), len(changes))
+			prettyChanges(changes)
+		case outputJSON:
+			encoder, done := watchJSONEncoder(opts, false)
+			for _, change := range changes {
+				if err := encoder.Encode(change); err != nil {
+					logger.Fatal("write json changes failed", zap.Error(err))
+				}
+			}
+			done()
+		}
+	}
+}
+
+// watchJSONEncoder json格式的watch输出为JSON lines: 第一行是第一轮的完整结果，之后每个变化一行；
+// 输出到文件时第一轮清空文件，之后追加
+func watchJSONEncoder(opts *scanOptions, first bool) (*json.Encoder, func()) {
+	var writer io.Writer = os.Stdout
+	done := func() {}
+	if opts.OutputFile != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if first {
+			flags |= os.O_TRUNC
+		}
+
+		file, err := os.OpenFile(opts.OutputFile, flags, 0644)
+		if err != nil {
+			logger.Fatal("open output file failed", zap.Error(err))
+		}
+		writer = file
+		done = func() { file.Close() }
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	return encoder, done
+}
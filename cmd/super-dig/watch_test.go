@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+)
+
+func TestWatchJSONLines(t *testing.T) {
+	newGeo := func(guangdong string) *dnstest.GeoDNS {
+		geo, err := dnstest.NewGeoDNS("www.example.com", map[string][]string{
+			"1.0.1.0/24":       {guangdong},
+			"36.134.0.0/16":    {"10.0.2.1"},
+			dnstest.GeoDefault: {"10.0.9.9"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return geo
+	}
+
+	// 两轮之间切换广东电信的应答
+	var geo atomic.Pointer[dnstest.GeoDNS]
+	geo.Store(newGeo("10.0.1.1"))
+	server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+		return geo.Load().ServeDNS(req)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	opts := testOptions(t, server, []configs.IPRegion{
+		{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+		{Country: "中国", Province: "北京市", ISP: "移动", IPs: []string{"36.134.70.0/24"}},
+		{Country: "美国", Province: "0", ISP: "0", IPs: []string{"8.8.8.0/24"}},
+	})
+	opts.Outputs = []string{outputJSON}
+	opts.OutputFile = filepath.Join(t.TempDir(), "watch.json")
+
+	// 第一轮清空之前的输出文件
+	if err := os.WriteFile(opts.OutputFile, []byte("{\"stale\": \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := &watcher{opts: opts}
+	if changes := watcher.runRound(); len(changes) != 0 {
+		t.Errorf("first round changes %+v", changes)
+	}
+
+	geo.Store(newGeo("10.0.1.2"))
+	changes := watcher.runRound()
+	if len(changes) != 2 {
+		t.Fatalf("second round %d changes, want 2: %+v", len(changes), changes)
+	}
+
+	// 没有变化的一轮不输出
+	if changes := watcher.runRound(); len(changes) != 0 {
+		t.Errorf("third round changes %+v", changes)
+	}
+
+	data, err := os.ReadFile(opts.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("%d lines, want 3:\n%s", len(lines), data)
+	}
+
+	// 每一行都是完整的json: 第一行是第一轮的结果，之后每个变化一行
+	var report scanReport
+	if err := json.Unmarshal(lines[0], &report); err != nil {
+		t.Fatalf("first line: %v\n%s", err, lines[0])
+	}
+	if len(report.Probes) != 6 {
+		t.Errorf("first line %d probes, want 6", len(report.Probes))
+	}
+	for _, record := range report.Probes {
+		if record.Subnet == "1.0.1.0" && !reflect.DeepEqual(record.Answers, []string{"10.0.1.1"}) {
+			t.Errorf("first round %s %s answers %v", record.Subnet, record.resolver(), record.Answers)
+		}
+	}
+
+	for idx, line := range lines[1:] {
+		var change recordChange
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&change); err != nil {
+			t.Fatalf("line %d: %v\n%s", idx+2, err, line)
+		}
+
+		if change.Subnet != "1.0.1.0" || change.Province != "广东省" ||
+			!reflect.DeepEqual(change.Added, []string{"10.0.1.2"}) || !reflect.DeepEqual(change.Removed, []string{"10.0.1.1"}) {
+			t.Errorf("line %d: change %+v", idx+2, change)
+		}
+	}
+}
@@ -1,13 +1,139 @@
 package configs
 
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type IPRegion struct {
-	Country  string   `json:"country"`
-	Province string   `json:"province"`
-	ISP      string   `json:"isp"`
-	IPs      []string `json:"ips"`
+	Country  string   `json:"country" yaml:"country"`
+	Province string   `json:"province" yaml:"province"`
+	ISP      string   `json:"isp" yaml:"isp"`
+	IPs      []string `json:"ips" yaml:"ips"`                           // 单个IP或者CIDR，如"1.0.1.0"、"36.134.0.0/16"
+	Sample   string   `json:"sample,omitempty" yaml:"sample,omitempty"` // CIDR的采样策略: first, random:N, every，为空使用--sample
 }
 
+const (
+	DefaultPort    = 53
+	DefaultTimeout = 10 * time.Second
+	ProtocolUDP    = "udp"
+	ProtocolTCP    = "tcp"
+)
+
 type DNS struct {
-	Nameserver string `json:"nameserver"`
-	Desc       string `json:"desc"`
+	Nameserver string `json:"nameserver" yaml:"nameserver"`
+	Desc       string `json:"desc" yaml:"desc"`
+	Port       int    `json:"port,omitempty" yaml:"port,omitempty"`         // 默认53
+	Protocol   string `json:"protocol,omitempty" yaml:"protocol,omitempty"` // udp或tcp，默认udp
+	ECS        *bool  `json:"ecs,omitempty" yaml:"ecs,omitempty"`           // 是否支持edns client subnet，默认支持
+	Source     string `json:"source,omitempty" yaml:"source,omitempty"`     // 绑定的本地地址
+	Timeout    string `json:"timeout,omitempty" yaml:"timeout,omitempty"`   // 单次查询的超时时间，如"3s"，默认10s
+}
+
+// ParseNameserver 解析命令行中的nameserver地址，支持8.8.8.8、8.8.8.8:53、2001:4860:4860::8888、
+// [2001:4860:4860::8888]:53，以及dns.google、dns.google:53这样的主机名
+func ParseNameserver(addr string) (DNS, error) {
+	var dns DNS
+	if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+		dns.Nameserver = ip.String()
+		return dns, nil
+	}
+
+	if !strings.Contains(addr, ":") {
+		dns.Nameserver = addr
+		return dns, dns.Validate()
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return dns, fmt.Errorf("invalid nameserver %q: %w", addr, err)
+	}
+
+	dns.Nameserver = host
+	if dns.Port, err = strconv.Atoi(port); err != nil || dns.Port <= 0 {
+		return dns, fmt.Errorf("invalid nameserver %q: bad port", addr)
+	}
+
+	return dns, dns.Validate()
+}
+
+// Address 返回nameserver的host:port，IPv6地址会加上[]
+func (dns *DNS) Address() string {
+	port := dns.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	return net.JoinHostPort(dns.Nameserver, strconv.Itoa(port))
+}
+
+// Key 区分同一host:port上不同协议的nameserver，作为连接和探测结果的标识
+func (dns *DNS) Key() string {
+	return dns.Network() + "/" + dns.Address()
+}
+
+func (dns *DNS) Network() string {
+	if dns.Protocol == "" {
+		return ProtocolUDP
+	}
+
+	return dns.Protocol
+}
+
+func (dns *DNS) SupportECS() bool {
+	return dns.ECS == nil || *dns.ECS
+}
+
+func (dns *DNS) QueryTimeout() time.Duration {
+	timeout, err := time.ParseDuration(dns.Timeout)
+	if err != nil || timeout <= 0 {
+		return DefaultTimeout
+	}
+
+	return timeout
+}
+
+// Validate 校验nameserver配置，返回的错误以出错的字段名开头
+func (dns *DNS) Validate() error {
+	if dns.Nameserver == "" {
+		return fmt.Errorf("nameserver: required")
+	}
+
+	// 不是IP的nameserver作为主机名，由net.Dial解析
+	nameserver := net.ParseIP(dns.Nameserver)
+	if nameserver == nil && strings.ContainsAny(dns.Nameserver, ":[]/ ") {
+		return fmt.Errorf("nameserver: %q is neither an IP address nor a hostname, specify the port with the port field", dns.Nameserver)
+	}
+
+	if dns.Port < 0 || dns.Port > 65535 {
+		return fmt.Errorf("port: %d out of range 1-65535", dns.Port)
+	}
+
+	switch dns.Protocol {
+	case "", ProtocolUDP, ProtocolTCP:
+	default:
+		return fmt.Errorf("protocol: unknown value %q, expect udp or tcp", dns.Protocol)
+	}
+
+	if dns.Source != "" {
+		source := net.ParseIP(dns.Source)
+		if source == nil {
+			return fmt.Errorf("source: %q is not an IP address", dns.Source)
+		}
+
+		if nameserver != nil && (source.To4() == nil) != (nameserver.To4() == nil) {
+			return fmt.Errorf("source: address family of %s mismatches nameserver %s", dns.Source, dns.Nameserver)
+		}
+	}
+
+	if dns.Timeout != "" {
+		if timeout, err := time.ParseDuration(dns.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout: invalid duration %q, expect e.g. 3s or 500ms", dns.Timeout)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,107 @@
+package configs_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+)
+
+func TestParseNameserver(t *testing.T) {
+	tests := []struct {
+		addr    string
+		host    string
+		port    int
+		address string
+		err     bool
+	}{
+		{"8.8.8.8", "8.8.8.8", 0, "8.8.8.8:53", false},
+		{"127.0.0.1:5353", "127.0.0.1", 5353, "127.0.0.1:5353", false},
+		{"2001:4860:4860::8888", "2001:4860:4860::8888", 0, "[2001:4860:4860::8888]:53", false},
+		{"[2001:4860:4860::8888]", "2001:4860:4860::8888", 0, "[2001:4860:4860::8888]:53", false},
+		{"[2001:4860:4860::8888]:53", "2001:4860:4860::8888", 53, "[2001:4860:4860::8888]:53", false},
+		{"dns.google", "dns.google", 0, "dns.google:53", false},
+		{"resolver.corp.internal:5353", "resolver.corp.internal", 5353, "resolver.corp.internal:5353", false},
+		{"127.0.0.1:dns", "", 0, "", true},
+		{"127.0.0.1:0", "", 0, "", true},
+		{"127.0.0.1:70000", "", 0, "", true},
+		{"2001:4860:4860::8888:53:x", "", 0, "", true},
+		{"", "", 0, "", true},
+	}
+
+	for _, test := range tests {
+		dns, err := configs.ParseNameserver(test.addr)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseNameserver(%q) = %+v, want error", test.addr, dns)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseNameserver(%q): %v", test.addr, err)
+			continue
+		}
+		if dns.Nameserver != test.host || dns.Port != test.port || dns.Address() != test.address {
+			t.Errorf("ParseNameserver(%q) = %s port %d address %s, want %s port %d address %s", test.addr,
+				dns.Nameserver, dns.Port, dns.Address(), test.host, test.port, test.address)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		dns configs.DNS
+		key string
+	}{
+		{configs.DNS{Nameserver: "8.8.8.8"}, "udp/8.8.8.8:53"},
+		{configs.DNS{Nameserver: "8.8.8.8", Protocol: configs.ProtocolTCP}, "tcp/8.8.8.8:53"},
+		{configs.DNS{Nameserver: "127.0.0.1", Port: 5353}, "udp/127.0.0.1:5353"},
+		{configs.DNS{Nameserver: "2001:4860:4860::8888", Protocol: configs.ProtocolTCP}, "tcp/[2001:4860:4860::8888]:53"},
+		{configs.DNS{Nameserver: "dns.google", Port: 853}, "udp/dns.google:853"},
+	}
+
+	for _, test := range tests {
+		if key := test.dns.Key(); key != test.key {
+			t.Errorf("%+v key %s, want %s", test.dns, key, test.key)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		dns configs.DNS
+		err string // 错误的前缀，为空表示合法
+	}{
+		{configs.DNS{Nameserver: "127.0.0.1", Port: 5353}, ""},
+		{configs.DNS{Nameserver: "2001:4860:4860::8888", Source: "::1"}, ""},
+		{configs.DNS{Nameserver: "dns.google", Source: "10.0.0.1", Protocol: configs.ProtocolTCP}, ""},
+		{configs.DNS{Nameserver: "dns.google", Source: "::1"}, ""},
+		{configs.DNS{Nameserver: "8.8.8.8", Timeout: "500ms"}, ""},
+		{configs.DNS{}, "nameserver:"},
+		{configs.DNS{Nameserver: "127.0.0.1:5353"}, "nameserver:"},
+		{configs.DNS{Nameserver: "[2001:4860:4860::8888]"}, "nameserver:"},
+		{configs.DNS{Nameserver: "8.8.8.8", Port: 70000}, "port:"},
+		{configs.DNS{Nameserver: "8.8.8.8", Port: -1}, "port:"},
+		{configs.DNS{Nameserver: "8.8.8.8", Protocol: "tls"}, "protocol:"},
+		{configs.DNS{Nameserver: "8.8.8.8", Source: "eth0"}, "source:"},
+		{configs.DNS{Nameserver: "8.8.8.8", Source: "::1"}, "source:"},
+		{configs.DNS{Nameserver: "2001:4860:4860::8888", Source: "10.0.0.1"}, "source:"},
+		{configs.DNS{Nameserver: "8.8.8.8", Timeout: "3"}, "timeout:"},
+		{configs.DNS{Nameserver: "8.8.8.8", Timeout: "-1s"}, "timeout:"},
+	}
+
+	for _, test := range tests {
+		err := test.dns.Validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", test.dns, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%+v: error %v, want prefix %q", test.dns, err, test.err)
+		}
+	}
+}
@@ -2,6 +2,13 @@ module github.com/walkerdu/super-dig
 
 go 1.20
 
-require go.uber.org/zap v1.25.0
+require (
+	go.etcd.io/bbolt v1.3.8
+	go.uber.org/zap v1.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require go.uber.org/multierr v1.10.0 // indirect
+require (
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
@@ -125,42 +125,5 @@ func (additional *Additional) SetClientSubnetOptAddress(offset int, address []by
 }
 
 func (additional *Additional) AddEDNSClientSubnet(offset int, clientIP net.IP, sourceNetMaskLen uint8) int {
-	// Set RR NAME (empty, as it's not required for EDNS options)
-	offset += additional.SetName(offset)
-
-	// Set RR Type = 41 (OPT)
-	offset += additional.SetType(offset, 41)
-
-	// Set RR Class = 4096 (UDP Payload Size)
-	offset += additional.SetClass(offset, 4096)
-
-	// Set RR TTL = 0
-	offset += additional.SetTTL(offset, 0)
-
-	subNetIpLen := sourceNetMaskLen / 8
-
-	// Set RR RDLEN = (8 + SubNet IP Len )bytes for EDNS Client Subnet option
-	offset += additional.SetDLen(offset, uint16(2+2+2+1+1+subNetIpLen))
-
-	// Set Option Code = 8 (EDNS Client Subnet)
-	offset += additional.SetOptCode(offset, 8)
-
-	// Set Option Length = (4 + SubNet IP Len) bytes
-	offset += additional.SetOptDLen(offset, uint16(2+2+subNetIpLen))
-
-	// IP Version (1 for IPv4, 2 for IPv6)
-	offset += additional.SetClientSubnetOptFamily(offset, 1)
-
-	// Source Netmask
-	offset += additional.SetClientSubnetOptSourceNetMask(offset, sourceNetMaskLen)
-
-	// Scope Netmask (0 for IPv4, 0 for IPv6)
-	offset += additional.SetClientSubnetOptScopeNetMask(offset, 0x00)
-
-	clientIP = clientIP.To4()[0:subNetIpLen]
-
-	// Client SubNet IP address (4 bytes for IPv4, 16 bytes for IPv6)
-	offset += additional.SetClientSubnetOptAddress(offset, clientIP)
-
-	return offset
+	return additional.AddOPT(offset, DefaultUDPSize, 0, false, []EDNSOption{NewClientSubnetOption(clientIP, sourceNetMaskLen)})
 }
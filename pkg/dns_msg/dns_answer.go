@@ -2,7 +2,10 @@ package dns_msg
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
 /*
@@ -46,10 +49,12 @@ func (answer *Answer) GetName(offset int) (name string, length int) {
 		}
 
 		if labelLen&0xC0 == 0xC0 {
-			// 如果是指针，则跳转到指针指向的位置继续解析
-			pointerOffset := int(binary.BigEndian.Uint16([]byte{0, answer.Data[offset] & 0x3F}))
-			namePart, _ := answer.GetName(pointerOffset)
-			name += namePart
+			// 如果是指针，则跳转到指针指向的位置继续解析，指针只能指向前面的数据，避免死循环
+			pointerOffset := int(binary.BigEndian.Uint16([]byte{byte(labelLen) & 0x3F, answer.Data[offset]}))
+			if pointerOffset < begin_offset {
+				namePart, _ := answer.GetName(pointerOffset)
+				name += namePart
+			}
 			offset++
 			break
 		}
@@ -59,8 +64,10 @@ func (answer *Answer) GetName(offset int) (name string, length int) {
 		offset += labelLen
 	}
 
-	// 如果 name 以 . 结尾，去掉这个点
-	if name[len(name)-1] == '.' {
+	// 如果 name 以 . 结尾，去掉这个点，根域名为"."
+	if name == "" {
+		name = "."
+	} else if name[len(name)-1] == '.' {
 		name = name[:len(name)-1]
 	}
 
@@ -92,3 +99,46 @@ func ParseIPFromRData(rdata []byte) net.IP {
 	copy(ip, rdata)
 	return ip
 }
+
+// GetRDataString 返回RDATA的展示格式，RDATA中的域名可能是指向报文其他位置的指针，所以需要整个报文
+func (answer *Answer) GetRDataString(offset int, rType uint16, rDLen uint16) string {
+	rData := answer.GetData(offset, rDLen)
+
+	switch rType {
+	case TypeA, TypeAAAA:
+		return ParseIPFromRData(rData).String()
+	case TypeNS, TypeCNAME, TypePTR:
+		name, _ := answer.GetName(offset)
+		return name
+	case TypeMX:
+		name, _ := answer.GetName(offset + 2)
+		return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rData), name)
+	case TypeTXT:
+		var txts []string
+		for idx := 0; idx < len(rData); idx += 1 + int(rData[idx]) {
+			end := idx + 1 + int(rData[idx])
+			if end > len(rData) {
+				end = len(rData)
+			}
+			txts = append(txts, strconv.Quote(string(rData[idx+1:end])))
+		}
+		return strings.Join(txts, " ")
+	case TypeSOA:
+		mName, length := answer.GetName(offset)
+		rName, rLength := answer.GetName(offset + length)
+		fields := rData[length+rLength:]
+		return fmt.Sprintf("%s %s %d %d %d %d %d", mName, rName,
+			binary.BigEndian.Uint32(fields[0:]), binary.BigEndian.Uint32(fields[4:]), binary.BigEndian.Uint32(fields[8:]),
+			binary.BigEndian.Uint32(fields[12:]), binary.BigEndian.Uint32(fields[16:]))
+	case TypeDS, TypeRRSIG, TypeNSEC, TypeDNSKEY, TypeNSEC3:
+		return dnssecRDataString(&RR{Type: rType, Data: rData})
+	case TypeSVCB, TypeHTTPS:
+		if svcb, err := ParseSVCB(&RR{Type: rType, Data: rData}); err == nil {
+			return svcb.String()
+		}
+		return fmt.Sprintf("\\# %d %x", len(rData), rData)
+	default:
+		// RFC3597 未知类型
+		return fmt.Sprintf("\\# %d %x", len(rData), rData)
+	}
+}
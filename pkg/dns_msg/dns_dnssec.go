@@ -0,0 +1,393 @@
+package dns_msg
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+   https://www.rfc-editor.org/rfc/rfc4034 DNSKEY、RRSIG、NSEC、DS
+   https://www.rfc-editor.org/rfc/rfc5155 NSEC3
+
+   DNSKEY RDATA:
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |              Flags            |    Protocol   |   Algorithm   |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    /                            Public Key                         /
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+
+   RRSIG RDATA:
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |        Type Covered           |  Algorithm    |     Labels    |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                         Original TTL                          |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                      Signature Expiration                     |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                      Signature Inception                      |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |            Key Tag            |                               /
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+         Signer's Name         /
+    /                                                               /
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    /                            Signature                          /
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+
+   DS RDATA:
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |           Key Tag             |  Algorithm    |  Digest Type  |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    /                            Digest                             /
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+
+   NSEC RDATA: Next Domain Name | Type Bit Maps
+   NSEC3 RDATA: Hash Alg(1) | Flags(1) | Iterations(2) | Salt Length(1) | Salt | Hash Length(1) | Next Hashed Owner | Type Bit Maps
+   RDATA中的域名不会被压缩
+*/
+
+// DNSSEC算法，https://www.iana.org/assignments/dns-sec-alg-numbers/dns-sec-alg-numbers.xhtml
+const (
+	AlgRSASHA1          uint8 = 5
+	AlgRSASHA1NSEC3SHA1 uint8 = 7
+	AlgRSASHA256        uint8 = 8
+	AlgRSASHA512        uint8 = 10
+	AlgECDSAP256SHA256  uint8 = 13
+	AlgECDSAP384SHA384  uint8 = 14
+	AlgED25519          uint8 = 15
+)
+
+// DS摘要算法
+const (
+	DigestSHA1   uint8 = 1
+	DigestSHA256 uint8 = 2
+	DigestSHA384 uint8 = 4
+)
+
+const (
+	DNSKEYFlagZone uint16 = 0x0100
+	DNSKEYFlagSEP  uint16 = 0x0001
+
+	NSEC3FlagOptOut uint8 = 0x01
+)
+
+type DNSKEY struct {
+	Owner     string
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+	RData     []byte
+}
+
+type DS struct {
+	Owner      string
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+type RRSIG struct {
+	Owner       string
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+	// 签名之前的RDATA，验证签名时使用
+	signedRData []byte
+}
+
+type NSEC struct {
+	Owner    string
+	NextName string
+	Types    []uint16
+}
+
+type NSEC3 struct {
+	Owner      string
+	HashAlg    uint8
+	Flags      uint8
+	Iterations uint16
+	Salt       []byte
+	NextHashed []byte
+	Types      []uint16
+}
+
+// ParseDNSKEY 解析DNSKEY记录
+func ParseDNSKEY(rr *RR) (*DNSKEY, error) {
+	if rr.Type != TypeDNSKEY || len(rr.Data) < 4 {
+		return nil, fmt.Errorf("invalid DNSKEY record of %s", rr.Name)
+	}
+
+	return &DNSKEY{
+		Owner:     rr.Name,
+		Flags:     binary.BigEndian.Uint16(rr.Data),
+		Protocol:  rr.Data[2],
+		Algorithm: rr.Data[3],
+		PublicKey: rr.Data[4:],
+		RData:     rr.Data,
+	}, nil
+}
+
+// ParseDS 解析DS记录
+func ParseDS(rr *RR) (*DS, error) {
+	if rr.Type != TypeDS || len(rr.Data) < 4 {
+		return nil, fmt.Errorf("invalid DS record of %s", rr.Name)
+	}
+
+	return &DS{
+		Owner:      rr.Name,
+		KeyTag:     binary.BigEndian.Uint16(rr.Data),
+		Algorithm:  rr.Data[2],
+		DigestType: rr.Data[3],
+		Digest:     rr.Data[4:],
+	}, nil
+}
+
+// ParseRRSIG 解析RRSIG记录
+func ParseRRSIG(rr *RR) (sig *RRSIG, err error) {
+	if rr.Type != TypeRRSIG || len(rr.Data) < 19 {
+		return nil, fmt.Errorf("invalid RRSIG record of %s", rr.Name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			sig, err = nil, fmt.Errorf("invalid RRSIG record of %s: %v", rr.Name, r)
+		}
+	}()
+
+	data := rr.Data
+	sig = &RRSIG{
+		Owner:       rr.Name,
+		TypeCovered: binary.BigEndian.Uint16(data),
+		Algorithm:   data[2],
+		Labels:      data[3],
+		OriginalTTL: binary.BigEndian.Uint32(data[4:]),
+		Expiration:  binary.BigEndian.Uint32(data[8:]),
+		Inception:   binary.BigEndian.Uint32(data[12:]),
+		KeyTag:      binary.BigEndian.Uint16(data[16:]),
+	}
+
+	signer := Answer{Data: data}
+	name, length := signer.GetName(18)
+	sig.SignerName = name
+	sig.Signature = data[18+length:]
+	sig.signedRData = data[0 : 18+length]
+
+	return sig, nil
+}
+
+// ParseNSEC 解析NSEC记录
+func ParseNSEC(rr *RR) (nsec *NSEC, err error) {
+	if rr.Type != TypeNSEC || len(rr.Data) < 1 {
+		return nil, fmt.Errorf("invalid NSEC record of %s", rr.Name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			nsec, err = nil, fmt.Errorf("invalid NSEC record of %s: %v", rr.Name, r)
+		}
+	}()
+
+	next := Answer{Data: rr.Data}
+	name, length := next.GetName(0)
+	types, err := parseTypeBitMaps(rr.Data[length:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid NSEC record of %s: %w", rr.Name, err)
+	}
+
+	return &NSEC{Owner: rr.Name, NextName: name, Types: types}, nil
+}
+
+// ParseNSEC3 解析NSEC3记录
+func ParseNSEC3(rr *RR) (*NSEC3, error) {
+	data := rr.Data
+	if rr.Type != TypeNSEC3 || len(data) < 5 || len(data) < 6+int(data[4]) {
+		return nil, fmt.Errorf("invalid NSEC3 record of %s", rr.Name)
+	}
+
+	nsec3 := &NSEC3{
+		Owner:      rr.Name,
+		HashAlg:    data[0],
+		Flags:      data[1],
+		Iterations: binary.BigEndian.Uint16(data[2:]),
+	}
+
+	offset := 5 + int(data[4])
+	nsec3.Salt = data[5:offset]
+
+	hashLen := int(data[offset])
+	offset++
+	if offset+hashLen > len(data) {
+		return nil, fmt.Errorf("invalid NSEC3 record of %s", rr.Name)
+	}
+	nsec3.NextHashed = data[offset : offset+hashLen]
+
+	types, err := parseTypeBitMaps(data[offset+hashLen:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid NSEC3 record of %s: %w", rr.Name, err)
+	}
+	nsec3.Types = types
+
+	return nsec3, nil
+}
+
+func (nsec *NSEC) HasType(rType uint16) bool {
+	return hasType(nsec.Types, rType)
+}
+
+// Covers name是否在(owner, next)之间，最后一个NSEC的next是zone的顶点，回绕到第一个，RFC4034 4.1.1
+func (nsec *NSEC) Covers(name string) bool {
+	if CompareNames(nsec.Owner, nsec.NextName) < 0 {
+		return CompareNames(nsec.Owner, name) < 0 && CompareNames(name, nsec.NextName) < 0
+	}
+
+	return CompareNames(nsec.Owner, name) < 0 || CompareNames(name, nsec.NextName) < 0
+}
+
+func (nsec3 *NSEC3) HasType(rType uint16) bool {
+	return hasType(nsec3.Types, rType)
+}
+
+func (nsec3 *NSEC3) OptOut() bool {
+	return nsec3.Flags&NSEC3FlagOptOut != 0
+}
+
+// OwnerHash NSEC3 owner的第一个label，即base32hex编码的hash
+func (nsec3 *NSEC3) OwnerHash() string {
+	label, _, _ := strings.Cut(nsec3.Owner, ".")
+	return strings.ToUpper(label)
+}
+
+func (nsec3 *NSEC3) NextHash() string {
+	return base32HexNoPadding.EncodeToString(nsec3.NextHashed)
+}
+
+// Covers hash是否在(owner, next)之间，最后一个NSEC3的next回绕到第一个
+func (nsec3 *NSEC3) Covers(hash string) bool {
+	owner, next, hash := nsec3.OwnerHash(), nsec3.NextHash(), strings.ToUpper(hash)
+	if owner < next {
+		return owner < hash && hash < next
+	}
+
+	return owner < hash || hash < next
+}
+
+// Hash 用该NSEC3的参数计算name的hash
+func (nsec3 *NSEC3) Hash(name string) (string, error) {
+	return NSEC3Hash(name, nsec3.HashAlg, nsec3.Salt, nsec3.Iterations)
+}
+
+// Matches NSEC3的owner是否是该hash
+func (nsec3 *NSEC3) Matches(hash string) bool {
+	return strings.EqualFold(nsec3.OwnerHash(), hash)
+}
+
+func hasType(types []uint16, rType uint16) bool {
+	for _, t := range types {
+		if t == rType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTypeBitMaps 解析NSEC/NSEC3中的Type Bit Maps，RFC4034 4.1.2
+func parseTypeBitMaps(data []byte) ([]uint16, error) {
+	var types []uint16
+	for offset := 0; offset < len(data); {
+		if offset+2 > len(data) {
+			return nil, fmt.Errorf("type bit maps truncated")
+		}
+
+		window, length := int(data[offset]), int(data[offset+1])
+		offset += 2
+		if length == 0 || length > 32 || offset+length > len(data) {
+			return nil, fmt.Errorf("invalid type bit map length %d", length)
+		}
+
+		for idx := 0; idx < length; idx++ {
+			for bit := 0; bit < 8; bit++ {
+				if data[offset+idx]&(0x80>>bit) != 0 {
+					types = append(types, uint16(window<<8|idx*8+bit))
+				}
+			}
+		}
+		offset += length
+	}
+
+	return types, nil
+}
+
+var base32HexNoPadding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// dnssecRDataString DNSSEC记录的展示格式，和dig一致
+func dnssecRDataString(rr *RR) string {
+	var err error
+	var str string
+	switch rr.Type {
+	case TypeDNSKEY:
+		var key *DNSKEY
+		if key, err = ParseDNSKEY(rr); err == nil {
+			str = fmt.Sprintf("%d %d %d %s", key.Flags, key.Protocol, key.Algorithm,
+				base64.StdEncoding.EncodeToString(key.PublicKey))
+		}
+	case TypeDS:
+		var ds *DS
+		if ds, err = ParseDS(rr); err == nil {
+			str = fmt.Sprintf("%d %d %d %X", ds.KeyTag, ds.Algorithm, ds.DigestType, ds.Digest)
+		}
+	case TypeRRSIG:
+		var sig *RRSIG
+		if sig, err = ParseRRSIG(rr); err == nil {
+			str = fmt.Sprintf("%s %d %d %d %s %s %d %s %s", TypeString(sig.TypeCovered), sig.Algorithm, sig.Labels,
+				sig.OriginalTTL, sigTimeString(sig.Expiration), sigTimeString(sig.Inception), sig.KeyTag,
+				sig.SignerName, base64.StdEncoding.EncodeToString(sig.Signature))
+		}
+	case TypeNSEC:
+		var nsec *NSEC
+		if nsec, err = ParseNSEC(rr); err == nil {
+			str = strings.TrimSpace(nsec.NextName + " " + typesString(nsec.Types))
+		}
+	case TypeNSEC3:
+		var nsec3 *NSEC3
+		if nsec3, err = ParseNSEC3(rr); err == nil {
+			salt := "-"
+			if len(nsec3.Salt) > 0 {
+				salt = fmt.Sprintf("%X", nsec3.Salt)
+			}
+			str = strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", nsec3.HashAlg, nsec3.Flags, nsec3.Iterations,
+				salt, nsec3.NextHash(), typesString(nsec3.Types)))
+		}
+	}
+
+	if err != nil || str == "" {
+		return fmt.Sprintf("\\# %d %x", len(rr.Data), rr.Data)
+	}
+
+	return str
+}
+
+func typesString(types []uint16) string {
+	var names []string
+	for _, t := range types {
+		names = append(names, TypeString(t))
+	}
+
+	return strings.Join(names, " ")
+}
+
+// sigTimeString RRSIG中的时间，YYYYMMDDHHmmSS格式
+func sigTimeString(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
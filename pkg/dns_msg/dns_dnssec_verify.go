@@ -0,0 +1,371 @@
+package dns_msg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported DNSSEC algorithm")
+	ErrUnsupportedDigest    = errors.New("unsupported DS digest type")
+)
+
+// SupportedAlgorithm 是否支持该DNSSEC签名算法，不支持的算法按insecure处理，RFC4035 5.2
+func SupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case AlgRSASHA1, AlgRSASHA1NSEC3SHA1, AlgRSASHA256, AlgRSASHA512, AlgECDSAP256SHA256, AlgECDSAP384SHA384, AlgED25519:
+		return true
+	}
+
+	return false
+}
+
+func SupportedDigest(digestType uint8) bool {
+	return digestType == DigestSHA1 || digestType == DigestSHA256 || digestType == DigestSHA384
+}
+
+// KeyTag 计算DNSKEY的key tag，RFC4034 Appendix B
+func (key *DNSKEY) KeyTag() uint16 {
+	var ac uint32
+	for idx, b := range key.RData {
+		if idx&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+
+	return uint16(ac & 0xFFFF)
+}
+
+// Digest 计算DNSKEY的DS摘要: digest = hash(owner name | DNSKEY RDATA)
+func (key *DNSKEY) Digest(digestType uint8) ([]byte, error) {
+	var h hash.Hash
+	switch digestType {
+	case DigestSHA1:
+		h = sha1.New()
+	case DigestSHA256:
+		h = sha256.New()
+	case DigestSHA384:
+		h = sha512.New384()
+	default:
+		return nil, ErrUnsupportedDigest
+	}
+
+	h.Write(CanonicalName(key.Owner))
+	h.Write(key.RData)
+
+	return h.Sum(nil), nil
+}
+
+// Matches DS是否是该DNSKEY的摘要
+func (ds *DS) Matches(key *DNSKEY) bool {
+	if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm || !strings.EqualFold(ds.Owner, key.Owner) {
+		return false
+	}
+
+	digest, err := key.Digest(ds.DigestType)
+	return err == nil && bytes.Equal(digest, ds.Digest)
+}
+
+// CanonicalName 域名的canonical wire格式: 小写，不压缩，RFC4034 6.2
+func CanonicalName(name string) []byte {
+	var data []byte
+	for _, label := range strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".") {
+		if label == "" {
+			continue
+		}
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+
+	return append(data, 0)
+}
+
+// LabelCount 域名的label数，根为0
+func LabelCount(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || name == "." {
+		return 0
+	}
+
+	return strings.Count(name, ".") + 1
+}
+
+// CompareNames 按canonical顺序比较两个域名，从最右边的label开始逐个比较小写的label，RFC4034 6.1
+func CompareNames(a, b string) int {
+	aLabels, bLabels := canonicalLabels(a), canonicalLabels(b)
+	for i, j := len(aLabels)-1, len(bLabels)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(aLabels[i], bLabels[j]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(aLabels) < len(bLabels):
+		return -1
+	case len(aLabels) > len(bLabels):
+		return 1
+	}
+
+	return 0
+}
+
+func canonicalLabels(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || name == "." {
+		return nil
+	}
+
+	return strings.Split(name, ".")
+}
+
+// CanonicalRData RR的canonical RDATA: RDATA中的域名展开指针并转为小写，RFC4034 6.2
+func (msg *Message) CanonicalRData(rr *RR) []byte {
+	answer := Answer{Data: msg.Raw}
+	switch rr.Type {
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		name, _ := answer.GetName(rr.Offset)
+		return CanonicalName(name)
+	case TypeMX:
+		name, _ := answer.GetName(rr.Offset + 2)
+		return append(append([]byte(nil), rr.Data[0:2]...), CanonicalName(name)...)
+	case TypeSRV:
+		name, _ := answer.GetName(rr.Offset + 6)
+		return append(append([]byte(nil), rr.Data[0:6]...), CanonicalName(name)...)
+	case TypeSOA:
+		mName, length := answer.GetName(rr.Offset)
+		rName, rLength := answer.GetName(rr.Offset + length)
+		data := append(CanonicalName(mName), CanonicalName(rName)...)
+		return append(data, rr.Data[length+rLength:]...)
+	}
+
+	return rr.Data
+}
+
+// VerifyRRSIG 用key验证sig对rrset的签名，rrset必须是同一个owner和type的记录，RFC4035 5.3
+func (msg *Message) VerifyRRSIG(sig *RRSIG, key *DNSKEY, rrset []RR, now time.Time) (err error) {
+	if len(rrset) == 0 {
+		return fmt.Errorf("empty rrset")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed rrset %s: %v", rrset[0].Name, r)
+		}
+	}()
+
+	owner := rrset[0].Name
+	switch {
+	case sig.TypeCovered != rrset[0].Type:
+		return fmt.Errorf("RRSIG covers %s, not %s", TypeString(sig.TypeCovered), TypeString(rrset[0].Type))
+	case !strings.EqualFold(sig.SignerName, key.Owner) || sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm:
+		return fmt.Errorf("RRSIG of %s is not signed by key %d of %s", owner, key.KeyTag(), key.Owner)
+	case key.Flags&DNSKEYFlagZone == 0 || key.Protocol != 3:
+		return fmt.Errorf("key %d of %s is not a zone key", key.KeyTag(), key.Owner)
+	case int(sig.Labels) > LabelCount(owner):
+		return fmt.Errorf("RRSIG labels %d of %s is too large", sig.Labels, owner)
+	}
+
+	// 序号算术比较，RFC1982
+	unix := uint32(now.Unix())
+	if int32(unix-sig.Inception) < 0 {
+		return fmt.Errorf("RRSIG of %s %s is not yet valid, inception %s", owner, TypeString(sig.TypeCovered), sigTimeString(sig.Inception))
+	}
+	if int32(sig.Expiration-unix) < 0 {
+		return fmt.Errorf("RRSIG of %s %s expired at %s", owner, TypeString(sig.TypeCovered), sigTimeString(sig.Expiration))
+	}
+
+	// 通配符展开的记录按照签名时的owner "*.<后Labels个label>"计算
+	signedOwner := owner
+	if int(sig.Labels) < LabelCount(owner) {
+		labels := strings.Split(strings.TrimSuffix(owner, "."), ".")
+		signedOwner = "*." + strings.Join(labels[len(labels)-int(sig.Labels):], ".")
+	}
+
+	// 每条记录: owner | type | class | original TTL | RDLENGTH | RDATA，按canonical RDATA排序并去重
+	var rdatas [][]byte
+	for idx := range rrset {
+		rdatas = append(rdatas, msg.CanonicalRData(&rrset[idx]))
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+
+	signed := append([]byte(nil), sig.signedRData[0:18]...)
+	signed = append(signed, CanonicalName(sig.SignerName)...)
+	ownerData := CanonicalName(signedOwner)
+	for idx, rdata := range rdatas {
+		if idx > 0 && bytes.Equal(rdata, rdatas[idx-1]) {
+			continue
+		}
+
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:], rrset[0].Type)
+		binary.BigEndian.PutUint16(fixed[2:], rrset[0].Class)
+		binary.BigEndian.PutUint32(fixed[4:], sig.OriginalTTL)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+
+		signed = append(signed, ownerData...)
+		signed = append(signed, fixed[:]...)
+		signed = append(signed, rdata...)
+	}
+
+	return verifySignature(key, signed, sig.Signature)
+}
+
+func verifySignature(key *DNSKEY, data, signature []byte) error {
+	var hashType crypto.Hash
+	switch key.Algorithm {
+	case AlgRSASHA1, AlgRSASHA1NSEC3SHA1:
+		hashType = crypto.SHA1
+	case AlgRSASHA256, AlgECDSAP256SHA256:
+		hashType = crypto.SHA256
+	case AlgRSASHA512:
+		hashType = crypto.SHA512
+	case AlgECDSAP384SHA384:
+		hashType = crypto.SHA384
+	case AlgED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid ED25519 public key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, signature) {
+			return fmt.Errorf("signature verification failed")
+		}
+		return nil
+	default:
+		return ErrUnsupportedAlgorithm
+	}
+
+	h := hashType.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch key.Algorithm {
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		// 公钥为X|Y，签名为R|S
+		curve := elliptic.P256()
+		if key.Algorithm == AlgECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		if len(key.PublicKey) != 2*size || len(signature) != 2*size {
+			return fmt.Errorf("invalid ECDSA public key or signature length")
+		}
+
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[0:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		r := new(big.Int).SetBytes(signature[0:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("signature verification failed")
+		}
+		return nil
+	}
+
+	pub, err := parseRSAPublicKey(key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if err := rsa.VerifyPKCS1v15(pub, hashType, digest, signature); err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	return nil
+}
+
+// parseRSAPublicKey RFC3110: exponent长度(1或3字节) | exponent | modulus
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("invalid RSA public key")
+	}
+
+	expLen, offset := int(data[0]), 1
+	if expLen == 0 {
+		expLen, offset = int(binary.BigEndian.Uint16(data[1:])), 3
+	}
+
+	if expLen == 0 || expLen > 4 || offset+expLen >= len(data) {
+		return nil, fmt.Errorf("invalid RSA public key exponent")
+	}
+
+	exponent := 0
+	for _, b := range data[offset : offset+expLen] {
+		exponent = exponent<<8 | int(b)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(data[offset+expLen:]),
+		E: exponent,
+	}, nil
+}
+
+// NSEC3Hash 计算name的NSEC3 hash，返回base32hex编码，RFC5155 5
+func NSEC3Hash(name string, hashAlg uint8, salt []byte, iterations uint16) (string, error) {
+	if hashAlg != 1 {
+		return "", fmt.Errorf("unsupported NSEC3 hash algorithm %d", hashAlg)
+	}
+
+	h := sha1.New()
+	h.Write(CanonicalName(name))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for idx := uint16(0); idx < iterations; idx++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(nil)
+	}
+
+	return base32HexNoPadding.EncodeToString(digest), nil
+}
+
+// RRSet 返回rrs中owner为name、类型为rType的记录
+func RRSet(rrs []RR, name string, rType uint16) []RR {
+	var rrset []RR
+	for _, rr := range rrs {
+		if rr.Type == rType && strings.EqualFold(rr.Name, name) {
+			rrset = append(rrset, rr)
+		}
+	}
+
+	return rrset
+}
+
+// Signatures 返回rrs中owner为name、覆盖rType的RRSIG
+func Signatures(rrs []RR, name string, rType uint16) []*RRSIG {
+	var sigs []*RRSIG
+	for idx := range rrs {
+		rr := &rrs[idx]
+		if rr.Type != TypeRRSIG || !strings.EqualFold(rr.Name, name) {
+			continue
+		}
+
+		if sig, err := ParseRRSIG(rr); err == nil && sig.TypeCovered == rType {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
@@ -0,0 +1,265 @@
+package dns_msg_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+	"github.com/walkerdu/super-dig/pkg/dnstest"
+)
+
+// RFC4034 5.4的示例key，RFC4509 2.2.1给出了它的SHA-256 DS
+const rfc4034Key = "AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvxeg" +
+	"Xd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw=="
+
+func TestKeyTagAndDS(t *testing.T) {
+	publicKey, err := base64.StdEncoding.DecodeString(rfc4034Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := dnsMsg.ParseDNSKEY(&dnsMsg.RR{Name: "dskey.example.com", Type: dnsMsg.TypeDNSKEY,
+		Data: append([]byte{0x01, 0x00, 3, dnsMsg.AlgRSASHA1}, publicKey...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.KeyTag() != 60485 {
+		t.Errorf("key tag %d, want 60485", key.KeyTag())
+	}
+
+	tests := []struct {
+		owner      string
+		digestType uint8
+		digest     string
+		match      bool
+	}{
+		{"dskey.example.com", dnsMsg.DigestSHA1, "2BB183AF5F22588179A53B0A98631FAD1A292118", true},
+		{"dskey.example.com", dnsMsg.DigestSHA256, "D4B7D520E7BB5F0F67674A0CCEB1E3E0614B93C4F9E99B8383F6A1E4469DA50A", true},
+		{"DSKEY.Example.COM", dnsMsg.DigestSHA1, "2BB183AF5F22588179A53B0A98631FAD1A292118", true},
+		{"dskey.example.com", dnsMsg.DigestSHA1, "2BB183AF5F22588179A53B0A98631FAD1A292119", false},
+		{"other.example.com", dnsMsg.DigestSHA1, "2BB183AF5F22588179A53B0A98631FAD1A292118", false},
+		{"dskey.example.com", 3, "2BB183AF5F22588179A53B0A98631FAD1A292118", false},
+	}
+
+	for _, test := range tests {
+		digest, _ := hex.DecodeString(test.digest)
+		ds := &dnsMsg.DS{Owner: test.owner, KeyTag: 60485, Algorithm: dnsMsg.AlgRSASHA1, DigestType: test.digestType, Digest: digest}
+		if ds.Matches(key) != test.match {
+			t.Errorf("DS %s %d %s matches %v, want %v", test.owner, test.digestType, test.digest, !test.match, test.match)
+		}
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC5155 Appendix A，salt为aabbccdd，12次迭代
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	tests := map[string]string{
+		"example":     "0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM",
+		"EXAMPLE.":    "0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM",
+		"a.example":   "35MTHGPGCU1QG68FAB165KLNSNK3DPVL",
+		"ai.example":  "GJEQE526PLBF1G8MKLP59ENFD789NJGI",
+		"ns1.example": "2T7B4G4VSA5SMI47K61MV5BV1A22BOJR",
+		"*.w.example": "R53BQ7CC2UVMUBFU5OCMM6PERS9TK9EN",
+		"x.w.example": "B4UM86EGHHDS6NEA196SMVMLO4ORS995",
+	}
+
+	for name, want := range tests {
+		hash, err := dnsMsg.NSEC3Hash(name, 1, salt, 12)
+		if err != nil || hash != want {
+			t.Errorf("NSEC3Hash(%s) = %s, %v, want %s", name, hash, err, want)
+		}
+	}
+
+	if _, err := dnsMsg.NSEC3Hash("example", 2, salt, 12); err == nil {
+		t.Error("unsupported hash algorithm is not an error")
+	}
+}
+
+func TestCompareNames(t *testing.T) {
+	// RFC4034 6.1的示例，按canonical顺序排列
+	names := []string{
+		"example",
+		"a.example",
+		"yljkjljk.a.example",
+		"Z.a.example",
+		"zABC.a.EXAMPLE",
+		"z.example",
+		"\x01.z.example",
+		"*.z.example",
+		"\xc8.z.example",
+	}
+
+	for i := range names {
+		for j := range names {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+
+			if got := dnsMsg.CompareNames(names[i], names[j]); got != want {
+				t.Errorf("CompareNames(%q, %q) = %d, want %d", names[i], names[j], got, want)
+			}
+		}
+	}
+
+	if dnsMsg.CompareNames("Example.", "example") != 0 || dnsMsg.CompareNames(".", "example") >= 0 {
+		t.Error("root or trailing dot compared incorrectly")
+	}
+}
+
+func TestNSECCovers(t *testing.T) {
+	tests := []struct {
+		owner, next, name string
+		covers            bool
+	}{
+		{"a.example", "d.example", "b.example", true},
+		{"a.example", "d.example", "x.b.example", true},
+		{"a.example", "d.example", "a.example", false},
+		{"a.example", "d.example", "d.example", false},
+		{"a.example", "d.example", "e.example", false},
+		// 最后一个NSEC指向zone的顶点
+		{"d.example", "example", "e.example", true},
+		{"d.example", "example", "x.d.example", true},
+		{"d.example", "example", "c.example", false},
+	}
+
+	for _, test := range tests {
+		nsec := &dnsMsg.NSEC{Owner: test.owner, NextName: test.next}
+		if nsec.Covers(test.name) != test.covers {
+			t.Errorf("NSEC %s -> %s covers %s: %v, want %v", test.owner, test.next, test.name, !test.covers, test.covers)
+		}
+	}
+}
+
+func TestCanonicalRData(t *testing.T) {
+	// 应答中CNAME和MX的RDATA都用指针指向question中的"Example.COM"
+	raw := []byte{0, 0, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0,
+		3, 'w', 'w', 'w', 7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'C', 'O', 'M', 0, 0, 1, 0, 1,
+		0xc0, 12, 0, 5, 0, 1, 0, 0, 1, 0x2c, 0, 6, 3, 'C', 'D', 'N', 0xc0, 16,
+		0xc0, 16, 0, 15, 0, 1, 0, 0, 1, 0x2c, 0, 9, 0, 10, 4, 'M', 'a', 'i', 'l', 0xc0, 16,
+	}
+	msg, err := dnsMsg.ParseMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 2 {
+		t.Fatalf("%d answers", len(msg.Answers))
+	}
+
+	want := [][]byte{
+		[]byte("\x03cdn\x07example\x03com\x00"),
+		[]byte("\x00\x0a\x04mail\x07example\x03com\x00"),
+	}
+	for idx := range msg.Answers {
+		if got := msg.CanonicalRData(&msg.Answers[idx]); !bytes.Equal(got, want[idx]) {
+			t.Errorf("canonical RDATA of %s %q, want %q", dnsMsg.TypeString(msg.Answers[idx].Type), got, want[idx])
+		}
+	}
+
+	// 不包含域名的RDATA保持不变
+	rr := &dnsMsg.RR{Type: dnsMsg.TypeTXT, Data: []byte("\x03ABC")}
+	if got := msg.CanonicalRData(rr); !bytes.Equal(got, rr.Data) {
+		t.Errorf("canonical RDATA of TXT %q", got)
+	}
+}
+
+func TestParseRSAPublicKey(t *testing.T) {
+	modulus := bytes.Repeat([]byte{0xc5}, 64)
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"short exponent length", append([]byte{3, 1, 0, 1}, modulus...), true},
+		{"long exponent length", append([]byte{0, 0, 3, 1, 0, 1}, modulus...), true},
+		{"empty", nil, false},
+		{"no modulus", []byte{3, 1, 0, 1}, false},
+		{"zero exponent length", append([]byte{0, 0, 0}, modulus...), false},
+		{"exponent too long", append([]byte{5, 1, 0, 0, 0, 1}, modulus...), false},
+	}
+
+	for _, test := range tests {
+		key, err := dnsMsg.ParseRSAPublicKey(test.data)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if key.E != 65537 || key.N.Cmp(new(big.Int).SetBytes(modulus)) != 0 {
+			t.Errorf("%s: exponent %d, modulus %x", test.name, key.E, key.N.Bytes())
+		}
+	}
+}
+
+func TestVerifyRRSIG(t *testing.T) {
+	now := time.Now()
+	for _, alg := range []uint8{dnsMsg.AlgECDSAP256SHA256, dnsMsg.AlgED25519, dnsMsg.AlgRSASHA256} {
+		signer, err1 := dnstest.NewSigner("example.com", alg)
+		other, err2 := dnstest.NewSigner("example.com", alg)
+		if err1 != nil || err2 != nil {
+			t.Fatal(err1, err2)
+		}
+
+		expired := *signer
+		expired.Inception, expired.Expiration = now.Add(-48*time.Hour), now.Add(-time.Hour)
+
+		rrset := []dnstest.RR{dnstest.A("www.example.com", 300, "10.0.0.2"), dnstest.A("www.example.com", 300, "10.0.0.1")}
+		cname := []dnstest.RR{dnstest.CNAME("Alias.Example.com", 300, "Edge.Example.NET")}
+		wildcard := signer.Sign([]dnstest.RR{dnstest.A("*.wild.example.com", 300, "10.0.0.3")})
+		wildcard.Name = "a.b.wild.example.com"
+		apex := signer.Sign(rrset)
+		apex.Name = "example.com"
+
+		tests := []struct {
+			name    string
+			answers []dnstest.RR
+			signer  *dnstest.Signer
+			now     time.Time
+			ok      bool
+		}{
+			{"valid", append(rrset, signer.Sign(rrset)), signer, now, true},
+			{"mixed case", append(cname, signer.Sign(cname)), signer, now, true},
+			{"wildcard", []dnstest.RR{dnstest.A("a.b.wild.example.com", 300, "10.0.0.3"), wildcard}, signer, now, true},
+			{"tampered", []dnstest.RR{rrset[0], dnstest.A("www.example.com", 300, "10.0.0.9"), signer.Sign(rrset)}, signer, now, false},
+			{"other key", append(rrset, signer.Sign(rrset)), other, now, false},
+			{"expired", append(rrset, expired.Sign(rrset)), signer, now, false},
+			{"not yet valid", append(rrset, signer.Sign(rrset)), signer, now.Add(-48 * time.Hour), false},
+			{"labels too large", []dnstest.RR{dnstest.A("example.com", 300, "10.0.0.1"), dnstest.A("example.com", 300, "10.0.0.2"), apex}, signer, now, false},
+		}
+
+		for _, test := range tests {
+			msg, err := dnsMsg.ParseMessage(dnstest.Pack(test.answers[0].Name, test.answers[0].Type,
+				&dnstest.Response{Answers: test.answers}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			last := len(msg.Answers) - 1
+			sig, err := dnsMsg.ParseRRSIG(&msg.Answers[last])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dnskey := test.signer.DNSKEY(3600)
+			key, err := dnsMsg.ParseDNSKEY(&dnsMsg.RR{Name: dnskey.Name, Type: dnskey.Type, Data: dnskey.Data})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = msg.VerifyRRSIG(sig, key, msg.Answers[:last], test.now)
+			if (err == nil) != test.ok {
+				t.Errorf("algorithm %d, %s: %v", alg, test.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package dns_msg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+/*
+   https://www.rfc-editor.org/rfc/rfc6891#section-6.1.3
+   OPT记录的TTL字段:
+
+                +0 (MSB)                            +1 (LSB)
+     +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+  0: |         EXTENDED-RCODE        |            VERSION            |
+     +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+  2: | DO|                           Z                               |
+     +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+*/
+
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-11
+const (
+	OptionNSID         uint16 = 3  // RFC5001
+	OptionClientSubnet uint16 = 8  // RFC7871
+	OptionCookie       uint16 = 10 // RFC7873
+
+	DefaultUDPSize uint16 = 4096
+)
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// EDNS 解析后的OPT记录
+type EDNS struct {
+	UDPSize  uint16
+	ExtRCode uint8
+	Version  uint8
+	DO       bool
+	Options  []EDNSOption
+}
+
+// EDNS 返回报文中的OPT记录，没有时返回false
+func (msg *Message) EDNS() (*EDNS, bool) {
+	for idx := range msg.Additional {
+		rr := &msg.Additional[idx]
+		if rr.Type != TypeOPT {
+			continue
+		}
+
+		edns := &EDNS{
+			UDPSize:  rr.Class,
+			ExtRCode: uint8(rr.TTL >> 24),
+			Version:  uint8(rr.TTL >> 16),
+			DO:       rr.TTL&0x8000 != 0,
+		}
+
+		for offset := 0; offset+4 <= len(rr.Data); {
+			code := binary.BigEndian.Uint16(rr.Data[offset:])
+			length := int(binary.BigEndian.Uint16(rr.Data[offset+2:]))
+			offset += 4
+
+			if offset+length > len(rr.Data) {
+				break
+			}
+
+			edns.Options = append(edns.Options, EDNSOption{Code: code, Data: rr.Data[offset : offset+length]})
+			offset += length
+		}
+
+		return edns, true
+	}
+
+	return nil, false
+}
+
+// Option 返回第一个指定code的option
+func (edns *EDNS) Option(code uint16) ([]byte, bool) {
+	for _, option := range edns.Options {
+		if option.Code == code {
+			return option.Data, true
+		}
+	}
+
+	return nil, false
+}
+
+// AddOPT 添加OPT记录，返回写入后的offset
+func (additional *Additional) AddOPT(offset int, udpSize uint16, version uint8, do bool, options []EDNSOption) int {
+	// Set RR NAME (empty, as it's not required for EDNS options)
+	offset += additional.SetName(offset)
+
+	// Set RR Type = 41 (OPT)
+	offset += additional.SetType(offset, TypeOPT)
+
+	// Set RR Class = UDP Payload Size
+	offset += additional.SetClass(offset, udpSize)
+
+	// Set RR TTL = extended RCODE and flags
+	ttl := uint32(version) << 16
+	if do {
+		ttl |= 0x8000
+	}
+	offset += additional.SetTTL(offset, ttl)
+
+	rDLen := 0
+	for _, option := range options {
+		rDLen += 4 + len(option.Data)
+	}
+	offset += additional.SetDLen(offset, uint16(rDLen))
+
+	for _, option := range options {
+		offset += additional.SetOptCode(offset, option.Code)
+		offset += additional.SetOptDLen(offset, uint16(len(option.Data)))
+		offset += copy(additional.Data[offset:], option.Data)
+	}
+
+	return offset
+}
+
+// ClientSubnet 解析后的edns client subnet option
+type ClientSubnet struct {
+	Family       uint16
+	SourcePrefix uint8
+	ScopePrefix  uint8
+	Address      net.IP
+}
+
+func (subnet *ClientSubnet) String() string {
+	return fmt.Sprintf("%s/%d/%d", subnet.Address, subnet.SourcePrefix, subnet.ScopePrefix)
+}
+
+func ParseClientSubnet(data []byte) (*ClientSubnet, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("client subnet option too short: %d bytes", len(data))
+	}
+
+	subnet := &ClientSubnet{
+		Family:       binary.BigEndian.Uint16(data),
+		SourcePrefix: data[2],
+		ScopePrefix:  data[3],
+	}
+
+	addrLen := net.IPv4len
+	if subnet.Family == 2 {
+		addrLen = net.IPv6len
+	} else if subnet.Family != 1 {
+		return nil, fmt.Errorf("unknown client subnet family %d", subnet.Family)
+	}
+
+	if len(data)-4 > addrLen {
+		return nil, fmt.Errorf("client subnet address too long: %d bytes", len(data)-4)
+	}
+
+	subnet.Address = make(net.IP, addrLen)
+	copy(subnet.Address, data[4:])
+
+	return subnet, nil
+}
+
+// NewClientSubnetOption 构造edns client subnet option，只携带source netmask覆盖的字节，多余的bit置0
+func NewClientSubnetOption(clientIP net.IP, sourceNetMaskLen uint8) EDNSOption {
+	// IP Version (1 for IPv4, 2 for IPv6)
+	family := uint16(1)
+	address := clientIP.To4()
+	if address == nil {
+		family = 2
+		address = clientIP.To16()
+	}
+
+	subNetIpLen := (int(sourceNetMaskLen) + 7) / 8
+	address = append([]byte(nil), address[0:subNetIpLen]...)
+	if remain := sourceNetMaskLen % 8; remain != 0 {
+		address[subNetIpLen-1] &= 0xFF << (8 - remain)
+	}
+
+	option := Additional{
+		Data: make([]byte, 2+1+1+subNetIpLen),
+	}
+
+	offset := option.SetClientSubnetOptFamily(0, family)
+
+	// Source Netmask
+	offset += option.SetClientSubnetOptSourceNetMask(offset, sourceNetMaskLen)
+
+	// Scope Netmask (0 for IPv4, 0 for IPv6)
+	offset += option.SetClientSubnetOptScopeNetMask(offset, 0x00)
+
+	// Client SubNet IP address (4 bytes for IPv4, 16 bytes for IPv6)
+	option.SetClientSubnetOptAddress(offset, address)
+
+	return EDNSOption{Code: OptionClientSubnet, Data: option.Data}
+}
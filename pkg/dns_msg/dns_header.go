@@ -85,6 +85,28 @@ func (header *DNSHeader) GetRA() uint8 {
 	return header[3] >> 7
 }
 
+// SetAD Z中的AD位，RFC4035
+func (header *DNSHeader) SetAD(value uint8) {
+	header[3] |= (value & 0x01) << 5
+}
+
+func (header *DNSHeader) GetAD() uint8 {
+	return (header[3] >> 5) & 0x01
+}
+
+// SetCD Z中的CD位，RFC4035，设置后验证失败的递归nameserver也会返回结果
+func (header *DNSHeader) SetCD(value uint8) {
+	header[3] |= (value & 0x01) << 4
+}
+
+func (header *DNSHeader) GetCD() uint8 {
+	return (header[3] >> 4) & 0x01
+}
+
+func (header *DNSHeader) SetRCode(value uint8) {
+	header[3] |= value & 0x0F
+}
+
 func (header *DNSHeader) GetRCode() uint8 {
 	return header[3] & 0x0F
 }
@@ -101,10 +123,18 @@ func (header *DNSHeader) GetQDCount() uint16 {
 	return binary.BigEndian.Uint16(header[4:])
 }
 
+func (header *DNSHeader) SetANCount(value uint16) {
+	binary.BigEndian.PutUint16(header[6:], value)
+}
+
 func (header *DNSHeader) GetANCount() uint16 {
 	return binary.BigEndian.Uint16(header[6:])
 }
 
+func (header *DNSHeader) SetNSCount(value uint16) {
+	binary.BigEndian.PutUint16(header[8:], value)
+}
+
 func (header *DNSHeader) GetNSCount() uint16 {
 	return binary.BigEndian.Uint16(header[8:])
 }
@@ -0,0 +1,189 @@
+package dns_msg
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+   https://datatracker.ietf.org/doc/html/rfc1035#section-4.1
+
+    +---------------------+
+    |        Header       |
+    +---------------------+
+    |       Question      | the question for the name server
+    +---------------------+
+    |        Answer       | RRs answering the question
+    +---------------------+
+    |      Authority      | RRs pointing toward an authority
+    +---------------------+
+    |      Additional     | RRs holding additional information
+    +---------------------+
+*/
+
+// QuestionRR Question Section中的一项
+type QuestionRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR Answer/Authority/Additional Section中的一条资源记录
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+	// RDATA在报文中的偏移，RDATA中的域名可能是指向报文其他位置的指针
+	Offset int
+}
+
+// Message 解析后的DNS报文
+type Message struct {
+	Header     DNSHeader
+	Questions  []QuestionRR
+	Answers    []RR
+	Authority  []RR
+	Additional []RR
+	Raw        []byte
+}
+
+// ParseMessage 解析完整的DNS报文，报文不完整或格式错误时返回error
+func ParseMessage(data []byte) (msg *Message, err error) {
+	msg = &Message{Raw: data}
+	if len(data) < len(msg.Header) {
+		return nil, fmt.Errorf("message too short: %d bytes", len(data))
+	}
+	copy(msg.Header[:], data)
+
+	// 域名解析越界时会panic
+	defer func() {
+		if r := recover(); r != nil {
+			msg, err = nil, fmt.Errorf("malformed message: %v", r)
+		}
+	}()
+
+	question := Question{Data: data}
+	offset := len(msg.Header)
+	for idx := uint16(0); idx < msg.Header.GetQDCount(); idx++ {
+		var q QuestionRR
+		var length int
+
+		q.Name, length = question.GetQName(offset)
+		offset += length
+
+		if offset+4 > len(data) {
+			return nil, fmt.Errorf("question section truncated")
+		}
+
+		q.Type, length = question.GetQType(offset)
+		offset += length
+
+		q.Class, length = question.GetQClass(offset)
+		offset += length
+
+		msg.Questions = append(msg.Questions, q)
+	}
+
+	sections := []struct {
+		count uint16
+		rrs   *[]RR
+	}{
+		{msg.Header.GetANCount(), &msg.Answers},
+		{msg.Header.GetNSCount(), &msg.Authority},
+		{msg.Header.GetARCount(), &msg.Additional},
+	}
+
+	answer := Answer{Data: data}
+	for _, section := range sections {
+		for idx := uint16(0); idx < section.count; idx++ {
+			var rr RR
+			var length int
+
+			rr.Name, length = answer.GetName(offset)
+			offset += length
+
+			if offset+10 > len(data) {
+				return nil, fmt.Errorf("resource record truncated")
+			}
+
+			rr.Type, length = answer.GetType(offset)
+			offset += length
+
+			rr.Class, length = answer.GetClass(offset)
+			offset += length
+
+			rr.TTL, length = answer.GetTTL(offset)
+			offset += length
+
+			rDLen, length := answer.GetDLen(offset)
+			offset += length
+
+			if offset+int(rDLen) > len(data) {
+				return nil, fmt.Errorf("rdata of %s truncated", rr.Name)
+			}
+
+			rr.Offset = offset
+			rr.Data = answer.GetData(offset, rDLen)
+			offset += int(rDLen)
+
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+
+	return msg, nil
+}
+
+// RDataString 返回RR的RDATA展示格式
+func (msg *Message) RDataString(rr *RR) (str string) {
+	defer func() {
+		if r := recover(); r != nil {
+			str = fmt.Sprintf("\\# %d %x", len(rr.Data), rr.Data)
+		}
+	}()
+
+	answer := Answer{Data: msg.Raw}
+	return answer.GetRDataString(rr.Offset, rr.Type, uint16(len(rr.Data)))
+}
+
+// RRString 返回类似dig的一行RR展示格式
+func (msg *Message) RRString(rr *RR) string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s", rr.Name, rr.TTL, TypeString(rr.Type), msg.RDataString(rr))
+}
+
+// RCode 返回扩展后的RCODE，EDNS把RCODE扩展到了12位
+func (msg *Message) RCode() uint16 {
+	rcode := uint16(msg.Header.GetRCode())
+	if edns, ok := msg.EDNS(); ok {
+		rcode |= uint16(edns.ExtRCode) << 4
+	}
+
+	return rcode
+}
+
+func (msg *Message) String() string {
+	var builder strings.Builder
+	builder.WriteString(msg.Header.String())
+
+	for _, q := range msg.Questions {
+		fmt.Fprintf(&builder, ";%s\t%s\n", q.Name, TypeString(q.Type))
+	}
+
+	for _, section := range []struct {
+		name string
+		rrs  []RR
+	}{{"ANSWER", msg.Answers}, {"AUTHORITY", msg.Authority}, {"ADDITIONAL", msg.Additional}} {
+		if len(section.rrs) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&builder, ";; %s SECTION:\n", section.name)
+		for idx := range section.rrs {
+			builder.WriteString(msg.RRString(&section.rrs[idx]))
+			builder.WriteString("\n")
+		}
+	}
+
+	return builder.String()
+}
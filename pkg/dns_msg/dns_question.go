@@ -26,8 +26,13 @@ type Question struct {
 }
 
 func (question *Question) AddQuestion(qName string, qType, qClass uint16) {
-	labels := strings.Split(qName, ".")
+	// 忽略结尾的"."，根域名没有label
+	labels := strings.Split(strings.TrimSuffix(qName, "."), ".")
 	for _, label := range labels {
+		if label == "" {
+			continue
+		}
+
 		question.Data = append(question.Data, byte(len(label))) // 添加标签长度
 		question.Data = append(question.Data, []byte(label)...) // 添加标签内容
 	}
@@ -53,10 +58,12 @@ func (question *Question) GetQName(offset int) (name string, length int) {
 		}
 
 		if labelLen&0xC0 == 0xC0 {
-			// 如果是指针，则跳转到指针指向的位置继续解析
-			pointerOffset := int(binary.BigEndian.Uint16([]byte{0, question.Data[offset] & 0x3F}))
-			namePart, _ := question.GetQName(pointerOffset)
-			name += namePart
+			// 如果是指针，则跳转到指针指向的位置继续解析，指针只能指向前面的数据，避免死循环
+			pointerOffset := int(binary.BigEndian.Uint16([]byte{byte(labelLen) & 0x3F, question.Data[offset]}))
+			if pointerOffset < begin_offset {
+				namePart, _ := question.GetQName(pointerOffset)
+				name += namePart
+			}
 			offset++
 			break
 		}
@@ -66,8 +73,10 @@ func (question *Question) GetQName(offset int) (name string, length int) {
 		offset += labelLen
 	}
 
-	// 如果 name 以 . 结尾，去掉这个点
-	if name[len(name)-1] == '.' {
+	// 如果 name 以 . 结尾，去掉这个点，根域名为"."
+	if name == "" {
+		name = "."
+	} else if name[len(name)-1] == '.' {
 		name = name[:len(name)-1]
 	}
 
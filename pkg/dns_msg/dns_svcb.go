@@ -0,0 +1,217 @@
+package dns_msg
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+   https://www.rfc-editor.org/rfc/rfc9460 SVCB和HTTPS记录
+
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                  SvcPriority                  |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    /                  TargetName                   /
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                 SvcParamKey                   |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |              SvcParamValue length             |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    /                 SvcParamValue                 /
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    ...
+
+   SvcPriority为0时是AliasMode，TargetName中的域名不会被压缩，SvcParamKey按从小到大排列
+*/
+
+// https://www.iana.org/assignments/dns-svcb/dns-svcb.xhtml
+const (
+	SvcParamMandatory     uint16 = 0
+	SvcParamALPN          uint16 = 1
+	SvcParamNoDefaultALPN uint16 = 2
+	SvcParamPort          uint16 = 3
+	SvcParamIPv4Hint      uint16 = 4
+	SvcParamECH           uint16 = 5
+	SvcParamIPv6Hint      uint16 = 6
+	SvcParamDOHPath       uint16 = 7
+)
+
+var svcParamNames = map[uint16]string{
+	SvcParamMandatory:     "mandatory",
+	SvcParamALPN:          "alpn",
+	SvcParamNoDefaultALPN: "no-default-alpn",
+	SvcParamPort:          "port",
+	SvcParamIPv4Hint:      "ipv4hint",
+	SvcParamECH:           "ech",
+	SvcParamIPv6Hint:      "ipv6hint",
+	SvcParamDOHPath:       "dohpath",
+}
+
+type SvcParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// SVCB 解析后的SVCB/HTTPS记录
+type SVCB struct {
+	Priority uint16
+	Target   string
+	Params   []SvcParam
+}
+
+// SvcParamKeyString 返回SvcParamKey的名字，未知的key表示为keyNNNNN
+func SvcParamKeyString(key uint16) string {
+	if name, ok := svcParamNames[key]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("key%d", key)
+}
+
+// ParseSVCB 解析SVCB或HTTPS记录
+func ParseSVCB(rr *RR) (svcb *SVCB, err error) {
+	if (rr.Type != TypeSVCB && rr.Type != TypeHTTPS) || len(rr.Data) < 3 {
+		return nil, fmt.Errorf("invalid %s record of %s", TypeString(rr.Type), rr.Name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			svcb, err = nil, fmt.Errorf("invalid %s record of %s: %v", TypeString(rr.Type), rr.Name, r)
+		}
+	}()
+
+	target := Answer{Data: rr.Data}
+	name, length := target.GetName(2)
+	svcb = &SVCB{
+		Priority: binary.BigEndian.Uint16(rr.Data),
+		Target:   name,
+	}
+
+	for offset := 2 + length; offset < len(rr.Data); {
+		if offset+4 > len(rr.Data) {
+			return nil, fmt.Errorf("invalid %s record of %s: SvcParam truncated", TypeString(rr.Type), rr.Name)
+		}
+
+		key := binary.BigEndian.Uint16(rr.Data[offset:])
+		valueLen := int(binary.BigEndian.Uint16(rr.Data[offset+2:]))
+		offset += 4
+		if offset+valueLen > len(rr.Data) {
+			return nil, fmt.Errorf("invalid %s record of %s: SvcParam %s truncated", TypeString(rr.Type), rr.Name,
+				SvcParamKeyString(key))
+		}
+
+		svcb.Params = append(svcb.Params, SvcParam{Key: key, Value: rr.Data[offset : offset+valueLen]})
+		offset += valueLen
+	}
+
+	return svcb, nil
+}
+
+// Param 返回指定key的SvcParam
+func (svcb *SVCB) Param(key uint16) ([]byte, bool) {
+	for _, param := range svcb.Params {
+		if param.Key == key {
+			return param.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// ALPN 返回alpn中的协议列表
+func (svcb *SVCB) ALPN() []string {
+	value, _ := svcb.Param(SvcParamALPN)
+
+	var protocols []string
+	for offset := 0; offset < len(value); {
+		length := int(value[offset])
+		if offset+1+length > len(value) {
+			break
+		}
+		protocols = append(protocols, string(value[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+
+	return protocols
+}
+
+// String 和dig一致的展示格式，例如: 1 . alpn="h3,h2" ipv4hint=1.2.3.4，域名和其他记录一样不带末尾的点
+func (svcb *SVCB) String() string {
+	parts := []string{fmt.Sprint(svcb.Priority), svcb.Target}
+	for _, param := range svcb.Params {
+		parts = append(parts, param.String())
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (param *SvcParam) String() string {
+	key := SvcParamKeyString(param.Key)
+	value := param.Value
+
+	switch param.Key {
+	case SvcParamMandatory:
+		var keys []string
+		for offset := 0; offset+2 <= len(value); offset += 2 {
+			keys = append(keys, SvcParamKeyString(binary.BigEndian.Uint16(value[offset:])))
+		}
+		return key + "=" + strings.Join(keys, ",")
+	case SvcParamALPN:
+		svcb := SVCB{Params: []SvcParam{*param}}
+		var protocols []string
+		for _, protocol := range svcb.ALPN() {
+			// alpn中的逗号需要转义
+			protocols = append(protocols, strings.ReplaceAll(escapeCharString(protocol), ",", "\\\\,"))
+		}
+		return key + "=\"" + strings.Join(protocols, ",") + "\""
+	case SvcParamNoDefaultALPN:
+		return key
+	case SvcParamPort:
+		if len(value) == 2 {
+			return fmt.Sprintf("%s=%d", key, binary.BigEndian.Uint16(value))
+		}
+	case SvcParamIPv4Hint, SvcParamIPv6Hint:
+		size := net.IPv4len
+		if param.Key == SvcParamIPv6Hint {
+			size = net.IPv6len
+		}
+
+		if len(value)%size == 0 {
+			var ips []string
+			for offset := 0; offset < len(value); offset += size {
+				ips = append(ips, ParseIPFromRData(value[offset:offset+size]).String())
+			}
+			return key + "=" + strings.Join(ips, ",")
+		}
+	case SvcParamECH:
+		return key + "=" + base64.StdEncoding.EncodeToString(value)
+	}
+
+	if len(value) == 0 {
+		return key
+	}
+
+	return key + "=\"" + escapeCharString(string(value)) + "\""
+}
+
+// escapeCharString 按zone文件的character-string转义，不可打印字符表示为\DDD
+func escapeCharString(str string) string {
+	var builder strings.Builder
+	for idx := 0; idx < len(str); idx++ {
+		c := str[idx]
+		switch {
+		case c == '"' || c == '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(c)
+		case c < 0x20 || c > 0x7E:
+			fmt.Fprintf(&builder, "\\%03d", c)
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,136 @@
+package dns_msg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4
+const (
+	TypeA          uint16 = 1
+	TypeNS         uint16 = 2
+	TypeCNAME      uint16 = 5
+	TypeSOA        uint16 = 6
+	TypePTR        uint16 = 12
+	TypeMX         uint16 = 15
+	TypeTXT        uint16 = 16
+	TypeAAAA       uint16 = 28
+	TypeSRV        uint16 = 33
+	TypeDNAME      uint16 = 39
+	TypeOPT        uint16 = 41
+	TypeDS         uint16 = 43
+	TypeRRSIG      uint16 = 46
+	TypeNSEC       uint16 = 47
+	TypeDNSKEY     uint16 = 48
+	TypeNSEC3      uint16 = 50
+	TypeNSEC3PARAM uint16 = 51
+	TypeSVCB       uint16 = 64
+	TypeHTTPS      uint16 = 65
+	TypeANY        uint16 = 255
+
+	ClassINET uint16 = 1
+)
+
+var typeNames = map[uint16]string{
+	TypeA:          "A",
+	TypeNS:         "NS",
+	TypeCNAME:      "CNAME",
+	TypeSOA:        "SOA",
+	TypePTR:        "PTR",
+	TypeMX:         "MX",
+	TypeTXT:        "TXT",
+	TypeAAAA:       "AAAA",
+	TypeSRV:        "SRV",
+	TypeDNAME:      "DNAME",
+	TypeOPT:        "OPT",
+	TypeDS:         "DS",
+	TypeRRSIG:      "RRSIG",
+	TypeNSEC:       "NSEC",
+	TypeDNSKEY:     "DNSKEY",
+	TypeNSEC3:      "NSEC3",
+	TypeNSEC3PARAM: "NSEC3PARAM",
+	TypeSVCB:       "SVCB",
+	TypeHTTPS:      "HTTPS",
+	TypeANY:        "ANY",
+}
+
+// TypeString 返回RR类型的名字，未知类型按RFC3597表示为TYPEnnn
+func TypeString(rType uint16) string {
+	if name, ok := typeNames[rType]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("TYPE%d", rType)
+}
+
+// ParseType 解析RR类型的名字，不区分大小写，支持TYPEnnn
+func ParseType(name string) (uint16, error) {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	for rType, typeName := range typeNames {
+		if typeName == upper {
+			return rType, nil
+		}
+	}
+
+	if strings.HasPrefix(upper, "TYPE") {
+		if rType, err := strconv.ParseUint(upper[4:], 10, 16); err == nil {
+			return uint16(rType), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown RR type %q", name)
+}
+
+const (
+	RCodeSuccess        uint16 = 0
+	RCodeFormatError    uint16 = 1
+	RCodeServerFailure  uint16 = 2
+	RCodeNameError      uint16 = 3
+	RCodeNotImplemented uint16 = 4
+	RCodeRefused        uint16 = 5
+)
+
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-6
+var rcodeNames = map[uint16]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+	16: "BADVERS",
+	23: "BADCOOKIE",
+}
+
+// ParseRCode 把RCODE的名字(不区分大小写)或者RCODE<n>转换为RCODE
+func ParseRCode(name string) (uint16, error) {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	for rcode, rcodeName := range rcodeNames {
+		if rcodeName == upper {
+			return rcode, nil
+		}
+	}
+
+	if strings.HasPrefix(upper, "RCODE") {
+		if rcode, err := strconv.ParseUint(upper[5:], 10, 12); err == nil {
+			return uint16(rcode), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown rcode %q", name)
+}
+
+// RCodeString 返回RCODE的名字，和dig的展示一致
+func RCodeString(rcode uint16) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("RCODE%d", rcode)
+}
@@ -0,0 +1,3 @@
+package dns_msg
+
+var ParseRSAPublicKey = parseRSAPublicKey
@@ -0,0 +1,338 @@
+package dnstest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+// Signer 测试zone的签名key，同时作为KSK和ZSK，生成DNSKEY、DS和RRSIG；
+// canonical格式按RFC4034单独实现，不依赖dns_msg的验证代码
+type Signer struct {
+	Zone       string
+	Algorithm  uint8
+	Inception  time.Time
+	Expiration time.Time
+	key        crypto.Signer
+	publicKey  []byte
+}
+
+// NewSigner 生成zone的key，支持ECDSAP256SHA256、ED25519和RSASHA256，签名有效期为前后一天
+func NewSigner(zone string, algorithm uint8) (*Signer, error) {
+	now := time.Now()
+	signer := &Signer{
+		Zone:       strings.ToLower(zone),
+		Algorithm:  algorithm,
+		Inception:  now.Add(-24 * time.Hour),
+		Expiration: now.Add(24 * time.Hour),
+	}
+
+	switch algorithm {
+	case dnsMsg.AlgECDSAP256SHA256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer.key = key
+		signer.publicKey = append(key.X.FillBytes(make([]byte, 32)), key.Y.FillBytes(make([]byte, 32))...)
+	case dnsMsg.AlgED25519:
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer.key, signer.publicKey = key, pub
+	case dnsMsg.AlgRSASHA256:
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			return nil, err
+		}
+		// RFC3110: exponent长度 | exponent | modulus
+		exponent := big.NewInt(int64(key.E)).Bytes()
+		signer.key = key
+		signer.publicKey = append(append([]byte{byte(len(exponent))}, exponent...), key.N.Bytes()...)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %d", algorithm)
+	}
+
+	return signer, nil
+}
+
+// DNSKEY zone顶点的DNSKEY记录，flags为257(Zone|SEP)
+func (signer *Signer) DNSKEY(ttl uint32) RR {
+	data := []byte{0x01, 0x01, 3, signer.Algorithm}
+	return RR{Name: signer.Zone, Type: dnsMsg.TypeDNSKEY, TTL: ttl, Data: append(data, signer.publicKey...)}
+}
+
+// KeyTag RFC4034 Appendix B
+func (signer *Signer) KeyTag() uint16 {
+	var ac uint32
+	for idx, b := range signer.DNSKEY(0).Data {
+		if idx%2 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+
+	return uint16(ac + ac>>16)
+}
+
+// DS 父zone中的SHA-256 DS记录
+func (signer *Signer) DS(ttl uint32) RR {
+	digest := sha256.Sum256(append(canonicalName(signer.Zone), signer.DNSKEY(0).Data...))
+
+	data := binary.BigEndian.AppendUint16(nil, signer.KeyTag())
+	data = append(data, signer.Algorithm, dnsMsg.DigestSHA256)
+	return RR{Name: signer.Zone, Type: dnsMsg.TypeDS, TTL: ttl, Data: append(data, digest[:]...)}
+}
+
+// Sign 对同一个owner和type的rrset签名，owner为"*.xxx"时RRSIG的Labels不包括"*"，
+// 通配符展开的应答把返回的RRSIG的Name改成查询的name即可
+func (signer *Signer) Sign(rrset []RR) RR {
+	owner := strings.ToLower(rrset[0].Name)
+	labels := len(strings.Split(strings.TrimPrefix(owner, "*."), "."))
+	if owner == "." || owner == "*" {
+		labels = 0
+	}
+
+	rdata := binary.BigEndian.AppendUint16(nil, rrset[0].Type)
+	rdata = append(rdata, signer.Algorithm, byte(labels))
+	rdata = binary.BigEndian.AppendUint32(rdata, rrset[0].TTL)
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(signer.Expiration.Unix()))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(signer.Inception.Unix()))
+	rdata = binary.BigEndian.AppendUint16(rdata, signer.KeyTag())
+	rdata = append(rdata, canonicalName(signer.Zone)...)
+
+	var rdatas [][]byte
+	for idx := range rrset {
+		rdatas = append(rdatas, canonicalRData(&rrset[idx]))
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	signed := append([]byte(nil), rdata...)
+	for _, data := range rdatas {
+		signed = append(signed, canonicalName(owner)...)
+		signed = binary.BigEndian.AppendUint16(signed, rrset[0].Type)
+		signed = binary.BigEndian.AppendUint16(signed, dnsMsg.ClassINET)
+		signed = binary.BigEndian.AppendUint32(signed, rrset[0].TTL)
+		signed = binary.BigEndian.AppendUint16(signed, uint16(len(data)))
+		signed = append(signed, data...)
+	}
+
+	return RR{Name: rrset[0].Name, Type: dnsMsg.TypeRRSIG, TTL: rrset[0].TTL, Data: append(rdata, signer.sign(signed)...)}
+}
+
+// Signed 返回rrs和每个(owner, type)的RRSIG
+func (signer *Signer) Signed(rrs []RR) []RR {
+	var keys []string
+	rrsets := make(map[string][]RR)
+	for _, rr := range rrs {
+		key := fmt.Sprintf("%s|%d", strings.ToLower(rr.Name), rr.Type)
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	signed := append([]RR(nil), rrs...)
+	for _, key := range keys {
+		signed = append(signed, signer.Sign(rrsets[key]))
+	}
+
+	return signed
+}
+
+func (signer *Signer) sign(data []byte) []byte {
+	switch key := signer.key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			panic(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			panic(err)
+		}
+		return signature
+	}
+
+	return nil
+}
+
+// NSEC types中不需要包括NSEC和RRSIG
+func NSEC(name string, ttl uint32, next string, types ...uint16) RR {
+	types = append(append([]uint16(nil), types...), dnsMsg.TypeNSEC, dnsMsg.TypeRRSIG)
+	return RR{Name: name, Type: dnsMsg.TypeNSEC, TTL: ttl, Data: append(canonicalName(next), typeBitMaps(types)...)}
+}
+
+// NSECChain 按canonical顺序生成zone的NSEC链，names为zone中小写的name和它们的类型，最后一个NSEC指向第一个
+func NSECChain(ttl uint32, names map[string][]uint16) []RR {
+	var owners []string
+	for name := range names {
+		owners = append(owners, name)
+	}
+	sort.Slice(owners, func(i, j int) bool { return canonicalLess(owners[i], owners[j]) })
+
+	var chain []RR
+	for idx, owner := range owners {
+		chain = append(chain, NSEC(owner, ttl, owners[(idx+1)%len(owners)], names[owner]...))
+	}
+
+	return chain
+}
+
+// NSEC3Hash 计算name的NSEC3 SHA-1 hash，返回小写的base32hex编码，RFC5155 5
+func NSEC3Hash(name string, salt []byte, iterations uint16) string {
+	return base32Hex.EncodeToString(nsec3Hash(name, salt, iterations))
+}
+
+// NSEC3Chain 按hash顺序生成zone的NSEC3链，names为zone中的name和它们的类型，empty non-terminal的类型为空
+func NSEC3Chain(zone string, ttl uint32, salt []byte, iterations uint16, optOut bool, names map[string][]uint16) []RR {
+	var hashes [][]byte
+	typesOf := make(map[string][]uint16)
+	for name, types := range names {
+		hash := nsec3Hash(name, salt, iterations)
+		hashes = append(hashes, hash)
+		typesOf[string(hash)] = types
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+
+	var flags byte
+	if optOut {
+		flags = 1
+	}
+
+	var chain []RR
+	for idx, hash := range hashes {
+		types := typesOf[string(hash)]
+		if len(types) > 0 {
+			types = append(append([]uint16(nil), types...), dnsMsg.TypeRRSIG)
+		}
+
+		next := hashes[(idx+1)%len(hashes)]
+		data := []byte{1, flags}
+		data = binary.BigEndian.AppendUint16(data, iterations)
+		data = append(data, byte(len(salt)))
+		data = append(data, salt...)
+		data = append(data, byte(len(next)))
+		data = append(data, next...)
+		data = append(data, typeBitMaps(types)...)
+
+		owner := base32Hex.EncodeToString(hash) + "." + strings.ToLower(zone)
+		if zone == "." {
+			owner = base32Hex.EncodeToString(hash)
+		}
+		chain = append(chain, RR{Name: owner, Type: dnsMsg.TypeNSEC3, TTL: ttl, Data: data})
+	}
+
+	return chain
+}
+
+var base32Hex = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	digest := sha1.Sum(append(canonicalName(name), salt...))
+	for idx := uint16(0); idx < iterations; idx++ {
+		digest = sha1.Sum(append(digest[:], salt...))
+	}
+
+	return digest[:]
+}
+
+// typeBitMaps RFC4034 4.1.2，每个window只编码到最后一个非零字节
+func typeBitMaps(types []uint16) []byte {
+	var windows [256][32]byte
+	var used [256]int
+	for _, t := range types {
+		window, bit := t>>8, t&0xFF
+		windows[window][bit/8] |= 0x80 >> (bit % 8)
+		if int(bit/8)+1 > used[window] {
+			used[window] = int(bit/8) + 1
+		}
+	}
+
+	var data []byte
+	for window := range windows {
+		if used[window] > 0 {
+			data = append(data, byte(window), byte(used[window]))
+			data = append(data, windows[window][:used[window]]...)
+		}
+	}
+
+	return data
+}
+
+func canonicalName(name string) []byte {
+	return encodeName(strings.ToLower(name))
+}
+
+// canonicalRData RDATA中的域名转为小写，dnstest的RDATA中域名不压缩
+func canonicalRData(rr *RR) []byte {
+	data := append([]byte(nil), rr.Data...)
+	offset, names := 0, 0
+	switch rr.Type {
+	case dnsMsg.TypeNS, dnsMsg.TypeCNAME, dnsMsg.TypePTR, dnsMsg.TypeDNAME:
+		names = 1
+	case dnsMsg.TypeSOA:
+		names = 2
+	case dnsMsg.TypeMX:
+		offset, names = 2, 1
+	case dnsMsg.TypeSRV:
+		offset, names = 6, 1
+	}
+
+	for ; names > 0; names-- {
+		for data[offset] != 0 {
+			end := offset + 1 + int(data[offset])
+			copy(data[offset+1:end], bytes.ToLower(data[offset+1:end]))
+			offset = end
+		}
+		offset++
+	}
+
+	return data
+}
+
+// canonicalLess RFC4034 6.1，从最右边的label开始比较小写的label
+func canonicalLess(a, b string) bool {
+	aLabels, bLabels := reversedLabels(a), reversedLabels(b)
+	for idx := 0; idx < len(aLabels) && idx < len(bLabels); idx++ {
+		if aLabels[idx] != bLabels[idx] {
+			return aLabels[idx] < bLabels[idx]
+		}
+	}
+
+	return len(aLabels) < len(bLabels)
+}
+
+func reversedLabels(name string) []string {
+	var labels []string
+	for _, label := range strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".") {
+		if label != "" {
+			labels = append([]string{label}, labels...)
+		}
+	}
+
+	return labels
+}
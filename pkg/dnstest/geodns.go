@@ -0,0 +1,105 @@
+package dnstest
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+// GeoDefault GeoDNS表中没有ECS或者没有匹配的网段时使用的key
+const GeoDefault = "default"
+
+// GeoDNS 模拟按地区调度的权威nameserver: 用查询中ECS的地址在Routes中最长匹配，
+// 应答匹配网段的A/AAAA记录，ECS的scope prefix为匹配网段的长度
+type GeoDNS struct {
+	Domain  string // 只应答这个域名，其他域名返回NXDOMAIN
+	CNAME   string // 不为空时Domain先CNAME到这个域名，地址记录的owner为CNAME
+	TTL     uint32
+	Routes  []GeoRoute
+	Default []netip.Addr
+}
+
+type GeoRoute struct {
+	Prefix netip.Prefix
+	Addrs  []netip.Addr
+}
+
+// NewGeoDNS table的key为CIDR或者GeoDefault，value为应答的地址，IPv4和IPv6可以混合
+func NewGeoDNS(domain string, table map[string][]string) (*GeoDNS, error) {
+	geo := &GeoDNS{Domain: domain, TTL: 60}
+	for key, values := range table {
+		var addrs []netip.Addr
+		for _, value := range values {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			addrs = append(addrs, addr)
+		}
+
+		if key == GeoDefault {
+			geo.Default = addrs
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(key)
+		if err != nil {
+			return nil, err
+		}
+		geo.Routes = append(geo.Routes, GeoRoute{Prefix: prefix.Masked(), Addrs: addrs})
+	}
+
+	return geo, nil
+}
+
+// Lookup 返回addr最长匹配的网段和地址，没有匹配时返回Default和长度为0的网段
+func (geo *GeoDNS) Lookup(addr netip.Addr) (netip.Prefix, []netip.Addr) {
+	var best *GeoRoute
+	for idx := range geo.Routes {
+		route := &geo.Routes[idx]
+		if route.Prefix.Contains(addr) && (best == nil || route.Prefix.Bits() > best.Prefix.Bits()) {
+			best = route
+		}
+	}
+
+	if best == nil {
+		return netip.Prefix{}, geo.Default
+	}
+	return best.Prefix, best.Addrs
+}
+
+func (geo *GeoDNS) ServeDNS(req *Request) *Response {
+	domain := strings.ToLower(strings.TrimSuffix(geo.Domain, "."))
+	if req.Name != domain {
+		return &Response{RCode: dnsMsg.RCodeNameError, Authoritative: true}
+	}
+
+	resp := &Response{Authoritative: true}
+	owner := req.Name
+	if geo.CNAME != "" {
+		resp.Answers = append(resp.Answers, CNAME(owner, geo.TTL, geo.CNAME))
+		owner = geo.CNAME
+	}
+
+	addrs := geo.Default
+	if req.ClientSubnet != nil {
+		if addr, ok := netip.AddrFromSlice(req.ClientSubnet.Address); ok {
+			var prefix netip.Prefix
+			prefix, addrs = geo.Lookup(addr.Unmap())
+			if prefix.IsValid() {
+				resp.ScopePrefix = uint8(prefix.Bits())
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		if (req.Type == dnsMsg.TypeA && addr.Is4()) || (req.Type == dnsMsg.TypeAAAA && addr.Is6()) ||
+			req.Type == dnsMsg.TypeANY {
+			resp.Answers = append(resp.Answers, addrRR(owner, geo.TTL, addr))
+		}
+	}
+
+	return resp
+}
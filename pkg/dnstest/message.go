@@ -0,0 +1,181 @@
+package dnstest
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+// Request 收到的一个查询
+type Request struct {
+	Network      string // udp或tcp
+	RemoteAddr   net.Addr
+	Msg          *dnsMsg.Message
+	Name         string // 第一个question的域名，小写，不带结尾的"."
+	Type         uint16
+	EDNS         *dnsMsg.EDNS         // 没有OPT记录时为nil
+	ClientSubnet *dnsMsg.ClientSubnet // 没有ECS时为nil
+}
+
+// RR 应答中的一条资源记录，Data为RDATA，其中的域名不压缩
+type RR struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// Response handler的应答，查询中有OPT记录时自动带上OPT，有ECS时按ScopePrefix回显
+type Response struct {
+	RCode         uint16
+	Authoritative bool
+	Truncated     bool
+	ScopePrefix   uint8
+	Answers       []RR
+	Authority     []RR
+	Additional    []RR
+}
+
+func A(name string, ttl uint32, addr string) RR {
+	ip := netip.MustParseAddr(addr).As4()
+	return RR{Name: name, Type: dnsMsg.TypeA, TTL: ttl, Data: ip[:]}
+}
+
+func AAAA(name string, ttl uint32, addr string) RR {
+	ip := netip.MustParseAddr(addr).As16()
+	return RR{Name: name, Type: dnsMsg.TypeAAAA, TTL: ttl, Data: ip[:]}
+}
+
+func CNAME(name string, ttl uint32, target string) RR {
+	return RR{Name: name, Type: dnsMsg.TypeCNAME, TTL: ttl, Data: encodeName(target)}
+}
+
+func NS(name string, ttl uint32, host string) RR {
+	return RR{Name: name, Type: dnsMsg.TypeNS, TTL: ttl, Data: encodeName(host)}
+}
+
+// SOA serial之后的refresh、retry、expire、minimum使用固定值
+func SOA(zone string, ttl uint32, ns, mbox string, serial uint32) RR {
+	data := append(encodeName(ns), encodeName(mbox)...)
+	for _, value := range []uint32{serial, 3600, 600, 86400, 300} {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return RR{Name: zone, Type: dnsMsg.TypeSOA, TTL: ttl, Data: data}
+}
+
+// TXT 每个字符串一个character-string，超过255字节的部分被截断
+func TXT(name string, ttl uint32, texts ...string) RR {
+	var data []byte
+	for _, text := range texts {
+		if len(text) > 255 {
+			text = text[:255]
+		}
+		data = append(data, byte(len(text)))
+		data = append(data, text...)
+	}
+	return RR{Name: name, Type: dnsMsg.TypeTXT, TTL: ttl, Data: data}
+}
+
+// addrRR 按地址族返回A或者AAAA记录
+func addrRR(name string, ttl uint32, addr netip.Addr) RR {
+	if addr.Is4() {
+		ip := addr.As4()
+		return RR{Name: name, Type: dnsMsg.TypeA, TTL: ttl, Data: ip[:]}
+	}
+
+	ip := addr.As16()
+	return RR{Name: name, Type: dnsMsg.TypeAAAA, TTL: ttl, Data: ip[:]}
+}
+
+func encodeName(name string) []byte {
+	var data []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0)
+}
+
+func appendRR(data []byte, rr *RR) []byte {
+	data = append(data, encodeName(rr.Name)...)
+	data = binary.BigEndian.AppendUint16(data, rr.Type)
+	data = binary.BigEndian.AppendUint16(data, dnsMsg.ClassINET)
+	data = binary.BigEndian.AppendUint32(data, rr.TTL)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(rr.Data)))
+	return append(data, rr.Data...)
+}
+
+// Pack 构造name、qType查询的应答报文，不经过Server直接测试报文的解析
+func Pack(name string, qType uint16, resp *Response) []byte {
+	req := &Request{Msg: &dnsMsg.Message{
+		Questions: []dnsMsg.QuestionRR{{Name: name, Type: qType, Class: dnsMsg.ClassINET}},
+	}}
+	return encodeResponse(req, resp, false)
+}
+
+// encodeResponse 构造req的应答报文，truncate时只保留header、question和OPT
+func encodeResponse(req *Request, resp *Response, truncate bool) []byte {
+	query := &req.Msg.Header
+
+	var header dnsMsg.DNSHeader
+	header.SetID(query.GetID())
+	header.SetQR(1)
+	header.SetOpCode(query.GetOpCode())
+	if resp.Authoritative {
+		header.SetAA(1)
+	}
+	if resp.Truncated || truncate {
+		header.SetTC(1)
+	}
+	header.SetRD(query.GetRD())
+	header.SetRA(1)
+	header.SetCD(query.GetCD())
+	header.SetRCode(uint8(resp.RCode & 0x0F))
+	header.SetQDCount(uint16(len(req.Msg.Questions)))
+
+	var sections [3][]RR
+	if !truncate {
+		sections = [3][]RR{resp.Answers, resp.Authority, resp.Additional}
+	}
+	header.SetANCount(uint16(len(sections[0])))
+	header.SetNSCount(uint16(len(sections[1])))
+	arCount := len(sections[2])
+	if req.EDNS != nil {
+		arCount += 1
+	}
+	header.SetARCount(uint16(arCount))
+
+	data := append([]byte(nil), header.GetHeader()...)
+	for _, question := range req.Msg.Questions {
+		var q dnsMsg.Question
+		q.AddQuestion(question.Name, question.Type, question.Class)
+		data = append(data, q.Data...)
+	}
+
+	for _, rrs := range sections {
+		for idx := range rrs {
+			data = appendRR(data, &rrs[idx])
+		}
+	}
+
+	if req.EDNS != nil {
+		var options []dnsMsg.EDNSOption
+		if req.ClientSubnet != nil {
+			option := dnsMsg.NewClientSubnetOption(req.ClientSubnet.Address, req.ClientSubnet.SourcePrefix)
+			option.Data[3] = resp.ScopePrefix
+			options = append(options, option)
+		}
+
+		additional := dnsMsg.Additional{Data: make([]byte, 512)}
+		offset := additional.AddOPT(0, dnsMsg.DefaultUDPSize, 0, req.EDNS.DO, options)
+		data = append(data, additional.Data[:offset]...)
+	}
+
+	return data
+}
@@ -0,0 +1,245 @@
+package dnstest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+/*
+   测试用的DNS server，在127.0.0.1的随机端口上同时监听UDP和TCP，把查询交给Handler处理:
+
+   server, err := dnstest.NewServer(dnstest.HandlerFunc(func(req *dnstest.Request) *dnstest.Response {
+       return &dnstest.Response{Answers: []dnstest.RR{dnstest.A(req.Name, 60, "10.0.0.1")}}
+   }))
+   defer server.Close()
+
+   UDP的应答超过512字节(有OPT时为OPT中的UDP payload size)时只返回header并设置TC，客户端需要通过TCP重试
+*/
+
+const maxUDPSize = 512
+
+// Handler 处理一个查询，返回nil时不应答，用于模拟超时
+type Handler interface {
+	ServeDNS(req *Request) *Response
+}
+
+type HandlerFunc func(req *Request) *Response
+
+func (f HandlerFunc) ServeDNS(req *Request) *Response {
+	return f(req)
+}
+
+type Server struct {
+	Addr       string // ip:port，UDP和TCP使用同一个端口
+	handler    Handler
+	udp        net.PacketConn
+	tcp        net.Listener
+	udpQueries atomic.Int64
+	tcpQueries atomic.Int64
+
+	mutex  sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer 在127.0.0.1的随机端口上启动UDP和TCP的监听，端口被其他程序的TCP占用时重新选择
+func NewServer(handler Handler) (*Server, error) {
+	return NewServerAt("127.0.0.1:0", handler)
+}
+
+// NewServerAt 在addr上监听，端口为0时选择随机端口。迭代解析中referral只有nameserver的地址，
+// 模拟根、TLD和权威服务器时需要相同的端口和不同的地址，如127.0.0.2:port(Linux上127.0.0.0/8都是loopback)
+func NewServerAt(addr string, handler Handler) (*Server, error) {
+	server := &Server{handler: handler, conns: make(map[net.Conn]bool)}
+
+	retries := 1
+	if _, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
+		retries = 10
+	}
+
+	var err error
+	for retry := 0; retry < retries; retry++ {
+		if server.udp, err = net.ListenPacket("udp", addr); err != nil {
+			return nil, err
+		}
+
+		server.Addr = server.udp.LocalAddr().String()
+		if server.tcp, err = net.Listen("tcp", server.Addr); err == nil {
+			break
+		}
+		server.udp.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen tcp failed: %w", err)
+	}
+
+	server.wg.Add(2)
+	go server.serveUDP()
+	go server.serveTCP()
+
+	return server, nil
+}
+
+// Port 监听的端口，用于configs.DNS的Port
+func (server *Server) Port() int {
+	return server.udp.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Queries 收到的查询个数，包括不能解析的报文
+func (server *Server) Queries() int {
+	return int(server.udpQueries.Load() + server.tcpQueries.Load())
+}
+
+// NetworkQueries 通过udp或tcp收到的查询个数
+func (server *Server) NetworkQueries(network string) int {
+	if network == "tcp" {
+		return int(server.tcpQueries.Load())
+	}
+
+	return int(server.udpQueries.Load())
+}
+
+// Close 停止监听，关闭所有的TCP连接并等待正在处理的查询结束
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	server.closed = true
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.mutex.Unlock()
+
+	server.udp.Close()
+	server.tcp.Close()
+	server.wg.Wait()
+	return nil
+}
+
+func (server *Server) serveUDP() {
+	defer server.wg.Done()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := server.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			if response := server.handle("udp", addr, query); response != nil {
+				server.udp.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+func (server *Server) serveTCP() {
+	defer server.wg.Done()
+
+	for {
+		conn, err := server.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		server.mutex.Lock()
+		if server.closed {
+			server.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		server.conns[conn] = true
+		server.mutex.Unlock()
+
+		server.wg.Add(1)
+		go server.serveConn(conn)
+	}
+}
+
+// serveConn 一个连接上可以有多个查询，按顺序应答
+func (server *Server) serveConn(conn net.Conn) {
+	defer server.wg.Done()
+	defer func() {
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		server.mutex.Unlock()
+		conn.Close()
+	}()
+
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		response := server.handle("tcp", conn.RemoteAddr(), query)
+		if response == nil {
+			continue
+		}
+
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle 解析查询并调用handler，不能解析的报文和handler返回nil时不应答
+func (server *Server) handle(network string, addr net.Addr, query []byte) []byte {
+	if network == "tcp" {
+		server.tcpQueries.Add(1)
+	} else {
+		server.udpQueries.Add(1)
+	}
+
+	msg, err := dnsMsg.ParseMessage(query)
+	if err != nil || len(msg.Questions) == 0 {
+		return nil
+	}
+
+	req := &Request{
+		Network:    network,
+		RemoteAddr: addr,
+		Msg:        msg,
+		Name:       strings.ToLower(strings.TrimSuffix(msg.Questions[0].Name, ".")),
+		Type:       msg.Questions[0].Type,
+	}
+	if edns, ok := msg.EDNS(); ok {
+		req.EDNS = edns
+		if data, ok := edns.Option(dnsMsg.OptionClientSubnet); ok {
+			req.ClientSubnet, _ = dnsMsg.ParseClientSubnet(data)
+		}
+	}
+
+	resp := server.handler.ServeDNS(req)
+	if resp == nil {
+		return nil
+	}
+
+	response := encodeResponse(req, resp, false)
+	if network == "udp" {
+		limit := maxUDPSize
+		if req.EDNS != nil && int(req.EDNS.UDPSize) > limit {
+			limit = int(req.EDNS.UDPSize)
+		}
+		if len(response) > limit {
+			response = encodeResponse(req, resp, true)
+		}
+	}
+
+	return response
+}
@@ -0,0 +1,213 @@
+package dnstest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	dnsMsg "github.com/walkerdu/super-dig/pkg/dns_msg"
+)
+
+func buildQuery(t *testing.T, name string, qType uint16, subnet string) []byte {
+	t.Helper()
+
+	var header dnsMsg.DNSHeader
+	header.SetID(0x1234)
+	header.SetRD(1)
+	header.SetQDCount(1)
+
+	var question dnsMsg.Question
+	question.AddQuestion(name, qType, dnsMsg.ClassINET)
+
+	if subnet == "" {
+		return append(header.GetHeader(), question.Data...)
+	}
+
+	prefix := netip.MustParsePrefix(subnet)
+	header.SetARCount(1)
+	additional := dnsMsg.Additional{Data: make([]byte, 512)}
+	option := dnsMsg.NewClientSubnetOption(net.IP(prefix.Addr().AsSlice()), uint8(prefix.Bits()))
+	offset := additional.AddOPT(0, dnsMsg.DefaultUDPSize, 0, false, []dnsMsg.EDNSOption{option})
+
+	query := append(header.GetHeader(), question.Data...)
+	return append(query, additional.Data[:offset]...)
+}
+
+func exchange(t *testing.T, network, addr string, query []byte) *dnsMsg.Message {
+	t.Helper()
+
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	var response []byte
+	if network == "tcp" {
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			t.Fatal(err)
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatal(err)
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response = buf[:n]
+	}
+
+	msg, err := dnsMsg.ParseMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func answerStrings(msg *dnsMsg.Message) []string {
+	var answers []string
+	for idx := range msg.Answers {
+		answers = append(answers, dnsMsg.TypeString(msg.Answers[idx].Type)+" "+msg.RDataString(&msg.Answers[idx]))
+	}
+	return answers
+}
+
+func TestGeoDNS(t *testing.T) {
+	geo, err := NewGeoDNS("www.example.com", map[string][]string{
+		"1.0.1.0/24":     {"10.0.1.1"},
+		"1.0.0.0/16":     {"10.0.0.1", "2001:db8::1"},
+		"2400:da00::/32": {"2001:db8::2"},
+		GeoDefault:       {"10.0.9.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo.CNAME = "www.example.com.cdn.example.net"
+
+	server, err := NewServer(geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		qType   uint16
+		subnet  string
+		answers string
+		scope   uint8
+	}{
+		{dnsMsg.TypeA, "1.0.1.0/24", "[CNAME www.example.com.cdn.example.net A 10.0.1.1]", 24},
+		{dnsMsg.TypeA, "1.0.8.0/24", "[CNAME www.example.com.cdn.example.net A 10.0.0.1]", 16},
+		{dnsMsg.TypeAAAA, "1.0.8.0/24", "[CNAME www.example.com.cdn.example.net AAAA 2001:db8::1]", 16},
+		{dnsMsg.TypeAAAA, "2400:da00::/56", "[CNAME www.example.com.cdn.example.net AAAA 2001:db8::2]", 32},
+		{dnsMsg.TypeA, "36.0.0.0/24", "[CNAME www.example.com.cdn.example.net A 10.0.9.9]", 0},
+		{dnsMsg.TypeA, "", "[CNAME www.example.com.cdn.example.net A 10.0.9.9]", 0},
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		for _, test := range tests {
+			msg := exchange(t, network, server.Addr, buildQuery(t, "www.example.com", test.qType, test.subnet))
+			if got := fmt.Sprint(answerStrings(msg)); got != test.answers {
+				t.Errorf("%s %s %s: answers %s, want %s", network, dnsMsg.TypeString(test.qType), test.subnet,
+					got, test.answers)
+			}
+
+			if msg.Header.GetID() != 0x1234 || msg.Header.GetQR() != 1 || msg.Header.GetAA() != 1 {
+				t.Errorf("%s %s: unexpected header %s", network, test.subnet, &msg.Header)
+			}
+
+			edns, ok := msg.EDNS()
+			if test.subnet == "" {
+				if ok {
+					t.Errorf("%s: unexpected OPT in response of query without EDNS", network)
+				}
+				continue
+			}
+
+			data, ok := edns.Option(dnsMsg.OptionClientSubnet)
+			if !ok {
+				t.Fatalf("%s %s: no ECS in response", network, test.subnet)
+			}
+			subnet, err := dnsMsg.ParseClientSubnet(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subnet.ScopePrefix != test.scope {
+				t.Errorf("%s %s: scope prefix %d, want %d", network, test.subnet, subnet.ScopePrefix, test.scope)
+			}
+		}
+	}
+
+	msg := exchange(t, "udp", server.Addr, buildQuery(t, "other.example.com", dnsMsg.TypeA, ""))
+	if msg.RCode() != dnsMsg.RCodeNameError || len(msg.Answers) != 0 {
+		t.Errorf("other domain: rcode %s, answers %v", dnsMsg.RCodeString(msg.RCode()), answerStrings(msg))
+	}
+
+	if server.Queries() != 2*len(tests)+1 || server.NetworkQueries("tcp") != len(tests) {
+		t.Errorf("queries %d, tcp %d, want %d and %d", server.Queries(), server.NetworkQueries("tcp"),
+			2*len(tests)+1, len(tests))
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	server, err := NewServer(HandlerFunc(func(req *Request) *Response {
+		resp := &Response{}
+		for idx := 0; idx < 100; idx++ {
+			resp.Answers = append(resp.Answers, A(req.Name, 60, fmt.Sprintf("10.0.0.%d", idx)))
+		}
+		return resp
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	msg := exchange(t, "udp", server.Addr, buildQuery(t, "big.example.com", dnsMsg.TypeA, ""))
+	if msg.Header.GetTC() != 1 || len(msg.Answers) != 0 {
+		t.Errorf("udp: TC %d, %d answers, want truncated", msg.Header.GetTC(), len(msg.Answers))
+	}
+
+	msg = exchange(t, "tcp", server.Addr, buildQuery(t, "big.example.com", dnsMsg.TypeA, ""))
+	if msg.Header.GetTC() != 0 || len(msg.Answers) != 100 {
+		t.Errorf("tcp: TC %d, %d answers, want 100", msg.Header.GetTC(), len(msg.Answers))
+	}
+}
+
+func TestServerNoResponse(t *testing.T) {
+	server, err := NewServer(HandlerFunc(func(req *Request) *Response {
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("udp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(buildQuery(t, "drop.example.com", dnsMsg.TypeA, ""))
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 512)); err == nil {
+		t.Errorf("unexpected response")
+	}
+}
@@ -0,0 +1,38 @@
+package ip_db
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// DB 按起始地址排序的IP段，用于查询IP所在的IP段
+type DB struct {
+	ranges []Range
+}
+
+func NewDB(ranges []Range) *DB {
+	sorted := append([]Range(nil), ranges...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start.Less(sorted[j].Start)
+	})
+
+	return &DB{ranges: sorted}
+}
+
+// Lookup 查询IP所在的IP段，IP段之间不能重叠
+func (db *DB) Lookup(addr netip.Addr) (Range, bool) {
+	// 起始地址不大于addr的最后一个IP段
+	idx := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].Start)
+	}) - 1
+
+	if idx >= 0 && db.ranges[idx].Contains(addr) {
+		return db.ranges[idx], true
+	}
+
+	return Range{}, false
+}
+
+func (db *DB) Len() int {
+	return len(db.ranges)
+}
@@ -0,0 +1,88 @@
+package ip_db
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/walkerdu/super-dig/configs"
+)
+
+// RegionFilter 按国家/省份/ISP过滤IPRegion，支持通配符
+// 同一字段的多个include满足其一即可，命中任意一个exclude则剔除
+type RegionFilter struct {
+	Countries        []string `json:"countries,omitempty" yaml:"countries,omitempty"`
+	Provinces        []string `json:"provinces,omitempty" yaml:"provinces,omitempty"`
+	ISPs             []string `json:"isps,omitempty" yaml:"isps,omitempty"`
+	ExcludeCountries []string `json:"exclude_countries,omitempty" yaml:"exclude_countries,omitempty"`
+	ExcludeProvinces []string `json:"exclude_provinces,omitempty" yaml:"exclude_provinces,omitempty"`
+	ExcludeISPs      []string `json:"exclude_isps,omitempty" yaml:"exclude_isps,omitempty"`
+}
+
+// Validate 按字段定义的顺序检查通配符，保证多个字段出错时总是报告同一个
+func (filter *RegionFilter) Validate() error {
+	fields := []struct {
+		name     string
+		patterns []string
+	}{
+		{"countries", filter.Countries},
+		{"provinces", filter.Provinces},
+		{"isps", filter.ISPs},
+		{"exclude_countries", filter.ExcludeCountries},
+		{"exclude_provinces", filter.ExcludeProvinces},
+		{"exclude_isps", filter.ExcludeISPs},
+	}
+
+	for _, field := range fields {
+		for _, pattern := range field.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid pattern %q", field.name, pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (filter *RegionFilter) IsEmpty() bool {
+	return len(filter.Countries)+len(filter.Provinces)+len(filter.ISPs)+
+		len(filter.ExcludeCountries)+len(filter.ExcludeProvinces)+len(filter.ExcludeISPs) == 0
+}
+
+func (filter *RegionFilter) Match(ipRegion *configs.IPRegion) bool {
+	return matchInclude(filter.Countries, ipRegion.Country) &&
+		matchInclude(filter.Provinces, ipRegion.Province) &&
+		matchInclude(filter.ISPs, ipRegion.ISP) &&
+		!matchAny(filter.ExcludeCountries, ipRegion.Country) &&
+		!matchAny(filter.ExcludeProvinces, ipRegion.Province) &&
+		!matchAny(filter.ExcludeISPs, ipRegion.ISP)
+}
+
+// Filter 返回满足过滤条件的IPRegion
+func (filter *RegionFilter) Filter(ipRegions []configs.IPRegion) []configs.IPRegion {
+	if filter.IsEmpty() {
+		return ipRegions
+	}
+
+	var matched []configs.IPRegion
+	for idx := range ipRegions {
+		if filter.Match(&ipRegions[idx]) {
+			matched = append(matched, ipRegions[idx])
+		}
+	}
+
+	return matched
+}
+
+func matchInclude(patterns []string, value string) bool {
+	return len(patterns) == 0 || matchAny(patterns, value)
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
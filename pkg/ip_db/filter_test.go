@@ -0,0 +1,72 @@
+package ip_db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+)
+
+var testRegions = []configs.IPRegion{
+	{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0"}},
+	{Country: "中国", Province: "广东省", ISP: "移动", IPs: []string{"1.0.2.0"}},
+	{Country: "中国", Province: "广西壮族自治区", ISP: "联通", IPs: []string{"1.0.3.0"}},
+	{Country: "中国", Province: "北京市", ISP: "电信", IPs: []string{"1.0.4.0"}},
+	{Country: "日本", Province: "东京都", ISP: "NTT", IPs: []string{"1.0.5.0"}},
+	{Country: "美国", Province: "", ISP: "Google LLC", IPs: []string{"8.8.8.0"}},
+}
+
+func TestRegionFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter RegionFilter
+		ips    []string // 匹配的地区的第一个IP
+	}{
+		{"empty", RegionFilter{}, []string{"1.0.1.0", "1.0.2.0", "1.0.3.0", "1.0.4.0", "1.0.5.0", "8.8.8.0"}},
+		{"country", RegionFilter{Countries: []string{"中国"}}, []string{"1.0.1.0", "1.0.2.0", "1.0.3.0", "1.0.4.0"}},
+		{"repeated include", RegionFilter{Countries: []string{"日本", "美国"}}, []string{"1.0.5.0", "8.8.8.0"}},
+		{"glob", RegionFilter{Provinces: []string{"广*"}}, []string{"1.0.1.0", "1.0.2.0", "1.0.3.0"}},
+		{"fields are and-ed", RegionFilter{Provinces: []string{"广*"}, ISPs: []string{"电信", "联通"}}, []string{"1.0.1.0", "1.0.3.0"}},
+		{"exclude", RegionFilter{Countries: []string{"中国"}, ExcludeISPs: []string{"移动"}}, []string{"1.0.1.0", "1.0.3.0", "1.0.4.0"}},
+		{"exclude wins", RegionFilter{ISPs: []string{"电信"}, ExcludeProvinces: []string{"北京*"}}, []string{"1.0.1.0"}},
+		{"exclude only", RegionFilter{ExcludeCountries: []string{"中国", "日本"}}, []string{"8.8.8.0"}},
+		{"glob with space", RegionFilter{ISPs: []string{"Google *"}}, []string{"8.8.8.0"}},
+		{"empty province", RegionFilter{Provinces: []string{""}}, []string{"8.8.8.0"}},
+		{"no match", RegionFilter{Countries: []string{"中"}}, nil},
+	}
+
+	for _, test := range tests {
+		if err := test.filter.Validate(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		var ips []string
+		for _, ipRegion := range test.filter.Filter(testRegions) {
+			ips = append(ips, ipRegion.IPs[0])
+		}
+		if !reflect.DeepEqual(ips, test.ips) {
+			t.Errorf("%s: matched %v, want %v", test.name, ips, test.ips)
+		}
+	}
+}
+
+func TestRegionFilterValidate(t *testing.T) {
+	// 多个字段出错时总是报告第一个字段
+	filter := RegionFilter{
+		Countries:        []string{"中国"},
+		Provinces:        []string{"广["},
+		ISPs:             []string{"[电信"},
+		ExcludeCountries: []string{"\\"},
+		ExcludeISPs:      []string{"[移动"},
+	}
+	for i := 0; i < 20; i++ {
+		if err := filter.Validate(); err == nil || err.Error() != `provinces: invalid pattern "广["` {
+			t.Fatalf("Validate() = %v", err)
+		}
+	}
+
+	filter = RegionFilter{ExcludeProvinces: []string{"ok"}, ExcludeISPs: []string{"[移动"}}
+	if err := filter.Validate(); err == nil || err.Error() != `exclude_isps: invalid pattern "[移动"` {
+		t.Errorf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package ip_db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Range 一段连续IP地址及其归属地信息，国家/省份/ISP未知时为"0"
+type Range struct {
+	Start    netip.Addr
+	End      netip.Addr
+	Country  string
+	Province string
+	ISP      string
+}
+
+func (r *Range) Contains(addr netip.Addr) bool {
+	return r.Start.Compare(addr) <= 0 && addr.Compare(r.End) <= 0
+}
+
+/*
+   ip2region格式的IP段文件，每行一个IP段，以'|'分隔:
+   起始IP|结束IP|国家|区域|省份|城市|ISP
+
+   1.0.1.0|1.0.3.255|中国|0|福建省|福州市|电信
+*/
+
+const rangeFields = 7
+
+// ParseRangeLine 解析一行ip2region格式的IP段
+func ParseRangeLine(line string) (Range, error) {
+	fields := strings.Split(strings.TrimSpace(line), "|")
+	if len(fields) != rangeFields {
+		return Range{}, fmt.Errorf("expect %d fields, got %d", rangeFields, len(fields))
+	}
+
+	start, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid start ip: %w", err)
+	}
+
+	end, err := netip.ParseAddr(fields[1])
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid end ip: %w", err)
+	}
+
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return Range{}, fmt.Errorf("invalid ip range %s-%s", start, end)
+	}
+
+	return Range{
+		Start:    start,
+		End:      end,
+		Country:  fields[2],
+		Province: fields[4],
+		ISP:      fields[6],
+	}, nil
+}
+
+// ReadRanges 读取ip2region格式的IP段，非法的行通过illegal回调通知调用方，不中断解析
+func ReadRanges(reader io.Reader, illegal func(lineNo int, line string, err error)) ([]Range, error) {
+	var ranges []Range
+
+	scanner := bufio.NewScanner(reader)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		r, err := ParseRangeLine(line)
+		if err != nil {
+			if illegal != nil {
+				illegal(lineNo, line, err)
+			}
+			continue
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges, scanner.Err()
+}
+
+// LoadRangeFile 加载ip2region格式的IP段文件
+func LoadRangeFile(path string, illegal func(lineNo int, line string, err error)) ([]Range, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadRanges(file, illegal)
+}
@@ -0,0 +1,474 @@
+package ip_db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/walkerdu/super-dig/configs"
+)
+
+// 地区数据文件格式
+const (
+	FormatJSON      = "json"      // configs/ip_region.json格式的[]configs.IPRegion
+	FormatTxt       = "txt"       // data/ip_country_*.txt格式: 国家 省份 ISP IP...
+	FormatIP2Region = "ip2region" // 起始IP|结束IP|国家|区域|省份|城市|ISP
+	FormatCSV       = "csv"       // cidr,country,region,isp
+	FormatGeoLite2  = "geolite2"  // GeoLite2 Blocks CSV，配合Locations CSV和ASN CSV
+)
+
+var Formats = []string{FormatJSON, FormatTxt, FormatIP2Region, FormatCSV, FormatGeoLite2}
+
+// LoadOptions 加载地区数据的选项，Format为空时根据文件扩展名和内容自动识别
+type LoadOptions struct {
+	Format       string
+	GeoLocations string // GeoLite2 Locations CSV，例如GeoLite2-City-Locations-zh-CN.csv
+	GeoASN       string // GeoLite2 ASN CSV，例如GeoLite2-ASN-Blocks-IPv4.csv，可选
+
+	// ip2region格式中非法的行通过Illegal回调通知调用方，不中断加载，为nil时忽略
+	Illegal func(lineNo int, line string, err error)
+}
+
+// DetectFormat 根据扩展名和文件第一行识别地区数据文件格式
+func DetectFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	firstLine := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			firstLine = line
+			break
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(firstLine, "network,geoname_id"):
+		return FormatGeoLite2, nil
+	case strings.Count(firstLine, "|") == rangeFields-1:
+		return FormatIP2Region, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".csv":
+		return FormatCSV, nil
+	case ".txt":
+		return FormatTxt, nil
+	}
+
+	return "", fmt.Errorf("unknown region file format of %s, please specify the format", path)
+}
+
+// LoadRegionFile 加载地区数据文件，生成client subnet列表
+// 按IP段描述的格式，同一个国家/省份/ISP的IP段合并成一个IPRegion，IP段转换成CIDR
+func LoadRegionFile(path string, opts LoadOptions) ([]configs.IPRegion, error) {
+	format, err := resolveFormat(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatJSON:
+		return LoadJSONFile(path)
+	case FormatTxt:
+		return LoadTxtFile(path)
+	}
+
+	ranges, err := LoadRanges(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return RangesToRegions(ranges), nil
+}
+
+// LoadRanges 加载按IP段描述的地区数据文件
+func LoadRanges(path string, opts LoadOptions) ([]Range, error) {
+	format, err := resolveFormat(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatIP2Region:
+		return LoadRangeFile(path, opts.Illegal)
+	case FormatCSV:
+		return LoadCSVFile(path)
+	case FormatGeoLite2:
+		return LoadGeoLite2(path, opts.GeoLocations, opts.GeoASN)
+	default:
+		return nil, fmt.Errorf("format %s of %s has no ip ranges", format, path)
+	}
+}
+
+func resolveFormat(path string, opts LoadOptions) (string, error) {
+	if opts.Format == "" {
+		return DetectFormat(path)
+	}
+
+	for _, format := range Formats {
+		if opts.Format == format {
+			return format, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown region format %q, expect one of %s", opts.Format, strings.Join(Formats, ", "))
+}
+
+func LoadJSONFile(path string) ([]configs.IPRegion, error) {
+	byteValue, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipRegions []configs.IPRegion
+	if err := json.Unmarshal(byteValue, &ipRegions); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %w", path, err)
+	}
+
+	return ipRegions, nil
+}
+
+// LoadTxtFile 加载以空白分隔的文件，每行: 国家 省份 ISP IP [IP...]
+// ISP名字中可能有空格，从行尾开始识别IP，剩余部分作为ISP
+func LoadTxtFile(path string) ([]configs.IPRegion, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ipRegions []configs.IPRegion
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		ipIdx := len(fields)
+		for ipIdx > 0 && isIPOrCIDR(fields[ipIdx-1]) {
+			ipIdx--
+		}
+
+		if ipIdx < 3 || ipIdx == len(fields) {
+			return nil, fmt.Errorf("%s:%d: expect \"country province isp ip...\"", path, lineNo)
+		}
+
+		ipRegions = append(ipRegions, configs.IPRegion{
+			Country:  fields[0],
+			Province: fields[1],
+			ISP:      strings.Join(fields[2:ipIdx], " "),
+			IPs:      fields[ipIdx:],
+		})
+	}
+
+	return ipRegions, scanner.Err()
+}
+
+// LoadCSVFile 加载cidr,country,region,isp格式的CSV，第一行可以是表头
+func LoadCSVFile(path string) ([]Range, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+
+	var ranges []Range
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parse %s failed: %w", path, err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		if line == 1 && strings.EqualFold(record[0], "cidr") {
+			continue
+		}
+
+		prefix, err := parsePrefix(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		ranges = append(ranges, prefixRange(prefix, record[1], record[2], record[3]))
+	}
+
+	return ranges, nil
+}
+
+/*
+   GeoLite2 CSV: https://dev.maxmind.com/geoip/docs/databases/city-and-country#csv-databases
+
+   Blocks:    network,geoname_id,registered_country_geoname_id,...
+   Locations: geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,
+              subdivision_1_iso_code,subdivision_1_name,...
+   ASN:       network,autonomous_system_number,autonomous_system_organization
+
+   Country级别的Locations没有subdivision字段，省份为"0"；没有ASN文件时ISP为"0"
+*/
+
+type geoLocation struct {
+	country  string
+	province string
+}
+
+// LoadGeoLite2 加载GeoLite2 Blocks CSV，通过geoname_id关联Locations CSV得到国家和省份，
+// 通过所在的ASN网段得到ISP
+func LoadGeoLite2(blocksPath, locationsPath, asnPath string) ([]Range, error) {
+	if locationsPath == "" {
+		return nil, fmt.Errorf("geolite2 format requires locations csv")
+	}
+
+	locations := make(map[string]geoLocation)
+	err := readCSVWithHeader(locationsPath, []string{"geoname_id", "country_name"}, func(get func(string) string) error {
+		province := get("subdivision_1_name")
+		if province == "" {
+			province = "0"
+		}
+
+		locations[get("geoname_id")] = geoLocation{
+			country:  get("country_name"),
+			province: province,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var asnRanges []Range
+	if asnPath != "" {
+		err = readCSVWithHeader(asnPath, []string{"network", "autonomous_system_organization"}, func(get func(string) string) error {
+			prefix, err := parsePrefix(get("network"))
+			if err != nil {
+				return err
+			}
+
+			asnRanges = append(asnRanges, prefixRange(prefix, "", "", get("autonomous_system_organization")))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	asnDB := NewDB(asnRanges)
+
+	var ranges []Range
+	err = readCSVWithHeader(blocksPath, []string{"network", "geoname_id"}, func(get func(string) string) error {
+		prefix, err := parsePrefix(get("network"))
+		if err != nil {
+			return err
+		}
+
+		geonameID := get("geoname_id")
+		if geonameID == "" {
+			geonameID = get("registered_country_geoname_id")
+		}
+
+		location, ok := locations[geonameID]
+		if !ok {
+			location = geoLocation{country: "0", province: "0"}
+		}
+
+		isp := "0"
+		if asn, ok := asnDB.Lookup(prefix.Addr()); ok && asn.ISP != "" {
+			isp = asn.ISP
+		}
+
+		ranges = append(ranges, prefixRange(prefix, location.country, location.province, isp))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
+
+// readCSVWithHeader 按表头的列名读取CSV的每一行
+func readCSVWithHeader(path string, required []string, handle func(get func(column string) string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("read header of %s failed: %w", path, err)
+	}
+
+	columns := make(map[string]int)
+	for idx, name := range header {
+		columns[strings.TrimSpace(name)] = idx
+	}
+
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("%s: missing column %q", path, name)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("parse %s failed: %w", path, err)
+		}
+
+		get := func(column string) string {
+			if idx, ok := columns[column]; ok && idx < len(record) {
+				return record[idx]
+			}
+			return ""
+		}
+
+		if err := handle(get); err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+}
+
+// RangesToRegions 同一个国家/省份/ISP的IP段合并成一个IPRegion，保持第一次出现的顺序
+func RangesToRegions(ranges []Range) []configs.IPRegion {
+	var ipRegions []configs.IPRegion
+	regionIdx := make(map[[3]string]int)
+	for idx := range ranges {
+		r := &ranges[idx]
+		key := [3]string{r.Country, r.Province, r.ISP}
+
+		i, ok := regionIdx[key]
+		if !ok {
+			i = len(ipRegions)
+			regionIdx[key] = i
+			ipRegions = append(ipRegions, configs.IPRegion{
+				Country:  r.Country,
+				Province: r.Province,
+				ISP:      r.ISP,
+			})
+		}
+
+		for _, prefix := range r.Prefixes() {
+			ipRegions[i].IPs = append(ipRegions[i].IPs, prefix.String())
+		}
+	}
+
+	return ipRegions
+}
+
+// RegionsToRanges 把IPRegion转换回IP段，用于按IP查询所在的地区
+// 单个IP代表的是它所在的client subnet，按/24(IPv6为/56)展开，非法的IP忽略
+func RegionsToRanges(ipRegions []configs.IPRegion) []Range {
+	var ranges []Range
+	for _, ipRegion := range ipRegions {
+		for _, entry := range ipRegion.IPs {
+			prefix, err := parsePrefix(entry)
+			if err != nil {
+				continue
+			}
+
+			if !strings.Contains(entry, "/") {
+				bits := IPv4SubnetBits
+				if prefix.Addr().Is6() {
+					bits = IPv6SubnetBits
+				}
+				prefix = netip.PrefixFrom(prefix.Addr(), bits)
+			}
+
+			ranges = append(ranges, prefixRange(prefix, ipRegion.Country, ipRegion.Province, ipRegion.ISP))
+		}
+	}
+
+	return ranges
+}
+
+// Prefixes 把IP段转换成最少的CIDR列表
+func (r *Range) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	start := r.Start
+	for start.IsValid() && start.Compare(r.End) <= 0 {
+		// 从最大的网段开始找，起始地址对齐且不超过结束地址
+		var prefix netip.Prefix
+		for bits := 0; bits <= start.BitLen(); bits++ {
+			prefix = netip.PrefixFrom(start, bits)
+			if prefix.Masked().Addr() == start && lastAddr(prefix).Compare(r.End) <= 0 {
+				break
+			}
+		}
+
+		prefixes = append(prefixes, prefix)
+		start = lastAddr(prefix).Next()
+	}
+
+	return prefixes
+}
+
+// lastAddr 返回网段内的最后一个地址
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(addr)*8; bit++ {
+		addr[bit/8] |= 0x80 >> (bit % 8)
+	}
+
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
+
+func prefixRange(prefix netip.Prefix, country, province, isp string) Range {
+	return Range{
+		Start:    prefix.Masked().Addr(),
+		End:      lastAddr(prefix),
+		Country:  country,
+		Province: province,
+		ISP:      isp,
+	}
+}
+
+// parsePrefix 解析CIDR，单个IP作为/32(IPv6为/128)
+func parsePrefix(str string) (netip.Prefix, error) {
+	str = strings.TrimSpace(str)
+	if !strings.Contains(str, "/") {
+		addr, err := netip.ParseAddr(str)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr %q", str)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(str)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr %q", str)
+	}
+
+	return prefix.Masked(), nil
+}
+
+func isIPOrCIDR(str string) bool {
+	_, err := parsePrefix(str)
+	return err == nil
+}
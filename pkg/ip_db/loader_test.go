@@ -0,0 +1,129 @@
+package ip_db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/walkerdu/super-dig/configs"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := map[string]string{
+		"testdata/regions.json":                  FormatJSON,
+		"testdata/ip_country.txt":                FormatTxt,
+		"testdata/ip2region.txt":                 FormatIP2Region,
+		"testdata/regions.csv":                   FormatCSV,
+		"testdata/GeoLite2-City-Blocks-IPv4.csv": FormatGeoLite2,
+	}
+
+	for path, want := range tests {
+		if format, err := DetectFormat(path); err != nil || format != want {
+			t.Errorf("DetectFormat(%s) = %s, %v, want %s", path, format, err, want)
+		}
+	}
+
+	if format, err := DetectFormat("testdata/regions.dat"); err == nil {
+		t.Errorf("DetectFormat(regions.dat) = %s, want error", format)
+	}
+}
+
+func TestLoadRegionFile(t *testing.T) {
+	geoLite2 := LoadOptions{
+		GeoLocations: "testdata/GeoLite2-City-Locations-zh-CN.csv",
+		GeoASN:       "testdata/GeoLite2-ASN-Blocks-IPv4.csv",
+	}
+
+	tests := []struct {
+		path    string
+		opts    LoadOptions
+		regions []configs.IPRegion
+	}{
+		{"testdata/regions.json", LoadOptions{}, []configs.IPRegion{
+			{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0", "36.134.0.0/16"}, Sample: "random:2"},
+			{Country: "日本", Province: "0", ISP: "0", IPs: []string{"1.0.16.0"}},
+		}},
+		{"testdata/ip_country.txt", LoadOptions{}, []configs.IPRegion{
+			{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0", "1.0.2.0"}},
+			{Country: "中国", Province: "北京市", ISP: "联通", IPs: []string{"36.134.0.0/16"}},
+			{Country: "美国", Province: "0", ISP: "Google LLC", IPs: []string{"8.8.8.0", "2001:4860::/32"}},
+		}},
+		// IP段转换成最少的CIDR，同一个地区的IP段合并
+		{"testdata/ip2region.txt", LoadOptions{}, []configs.IPRegion{
+			{Country: "中国", Province: "福建省", ISP: "电信", IPs: []string{"1.0.1.0/24", "1.0.2.0/23"}},
+			{Country: "澳大利亚", Province: "维多利亚", ISP: "0", IPs: []string{"1.0.4.0/22"}},
+			{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.8.0/21", "1.0.32.0/19"}},
+			{Country: "中国", Province: "北京市", ISP: "联通", IPs: []string{"2001:db8::/112"}},
+		}},
+		{"testdata/regions.csv", LoadOptions{}, []configs.IPRegion{
+			{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0/24", "1.0.2.0/23"}},
+			{Country: "中国", Province: "北京市", ISP: "联通", IPs: []string{"2001:db8::/48"}},
+			{Country: "美国", Province: "0", ISP: "Google LLC", IPs: []string{"8.8.8.8/32"}},
+		}},
+		// 扩展名无法识别时通过--region-format指定
+		{"testdata/regions.dat", LoadOptions{Format: FormatCSV}, []configs.IPRegion{
+			{Country: "中国", Province: "广东省", ISP: "电信", IPs: []string{"1.0.1.0/24", "1.0.2.0/23"}},
+			{Country: "中国", Province: "北京市", ISP: "联通", IPs: []string{"2001:db8::/48"}},
+			{Country: "美国", Province: "0", ISP: "Google LLC", IPs: []string{"8.8.8.8/32"}},
+		}},
+		// 没有geoname_id时使用registered_country_geoname_id，找不到的location和ASN为"0"
+		{"testdata/GeoLite2-City-Blocks-IPv4.csv", geoLite2, []configs.IPRegion{
+			{Country: "中国", Province: "福建省", ISP: "CHINANET", IPs: []string{"1.0.1.0/24"}},
+			{Country: "中国", Province: "0", ISP: "CHINANET", IPs: []string{"1.0.2.0/23"}},
+			{Country: "日本", Province: "0", ISP: "ARTERIA Networks Corporation", IPs: []string{"1.0.16.0/24"}},
+			{Country: "0", Province: "0", ISP: "0", IPs: []string{"1.0.64.0/24"}},
+		}},
+		{"testdata/GeoLite2-City-Blocks-IPv4.csv", LoadOptions{Format: FormatGeoLite2, GeoLocations: geoLite2.GeoLocations}, []configs.IPRegion{
+			{Country: "中国", Province: "福建省", ISP: "0", IPs: []string{"1.0.1.0/24"}},
+			{Country: "中国", Province: "0", ISP: "0", IPs: []string{"1.0.2.0/23"}},
+			{Country: "日本", Province: "0", ISP: "0", IPs: []string{"1.0.16.0/24"}},
+			{Country: "0", Province: "0", ISP: "0", IPs: []string{"1.0.64.0/24"}},
+		}},
+	}
+
+	for _, test := range tests {
+		regions, err := LoadRegionFile(test.path, test.opts)
+		if err != nil {
+			t.Errorf("LoadRegionFile(%s, %s): %v", test.path, test.opts.Format, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(regions, test.regions) {
+			t.Errorf("LoadRegionFile(%s, %s) =\n%+v\nwant\n%+v", test.path, test.opts.Format, regions, test.regions)
+		}
+	}
+}
+
+func TestLoadRegionFileIllegal(t *testing.T) {
+	var lineNos []int
+	_, err := LoadRegionFile("testdata/ip2region.txt", LoadOptions{
+		Illegal: func(lineNo int, line string, err error) {
+			lineNos = append(lineNos, lineNo)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{4, 5, 9}; !reflect.DeepEqual(lineNos, want) {
+		t.Errorf("illegal lines %v, want %v", lineNos, want)
+	}
+
+	// 按指定格式解析不匹配的文件时报错
+	tests := []struct {
+		path string
+		opts LoadOptions
+	}{
+		{"testdata/regions.csv", LoadOptions{Format: FormatTxt}},
+		{"testdata/regions.json", LoadOptions{Format: FormatCSV}},
+		{"testdata/regions.csv", LoadOptions{Format: "xlsx"}},
+		{"testdata/regions.dat", LoadOptions{}},
+		{"testdata/GeoLite2-City-Blocks-IPv4.csv", LoadOptions{}},
+		{"testdata/missing.csv", LoadOptions{}},
+	}
+
+	for _, test := range tests {
+		if regions, err := LoadRegionFile(test.path, test.opts); err == nil {
+			t.Errorf("LoadRegionFile(%s, %q) = %v, want error", test.path, test.opts.Format, regions)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package ip_db
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/walkerdu/super-dig/configs"
+)
+
+const (
+	GroupByCountry  = "country"  // 每个国家一组，province和isp置为"0"
+	GroupByProvince = "province" // 每个省份一组，isp置为"0"
+	GroupByISP      = "isp"      // 每个省份的每个ISP一组
+)
+
+// SampleRule IP段采样规则，Country支持通配符，按顺序第一个匹配的规则生效
+type SampleRule struct {
+	Country string   `json:"country"`
+	GroupBy string   `json:"group_by"`
+	ISPs    []string `json:"isps,omitempty"` // 只保留这些ISP，为空不过滤
+	Samples int      `json:"samples"`        // 每组采样的IP个数，0表示丢弃匹配的IP段
+}
+
+// DefaultSampleRules 国内每个省份三大运营商各取1个，剔除非三大运营商，国外每个国家取1个
+var DefaultSampleRules = []SampleRule{
+	{Country: "0", Samples: 0},
+	{Country: "中国", GroupBy: GroupByISP, ISPs: []string{"电信", "移动", "联通"}, Samples: 1},
+	{Country: "中国", Samples: 0},
+	{Country: "*", GroupBy: GroupByCountry, Samples: 1},
+}
+
+func ValidateSampleRules(rules []SampleRule) error {
+	for idx, rule := range rules {
+		if _, err := path.Match(rule.Country, ""); err != nil {
+			return fmt.Errorf("rule[%d].country: invalid pattern %q", idx, rule.Country)
+		}
+
+		if rule.Samples < 0 {
+			return fmt.Errorf("rule[%d].samples: must not be negative", idx)
+		}
+
+		switch rule.GroupBy {
+		case GroupByCountry, GroupByProvince, GroupByISP:
+		case "":
+			if rule.Samples > 0 {
+				return fmt.Errorf("rule[%d].group_by: required when samples > 0", idx)
+			}
+		default:
+			return fmt.Errorf("rule[%d].group_by: unknown value %q, expect country, province or isp", idx, rule.GroupBy)
+		}
+	}
+
+	return nil
+}
+
+func (rule *SampleRule) match(r *Range) bool {
+	if ok, _ := path.Match(rule.Country, r.Country); !ok {
+		return false
+	}
+
+	if len(rule.ISPs) == 0 {
+		return true
+	}
+
+	for _, isp := range rule.ISPs {
+		if isp == r.ISP {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sample 按规则对IP段分组，每组按出现顺序取前Samples个IP段的起始IP，生成client subnet列表
+func Sample(ranges []Range, rules []SampleRule) ([]configs.IPRegion, error) {
+	if err := ValidateSampleRules(rules); err != nil {
+		return nil, err
+	}
+
+	var ipRegions []configs.IPRegion
+	groupIdx := make(map[[3]string]int)
+	for idx := range ranges {
+		r := &ranges[idx]
+
+		var rule *SampleRule
+		for ruleIdx := range rules {
+			if rules[ruleIdx].match(r) {
+				rule = &rules[ruleIdx]
+				break
+			}
+		}
+
+		if rule == nil || rule.Samples == 0 {
+			continue
+		}
+
+		group := [3]string{r.Country, r.Province, r.ISP}
+		switch rule.GroupBy {
+		case GroupByCountry:
+			group[1], group[2] = "0", "0"
+		case GroupByProvince:
+			group[2] = "0"
+		}
+
+		i, ok := groupIdx[group]
+		if !ok {
+			i = len(ipRegions)
+			groupIdx[group] = i
+			ipRegions = append(ipRegions, configs.IPRegion{
+				Country:  group[0],
+				Province: group[1],
+				ISP:      group[2],
+			})
+		}
+
+		if len(ipRegions[i].IPs) < rule.Samples {
+			ipRegions[i].IPs = append(ipRegions[i].IPs, r.Start.String())
+		}
+	}
+
+	return ipRegions, nil
+}
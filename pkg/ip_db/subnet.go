@@ -0,0 +1,159 @@
+package ip_db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	SampleFirst  = "first"  // 只取CIDR的第一个subnet
+	SampleRandom = "random" // 随机取N个subnet，格式random:N
+	SampleEvery  = "every"  // 取CIDR内的每一个subnet
+
+	// ECS client subnet的粒度
+	IPv4SubnetBits = 24
+	IPv6SubnetBits = 56
+
+	// 单个CIDR最多展开的subnet个数，every和random:N都受此限制
+	maxSubnets = 1 << 16
+)
+
+// SamplePolicy CIDR内client subnet的采样策略
+type SamplePolicy struct {
+	Mode  string
+	Count int
+}
+
+func (policy SamplePolicy) String() string {
+	if policy.Mode == SampleRandom {
+		return fmt.Sprintf("%s:%d", policy.Mode, policy.Count)
+	}
+
+	return policy.Mode
+}
+
+// ParseSamplePolicy 解析采样策略: first, random:N, every
+func ParseSamplePolicy(str string) (SamplePolicy, error) {
+	mode, count, hasCount := strings.Cut(str, ":")
+	switch mode {
+	case SampleFirst, SampleEvery:
+		if hasCount {
+			return SamplePolicy{}, fmt.Errorf("sample policy %q takes no count", mode)
+		}
+		return SamplePolicy{Mode: mode}, nil
+	case SampleRandom:
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return SamplePolicy{}, fmt.Errorf("invalid sample policy %q, expect random:N with N > 0", str)
+		}
+		if n > maxSubnets {
+			return SamplePolicy{}, fmt.Errorf("invalid sample policy %q, N must not exceed %d", str, maxSubnets)
+		}
+		return SamplePolicy{Mode: mode, Count: n}, nil
+	default:
+		return SamplePolicy{}, fmt.Errorf("unknown sample policy %q, expect first, random:N or every", str)
+	}
+}
+
+// ExpandSubnets 把IPRegion.IPs中的一项展开成client subnet列表
+// 单个IP保持原样，由查询时按默认粒度生成subnet；CIDR按照采样策略展开成/24(IPv6为/56)的subnet，
+// 比/24更小的CIDR直接作为一个subnet
+// random的结果只由CIDR决定，保证--resume前后展开的subnet一致
+func ExpandSubnets(entry string, policy SamplePolicy) ([]string, error) {
+	if !strings.Contains(entry, "/") {
+		if _, err := netip.ParseAddr(entry); err != nil && entry != "" {
+			return nil, fmt.Errorf("invalid ip %q", entry)
+		}
+		return []string{entry}, nil
+	}
+
+	block, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q: %w", entry, err)
+	}
+	block = block.Masked()
+
+	bits := IPv4SubnetBits
+	if block.Addr().Is6() {
+		bits = IPv6SubnetBits
+	}
+
+	if block.Bits() >= bits {
+		return []string{block.String()}, nil
+	}
+
+	shift := bits - block.Bits()
+	if shift > 62 {
+		shift = 62
+	}
+	total := uint64(1) << shift
+
+	var indexes []uint64
+	switch policy.Mode {
+	case SampleFirst:
+		indexes = []uint64{0}
+	case SampleEvery:
+		if total > maxSubnets {
+			return nil, fmt.Errorf("cidr %q contains too many subnets (%d > %d) for policy every", entry, total, maxSubnets)
+		}
+		for idx := uint64(0); idx < total; idx++ {
+			indexes = append(indexes, idx)
+		}
+	case SampleRandom:
+		hash := fnv.New64a()
+		hash.Write([]byte(block.String()))
+		rnd := rand.New(rand.NewSource(int64(hash.Sum64())))
+
+		if policy.Count <= 0 || policy.Count > maxSubnets {
+			return nil, fmt.Errorf("invalid sample count %d for cidr %q", policy.Count, entry)
+		}
+
+		count := uint64(policy.Count)
+		if count >= total {
+			for idx := uint64(0); idx < total; idx++ {
+				indexes = append(indexes, idx)
+			}
+			break
+		}
+
+		picked := make(map[uint64]bool)
+		for uint64(len(indexes)) < count {
+			idx := uint64(rnd.Int63n(int64(total)))
+			if !picked[idx] {
+				picked[idx] = true
+				indexes = append(indexes, idx)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown sample policy %q", policy.Mode)
+	}
+
+	subnets := make([]string, 0, len(indexes))
+	for _, idx := range indexes {
+		subnets = append(subnets, nthSubnet(block, bits, idx).String())
+	}
+
+	return subnets, nil
+}
+
+// nthSubnet 返回block内第n个长度为bits的subnet
+func nthSubnet(block netip.Prefix, bits int, n uint64) netip.Prefix {
+	addr := block.Addr()
+	if addr.Is4() {
+		ip := addr.As4()
+		value := binary.BigEndian.Uint32(ip[:]) + uint32(n<<(32-bits))
+		binary.BigEndian.PutUint32(ip[:], value)
+		return netip.PrefixFrom(netip.AddrFrom4(ip), bits)
+	}
+
+	// IPv6 subnet不超过/64，只需要对高64位做加法
+	ip := addr.As16()
+	value := binary.BigEndian.Uint64(ip[:8]) + n<<(64-bits)
+	binary.BigEndian.PutUint64(ip[:8], value)
+	return netip.PrefixFrom(netip.AddrFrom16(ip), bits)
+}
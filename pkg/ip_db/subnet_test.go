@@ -0,0 +1,134 @@
+package ip_db
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseSamplePolicy(t *testing.T) {
+	tests := []struct {
+		str    string
+		policy SamplePolicy
+		err    bool
+	}{
+		{"first", SamplePolicy{Mode: SampleFirst}, false},
+		{"every", SamplePolicy{Mode: SampleEvery}, false},
+		{"random:3", SamplePolicy{Mode: SampleRandom, Count: 3}, false},
+		{fmt.Sprintf("random:%d", maxSubnets), SamplePolicy{Mode: SampleRandom, Count: maxSubnets}, false},
+		{fmt.Sprintf("random:%d", maxSubnets+1), SamplePolicy{}, true},
+		{"random:10000000", SamplePolicy{}, true},
+		{"random", SamplePolicy{}, true},
+		{"random:0", SamplePolicy{}, true},
+		{"random:x", SamplePolicy{}, true},
+		{"first:2", SamplePolicy{}, true},
+		{"all", SamplePolicy{}, true},
+	}
+
+	for _, test := range tests {
+		policy, err := ParseSamplePolicy(test.str)
+		if (err != nil) != test.err || policy != test.policy {
+			t.Errorf("ParseSamplePolicy(%q) = %+v, %v", test.str, policy, err)
+		}
+		if err == nil && policy.String() != test.str {
+			t.Errorf("%+v String() = %s, want %s", policy, policy.String(), test.str)
+		}
+	}
+}
+
+func TestExpandSubnets(t *testing.T) {
+	first := SamplePolicy{Mode: SampleFirst}
+	every := SamplePolicy{Mode: SampleEvery}
+
+	tests := []struct {
+		entry   string
+		policy  SamplePolicy
+		subnets []string
+	}{
+		{"1.0.1.0", first, []string{"1.0.1.0"}},
+		{"2001:db8::1", every, []string{"2001:db8::1"}},
+		{"36.134.0.0/16", first, []string{"36.134.0.0/24"}},
+		{"36.134.5.7/16", first, []string{"36.134.0.0/24"}},
+		{"10.0.0.0/22", every, []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"}},
+		{"10.0.0.0/22", SamplePolicy{Mode: SampleRandom, Count: 4},
+			[]string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"}},
+		{"10.0.0.0/23", SamplePolicy{Mode: SampleRandom, Count: 100}, []string{"10.0.0.0/24", "10.0.1.0/24"}},
+		// 比/24更小的CIDR整个作为一个subnet
+		{"10.0.0.128/25", every, []string{"10.0.0.128/25"}},
+		{"10.0.0.8/30", SamplePolicy{Mode: SampleRandom, Count: 3}, []string{"10.0.0.8/30"}},
+		{"2001:db8:0:100::/56", every, []string{"2001:db8:0:100::/56"}},
+		{"2001:db8::/64", first, []string{"2001:db8::/64"}},
+		{"2001:db8::/54", every, []string{"2001:db8::/56", "2001:db8:0:100::/56", "2001:db8:0:200::/56", "2001:db8:0:300::/56"}},
+		{"2001:db8::/32", first, []string{"2001:db8::/56"}},
+	}
+
+	for _, test := range tests {
+		subnets, err := ExpandSubnets(test.entry, test.policy)
+		if err != nil || !reflect.DeepEqual(subnets, test.subnets) {
+			t.Errorf("ExpandSubnets(%s, %s) = %v, %v, want %v", test.entry, test.policy, subnets, err, test.subnets)
+		}
+	}
+}
+
+func TestExpandSubnetsRandom(t *testing.T) {
+	for _, entry := range []string{"36.134.0.0/16", "2001:db8::/32"} {
+		policy := SamplePolicy{Mode: SampleRandom, Count: 8}
+		subnets, err := ExpandSubnets(entry, policy)
+		if err != nil || len(subnets) != 8 {
+			t.Fatalf("ExpandSubnets(%s, %s) = %v, %v", entry, policy, subnets, err)
+		}
+
+		// 同一个CIDR多次展开的结果相同，--resume依赖这一点
+		again, _ := ExpandSubnets(entry, policy)
+		if !reflect.DeepEqual(subnets, again) {
+			t.Errorf("ExpandSubnets(%s, %s) is not deterministic: %v, %v", entry, policy, subnets, again)
+		}
+
+		block := netip.MustParsePrefix(entry)
+		seen := make(map[string]bool)
+		for _, subnet := range subnets {
+			prefix, err := netip.ParsePrefix(subnet)
+			if err != nil || !block.Contains(prefix.Addr()) || seen[subnet] {
+				t.Errorf("ExpandSubnets(%s, %s) returned %s", entry, policy, subnet)
+			}
+			seen[subnet] = true
+		}
+	}
+
+	// 不同的CIDR采样到的位置不同
+	a, _ := ExpandSubnets("36.134.0.0/16", SamplePolicy{Mode: SampleRandom, Count: 4})
+	b, _ := ExpandSubnets("36.135.0.0/16", SamplePolicy{Mode: SampleRandom, Count: 4})
+	for idx := range a {
+		if a[idx][len("36.134."):] != b[idx][len("36.135."):] {
+			return
+		}
+	}
+	t.Errorf("random samples of different cidrs are identical: %v, %v", a, b)
+}
+
+func TestExpandSubnetsLimit(t *testing.T) {
+	tests := []struct {
+		entry  string
+		policy SamplePolicy
+		count  int
+		err    bool
+	}{
+		{"10.0.0.0/8", SamplePolicy{Mode: SampleEvery}, maxSubnets, false},
+		{"10.0.0.0/7", SamplePolicy{Mode: SampleEvery}, 0, true},
+		{"2001:db8::/40", SamplePolicy{Mode: SampleEvery}, maxSubnets, false},
+		{"2001:db8::/32", SamplePolicy{Mode: SampleEvery}, 0, true},
+		{"2001:db8::/32", SamplePolicy{Mode: SampleRandom, Count: 10000000}, 0, true},
+		{"10.0.0.0/7", SamplePolicy{Mode: SampleRandom, Count: 1000}, 1000, false},
+		{"10.0.0.0/24/8", SamplePolicy{Mode: SampleFirst}, 0, true},
+		{"10.0.0.300", SamplePolicy{Mode: SampleFirst}, 0, true},
+		{"10.0.0.0/16", SamplePolicy{Mode: "all"}, 0, true},
+	}
+
+	for _, test := range tests {
+		subnets, err := ExpandSubnets(test.entry, test.policy)
+		if (err != nil) != test.err || len(subnets) != test.count {
+			t.Errorf("ExpandSubnets(%s, %s) = %d subnets, %v", test.entry, test.policy, len(subnets), err)
+		}
+	}
+}